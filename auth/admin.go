@@ -0,0 +1,210 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Roles that can be assigned to an account on the admin port.  Roles are ordered: each role
+// is allowed to do everything the roles below it can.
+type AdminRole int
+
+const (
+	AdminRoleNone        AdminRole = iota // No access
+	AdminRoleReadOnly                     // Read-only operator: GET/HEAD requests only
+	AdminRoleUserManager                  // Can also manage users, roles and sessions
+	AdminRoleDbAdmin                      // Can also write documents and manage databases
+	AdminRoleFullAdmin                    // Unrestricted, including server-wide settings
+)
+
+var adminRoleNames = []string{
+	AdminRoleNone:        "none",
+	AdminRoleReadOnly:    "read_only",
+	AdminRoleUserManager: "user_manager",
+	AdminRoleDbAdmin:     "db_admin",
+	AdminRoleFullAdmin:   "admin",
+}
+
+func (role AdminRole) String() string {
+	if role < 0 || int(role) >= len(adminRoleNames) {
+		return fmt.Sprintf("AdminRole(%d)", int(role))
+	}
+	return adminRoleNames[role]
+}
+
+// Returns true if the role includes the privileges of the required role.
+func (role AdminRole) Allows(required AdminRole) bool {
+	return role >= required
+}
+
+// Parses an admin role name as it appears in config or in an admin account document.
+func ParseAdminRole(name string) (AdminRole, error) {
+	for role, roleName := range adminRoleNames {
+		if roleName == name && AdminRole(role) != AdminRoleNone {
+			return AdminRole(role), nil
+		}
+	}
+	return AdminRoleNone, base.HTTPErrorf(http.StatusBadRequest, "Invalid admin role %q", name)
+}
+
+// An account that can authenticate against the admin API.  Accounts are either defined in the
+// server config, or stored in the bucket as a "_sync:admin:" document.
+type AdminAccount struct {
+	Name          string    `json:"name"`
+	Role          AdminRole `json:"-"`
+	RoleName      string    `json:"role"`
+	PasswordHash_ []byte    `json:"passwordhash_bcrypt,omitempty"`
+	TokenHash_    string    `json:"tokenhash,omitempty"`
+}
+
+// Key prefix reserved for admin account documents in the bucket
+const AdminKeyPrefix = "_sync:admin:"
+
+// Admin account names are validated as principal names, which can't contain ':', so token
+// lookup docs can't collide with account docs.
+const adminTokenKeyPrefix = AdminKeyPrefix + "token:"
+
+func docIDForAdminAccount(name string) string {
+	return AdminKeyPrefix + name
+}
+
+func docIDForAdminToken(tokenHash string) string {
+	return adminTokenKeyPrefix + tokenHash
+}
+
+// Returns the hex-encoded SHA-256 digest of a bearer token.  Tokens are random secrets with
+// plenty of entropy, so unlike passwords they don't need a slow hash.
+func HashAdminToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+// Creates a new admin account.  Either password or token (or both) may be empty.
+func NewAdminAccount(name string, role AdminRole, password string, token string) (*AdminAccount, error) {
+	if name == "" || !IsValidPrincipalName(name) {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid admin account name %q", name)
+	}
+	if role == AdminRoleNone {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Admin account %q has no role", name)
+	}
+	account := &AdminAccount{Name: name, Role: role, RoleName: role.String()}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), kBcryptCostFactor)
+		if err != nil {
+			return nil, err
+		}
+		account.PasswordHash_ = hash
+	}
+	if token != "" {
+		account.TokenHash_ = HashAdminToken(token)
+	}
+	return account, nil
+}
+
+// Returns true if the given password is correct for this account.
+func (account *AdminAccount) Authenticate(password string) bool {
+	if account == nil || account.PasswordHash_ == nil || password == "" {
+		return false
+	}
+	return compareHashAndPassword(account.PasswordHash_, []byte(password))
+}
+
+// Looks up an admin account stored in the bucket.  Returns nil if there is no such account.
+func (auth *Authenticator) GetAdminAccount(name string) (*AdminAccount, error) {
+	var account AdminAccount
+	_, err := auth.bucket.Get(docIDForAdminAccount(name), &account)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if account.Role, err = ParseAdminRole(account.RoleName); err != nil {
+		base.Warn("Admin account %q has invalid role %q - ignoring", name, account.RoleName)
+		return nil, nil
+	}
+	return &account, nil
+}
+
+// Looks up the admin account stored in the bucket that owns the given bearer token.
+func (auth *Authenticator) GetAdminAccountForToken(token string) (*AdminAccount, error) {
+	tokenHash := HashAdminToken(token)
+	var info struct {
+		Name string `json:"name"`
+	}
+	_, err := auth.bucket.Get(docIDForAdminToken(tokenHash), &info)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	account, err := auth.GetAdminAccount(info.Name)
+	if account == nil || account.TokenHash_ != tokenHash {
+		// Stale token doc left behind by a token change
+		return nil, err
+	}
+	return account, nil
+}
+
+// Authenticates an admin account stored in the bucket by name and password.
+func (auth *Authenticator) AuthenticateAdmin(name string, password string) *AdminAccount {
+	account, _ := auth.GetAdminAccount(name)
+	if account == nil || !account.Authenticate(password) {
+		return nil
+	}
+	return account
+}
+
+// Saves an admin account to the bucket, replacing the token lookup doc if the token changed.
+func (auth *Authenticator) SaveAdminAccount(account *AdminAccount) error {
+	previous, err := auth.GetAdminAccount(account.Name)
+	if err != nil {
+		return err
+	}
+	account.RoleName = account.Role.String()
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	if err := auth.bucket.SetRaw(docIDForAdminAccount(account.Name), 0, data); err != nil {
+		return err
+	}
+	if previous != nil && previous.TokenHash_ != "" && previous.TokenHash_ != account.TokenHash_ {
+		auth.bucket.Delete(docIDForAdminToken(previous.TokenHash_))
+	}
+	if account.TokenHash_ != "" {
+		info := map[string]string{"name": account.Name}
+		if err := auth.bucket.Set(docIDForAdminToken(account.TokenHash_), 0, info); err != nil {
+			return err
+		}
+	}
+	base.LogTo("Auth", "Saved admin account %q with role %s", account.Name, account.Role)
+	return nil
+}
+
+// Deletes an admin account from the bucket.
+func (auth *Authenticator) DeleteAdminAccount(name string) error {
+	account, err := auth.GetAdminAccount(name)
+	if err != nil {
+		return err
+	} else if account == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "missing")
+	}
+	if account.TokenHash_ != "" {
+		auth.bucket.Delete(docIDForAdminToken(account.TokenHash_))
+	}
+	return auth.bucket.Delete(docIDForAdminAccount(name))
+}
@@ -0,0 +1,360 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// How stale an API key's last-used timestamp may get before it's rewritten.  This keeps a busy
+// client from turning every request into a bucket write.
+const kAPIKeyLastUsedGranularity = time.Minute
+
+// A long-lived API key that authenticates as a user.  The key itself is only returned when it's
+// created; the bucket only stores its hash.  A key can be restricted further than its user.
+type APIKey struct {
+	ID          string     `json:"id"`
+	Username    string     `json:"username"`
+	KeyHash     string     `json:"keyhash,omitempty"`
+	Description string     `json:"description,omitempty"`
+	ReadOnly    bool       `json:"read_only,omitempty"` // Only allows requests that don't modify the db
+	Channels    base.Set   `json:"channels,omitempty"`  // If non-nil, the only channels the key can access
+	Methods     []string   `json:"methods,omitempty"`   // If non-nil, the only HTTP methods the key can use
+	Created     time.Time  `json:"created"`
+	LastUsed    *time.Time `json:"last_used,omitempty"`
+}
+
+// The API keys of a single user, stored in one document so they can be listed.
+type apiKeyList struct {
+	Keys map[string]*APIKey `json:"keys"`
+}
+
+// Maps a key's hash to its owner, so a key can be found without knowing the user.
+type apiKeyLookup struct {
+	Username string `json:"username"`
+	ID       string `json:"id"`
+}
+
+// Key prefix reserved for API key lookup documents in the bucket
+const APIKeyKeyPrefix = "_sync:apikey:"
+
+// Key prefix reserved for per-user API key lists in the bucket
+const APIKeyListKeyPrefix = "_sync:apikeys:"
+
+func docIDForAPIKey(keyHash string) string {
+	return APIKeyKeyPrefix + keyHash
+}
+
+func docIDForAPIKeyList(username string) string {
+	return APIKeyListKeyPrefix + username
+}
+
+// API keys are random secrets with plenty of entropy, so unlike passwords they don't need a
+// slow hash.
+func hashAPIKey(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// Returns true if the key's method restrictions allow the given HTTP method.  (Read-only keys
+// are checked by the caller, which knows which requests are reads.)
+func (key *APIKey) AllowsMethod(method string) bool {
+	if key.Methods == nil {
+		return true
+	}
+	for _, allowed := range key.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (key *APIKey) validate() error {
+	for i, method := range key.Methods {
+		method = strings.ToUpper(method)
+		switch method {
+		case "GET", "HEAD", "POST", "PUT", "DELETE":
+			key.Methods[i] = method
+		default:
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid HTTP method %q", method)
+		}
+	}
+	for channel := range key.Channels {
+		if channel == ch.AllChannelWildcard {
+			return base.HTTPErrorf(http.StatusBadRequest, "API key channels can't include %q", channel)
+		}
+	}
+	return nil
+}
+
+// Creates a new API key for a user and saves it.  The properties of the key come from the
+// given APIKey; its ID, hash and creation time are filled in.  Returns the secret key, which
+// can't be recovered later.
+func (auth *Authenticator) CreateAPIKey(key *APIKey) (string, error) {
+	if err := key.validate(); err != nil {
+		return "", err
+	}
+	secret := base.GenerateRandomSecret()
+	key.ID = base.CreateUUID()[:16]
+	key.KeyHash = hashAPIKey(secret)
+	key.Created = time.Now()
+	key.LastUsed = nil
+
+	err := auth.updateAPIKeyList(key.Username, func(list *apiKeyList) error {
+		list.Keys[key.ID] = key
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	lookup := apiKeyLookup{Username: key.Username, ID: key.ID}
+	if err := auth.bucket.Set(docIDForAPIKey(key.KeyHash), 0, lookup); err != nil {
+		return "", err
+	}
+	base.LogTo("Auth", "Created API key %s for user %q", key.ID, key.Username)
+	return secret, nil
+}
+
+// Returns a user's API keys, oldest first.
+func (auth *Authenticator) GetAPIKeys(username string) ([]*APIKey, error) {
+	list, err := auth.getAPIKeyList(username)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*APIKey, 0, len(list.Keys))
+	for _, key := range list.Keys {
+		keys = append(keys, key)
+	}
+	sort.Sort(apiKeysByCreation(keys))
+	return keys, nil
+}
+
+// Returns one of a user's API keys, or nil if it doesn't exist.
+func (auth *Authenticator) GetAPIKey(username string, id string) (*APIKey, error) {
+	list, err := auth.getAPIKeyList(username)
+	if err != nil {
+		return nil, err
+	}
+	return list.Keys[id], nil
+}
+
+// Revokes one of a user's API keys.
+func (auth *Authenticator) DeleteAPIKey(username string, id string) error {
+	var deleted *APIKey
+	err := auth.updateAPIKeyList(username, func(list *apiKeyList) error {
+		if deleted = list.Keys[id]; deleted == nil {
+			return base.HTTPErrorf(http.StatusNotFound, "missing")
+		}
+		delete(list.Keys, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	auth.bucket.Delete(docIDForAPIKey(deleted.KeyHash))
+	base.LogTo("Auth", "Revoked API key %s of user %q", id, username)
+	return nil
+}
+
+// Revokes all of a user's API keys.
+func (auth *Authenticator) DeleteAPIKeys(username string) error {
+	list, err := auth.getAPIKeyList(username)
+	if err != nil {
+		return err
+	}
+	for _, key := range list.Keys {
+		auth.bucket.Delete(docIDForAPIKey(key.KeyHash))
+	}
+	if len(list.Keys) == 0 {
+		return nil
+	}
+	if err := auth.bucket.Delete(docIDForAPIKeyList(username)); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// Authenticates a request by API key.  Returns nil if the key doesn't exist, has been revoked,
+// or belongs to a disabled user.  If the key is restricted to a subset of channels, the
+// returned User only has access to those channels.
+func (auth *Authenticator) AuthenticateAPIKey(secret string) (User, *APIKey, error) {
+	keyHash := hashAPIKey(secret)
+	var lookup apiKeyLookup
+	_, err := auth.bucket.Get(docIDForAPIKey(keyHash), &lookup)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	key, err := auth.GetAPIKey(lookup.Username, lookup.ID)
+	if key == nil || key.KeyHash != keyHash {
+		// Revoked key whose lookup doc didn't get cleaned up
+		return nil, nil, err
+	}
+	user, err := auth.GetUser(key.Username)
+	if user == nil || user.Disabled() {
+		return nil, nil, err
+	}
+
+	if key.LastUsed == nil || time.Since(*key.LastUsed) > kAPIKeyLastUsedGranularity {
+		now := time.Now()
+		key.LastUsed = &now
+		err = auth.updateAPIKeyList(key.Username, func(list *apiKeyList) error {
+			if stored := list.Keys[key.ID]; stored != nil {
+				stored.LastUsed = &now
+			}
+			return nil
+		})
+		if err != nil {
+			base.Warn("Couldn't update last-used time of API key %s: %v", key.ID, err)
+		}
+	}
+
+	return scopeUserToAPIKey(user, key), key, nil
+}
+
+// Reloads a user from the bucket, keeping any API key restrictions the existing User has.
+func (auth *Authenticator) ReloadUser(user User) (User, error) {
+	reloaded, err := auth.GetUser(user.Name())
+	if reloaded == nil {
+		return nil, err
+	}
+	if scoped, ok := user.(*scopedUser); ok {
+		reloaded = &scopedUser{User: reloaded, scope: scoped.scope}
+	}
+	return reloaded, nil
+}
+
+func (auth *Authenticator) getAPIKeyList(username string) (*apiKeyList, error) {
+	var list apiKeyList
+	_, err := auth.bucket.Get(docIDForAPIKeyList(username), &list)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	if list.Keys == nil {
+		list.Keys = map[string]*APIKey{}
+	}
+	return &list, nil
+}
+
+func (auth *Authenticator) updateAPIKeyList(username string, callback func(*apiKeyList) error) error {
+	return auth.bucket.Update(docIDForAPIKeyList(username), 0, func(currentValue []byte) ([]byte, error) {
+		var list apiKeyList
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &list); err != nil {
+				return nil, err
+			}
+		}
+		if list.Keys == nil {
+			list.Keys = map[string]*APIKey{}
+		}
+		if err := callback(&list); err != nil {
+			return nil, err
+		}
+		return json.Marshal(list)
+	})
+}
+
+type apiKeysByCreation []*APIKey
+
+func (keys apiKeysByCreation) Len() int           { return len(keys) }
+func (keys apiKeysByCreation) Swap(i, j int)      { keys[i], keys[j] = keys[j], keys[i] }
+func (keys apiKeysByCreation) Less(i, j int) bool { return keys[i].Created.Before(keys[j].Created) }
+
+//////// CHANNEL-SCOPED USER:
+
+// A User whose channel access is limited to a subset of its channels, as seen through an API
+// key with a channel restriction.  Persistent properties are those of the underlying user.
+type scopedUser struct {
+	User
+	scope base.Set
+}
+
+func scopeUserToAPIKey(user User, key *APIKey) User {
+	if key.Channels == nil {
+		return user
+	}
+	return &scopedUser{User: user, scope: key.Channels}
+}
+
+func (user *scopedUser) filter(channels ch.TimedSet) ch.TimedSet {
+	result := ch.TimedSet{}
+	for channel, seq := range channels {
+		if user.scope.Contains(channel) {
+			result[channel] = seq
+		}
+	}
+	return result
+}
+
+func (user *scopedUser) Channels() ch.TimedSet {
+	return user.filter(user.User.Channels())
+}
+
+func (user *scopedUser) CanSeeChannel(channel string) bool {
+	return user.scope.Contains(channel) && user.User.CanSeeChannel(channel)
+}
+
+func (user *scopedUser) CanSeeChannelSince(channel string) uint64 {
+	if !user.scope.Contains(channel) {
+		return 0
+	}
+	return user.User.CanSeeChannelSince(channel)
+}
+
+func (user *scopedUser) AuthorizeAllChannels(channels base.Set) error {
+	return authorizeAllChannels(user, channels)
+}
+
+func (user *scopedUser) AuthorizeAnyChannel(channels base.Set) error {
+	return authorizeAnyChannel(user, channels)
+}
+
+func (user *scopedUser) InheritedChannels() ch.TimedSet {
+	return user.filter(user.User.InheritedChannels())
+}
+
+func (user *scopedUser) ExpandWildCardChannel(channels base.Set) base.Set {
+	if channels.Contains(ch.AllChannelWildcard) {
+		channels = user.InheritedChannels().AsSet()
+	}
+	return channels
+}
+
+func (user *scopedUser) FilterToAvailableChannels(channels base.Set) ch.TimedSet {
+	if channels.Contains(ch.AllChannelWildcard) {
+		return user.InheritedChannels()
+	}
+	return user.filter(user.User.FilterToAvailableChannels(channels))
+}
+
+func (user *scopedUser) GetAddedChannels(channels ch.TimedSet) base.Set {
+	output := base.Set{}
+	for userChannel := range user.InheritedChannels() {
+		if _, found := channels[userChannel]; !found {
+			output[userChannel] = struct{}{}
+		}
+	}
+	return output
+}
+
+// Saving a scoped user saves the underlying user, unrestricted.
+func (user *scopedUser) MarshalJSON() ([]byte, error) {
+	return json.Marshal(user.User)
+}
@@ -24,6 +24,7 @@ import (
 type Authenticator struct {
 	bucket          base.Bucket
 	channelComputer ChannelComputer
+	SessionOptions  *SessionOptions // Options for login sessions (may be nil)
 }
 
 // Interface for deriving the set of channels and roles a User/Role has access to.
@@ -138,6 +139,9 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 
 func (auth *Authenticator) rebuildChannels(princ Principal) error {
 	channels := princ.ExplicitChannels().Copy()
+	if user, ok := princ.(User); ok {
+		channels.Add(user.JWTChannels())
+	}
 
 	// Changes for vbucket sequence management.  We can't determine relative ordering of sequences
 	// across vbuckets.  To avoid redundant channel backfills during changes processing, we maintain
@@ -189,6 +193,9 @@ func (auth *Authenticator) rebuildRoles(user User) error {
 	if explicit := user.ExplicitRoles(); explicit != nil {
 		roles.Add(explicit)
 	}
+	if jwtRoles := user.JWTRoles(); jwtRoles != nil {
+		roles.Add(jwtRoles)
+	}
 
 	base.LogTo("Access", "Computed roles for %q: %s", user.Name(), roles)
 	user.setRolesSince(roles)
@@ -267,6 +274,9 @@ func (auth *Authenticator) Delete(p Principal) error {
 		if user.Email() != "" {
 			auth.bucket.Delete(docIDForUserEmail(user.Email()))
 		}
+		if err := auth.DeleteAPIKeys(user.Name()); err != nil {
+			return err
+		}
 	}
 	return auth.bucket.Delete(p.DocID())
 }
@@ -389,6 +399,14 @@ func (auth *Authenticator) authenticateJWT(jwt jose.JWT, provider *OIDCProvider)
 		}
 	}
 
+	// Update the roles and channels granted by the token's claims:
+	if user != nil && len(provider.ClaimMappings) > 0 {
+		if err := auth.updateJWTGrants(user, jwt, provider); err != nil {
+			base.LogTo("OIDC+", "Error updating grants from JWT claims: %v", err)
+			return nil, jwt, err
+		}
+	}
+
 	return user, jwt, nil
 }
 
@@ -450,7 +468,7 @@ func (auth *Authenticator) updateVbucketSequences(docID string, factory func() P
 			princ.setChannels(nil)
 		}
 
-		// If user, also check for explicit roles.
+		// If user, also check for explicit roles, and for roles and channels granted by JWT claims.
 		rolesChanged := false
 		if userPrinc, ok := princ.(*userImpl); ok {
 			for role, vbSeq := range userPrinc.ExplicitRoles() {
@@ -460,6 +478,21 @@ func (auth *Authenticator) updateVbucketSequences(docID string, factory func() P
 					rolesChanged = true
 				}
 			}
+			for role, vbSeq := range userPrinc.JWTRoles() {
+				if vbSeq.Sequence == 0 {
+					userPrinc.JWTRoles_[role] = sequence
+					rolesChanged = true
+				}
+			}
+			for channel, vbSeq := range userPrinc.JWTChannels() {
+				if vbSeq.Sequence == 0 {
+					userPrinc.JWTChannels_[channel] = sequence
+					channelsChanged = true
+				}
+			}
+			if channelsChanged {
+				princ.setChannels(nil)
+			}
 			// Invalidate calculated roles if changed.
 			if rolesChanged {
 				userPrinc.setRolesSince(nil)
@@ -0,0 +1,254 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	kDefaultMaxUserFailures   = 10
+	kDefaultMaxClientFailures = 100
+	kDefaultLockoutSecs       = 15 * 60
+	kDefaultFailureWindowSecs = 15 * 60
+)
+
+// Options for throttling failed password logins
+type LoginThrottleOptions struct {
+	MaxUserFailures   *int `json:"max_user_failures,omitempty"`   // Failures before a username is locked out (default 10)
+	MaxClientFailures *int `json:"max_client_failures,omitempty"` // Failures before a client IP address is locked out (default 100)
+	LockoutSecs       *int `json:"lockout_secs,omitempty"`        // How long a lockout lasts (default 900)
+	WindowSecs        *int `json:"window_secs,omitempty"`         // Failures are forgotten after this long without another (default 900)
+}
+
+// Kinds of login failure records
+const (
+	LoginFailuresUser   = "user"   // Failures for a username
+	LoginFailuresClient = "client" // Failures from a client IP address
+)
+
+// Key prefix reserved for login failure records in the bucket
+const LoginFailuresKeyPrefix = "_sync:loginfail:"
+
+// The recent failed logins for a username or client address.  These are stored in the bucket, so
+// they're shared by all the nodes serving a database.
+type LoginFailures struct {
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// Tracks failed password logins.  After a couple of failures a username has to wait before
+// trying again, with the delay doubling on each failure; after too many failures the username,
+// or client address, is locked out for a while.
+type LoginThrottle struct {
+	bucket            base.Bucket
+	maxUserFailures   int
+	maxClientFailures int
+	lockout           time.Duration
+	window            time.Duration
+}
+
+func NewLoginThrottle(bucket base.Bucket, options *LoginThrottleOptions) *LoginThrottle {
+	throttle := &LoginThrottle{
+		bucket:            bucket,
+		maxUserFailures:   kDefaultMaxUserFailures,
+		maxClientFailures: kDefaultMaxClientFailures,
+		lockout:           kDefaultLockoutSecs * time.Second,
+		window:            kDefaultFailureWindowSecs * time.Second,
+	}
+	if options.MaxUserFailures != nil && *options.MaxUserFailures > 0 {
+		throttle.maxUserFailures = *options.MaxUserFailures
+	}
+	if options.MaxClientFailures != nil && *options.MaxClientFailures > 0 {
+		throttle.maxClientFailures = *options.MaxClientFailures
+	}
+	if options.LockoutSecs != nil && *options.LockoutSecs > 0 {
+		throttle.lockout = time.Duration(*options.LockoutSecs) * time.Second
+	}
+	if options.WindowSecs != nil && *options.WindowSecs > 0 {
+		throttle.window = time.Duration(*options.WindowSecs) * time.Second
+	}
+	return throttle
+}
+
+func docIDForLoginFailures(kind string, id string) string {
+	return LoginFailuresKeyPrefix + kind + ":" + id
+}
+
+// Returns the recent login failures of a username or client address, or nil if there are none.
+func (throttle *LoginThrottle) GetFailures(kind string, id string) (*LoginFailures, error) {
+	var failures LoginFailures
+	_, err := throttle.bucket.Get(docIDForLoginFailures(kind, id), &failures)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if throttle.expired(&failures, time.Now()) {
+		return nil, nil
+	}
+	return &failures, nil
+}
+
+// Forgets the login failures of a username or client address, lifting any lockout.
+func (throttle *LoginThrottle) ClearFailures(kind string, id string) error {
+	err := throttle.bucket.Delete(docIDForLoginFailures(kind, id))
+	if base.IsDocNotFoundError(err) {
+		err = nil
+	}
+	return err
+}
+
+// A login attempt that the throttle has allowed to go ahead.  The caller reports the outcome.
+type LoginAttempt struct {
+	throttle *LoginThrottle
+	username string
+	client   string
+}
+
+// Checks whether a login attempt may go ahead.  If not, returns how long the client has to wait
+// before trying again.  An empty username or client isn't checked or tracked.
+//
+// An attempt that goes ahead is counted as a failure straight away, and taken back if it succeeds.
+// Checking and counting in the same update means concurrent attempts can't all get past the check
+// before any of them has failed, which would let them skip the delay.
+func (throttle *LoginThrottle) CheckLogin(username string, client string) (*LoginAttempt, time.Duration, error) {
+	now := time.Now()
+	attempt := &LoginAttempt{throttle: throttle}
+	if client != "" {
+		wait, err := throttle.reserveAttempt(LoginFailuresClient, client, throttle.maxClientFailures, false, now)
+		if err != nil || wait > 0 {
+			return nil, wait, err
+		}
+		attempt.client = client
+	}
+	if username != "" {
+		wait, err := throttle.reserveAttempt(LoginFailuresUser, username, throttle.maxUserFailures, true, now)
+		if err != nil || wait > 0 {
+			attempt.Succeeded() // gives back the client's reservation
+			return nil, wait, err
+		}
+		attempt.username = username
+	}
+	return attempt, 0, nil
+}
+
+// Records that the login attempt failed.  CheckLogin already counted it as a failure, so there's
+// nothing more to write.
+func (attempt *LoginAttempt) Failed() {
+}
+
+// Records that the login attempt succeeded, which forgets the username's earlier failures.
+// Failures from the client address are kept, so that an attacker can't reset them by logging
+// into an account of their own; only this attempt's reservation is taken back.
+func (attempt *LoginAttempt) Succeeded() {
+	if attempt.username != "" {
+		if err := attempt.throttle.ClearFailures(LoginFailuresUser, attempt.username); err != nil {
+			base.Warn("Couldn't clear login failures of %q: %v", attempt.username, err)
+		}
+	}
+	if attempt.client != "" {
+		attempt.throttle.releaseAttempt(LoginFailuresClient, attempt.client, attempt.throttle.maxClientFailures)
+	}
+}
+
+// Counts a login attempt as a failure of a username or client address, unless it has to wait
+// first, in which case it returns how long.
+func (throttle *LoginThrottle) reserveAttempt(kind string, id string, maxFailures int, progressive bool, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	expiry := base.DurationToCbsExpiry(throttle.window + throttle.lockout)
+	err := throttle.bucket.Update(docIDForLoginFailures(kind, id), expiry, func(currentValue []byte) ([]byte, error) {
+		var failures LoginFailures
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &failures); err != nil {
+				return nil, err
+			}
+			if throttle.expired(&failures, now) {
+				failures = LoginFailures{}
+			}
+		}
+		if wait = throttle.waitTime(&failures, progressive, now); wait > 0 {
+			return nil, couchbase.UpdateCancel
+		}
+		failures.Failures++
+		failures.LastFailure = now
+		if failures.Failures >= maxFailures && failures.LockedUntil == nil {
+			lockedUntil := now.Add(throttle.lockout)
+			failures.LockedUntil = &lockedUntil
+			base.Warn("Login: %s %q locked out after %d failed logins", kind, id, failures.Failures)
+		}
+		return json.Marshal(failures)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return wait, err
+}
+
+// Takes back a failure counted by reserveAttempt, lifting the lockout it may have caused.
+func (throttle *LoginThrottle) releaseAttempt(kind string, id string, maxFailures int) {
+	expiry := base.DurationToCbsExpiry(throttle.window + throttle.lockout)
+	err := throttle.bucket.Update(docIDForLoginFailures(kind, id), expiry, func(currentValue []byte) ([]byte, error) {
+		var failures LoginFailures
+		if currentValue == nil {
+			return nil, couchbase.UpdateCancel
+		} else if err := json.Unmarshal(currentValue, &failures); err != nil {
+			return nil, err
+		}
+		if failures.Failures > 0 {
+			failures.Failures--
+		}
+		if failures.Failures < maxFailures {
+			failures.LockedUntil = nil
+		}
+		if failures.Failures == 0 {
+			return nil, nil // deletes the record
+		}
+		return json.Marshal(failures)
+	})
+	if err != nil && err != couchbase.UpdateCancel {
+		base.Warn("Couldn't release login attempt of %s %q: %v", kind, id, err)
+	}
+}
+
+// Failure records expire once both the failure window and any lockout have passed.  (The bucket
+// expires them too, but not necessarily promptly.)
+func (throttle *LoginThrottle) expired(failures *LoginFailures, now time.Time) bool {
+	if failures.LockedUntil != nil && now.Before(*failures.LockedUntil) {
+		return false
+	}
+	if failures.LockedUntil != nil {
+		return true // the lockout is over; start over
+	}
+	return now.Sub(failures.LastFailure) > throttle.window
+}
+
+func (throttle *LoginThrottle) waitTime(failures *LoginFailures, progressive bool, now time.Time) time.Duration {
+	if failures == nil {
+		return 0
+	} else if failures.LockedUntil != nil {
+		return failures.LockedUntil.Sub(now)
+	} else if !progressive || failures.Failures < 2 {
+		return 0
+	}
+	// The delay is 1 second after the 2nd failure, 2 after the 3rd, 4 after the 4th...
+	delay := throttle.lockout
+	if shift := uint(failures.Failures - 2); shift < 32 {
+		if d := time.Second << shift; d < delay {
+			delay = d
+		}
+	}
+	return failures.LastFailure.Add(delay).Sub(now)
+}
@@ -51,6 +51,8 @@ type OIDCProvider struct {
 	OIDCClientOnce          sync.Once
 	IsDefault               bool
 	Name                    string
+
+	ClaimMappings []OIDCClaimMapping `json:"claim_mappings,omitempty"` // Grants roles and channels based on ID token claims
 }
 
 type OIDCProviderMap map[string]*OIDCProvider
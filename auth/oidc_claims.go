@@ -0,0 +1,167 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// What an OIDCClaimMapping grants
+const (
+	ClaimGrantRoles    = "roles"
+	ClaimGrantChannels = "channels"
+)
+
+// Grants roles or channels to OpenID Connect users based on a claim in their ID token.  The grants
+// are recomputed on every login, so they're revoked when the claim no longer contains the value.
+type OIDCClaimMapping struct {
+	Claim  string              `json:"claim"`            // Claim name; a dotted path selects a nested claim, e.g. "realm_access.roles"
+	Grant  string              `json:"grant"`            // What the claim's values grant: "roles" or "channels"
+	Values map[string][]string `json:"values,omitempty"` // Maps claim values to names; unmapped values are ignored.  If missing, values are used as names
+	Prefix string              `json:"prefix,omitempty"` // Prefix added to names taken directly from claim values
+}
+
+// Optionally implemented by a ChannelComputer, to allocate the sequence at which a change to a
+// principal's grants takes effect.  If it returns 0 the sequence is assigned when the principal
+// doc is processed by the change index (see UpdateUserVbucketSequences).
+type PrincipalSequencer interface {
+	NextPrincipalSequence() (uint64, error)
+}
+
+// Checks that the provider's claim mappings are well-formed.
+func (provider *OIDCProvider) ValidateClaimMappings() error {
+	for _, mapping := range provider.ClaimMappings {
+		if mapping.Claim == "" {
+			return fmt.Errorf("OpenID Connect provider %q has a claim mapping with no claim", provider.Name)
+		}
+		if mapping.Grant != ClaimGrantRoles && mapping.Grant != ClaimGrantChannels {
+			return fmt.Errorf("OpenID Connect provider %q: claim mapping for %q must grant %q or %q",
+				provider.Name, mapping.Claim, ClaimGrantRoles, ClaimGrantChannels)
+		}
+	}
+	return nil
+}
+
+// Returns the roles and channels the provider's claim mappings grant for a JWT.
+func (provider *OIDCProvider) claimGrants(jwt jose.JWT) (roles base.Set, channels base.Set, err error) {
+	claims, err := jwt.Claims()
+	if err != nil {
+		return nil, nil, err
+	}
+	roles = base.Set{}
+	channels = base.Set{}
+	for _, mapping := range provider.ClaimMappings {
+		for _, value := range getClaimValues(claims, mapping.Claim) {
+			var names []string
+			if mapping.Values != nil {
+				names = mapping.Values[value]
+			} else {
+				names = []string{mapping.Prefix + value}
+			}
+			for _, name := range names {
+				if mapping.Grant == ClaimGrantRoles {
+					if !IsValidPrincipalName(name) {
+						base.Warn("OIDC: Ignoring invalid role name %q from claim %q", name, mapping.Claim)
+						continue
+					}
+					roles[name] = struct{}{}
+				} else {
+					if !ch.IsValidChannel(name) {
+						base.Warn("OIDC: Ignoring invalid channel name %q from claim %q", name, mapping.Claim)
+						continue
+					}
+					channels[name] = struct{}{}
+				}
+			}
+		}
+	}
+	return roles, channels, nil
+}
+
+// Returns the string values of a claim, which may be a string or an array of strings.  A dotted
+// claim name is a path through nested objects.
+func getClaimValues(claims jose.Claims, claim string) []string {
+	var value interface{} = map[string]interface{}(claims)
+	for _, key := range strings.Split(claim, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Updates the roles and channels a user is granted by the claims in a JWT, saving the user if
+// they changed.
+func (auth *Authenticator) updateJWTGrants(user User, jwt jose.JWT, provider *OIDCProvider) error {
+	roles, channels, err := provider.claimGrants(jwt)
+	if err != nil {
+		return err
+	}
+	jwtRoles := user.JWTRoles()
+	if jwtRoles == nil {
+		jwtRoles = ch.TimedSet{}
+	}
+	jwtChannels := user.JWTChannels()
+	if jwtChannels == nil {
+		jwtChannels = ch.TimedSet{}
+	}
+	if jwtRoles.Equals(roles) && jwtChannels.Equals(channels) {
+		return nil
+	}
+
+	var nextSeq uint64
+	if sequencer, ok := auth.channelComputer.(PrincipalSequencer); ok {
+		if nextSeq, err = sequencer.NextPrincipalSequence(); err != nil {
+			return err
+		}
+		if nextSeq > 0 {
+			user.SetSequence(nextSeq)
+		}
+	}
+	if jwtRoles.UpdateAtSequence(roles, nextSeq) {
+		user.SetJWTRoles(jwtRoles)
+	}
+	if jwtChannels.UpdateAtSequence(channels, nextSeq) {
+		user.SetJWTChannels(jwtChannels)
+	}
+	base.LogTo("Access", "OIDC claims grant %q roles %v, channels %v", user.Name(), roles, channels)
+
+	// Recompute access now, since the caller is about to use the user:
+	if user.Channels() == nil {
+		if err := auth.rebuildChannels(user); err != nil {
+			return err
+		}
+	}
+	if user.RoleNames() == nil {
+		if err := auth.rebuildRoles(user); err != nil {
+			return err
+		}
+	}
+	return auth.Save(user)
+}
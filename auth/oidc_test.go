@@ -12,6 +12,9 @@ package auth
 import (
 	"testing"
 
+	"github.com/coreos/go-oidc/jose"
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbaselabs/go.assert"
 )
 
@@ -41,3 +44,78 @@ func TestOIDCUsername(t *testing.T) {
 	assert.Equals(t, IsValidPrincipalName(oidcUsername), true)
 
 }
+
+type sequencingComputer struct {
+	mockComputer
+	lastSeq uint64
+}
+
+func (self *sequencingComputer) NextPrincipalSequence() (uint64, error) {
+	self.lastSeq++
+	return self.lastSeq, nil
+}
+
+func makeTestJWT(t *testing.T, claims jose.Claims) jose.JWT {
+	jwt, err := jose.NewJWT(jose.JOSEHeader{"alg": "none"}, claims)
+	assert.Equals(t, err, nil)
+	return jwt
+}
+
+func TestOIDCClaimValues(t *testing.T) {
+	claims := jose.Claims{
+		"group":        "admins",
+		"groups":       []interface{}{"eng", "ops", 17},
+		"realm_access": map[string]interface{}{"roles": []interface{}{"reader"}},
+	}
+	assert.DeepEquals(t, getClaimValues(claims, "group"), []string{"admins"})
+	assert.DeepEquals(t, getClaimValues(claims, "groups"), []string{"eng", "ops"})
+	assert.DeepEquals(t, getClaimValues(claims, "realm_access.roles"), []string{"reader"})
+	assert.DeepEquals(t, getClaimValues(claims, "group.roles"), []string(nil))
+	assert.DeepEquals(t, getClaimValues(claims, "missing"), []string(nil))
+}
+
+func TestOIDCClaimGrants(t *testing.T) {
+	provider := &OIDCProvider{
+		Name: "test",
+		ClaimMappings: []OIDCClaimMapping{
+			{Claim: "groups", Grant: ClaimGrantRoles, Prefix: "oidc-"},
+			{Claim: "groups", Grant: ClaimGrantChannels, Values: map[string][]string{"eng": {"code", "docs"}}},
+		},
+	}
+	assert.Equals(t, provider.ValidateClaimMappings(), nil)
+
+	computer := &sequencingComputer{lastSeq: 10}
+	auth := NewAuthenticator(gTestBucket, computer)
+	user, _ := auth.NewUser("claimsUser", "letmein", ch.SetOf("public"))
+	assert.Equals(t, auth.Save(user), nil)
+
+	jwt := makeTestJWT(t, jose.Claims{"groups": []interface{}{"eng", "ops"}})
+	assert.Equals(t, auth.updateJWTGrants(user, jwt, provider), nil)
+	assert.DeepEquals(t, user.JWTRoles(), ch.AtSequence(base.SetOf("oidc-eng", "oidc-ops"), 11))
+	assert.DeepEquals(t, user.JWTChannels(), ch.AtSequence(base.SetOf("code", "docs"), 11))
+	assert.True(t, user.CanSeeChannel("code"))
+	assert.True(t, user.CanSeeChannel("public"))
+	assert.True(t, user.RoleNames().Contains("oidc-ops"))
+
+	// The grants are persisted, next to the explicit ones:
+	user, _ = auth.GetUser("claimsUser")
+	assert.True(t, user.CanSeeChannel("docs"))
+	assert.DeepEquals(t, user.ExplicitChannels().AsSet(), base.SetOf("public"))
+
+	// Unchanged claims don't allocate a sequence or save:
+	assert.Equals(t, auth.updateJWTGrants(user, jwt, provider), nil)
+	assert.Equals(t, computer.lastSeq, uint64(11))
+
+	// Grants are revoked when the claim values go away:
+	jwt = makeTestJWT(t, jose.Claims{"groups": []interface{}{"ops"}})
+	assert.Equals(t, auth.updateJWTGrants(user, jwt, provider), nil)
+	user, _ = auth.GetUser("claimsUser")
+	assert.DeepEquals(t, user.JWTRoles(), ch.AtSequence(base.SetOf("oidc-ops"), 11))
+	assert.Equals(t, len(user.JWTChannels()), 0)
+	assert.False(t, user.CanSeeChannel("code"))
+	assert.False(t, user.RoleNames().Contains("oidc-eng"))
+	assert.True(t, user.CanSeeChannel("public"))
+
+	provider.ClaimMappings = append(provider.ClaimMappings, OIDCClaimMapping{Claim: "groups", Grant: "admin"})
+	assert.True(t, provider.ValidateClaimMappings() != nil)
+}
@@ -97,6 +97,18 @@ type User interface {
 	// Sets the explicit roles the user belongs to.
 	SetExplicitRoles(ch.TimedSet)
 
+	// The roles the user was granted by claims in its OpenID Connect ID token.
+	JWTRoles() ch.TimedSet
+
+	// Sets the roles granted by ID token claims.
+	SetJWTRoles(ch.TimedSet)
+
+	// The channels the user was granted by claims in its OpenID Connect ID token.
+	JWTChannels() ch.TimedSet
+
+	// Sets the channels granted by ID token claims.
+	SetJWTChannels(ch.TimedSet)
+
 	// Every channel the user has access to, including those inherited from Roles.
 	InheritedChannels() ch.TimedSet
 
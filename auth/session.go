@@ -10,6 +10,9 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -24,6 +27,71 @@ type LoginSession struct {
 	Username   string        `json:"username"`
 	Expiration time.Time     `json:"expiration"`
 	Ttl        time.Duration `json:"ttl"`
+	Created    time.Time     `json:"created"`              // Zero for sessions created by older versions
+	LastUsed   time.Time     `json:"last_used"`            // Updated when the expiration is extended, not on every request
+	UserAgent  string        `json:"user_agent,omitempty"` // User-Agent of the client that logged in
+}
+
+// Returns a digest of a session ID, which identifies the session in lists of sessions without
+// being usable in its place as a credential.
+func SessionIDHash(sessionID string) string {
+	digest := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(digest[:])
+}
+
+// Options for login sessions
+type SessionOptions struct {
+	IdleTimeoutSecs     *int   `json:"idle_timeout_secs,omitempty"`     // Sessions expire after this long without use (default 24 hours)
+	AbsoluteTimeoutSecs *int   `json:"absolute_timeout_secs,omitempty"` // Sessions expire this long after login, however much they're used (default: never)
+	CookieSecure        bool   `json:"cookie_secure,omitempty"`         // Only send the session cookie over HTTPS
+	CookieSameSite      string `json:"cookie_samesite,omitempty"`       // SameSite attribute of the session cookie: "Strict", "Lax" or "None"
+	CookieDomain        string `json:"cookie_domain,omitempty"`         // Domain attribute of the session cookie
+}
+
+// Checks that the options are valid.
+func (options *SessionOptions) Validate() error {
+	if options == nil {
+		return nil
+	}
+	switch options.CookieSameSite {
+	case "", "Strict", "Lax", "None":
+	default:
+		return fmt.Errorf("Invalid cookie_samesite %q; must be \"Strict\", \"Lax\" or \"None\"", options.CookieSameSite)
+	}
+	if options.IdleTimeoutSecs != nil && *options.IdleTimeoutSecs <= 0 {
+		return fmt.Errorf("idle_timeout_secs must be positive")
+	}
+	if options.AbsoluteTimeoutSecs != nil && *options.AbsoluteTimeoutSecs <= 0 {
+		return fmt.Errorf("absolute_timeout_secs must be positive")
+	}
+	return nil
+}
+
+// The time-to-live of new sessions, which is extended each time they're used.
+func (options *SessionOptions) IdleTimeout() time.Duration {
+	if options == nil || options.IdleTimeoutSecs == nil {
+		return kDefaultSessionTTL
+	}
+	return time.Duration(*options.IdleTimeoutSecs) * time.Second
+}
+
+// The maximum lifetime of a session, or zero if there's no limit.
+func (options *SessionOptions) AbsoluteTimeout() time.Duration {
+	if options == nil || options.AbsoluteTimeoutSecs == nil {
+		return 0
+	}
+	return time.Duration(*options.AbsoluteTimeoutSecs) * time.Second
+}
+
+// Returns the time a session will expire if it isn't used again, limited by the absolute timeout.
+func (options *SessionOptions) expirationFor(session *LoginSession, now time.Time) time.Time {
+	expiration := now.Add(session.Ttl)
+	if limit := options.AbsoluteTimeout(); limit > 0 && !session.Created.IsZero() {
+		if maxExpiration := session.Created.Add(limit); expiration.After(maxExpiration) {
+			expiration = maxExpiration
+		}
+	}
+	return expiration
 }
 
 const CookieName = "SyncGatewaySession"
@@ -45,7 +113,13 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 		}
 		return nil, err
 	}
-	// Don't need to check session.Expiration, because Couchbase will have nuked the document.
+	// Couchbase nukes the document when it expires, but the absolute timeout (which may have
+	// been configured after the session was created) has to be checked here.
+	now := time.Now()
+	if limit := auth.SessionOptions.AbsoluteTimeout(); limit > 0 && !session.Created.IsZero() && now.After(session.Created.Add(limit)) {
+		auth.bucket.Delete(docIDForSession(session.ID))
+		return nil, nil
+	}
 	//update the session Expiration if 10% or more of the current expiration time has elapsed
 	//if the session does not contain a Ttl (probably created prior to upgrading SG), use
 	//default value of 24Hours
@@ -53,17 +127,18 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 		session.Ttl = kDefaultSessionTTL
 	}
 	duration := session.Ttl
-	sessionTimeElapsed := int((time.Now().Add(duration).Sub(session.Expiration)).Seconds())
+	sessionTimeElapsed := int((now.Add(duration).Sub(session.Expiration)).Seconds())
 	tenPercentOfTtl := int(duration.Seconds()) / 10
-	if sessionTimeElapsed > tenPercentOfTtl {
-		session.Expiration = time.Now().Add(duration)
-		ttlSec := int(duration.Seconds())
-		if err = auth.bucket.Set(docIDForSession(session.ID), ttlSec, session); err != nil {
+	if expiration := auth.SessionOptions.expirationFor(&session, now); sessionTimeElapsed > tenPercentOfTtl && expiration.After(session.Expiration) {
+		session.Expiration = expiration
+		session.LastUsed = now
+		if err = auth.bucket.Set(docIDForSession(session.ID), base.DurationToCbsExpiry(expiration.Sub(now)), session); err != nil {
 			return nil, err
 		}
+		auth.setSessionCookieAttributes(cookie)
 		base.AddDbPathToCookie(rq, cookie)
 		cookie.Expires = session.Expiration
-		http.SetCookie(response, cookie)
+		auth.SetSessionCookie(response, cookie)
 	}
 
 	user, err := auth.GetUser(session.Username)
@@ -73,19 +148,24 @@ func (auth *Authenticator) AuthenticateCookie(rq *http.Request, response http.Re
 	return user, err
 }
 
-func (auth *Authenticator) CreateSession(username string, ttl time.Duration) (*LoginSession, error) {
+// Creates a login session for a user.  The userAgent is recorded for the admin API's session list.
+func (auth *Authenticator) CreateSession(username string, ttl time.Duration, userAgent string) (*LoginSession, error) {
 	ttlSec := int(ttl.Seconds())
 	if ttlSec <= 0 {
 		return nil, base.HTTPErrorf(400, "Invalid session time-to-live")
 	}
 
+	now := time.Now()
 	session := &LoginSession{
-		ID:         base.GenerateRandomSecret(),
-		Username:   username,
-		Expiration: time.Now().Add(ttl),
-		Ttl:        ttl,
+		ID:        base.GenerateRandomSecret(),
+		Username:  username,
+		Ttl:       ttl,
+		Created:   now,
+		LastUsed:  now,
+		UserAgent: userAgent,
 	}
-	if err := auth.bucket.Set(docIDForSession(session.ID), base.DurationToCbsExpiry(ttl), session); err != nil {
+	session.Expiration = auth.SessionOptions.expirationFor(session, now)
+	if err := auth.bucket.Set(docIDForSession(session.ID), base.DurationToCbsExpiry(session.Expiration.Sub(now)), session); err != nil {
 		return nil, err
 	}
 	return session, nil
@@ -107,11 +187,33 @@ func (auth *Authenticator) MakeSessionCookie(session *LoginSession) *http.Cookie
 	if session == nil {
 		return nil
 	}
-	return &http.Cookie{
+	cookie := &http.Cookie{
 		Name:    CookieName,
 		Value:   session.ID,
 		Expires: session.Expiration,
 	}
+	auth.setSessionCookieAttributes(cookie)
+	return cookie
+}
+
+func (auth *Authenticator) setSessionCookieAttributes(cookie *http.Cookie) {
+	if options := auth.SessionOptions; options != nil {
+		cookie.Secure = options.CookieSecure
+		cookie.Domain = options.CookieDomain
+	}
+}
+
+// Adds a session cookie to a response.  Use this instead of http.SetCookie, which can't set the
+// SameSite attribute.
+func (auth *Authenticator) SetSessionCookie(response http.ResponseWriter, cookie *http.Cookie) {
+	value := cookie.String()
+	if value == "" {
+		return
+	}
+	if options := auth.SessionOptions; options != nil && options.CookieSameSite != "" {
+		value += "; SameSite=" + options.CookieSameSite
+	}
+	response.Header().Add("Set-Cookie", value)
 }
 
 func (auth Authenticator) DeleteSessionForCookie(rq *http.Request) *http.Cookie {
@@ -124,6 +226,7 @@ func (auth Authenticator) DeleteSessionForCookie(rq *http.Request) *http.Cookie
 	newCookie := *cookie
 	newCookie.Value = ""
 	newCookie.Expires = time.Now()
+	auth.setSessionCookieAttributes(&newCookie)
 	return &newCookie
 }
 
@@ -41,6 +41,8 @@ type userImplBody struct {
 	OldPasswordHash_ interface{} `json:"passwordhash,omitempty"` // For pre-beta compatibility
 	ExplicitRoles_   ch.TimedSet `json:"explicit_roles,omitempty"`
 	RolesSince_      ch.TimedSet `json:"rolesSince"`
+	JWTRoles_        ch.TimedSet `json:"jwt_roles,omitempty"`
+	JWTChannels_     ch.TimedSet `json:"jwt_channels,omitempty"`
 
 	OldExplicitRoles_ []string `json:"admin_roles,omitempty"` // obsolete; declared for migration
 }
@@ -185,6 +187,24 @@ func (user *userImpl) SetExplicitRoles(roles ch.TimedSet) {
 	user.setRolesSince(nil) // invalidate persistent cache of role names
 }
 
+func (user *userImpl) JWTRoles() ch.TimedSet {
+	return user.JWTRoles_
+}
+
+func (user *userImpl) SetJWTRoles(roles ch.TimedSet) {
+	user.JWTRoles_ = roles
+	user.setRolesSince(nil) // invalidate persistent cache of role names
+}
+
+func (user *userImpl) JWTChannels() ch.TimedSet {
+	return user.JWTChannels_
+}
+
+func (user *userImpl) SetJWTChannels(channels ch.TimedSet) {
+	user.JWTChannels_ = channels
+	user.setChannels(nil)
+}
+
 // Returns true if the given password is correct for this user, and the account isn't disabled.
 func (user *userImpl) Authenticate(password string) bool {
 	if user == nil {
@@ -215,17 +215,6 @@ func (bucket CouchbaseBucket) StartCouchbaseTapFeed(args sgbucket.TapArguments)
 // Start cbdatasource-based DCP feed, using DCPReceiver.
 func (bucket CouchbaseBucket) StartDCPFeed(args sgbucket.TapArguments) (sgbucket.TapFeed, error) {
 
-	// Recommended usage of cbdatasource is to let it manage it's own dedicated connection, so we're not
-	// reusing the bucket connection we've already established.
-	urls := []string{bucket.spec.Server}
-	poolName := bucket.spec.PoolName
-	if poolName == "" {
-		poolName = "default"
-	}
-	bucketName := bucket.spec.BucketName
-
-	vbucketIdsArr := []uint16(nil) // nil means get all the vbuckets.
-
 	dcpReceiver := NewDCPReceiver()
 
 	dcpReceiver.SetBucketNotifyFn(args.Notify)
@@ -254,17 +243,7 @@ func (bucket CouchbaseBucket) StartDCPFeed(args sgbucket.TapArguments) (sgbucket
 	}
 	dcpReceiver.SeedSeqnos(vbuuids, startSeqnos)
 
-	LogTo("Feed+", "Connecting to new bucket datasource.  URLs:%s, pool:%s, name:%s, auth:%s", urls, poolName, bucketName, bucket.spec.Auth)
-	bds, err := cbdatasource.NewBucketDataSource(
-		urls,
-		poolName,
-		bucketName,
-		"",
-		vbucketIdsArr,
-		bucket.spec.Auth,
-		dcpReceiver,
-		nil,
-	)
+	bds, err := bucket.newBucketDataSource(dcpReceiver)
 	if err != nil {
 		return nil, err
 	}
@@ -285,6 +264,32 @@ func (bucket CouchbaseBucket) StartDCPFeed(args sgbucket.TapArguments) (sgbucket
 	return &dcpFeed, nil
 }
 
+// Creates a cbdatasource BucketDataSource for all the bucket's vbuckets, that sends to the receiver.
+func (bucket CouchbaseBucket) newBucketDataSource(receiver cbdatasource.Receiver) (cbdatasource.BucketDataSource, error) {
+	// Recommended usage of cbdatasource is to let it manage it's own dedicated connection, so we're not
+	// reusing the bucket connection we've already established.
+	urls := []string{bucket.spec.Server}
+	poolName := bucket.spec.PoolName
+	if poolName == "" {
+		poolName = "default"
+	}
+	bucketName := bucket.spec.BucketName
+
+	vbucketIdsArr := []uint16(nil) // nil means get all the vbuckets.
+
+	LogTo("Feed+", "Connecting to new bucket datasource.  URLs:%s, pool:%s, name:%s, auth:%s", urls, poolName, bucketName, bucket.spec.Auth)
+	return cbdatasource.NewBucketDataSource(
+		urls,
+		poolName,
+		bucketName,
+		"",
+		vbucketIdsArr,
+		bucket.spec.Auth,
+		receiver,
+		nil,
+	)
+}
+
 func (bucket CouchbaseBucket) GetStatsVbSeqno(maxVbno uint16, useAbsHighSeqNo bool) (uuids map[uint16]uint64, highSeqnos map[uint16]uint64, seqErr error) {
 
 	stats := bucket.Bucket.GetStats("vbucket-seqno")
@@ -413,8 +418,20 @@ func GetCouchbaseBucket(spec BucketSpec, callback sgbucket.BucketNotifyFn) (buck
 	return
 }
 
+// Returns true if a server URL refers to Walrus rather than Couchbase Server.
+func IsWalrusServer(server string) bool {
+	isWalrus, _ := regexp.MatchString(`^(walrus:|file:|/|\.)`, server)
+	return isWalrus
+}
+
 func GetBucket(spec BucketSpec, callback sgbucket.BucketNotifyFn) (bucket Bucket, err error) {
-	if isWalrus, _ := regexp.MatchString(`^(walrus:|file:|/|\.)`, spec.Server); isWalrus {
+	if strings.HasPrefix(spec.Server, LocalBucketScheme) {
+		Logf("Opening local database %s on <%s>", spec.BucketName, spec.Server)
+		var localBucket *LocalBucket
+		if localBucket, err = GetLocalBucket(spec.Server, spec.BucketName); err == nil {
+			bucket = localBucket
+		}
+	} else if IsWalrusServer(spec.Server) {
 		Logf("Opening Walrus database %s on <%s>", spec.BucketName, spec.Server)
 		sgbucket.SetLogging(LogEnabled("Walrus"))
 		bucket, err = walrus.GetBucket(spec.Server, spec.PoolName, spec.BucketName)
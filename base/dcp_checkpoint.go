@@ -0,0 +1,152 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/couchbase/go-couchbase/cbdatasource"
+	"github.com/couchbase/gomemcached"
+	sgbucket "github.com/couchbase/sg-bucket"
+)
+
+// Returned by StartCheckpointedFeed when the bucket isn't using a DCP feed.
+var ErrCheckpointsUnsupported = errors.New("Checkpointed feeds require DCP")
+
+// A position in a vbucket's DCP stream.
+type VbucketCheckpoint struct {
+	VbNo   uint16 `json:"vb"`
+	VbUUID uint64 `json:"uuid"`
+	Seq    uint64 `json:"seq"`
+}
+
+// A mutation or deletion from a checkpointed feed, with its position in its vbucket's stream.
+type CheckpointedEvent struct {
+	sgbucket.TapEvent
+	Checkpoint VbucketCheckpoint
+}
+
+// A DCP feed that reports the position of each event, so that a client can save the positions
+// it's processed and later restart the feed from them.
+type CheckpointedFeed interface {
+	Events() <-chan CheckpointedEvent
+	Close() error
+}
+
+// Implemented by buckets that can start a CheckpointedFeed.
+type CheckpointedFeedBucket interface {
+	StartCheckpointedFeed(checkpoints []VbucketCheckpoint, notify sgbucket.BucketNotifyFn) (CheckpointedFeed, error)
+}
+
+type couchbaseCheckpointedFeedImpl struct {
+	bds    cbdatasource.BucketDataSource
+	events chan CheckpointedEvent
+}
+
+func (feed *couchbaseCheckpointedFeedImpl) Events() <-chan CheckpointedEvent {
+	return feed.events
+}
+
+func (feed *couchbaseCheckpointedFeedImpl) Close() error {
+	return feed.bds.Close()
+}
+
+// Starts a DCP feed that resumes each vbucket from its checkpoint.  Vbuckets without a
+// checkpoint are read from the beginning.  If a checkpoint's vbucket UUID is no longer in the
+// vbucket's failover log, the server rolls the stream back.
+func (bucket CouchbaseBucket) StartCheckpointedFeed(checkpoints []VbucketCheckpoint, notify sgbucket.BucketNotifyFn) (CheckpointedFeed, error) {
+	if bucket.spec.FeedType != DcpFeedType {
+		return nil, ErrCheckpointsUnsupported
+	}
+
+	// As in StartDCPFeed, this is also a check on whether the server supports DCP:
+	maxVbno, err := bucket.GetMaxVbno()
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := bucket.GetStatsVbSeqno(maxVbno, false); err != nil {
+		return nil, errors.New("Error retrieving stats-vbseqno - DCP not supported")
+	}
+
+	receiver := newCheckpointReceiver(checkpoints)
+	receiver.SetBucketNotifyFn(notify)
+
+	bds, err := bucket.newBucketDataSource(receiver)
+	if err != nil {
+		return nil, err
+	}
+	feed := &couchbaseCheckpointedFeedImpl{bds, receiver.events}
+	if err = bds.Start(); err != nil {
+		return nil, err
+	}
+	return feed, nil
+}
+
+// A DCPReceiver that sends CheckpointedEvents, tagged with the vbucket UUID from the metadata
+// cbdatasource saves when it opens each stream.
+type checkpointReceiver struct {
+	*DCPReceiver
+	uuidLock sync.Mutex
+	uuids    map[uint16]uint64
+	events   chan CheckpointedEvent
+}
+
+func newCheckpointReceiver(checkpoints []VbucketCheckpoint) *checkpointReceiver {
+	r := &checkpointReceiver{
+		DCPReceiver: &DCPReceiver{},
+		uuids:       make(map[uint16]uint64, len(checkpoints)),
+		events:      make(chan CheckpointedEvent, 10),
+	}
+	startSeqnos := make(map[uint16]uint64, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		r.uuids[checkpoint.VbNo] = checkpoint.VbUUID
+		startSeqnos[checkpoint.VbNo] = checkpoint.Seq
+	}
+	r.SeedSeqnos(r.uuids, startSeqnos)
+	return r
+}
+
+func (r *checkpointReceiver) DataUpdate(vbucketId uint16, key []byte, seq uint64,
+	req *gomemcached.MCRequest) error {
+	r.updateSeq(vbucketId, seq, true)
+	r.events <- r.makeEvent(req, vbucketId, seq, sgbucket.TapMutation)
+	return nil
+}
+
+func (r *checkpointReceiver) DataDelete(vbucketId uint16, key []byte, seq uint64,
+	req *gomemcached.MCRequest) error {
+	r.updateSeq(vbucketId, seq, true)
+	r.events <- r.makeEvent(req, vbucketId, seq, sgbucket.TapDeletion)
+	return nil
+}
+
+func (r *checkpointReceiver) makeEvent(rq *gomemcached.MCRequest, vbucketId uint16, seq uint64, opcode sgbucket.TapOpcode) CheckpointedEvent {
+	r.uuidLock.Lock()
+	uuid := r.uuids[vbucketId]
+	r.uuidLock.Unlock()
+	return CheckpointedEvent{
+		TapEvent:   makeFeedEvent(rq, vbucketId, opcode),
+		Checkpoint: VbucketCheckpoint{VbNo: vbucketId, VbUUID: uuid, Seq: seq},
+	}
+}
+
+// cbdatasource saves the vbucket's failover log in its metadata; the first entry is the UUID
+// the stream's sequences belong to.
+func (r *checkpointReceiver) SetMetaData(vbucketId uint16, value []byte) error {
+	var metadata cbdatasource.VBucketMetaData
+	if err := json.Unmarshal(value, &metadata); err == nil && len(metadata.FailOverLog) > 0 && len(metadata.FailOverLog[0]) > 0 {
+		r.uuidLock.Lock()
+		r.uuids[vbucketId] = metadata.FailOverLog[0][0]
+		r.uuidLock.Unlock()
+	}
+	return r.DCPReceiver.SetMetaData(vbucketId, value)
+}
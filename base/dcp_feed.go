@@ -142,6 +142,7 @@ func makeFeedEvent(rq *gomemcached.MCRequest, vbucketId uint16, opcode sgbucket.
 		Key:      rq.Key,
 		Value:    rq.Body,
 		Sequence: rq.Cas,
+		VbNo:     vbucketId,
 	}
 	return event
 }
@@ -152,6 +153,7 @@ func (r *DCPReceiver) SnapshotStart(vbucketId uint16,
 	// scenario, to support restart.  Not yet implemented due to concerns about impact of persistence
 	// on the shadowing DCP feed, as the SnapshotStart gets issued per vbucket.  It's not clear that the
 	// performance benefit on SG restart outweighs the performance impact during regular processing.
+	// (The shadower instead uses a checkpointReceiver, and saves the positions it's processed.)
 	return nil
 }
 
@@ -3,6 +3,8 @@ package base
 import (
 	"testing"
 
+	"github.com/couchbase/gomemcached"
+	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbaselabs/go.assert"
 )
 
@@ -38,3 +40,28 @@ func TestTransformBucketCredentials(t *testing.T) {
 	assert.Equals(t, bucketname2, inputBucketName2)
 
 }
+
+func TestCheckpointReceiver(t *testing.T) {
+	receiver := newCheckpointReceiver([]VbucketCheckpoint{{VbNo: 3, VbUUID: 1234, Seq: 50}})
+
+	// Seeded vbuckets resume from their checkpoints:
+	metadata, lastSeq, _ := receiver.GetMetaData(3)
+	assert.Equals(t, lastSeq, uint64(50))
+	assert.True(t, metadata != nil)
+	_, lastSeq, _ = receiver.GetMetaData(4)
+	assert.Equals(t, lastSeq, uint64(0))
+
+	go receiver.DataUpdate(3, []byte("doc"), 51, &gomemcached.MCRequest{Key: []byte("doc"), Body: []byte(`{}`), Cas: 99})
+	event := <-receiver.events
+	assert.Equals(t, event.Opcode, sgbucket.TapMutation)
+	assert.Equals(t, event.Sequence, uint64(99))
+	assert.Equals(t, event.VbNo, uint16(3))
+	assert.Equals(t, event.Checkpoint, VbucketCheckpoint{VbNo: 3, VbUUID: 1234, Seq: 51})
+
+	// A new stream's UUID comes from the failover log cbdatasource saves:
+	receiver.SetMetaData(4, []byte(`{"failOverLog":[[5678,0]]}`))
+	go receiver.DataDelete(4, []byte("doc"), 7, &gomemcached.MCRequest{Key: []byte("doc")})
+	event = <-receiver.events
+	assert.Equals(t, event.Opcode, sgbucket.TapDeletion)
+	assert.Equals(t, event.Checkpoint, VbucketCheckpoint{VbNo: 4, VbUUID: 5678, Seq: 7})
+}
@@ -57,6 +57,8 @@ func ErrorAsHTTPStatus(err error) (int, string) {
 		}
 	case sgbucket.MissingError:
 		return http.StatusNotFound, "missing"
+	case *BucketUnavailableError:
+		return http.StatusServiceUnavailable, "Database server is unavailable"
 	case *json.SyntaxError, *json.UnmarshalTypeError:
 		return http.StatusBadRequest, fmt.Sprintf("Invalid JSON: \"%v\"", err)
 	}
@@ -3,6 +3,7 @@ package base
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
@@ -10,9 +11,11 @@ import (
 
 // A wrapper around a Bucket to support forced errors.  For testing use only.
 type LeakyBucket struct {
-	bucket    Bucket
-	incrCount uint16
-	config    LeakyBucketConfig
+	bucket     Bucket
+	incrCount  uint16
+	config     LeakyBucketConfig
+	faults     *LeakyFaults // Faults injected at runtime (see SetFaults)
+	faultsLock sync.Mutex
 }
 
 // The config object that controls the LeakyBucket behavior
@@ -27,6 +30,9 @@ type LeakyBucketConfig struct {
 	TapFeedDeDuplication bool
 	TapFeedVbuckets      bool     // Emulate vbucket numbers on feed
 	TapFeedMissingDocs   []string // Emulate entry not appearing on tap feed
+
+	// Feeds can drop or duplicate events, as set at runtime by SetFaults
+	TapFeedFaults bool
 }
 
 func NewLeakyBucket(bucket Bucket, config LeakyBucketConfig) Bucket {
@@ -39,15 +45,27 @@ func (b *LeakyBucket) GetName() string {
 	return b.bucket.GetName()
 }
 func (b *LeakyBucket) Get(k string, rv interface{}) (cas uint64, err error) {
+	if err := b.injectFault(LeakyOpGet, k); err != nil {
+		return 0, err
+	}
 	return b.bucket.Get(k, rv)
 }
 func (b *LeakyBucket) GetRaw(k string) (v []byte, cas uint64, err error) {
+	if err := b.injectFault(LeakyOpGet, k); err != nil {
+		return nil, 0, err
+	}
 	return b.bucket.GetRaw(k)
 }
 func (b *LeakyBucket) GetBulkRaw(keys []string) (map[string][]byte, error) {
+	if err := b.injectFault(LeakyOpGet, keys...); err != nil {
+		return nil, err
+	}
 	return b.bucket.GetBulkRaw(keys)
 }
 func (b *LeakyBucket) GetAndTouchRaw(k string, exp int) (v []byte, cas uint64, err error) {
+	if err := b.injectFault(LeakyOpGet, k); err != nil {
+		return nil, 0, err
+	}
 	return b.bucket.GetAndTouchRaw(k, exp)
 }
 func (b *LeakyBucket) Add(k string, exp int, v interface{}) (added bool, err error) {
@@ -75,9 +93,15 @@ func (b *LeakyBucket) WriteCas(k string, flags int, exp int, cas uint64, v inter
 	return b.bucket.WriteCas(k, flags, exp, cas, v, opt)
 }
 func (b *LeakyBucket) Update(k string, exp int, callback sgbucket.UpdateFunc) (err error) {
+	if err := b.injectFault(LeakyOpWriteUpdate, k); err != nil {
+		return err
+	}
 	return b.bucket.Update(k, exp, callback)
 }
 func (b *LeakyBucket) WriteUpdate(k string, exp int, callback sgbucket.WriteUpdateFunc) (err error) {
+	if err := b.injectFault(LeakyOpWriteUpdate, k); err != nil {
+		return err
+	}
 	return b.bucket.WriteUpdate(k, exp, callback)
 }
 func (b *LeakyBucket) SetBulk(entries []*sgbucket.BulkSetEntry) (err error) {
@@ -94,6 +118,9 @@ func (b *LeakyBucket) Incr(k string, amt, def uint64, exp int) (uint64, error) {
 		b.incrCount = 0
 
 	}
+	if err := b.injectFault(LeakyOpIncr, k); err != nil {
+		return 0, err
+	}
 	return b.bucket.Incr(k, amt, def, exp)
 }
 
@@ -107,9 +134,15 @@ func (b *LeakyBucket) DeleteDDoc(docname string) error {
 	return b.bucket.DeleteDDoc(docname)
 }
 func (b *LeakyBucket) View(ddoc, name string, params map[string]interface{}) (sgbucket.ViewResult, error) {
+	if err := b.injectFault(LeakyOpView, ddoc+"/"+name); err != nil {
+		return sgbucket.ViewResult{}, err
+	}
 	return b.bucket.View(ddoc, name, params)
 }
 func (b *LeakyBucket) ViewCustom(ddoc, name string, params map[string]interface{}, vres interface{}) error {
+	if err := b.injectFault(LeakyOpView, ddoc+"/"+name); err != nil {
+		return err
+	}
 	return b.bucket.ViewCustom(ddoc, name, params, vres)
 }
 
@@ -118,6 +151,14 @@ func (b *LeakyBucket)  Refresh() error {
 }
 
 func (b *LeakyBucket) StartTapFeed(args sgbucket.TapArguments) (sgbucket.TapFeed, error) {
+	feed, err := b.startTapFeed(args)
+	if err == nil && b.config.TapFeedFaults {
+		feed = b.wrapFeedForFaults(feed)
+	}
+	return feed, err
+}
+
+func (b *LeakyBucket) startTapFeed(args sgbucket.TapArguments) (sgbucket.TapFeed, error) {
 
 	if b.config.TapFeedDeDuplication {
 		return b.wrapFeedForDeduplication(args)
@@ -1,7 +1,10 @@
 package base
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbaselabs/go.assert"
@@ -58,3 +61,56 @@ func TestDedupeNoDedupeDifferentDocs(t *testing.T) {
 	assert.True(t, len(deduped) == 2)
 
 }
+
+func TestLeakyBucketRuntimeFaults(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "leakybucket")
+	defer os.RemoveAll(dir)
+	localBucket, err := GetLocalBucket(LocalBucketScheme+dir, "leaky")
+	assert.Equals(t, err, nil)
+	bucket := NewLeakyBucket(localBucket, LeakyBucketConfig{TapFeedFaults: true}).(*LeakyBucket)
+	defer bucket.Close()
+	bucket.SetRaw("doc1", 0, []byte(`{}`))
+	bucket.SetRaw("doc2", 0, []byte(`{}`))
+
+	bucket.SetFaults(&LeakyFaults{
+		Ops:     map[string]*LeakyOpFault{LeakyOpGet: {ErrorRate: 1, Keys: []string{"doc1"}}},
+		Expires: time.Now().Add(time.Minute),
+	})
+	_, _, err = bucket.GetRaw("doc1")
+	assert.True(t, err != nil)
+	assert.False(t, IsDocNotFoundError(err))
+	_, _, err = bucket.GetRaw("doc2")
+	assert.Equals(t, err, nil)
+	_, err = bucket.Incr("counter", 1, 1, 0)
+	assert.Equals(t, err, nil)
+
+	// Expired faults are removed:
+	bucket.SetFaults(&LeakyFaults{
+		Ops:     map[string]*LeakyOpFault{LeakyOpGet: {ErrorRate: 1}},
+		Expires: time.Now().Add(-time.Second),
+	})
+	_, _, err = bucket.GetRaw("doc1")
+	assert.Equals(t, err, nil)
+	assert.True(t, bucket.Faults() == nil)
+
+	// Feed faults apply to a feed that's already running:
+	feed, err := bucket.StartTapFeed(sgbucket.TapArguments{Backfill: sgbucket.TapNoBackfill})
+	assert.Equals(t, err, nil)
+	defer feed.Close()
+	bucket.SetFaults(&LeakyFaults{
+		Feed:    &LeakyFeedFault{DuplicateRate: 1, Keys: []string{"doc3"}},
+		Expires: time.Now().Add(time.Minute),
+	})
+	bucket.SetRaw("doc3", 0, []byte(`{}`))
+	bucket.SetRaw("doc4", 0, []byte(`{}`))
+	var keys []string
+	for len(keys) < 3 {
+		select {
+		case event := <-feed.Events():
+			keys = append(keys, string(event.Key))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for events; got %v", keys)
+		}
+	}
+	assert.DeepEquals(t, keys, []string{"doc3", "doc3", "doc4"})
+}
@@ -0,0 +1,154 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	sgbucket "github.com/couchbase/sg-bucket"
+)
+
+// Types of operation that faults can be injected into
+const (
+	LeakyOpGet         = "get"          // Get, GetRaw, GetBulkRaw, GetAndTouchRaw
+	LeakyOpWriteUpdate = "write_update" // WriteUpdate, Update
+	LeakyOpIncr        = "incr"
+	LeakyOpView        = "view" // View, ViewCustom; keys are "ddoc/view"
+)
+
+// Faults injected into a LeakyBucket at runtime.  They're removed automatically at Expires.
+type LeakyFaults struct {
+	Ops     map[string]*LeakyOpFault `json:"ops,omitempty"`  // Faults by operation type (LeakyOp*)
+	Feed    *LeakyFeedFault          `json:"feed,omitempty"` // Faults in the bucket's feeds
+	Expires time.Time                `json:"expires"`
+}
+
+// A fault injected into a type of bucket operation.
+type LeakyOpFault struct {
+	ErrorRate float64  `json:"error_rate,omitempty"` // Fraction of calls (0-1) that fail
+	LatencyMs int      `json:"latency_ms,omitempty"` // Delay added to each call
+	Keys      []string `json:"keys,omitempty"`       // If given, only calls on these keys are affected
+}
+
+// A fault injected into a bucket's feeds.  Only mutations and deletions are affected.
+type LeakyFeedFault struct {
+	DropRate      float64  `json:"drop_rate,omitempty"`      // Fraction of events (0-1) that are lost
+	DuplicateRate float64  `json:"duplicate_rate,omitempty"` // Fraction of events sent twice
+	Keys          []string `json:"keys,omitempty"`           // If given, only events for these keys
+}
+
+// Checks the fault configuration for values out of range.
+func (faults *LeakyFaults) Validate() error {
+	for op, fault := range faults.Ops {
+		switch op {
+		case LeakyOpGet, LeakyOpWriteUpdate, LeakyOpIncr, LeakyOpView:
+		default:
+			return fmt.Errorf("Unknown operation type %q", op)
+		}
+		if fault == nil || fault.ErrorRate < 0 || fault.ErrorRate > 1 || fault.LatencyMs < 0 {
+			return fmt.Errorf("Invalid fault for %q", op)
+		}
+	}
+	if feed := faults.Feed; feed != nil {
+		if feed.DropRate < 0 || feed.DropRate > 1 || feed.DuplicateRate < 0 || feed.DuplicateRate > 1 {
+			return fmt.Errorf("Invalid feed fault")
+		}
+	}
+	return nil
+}
+
+func faultAppliesToKey(faultKeys []string, keys []string) bool {
+	if len(faultKeys) == 0 {
+		return true
+	}
+	for _, key := range keys {
+		for _, faultKey := range faultKeys {
+			if key == faultKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sets the faults injected into the bucket's operations, replacing any it had.  A nil value
+// removes them.
+func (b *LeakyBucket) SetFaults(faults *LeakyFaults) {
+	b.faultsLock.Lock()
+	defer b.faultsLock.Unlock()
+	b.faults = faults
+	if faults != nil {
+		Logf("LeakyBucket %s: Injecting faults until %v", b.GetName(), faults.Expires)
+	} else {
+		Logf("LeakyBucket %s: Removed injected faults", b.GetName())
+	}
+}
+
+// Returns the faults currently being injected, or nil if there are none (or they've expired).
+func (b *LeakyBucket) Faults() *LeakyFaults {
+	b.faultsLock.Lock()
+	defer b.faultsLock.Unlock()
+	if b.faults != nil && !time.Now().Before(b.faults.Expires) {
+		Logf("LeakyBucket %s: Injected faults expired", b.GetName())
+		b.faults = nil
+	}
+	return b.faults
+}
+
+// Delays and/or fails an operation, as configured by SetFaults.  The error is the temporary
+// failure a Couchbase server returns when it's overloaded.
+func (b *LeakyBucket) injectFault(op string, keys ...string) error {
+	faults := b.Faults()
+	if faults == nil {
+		return nil
+	}
+	fault := faults.Ops[op]
+	if fault == nil || !faultAppliesToKey(fault.Keys, keys) {
+		return nil
+	}
+	if fault.LatencyMs > 0 {
+		time.Sleep(time.Duration(fault.LatencyMs) * time.Millisecond)
+	}
+	if fault.ErrorRate > 0 && rand.Float64() < fault.ErrorRate {
+		LogTo("Bucket", "LeakyBucket: Injecting %s failure on %q", op, keys)
+		return &gomemcached.MCResponse{
+			Status: gomemcached.TMPFAIL,
+			Body:   []byte(fmt.Sprintf("Injected %s fault", op)),
+		}
+	}
+	return nil
+}
+
+// Wraps a feed so that it drops or duplicates events, as configured by SetFaults.
+func (b *LeakyBucket) wrapFeedForFaults(feed sgbucket.TapFeed) sgbucket.TapFeed {
+	channel := make(chan sgbucket.TapEvent, 10)
+	go func() {
+		defer close(channel)
+		for event := range feed.Events() {
+			if event.Opcode == sgbucket.TapMutation || event.Opcode == sgbucket.TapDeletion {
+				faults := b.Faults()
+				if faults != nil && faults.Feed != nil && faultAppliesToKey(faults.Feed.Keys, []string{string(event.Key)}) {
+					if rand.Float64() < faults.Feed.DropRate {
+						LogTo("Bucket", "LeakyBucket: Dropping feed event for %q", event.Key)
+						continue
+					} else if rand.Float64() < faults.Feed.DuplicateRate {
+						LogTo("Bucket", "LeakyBucket: Duplicating feed event for %q", event.Key)
+						channel <- event
+					}
+				}
+			}
+			channel <- event
+		}
+	}()
+	return &wrappedTapFeedImpl{channel: channel, wrappedTapFeed: feed}
+}
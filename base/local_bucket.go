@@ -0,0 +1,831 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	sgbucket "github.com/couchbase/sg-bucket"
+)
+
+// Server URL scheme that selects a LocalBucket, e.g. "local:/var/lib/sync_gateway"
+const LocalBucketScheme = "local:"
+
+// Types of records in a LocalBucket's log
+const (
+	localRecordSet        = byte(iota + 1) // A document's new value
+	localRecordDelete                      // A document deletion
+	localRecordDDoc                        // A design doc's new value
+	localRecordDeleteDDoc                  // A design doc deletion
+	localRecordCounters                    // The last CAS and vbucket sequences, written on compaction
+)
+
+const kLocalNumVbuckets = 1024       // Number of (emulated) vbuckets documents are hashed to
+const kLocalMaxRecordSize = 64 << 20 // Larger record lengths in the log are treated as corrupt
+const kLocalCompactMinSize = 4 << 20 // The log isn't compacted until it's at least this big...
+const kLocalCompactRatio = 2         // ...and this many times bigger than the live data
+
+var ErrLocalBucketClosed = errors.New("Bucket is closed")
+
+// Open LocalBuckets, by file path.  Each log file must only be opened once per process.
+var localBuckets = map[string]*LocalBucket{}
+var localBucketsLock sync.Mutex
+
+// A Bucket stored on local disk, for single-node deployments.  Every mutation is appended to a
+// write-ahead log file, which is synced before the mutation returns; the current state is kept in
+// memory and rebuilt from the log on open.  A record left incomplete by a crash is discarded, and
+// the log is compacted when it gets much bigger than the live data.  Documents are hashed to
+// vbuckets and given per-vbucket sequences, so the feed has DCP semantics.
+type LocalBucket struct {
+	name     string
+	path     string                // Path of the log file
+	lock     sync.Mutex            // Guards everything below
+	file     *os.File              // Log file, opened for appending (nil when closed)
+	logSize  int64                 // Size of the log file
+	liveSize int64                 // Size the log would be if compacted
+	items    map[string]*localItem // Current documents
+	ddocs    map[string][]byte     // Design docs, as JSON
+	views    map[string]*localView // Compiled views, by "ddoc/view"
+	lastCas  uint64                // CAS of the latest mutation
+	vbSeqs   []uint64              // Latest sequence of each vbucket
+	feeds    []*localFeed          // Open feeds, which are sent each mutation
+	refCount int
+}
+
+type localItem struct {
+	value []byte
+	cas   uint64
+	exp   uint32 // Absolute Unix time it expires at, or 0
+	vbSeq uint64 // Sequence in its vbucket
+	size  int64  // Size of its log record
+}
+
+func (item *localItem) expired(now time.Time) bool {
+	return item.exp != 0 && now.Unix() >= int64(item.exp)
+}
+
+// Converts a Couchbase expiry, which is either relative or absolute, to an absolute Unix time.
+func localExpiry(exp int) uint32 {
+	if exp <= 0 {
+		return 0
+	} else if exp <= kMaxDeltaTtl {
+		return uint32(time.Now().Unix()) + uint32(exp)
+	}
+	return uint32(exp)
+}
+
+// Opens a LocalBucket stored in a directory, given as a server URL with the "local:" scheme.
+// The bucket is created if it doesn't exist.
+func GetLocalBucket(server, bucketName string) (*LocalBucket, error) {
+	dir := strings.TrimPrefix(strings.TrimPrefix(server, LocalBucketScheme), "//")
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path, err := filepath.Abs(filepath.Join(dir, bucketName+".sgdb"))
+	if err != nil {
+		return nil, err
+	}
+
+	localBucketsLock.Lock()
+	defer localBucketsLock.Unlock()
+	bucket := localBuckets[path]
+	if bucket == nil {
+		if bucket, err = openLocalBucket(path, bucketName); err != nil {
+			return nil, err
+		}
+		localBuckets[path] = bucket
+	}
+	bucket.refCount++
+	return bucket, nil
+}
+
+func openLocalBucket(path, name string) (*LocalBucket, error) {
+	bucket := &LocalBucket{
+		name:   name,
+		path:   path,
+		items:  map[string]*localItem{},
+		ddocs:  map[string][]byte{},
+		views:  map[string]*localView{},
+		vbSeqs: make([]uint64, kLocalNumVbuckets),
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = bucket.replay(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	bucket.file = file
+	for ddocName, ddoc := range bucket.ddocs {
+		if err = bucket.compileViews(ddocName, ddoc); err != nil {
+			Warn("LocalBucket %s: Can't compile design doc %q: %v", name, ddocName, err)
+		}
+	}
+	if err = bucket.maybeCompact(); err != nil {
+		bucket.file.Close()
+		return nil, err
+	}
+	LogTo("Bucket", "Opened LocalBucket %s at %s: %d docs, %d log bytes", name, path,
+		len(bucket.items), bucket.logSize)
+	return bucket, nil
+}
+
+// Rebuilds the bucket's state by reading the log.  If the log ends with an incomplete or corrupt
+// record, which is what a crash in the middle of a write leaves, the log is truncated before it.
+func (bucket *LocalBucket) replay(file *os.File) error {
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		op, key, item, size, err := readLocalRecord(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			Warn("LocalBucket %s: Discarding log after offset %d: %v", bucket.name, offset, err)
+			if err = file.Truncate(offset); err != nil {
+				return err
+			}
+			if err = file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		bucket.apply(op, key, item, size)
+		offset += size
+	}
+	bucket.logSize = offset
+	return nil
+}
+
+// Applies a log record to the in-memory state.
+func (bucket *LocalBucket) apply(op byte, key string, item *localItem, size int64) {
+	if item.cas > bucket.lastCas {
+		bucket.lastCas = item.cas
+	}
+	switch op {
+	case localRecordSet, localRecordDelete:
+		if vbNo := VBHash(key, kLocalNumVbuckets); item.vbSeq > bucket.vbSeqs[vbNo] {
+			bucket.vbSeqs[vbNo] = item.vbSeq
+		}
+		if old := bucket.items[key]; old != nil {
+			bucket.liveSize -= old.size
+			delete(bucket.items, key)
+		}
+		if op == localRecordSet {
+			item.size = size
+			bucket.items[key] = item
+			bucket.liveSize += size
+		}
+	case localRecordDDoc:
+		bucket.ddocs[key] = item.value
+	case localRecordDeleteDDoc:
+		delete(bucket.ddocs, key)
+	case localRecordCounters:
+		for i := 0; i+8 <= len(item.value) && i/8 < kLocalNumVbuckets; i += 8 {
+			if seq := binary.LittleEndian.Uint64(item.value[i:]); seq > bucket.vbSeqs[i/8] {
+				bucket.vbSeqs[i/8] = seq
+			}
+		}
+	}
+}
+
+//////// LOG RECORDS:
+
+// Each record is a 4-byte length and a 4-byte CRC32 of the payload, followed by the payload: the
+// op, the item's CAS, expiry and vbucket sequence as varints, the key length and key, and the
+// rest is the value.
+func encodeLocalRecord(op byte, key string, item *localItem) []byte {
+	record := make([]byte, 8, 9+4*binary.MaxVarintLen64+len(key)+len(item.value))
+	record = append(record, op)
+	var varint [binary.MaxVarintLen64]byte
+	for _, n := range []uint64{item.cas, uint64(item.exp), item.vbSeq, uint64(len(key))} {
+		record = append(record, varint[:binary.PutUvarint(varint[:], n)]...)
+	}
+	record = append(record, key...)
+	record = append(record, item.value...)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(record)-8))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+	return record
+}
+
+// Reads the next record from a log.  Returns io.EOF only at a clean end of the log.
+func readLocalRecord(reader *bufio.Reader) (op byte, key string, item *localItem, size int64, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("incomplete record header")
+		}
+		return
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length == 0 || length > kLocalMaxRecordSize {
+		err = fmt.Errorf("invalid record length %d", length)
+		return
+	}
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		err = errors.New("incomplete record")
+		return
+	} else if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		err = errors.New("record checksum mismatch")
+		return
+	}
+
+	op = payload[0]
+	pos := 1
+	var fields [4]uint64
+	for i := range fields {
+		n, width := binary.Uvarint(payload[pos:])
+		if width <= 0 {
+			err = errors.New("invalid record field")
+			return
+		}
+		fields[i], pos = n, pos+width
+	}
+	if uint64(len(payload)-pos) < fields[3] {
+		err = errors.New("invalid record key")
+		return
+	}
+	key = string(payload[pos : pos+int(fields[3])])
+	item = &localItem{
+		value: payload[pos+int(fields[3]):],
+		cas:   fields[0],
+		exp:   uint32(fields[1]),
+		vbSeq: fields[2],
+	}
+	size = int64(8 + length)
+	return
+}
+
+// Appends a record to the log and syncs it.  If the write fails, the log is truncated back so
+// that a partial record isn't followed by later ones.  Caller must hold the lock.
+func (bucket *LocalBucket) writeRecord(op byte, key string, item *localItem) (int64, error) {
+	if bucket.file == nil {
+		return 0, ErrLocalBucketClosed
+	}
+	record := encodeLocalRecord(op, key, item)
+	_, err := bucket.file.Write(record)
+	if err == nil {
+		err = bucket.file.Sync()
+	}
+	if err != nil {
+		bucket.file.Truncate(bucket.logSize)
+		return 0, err
+	}
+	bucket.logSize += int64(len(record))
+	return int64(len(record)), nil
+}
+
+// Rewrites the log with only the current state, if it's grown big enough.  The new log is synced
+// and then renamed over the old one, so a crash leaves one or the other intact.  Caller must hold
+// the lock (or have exclusive access).
+func (bucket *LocalBucket) maybeCompact() error {
+	if bucket.logSize < kLocalCompactMinSize || bucket.logSize < kLocalCompactRatio*bucket.liveSize {
+		return nil
+	}
+	LogTo("Bucket", "Compacting LocalBucket %s (%d log bytes, %d live)", bucket.name,
+		bucket.logSize, bucket.liveSize)
+
+	tempPath := bucket.path + ".compact"
+	file, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	var logSize int64
+	write := func(op byte, key string, item *localItem) int64 {
+		record := encodeLocalRecord(op, key, item)
+		writer.Write(record)
+		logSize += int64(len(record))
+		return int64(len(record))
+	}
+
+	// The counters come first, since deleted docs' sequences and CASes aren't otherwise kept:
+	counters := make([]byte, 8*kLocalNumVbuckets)
+	for vbNo, seq := range bucket.vbSeqs {
+		binary.LittleEndian.PutUint64(counters[8*vbNo:], seq)
+	}
+	write(localRecordCounters, "", &localItem{value: counters, cas: bucket.lastCas})
+	for name, ddoc := range bucket.ddocs {
+		write(localRecordDDoc, name, &localItem{value: ddoc})
+	}
+	now := time.Now()
+	sizes := make(map[string]int64, len(bucket.items))
+	for _, key := range bucket.sortedKeys() {
+		if item := bucket.items[key]; !item.expired(now) {
+			sizes[key] = write(localRecordSet, key, item)
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tempPath, bucket.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	syncDir(filepath.Dir(bucket.path))
+
+	bucket.file.Close()
+	bucket.file = file
+	bucket.logSize = logSize
+	bucket.liveSize = 0
+	for key, item := range bucket.items {
+		if size, ok := sizes[key]; ok {
+			item.size = size
+			bucket.liveSize += size
+		} else {
+			delete(bucket.items, key) // expired
+		}
+	}
+	return nil
+}
+
+// Syncs a directory, so that a rename in it is durable.
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+// The bucket's keys in the order they were last written.  Caller must hold the lock.
+func (bucket *LocalBucket) sortedKeys() []string {
+	keys := make([]string, 0, len(bucket.items))
+	for key := range bucket.items {
+		keys = append(keys, key)
+	}
+	sort.Sort(localKeysByCas{keys, bucket.items})
+	return keys
+}
+
+type localKeysByCas struct {
+	keys  []string
+	items map[string]*localItem
+}
+
+func (s localKeysByCas) Len() int           { return len(s.keys) }
+func (s localKeysByCas) Less(i, j int) bool { return s.items[s.keys[i]].cas < s.items[s.keys[j]].cas }
+func (s localKeysByCas) Swap(i, j int)      { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+
+//////// DOCUMENT STORAGE:
+
+// Returns a key's current item, or nil if it doesn't exist.  An expired item is deleted.  Caller
+// must hold the lock.
+func (bucket *LocalBucket) getItem(k string) *localItem {
+	item := bucket.items[k]
+	if item != nil && item.expired(time.Now()) {
+		if _, err := bucket.store(k, nil, 0); err != nil {
+			Warn("LocalBucket %s: Couldn't delete expired doc %q: %v", bucket.name, k, err)
+		}
+		return nil
+	}
+	return item
+}
+
+// Writes a key's new value, or deletes it if value is nil, and sends the change to the feeds.
+// Returns the new CAS.  Caller must hold the lock.
+func (bucket *LocalBucket) store(k string, value []byte, exp uint32) (uint64, error) {
+	vbNo := VBHash(k, kLocalNumVbuckets)
+	item := &localItem{
+		cas:   bucket.lastCas + 1,
+		exp:   exp,
+		vbSeq: bucket.vbSeqs[vbNo] + 1,
+	}
+	op := localRecordDelete
+	event := sgbucket.TapEvent{Opcode: sgbucket.TapDeletion, Key: []byte(k), Sequence: item.vbSeq, VbNo: uint16(vbNo)}
+	if value != nil {
+		item.value = append([]byte(nil), value...)
+		op = localRecordSet
+		event.Opcode = sgbucket.TapMutation
+		event.Value = item.value
+	}
+	size, err := bucket.writeRecord(op, k, item)
+	if err != nil {
+		return 0, err
+	}
+	bucket.apply(op, k, item, size)
+	for _, feed := range bucket.feeds {
+		feed.send(event)
+	}
+	if err := bucket.maybeCompact(); err != nil {
+		Warn("LocalBucket %s: Compaction failed: %v", bucket.name, err)
+	}
+	return item.cas, nil
+}
+
+// Writes a value if the key's CAS matches; a CAS of 0 means the key must not exist.
+func (bucket *LocalBucket) storeCas(k string, exp int, cas uint64, value []byte) (uint64, error) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	var currentCas uint64
+	if item := bucket.getItem(k); item != nil {
+		currentCas = item.cas
+	}
+	if currentCas != cas {
+		if cas == 0 {
+			return 0, localStatusError(gomemcached.KEY_EEXISTS, k)
+		} else if currentCas == 0 {
+			return 0, sgbucket.MissingError{Key: k}
+		}
+		return 0, localStatusError(gomemcached.KEY_EEXISTS, k)
+	} else if value == nil && cas == 0 {
+		return 0, nil
+	}
+	return bucket.store(k, value, localExpiry(exp))
+}
+
+// Returns a memcached-style error, as a Couchbase server would.
+func localStatusError(status gomemcached.Status, k string) error {
+	return &gomemcached.MCResponse{Status: status, Key: []byte(k), Body: []byte(status.String())}
+}
+
+// Returns true if storeCas failed because the key exists or has changed.
+func isLocalCasMismatch(err error) bool {
+	if response, ok := err.(*gomemcached.MCResponse); ok {
+		return response.Status == gomemcached.KEY_EEXISTS
+	}
+	_, ok := err.(sgbucket.MissingError)
+	return ok
+}
+
+// Converts a value to be written to JSON, unless it's raw.
+func localEncode(v interface{}, opt sgbucket.WriteOptions) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	} else if opt&sgbucket.Raw != 0 {
+		data, ok := v.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("Raw value must be []byte, not %T", v)
+		}
+		return data, nil
+	}
+	return json.Marshal(v)
+}
+
+func (bucket *LocalBucket) GetName() string {
+	return bucket.name
+}
+
+func (bucket *LocalBucket) Get(k string, rv interface{}) (cas uint64, err error) {
+	data, cas, err := bucket.GetRaw(k)
+	if err != nil {
+		return 0, err
+	}
+	return cas, json.Unmarshal(data, rv)
+}
+
+func (bucket *LocalBucket) GetRaw(k string) (v []byte, cas uint64, err error) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	item := bucket.getItem(k)
+	if item == nil {
+		return nil, 0, sgbucket.MissingError{Key: k}
+	}
+	return append([]byte(nil), item.value...), item.cas, nil
+}
+
+func (bucket *LocalBucket) GetBulkRaw(keys []string) (map[string][]byte, error) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	result := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		if item := bucket.getItem(k); item != nil {
+			result[k] = append([]byte(nil), item.value...)
+		}
+	}
+	return result, nil
+}
+
+func (bucket *LocalBucket) GetAndTouchRaw(k string, exp int) (v []byte, cas uint64, err error) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	item := bucket.getItem(k)
+	if item == nil {
+		return nil, 0, sgbucket.MissingError{Key: k}
+	}
+	v = append([]byte(nil), item.value...)
+	cas, err = bucket.store(k, item.value, localExpiry(exp))
+	return v, cas, err
+}
+
+func (bucket *LocalBucket) Add(k string, exp int, v interface{}) (added bool, err error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+	return bucket.AddRaw(k, exp, data)
+}
+
+func (bucket *LocalBucket) AddRaw(k string, exp int, v []byte) (added bool, err error) {
+	if _, err = bucket.storeCas(k, exp, 0, v); isLocalCasMismatch(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (bucket *LocalBucket) Append(k string, data []byte) error {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	item := bucket.getItem(k)
+	if item == nil {
+		return sgbucket.MissingError{Key: k}
+	}
+	value := append(append([]byte(nil), item.value...), data...)
+	_, err := bucket.store(k, value, item.exp)
+	return err
+}
+
+func (bucket *LocalBucket) Set(k string, exp int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.SetRaw(k, exp, data)
+}
+
+func (bucket *LocalBucket) SetRaw(k string, exp int, v []byte) error {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	_, err := bucket.store(k, v, localExpiry(exp))
+	return err
+}
+
+func (bucket *LocalBucket) Delete(k string) error {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if bucket.getItem(k) == nil {
+		return sgbucket.MissingError{Key: k}
+	}
+	_, err := bucket.store(k, nil, 0)
+	return err
+}
+
+// Writes a value, or deletes the key if v is nil.  Flags aren't stored.
+func (bucket *LocalBucket) Write(k string, flags int, exp int, v interface{}, opt sgbucket.WriteOptions) error {
+	data, err := localEncode(v, opt)
+	if err != nil {
+		return err
+	}
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	item := bucket.getItem(k)
+	if opt&sgbucket.AddOnly != 0 && item != nil {
+		return localStatusError(gomemcached.KEY_EEXISTS, k)
+	} else if opt&sgbucket.Append != 0 && item != nil && data != nil {
+		data = append(append([]byte(nil), item.value...), data...)
+	} else if data == nil && item == nil {
+		return sgbucket.MissingError{Key: k}
+	}
+	_, err = bucket.store(k, data, localExpiry(exp))
+	return err
+}
+
+// Writes a value, or deletes the key if v is nil, if its CAS matches.  A CAS of 0 means the key
+// must not exist.
+func (bucket *LocalBucket) WriteCas(k string, flags int, exp int, cas uint64, v interface{}, opt sgbucket.WriteOptions) (uint64, error) {
+	data, err := localEncode(v, opt)
+	if err != nil {
+		return 0, err
+	}
+	return bucket.storeCas(k, exp, cas, data)
+}
+
+func (bucket *LocalBucket) Update(k string, exp int, callback sgbucket.UpdateFunc) error {
+	writeCallback := func(current []byte) ([]byte, sgbucket.WriteOptions, error) {
+		updated, err := callback(current)
+		return updated, 0, err
+	}
+	return bucket.WriteUpdate(k, exp, writeCallback)
+}
+
+// Calls the callback with the current value (nil if there isn't one) and writes the value it
+// returns, or deletes the key if it returns nil.  If the key changes in the meantime, this repeats.
+func (bucket *LocalBucket) WriteUpdate(k string, exp int, callback sgbucket.WriteUpdateFunc) error {
+	for {
+		current, cas, err := bucket.GetRaw(k)
+		if err != nil && !IsDocNotFoundError(err) {
+			return err
+		}
+		updated, _, err := callback(current)
+		if err != nil {
+			return err
+		}
+		if _, err = bucket.storeCas(k, exp, cas, updated); !isLocalCasMismatch(err) {
+			return err
+		}
+		// The key changed since it was read; try again
+	}
+}
+
+func (bucket *LocalBucket) SetBulk(entries []*sgbucket.BulkSetEntry) error {
+	for _, entry := range entries {
+		entry.Cas, entry.Error = bucket.WriteCas(entry.Key, 0, 0, entry.Cas, entry.Value, 0)
+	}
+	return nil
+}
+
+// Adds amt to a counter and returns its new value.  A missing counter is created with value def.
+func (bucket *LocalBucket) Incr(k string, amt, def uint64, exp int) (uint64, error) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	counter := def
+	if item := bucket.getItem(k); item != nil {
+		if _, err := fmt.Sscanf(string(item.value), "%d", &counter); err != nil {
+			return 0, fmt.Errorf("Value of %q isn't a counter", k)
+		} else if amt == 0 {
+			return counter, nil
+		}
+		counter += amt
+	} else if amt == 0 && def == 0 {
+		return 0, nil
+	}
+	_, err := bucket.store(k, []byte(fmt.Sprintf("%d", counter)), localExpiry(exp))
+	return counter, err
+}
+
+func (bucket *LocalBucket) Refresh() error {
+	return nil
+}
+
+func (bucket *LocalBucket) VBHash(docID string) uint32 {
+	return VBHash(docID, kLocalNumVbuckets)
+}
+
+// Closes the bucket once every GetLocalBucket call that returned it has been matched by a Close.
+func (bucket *LocalBucket) Close() {
+	localBucketsLock.Lock()
+	defer localBucketsLock.Unlock()
+	if bucket.refCount--; bucket.refCount > 0 {
+		return
+	}
+	delete(localBuckets, bucket.path)
+
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	for _, feed := range bucket.feeds {
+		feed.stop()
+	}
+	bucket.feeds = nil
+	if bucket.file != nil {
+		bucket.file.Close()
+		bucket.file = nil
+	}
+}
+
+func (bucket *LocalBucket) Dump() {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	Logf("LocalBucket %s at %s: %d docs, %d log bytes", bucket.name, bucket.path, len(bucket.items),
+		bucket.logSize)
+	for _, key := range bucket.sortedKeys() {
+		item := bucket.items[key]
+		Logf("    %q (cas %d, vbseq %d) = %s", key, item.cas, item.vbSeq, item.value)
+	}
+}
+
+//////// FEED:
+
+// A feed of a LocalBucket's mutations.  Events are queued without limit, so a slow reader never
+// blocks writers.
+type localFeed struct {
+	events   chan sgbucket.TapEvent
+	done     chan struct{}
+	keysOnly bool
+	bucket   *LocalBucket
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    []sgbucket.TapEvent
+	draining bool // Ends once the queue is empty (for dumps)
+	stopped  bool
+}
+
+// Starts a feed.  Unless args.Backfill is TapNoBackfill, it begins with a mutation for every
+// current doc, in the order they were written.  If args.Dump is set, it ends after that.
+func (bucket *LocalBucket) StartTapFeed(args sgbucket.TapArguments) (sgbucket.TapFeed, error) {
+	feed := &localFeed{
+		events:   make(chan sgbucket.TapEvent, 10),
+		done:     make(chan struct{}),
+		keysOnly: args.KeysOnly,
+		bucket:   bucket,
+		draining: args.Dump,
+	}
+	feed.cond = sync.NewCond(&feed.lock)
+
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if bucket.file == nil {
+		return nil, ErrLocalBucketClosed
+	}
+	if args.Backfill != sgbucket.TapNoBackfill || args.Dump {
+		feed.send(sgbucket.TapEvent{Opcode: sgbucket.TapBeginBackfill})
+		now := time.Now()
+		for _, key := range bucket.sortedKeys() {
+			if item := bucket.items[key]; !item.expired(now) {
+				feed.send(sgbucket.TapEvent{
+					Opcode:   sgbucket.TapMutation,
+					Key:      []byte(key),
+					Value:    item.value,
+					Sequence: item.vbSeq,
+					VbNo:     uint16(VBHash(key, kLocalNumVbuckets)),
+				})
+			}
+		}
+		feed.send(sgbucket.TapEvent{Opcode: sgbucket.TapEndBackfill})
+	}
+	if !args.Dump {
+		bucket.feeds = append(bucket.feeds, feed)
+	}
+	go feed.run()
+	return feed, nil
+}
+
+func (feed *localFeed) Events() <-chan sgbucket.TapEvent {
+	return feed.events
+}
+
+func (feed *localFeed) Close() error {
+	bucket := feed.bucket
+	bucket.lock.Lock()
+	for i, f := range bucket.feeds {
+		if f == feed {
+			bucket.feeds = append(bucket.feeds[:i], bucket.feeds[i+1:]...)
+			break
+		}
+	}
+	bucket.lock.Unlock()
+	feed.stop()
+	return nil
+}
+
+func (feed *localFeed) send(event sgbucket.TapEvent) {
+	if feed.keysOnly {
+		event.Value = nil
+	}
+	feed.lock.Lock()
+	feed.queue = append(feed.queue, event)
+	feed.lock.Unlock()
+	feed.cond.Signal()
+}
+
+func (feed *localFeed) stop() {
+	feed.lock.Lock()
+	if !feed.stopped {
+		feed.stopped = true
+		close(feed.done)
+	}
+	feed.lock.Unlock()
+	feed.cond.Signal()
+}
+
+// Moves queued events to the events channel, until the feed is stopped.
+func (feed *localFeed) run() {
+	defer close(feed.events)
+	for {
+		feed.lock.Lock()
+		for len(feed.queue) == 0 && !feed.stopped && !feed.draining {
+			feed.cond.Wait()
+		}
+		if feed.stopped || len(feed.queue) == 0 {
+			feed.lock.Unlock()
+			return
+		}
+		event := feed.queue[0]
+		feed.queue = feed.queue[1:]
+		feed.lock.Unlock()
+
+		select {
+		case feed.events <- event:
+		case <-feed.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,213 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func openTestLocalBucket(t *testing.T, dir string) *LocalBucket {
+	bucket, err := GetLocalBucket(LocalBucketScheme+dir, "test")
+	assert.Equals(t, err, nil)
+	return bucket
+}
+
+func TestLocalBucketCas(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "localbucket")
+	defer os.RemoveAll(dir)
+	bucket := openTestLocalBucket(t, dir)
+	defer bucket.Close()
+
+	cas, err := bucket.WriteCas("doc", 0, 0, 0, []byte(`{"n":1}`), sgbucket.Raw)
+	assert.Equals(t, err, nil)
+	_, err = bucket.WriteCas("doc", 0, 0, 0, []byte(`{"n":2}`), sgbucket.Raw)
+	assert.True(t, err != nil)
+	_, err = bucket.WriteCas("doc", 0, 0, cas+100, []byte(`{"n":2}`), sgbucket.Raw)
+	assert.True(t, err != nil)
+	newCas, err := bucket.WriteCas("doc", 0, 0, cas, []byte(`{"n":2}`), sgbucket.Raw)
+	assert.Equals(t, err, nil)
+	assert.True(t, newCas > cas)
+
+	added, err := bucket.AddRaw("doc", 0, []byte(`{}`))
+	assert.Equals(t, err, nil)
+	assert.False(t, added)
+
+	err = bucket.Update("doc", 0, func(current []byte) ([]byte, error) {
+		assert.Equals(t, string(current), `{"n":2}`)
+		return []byte(`{"n":3}`), nil
+	})
+	assert.Equals(t, err, nil)
+	value, _, err := bucket.GetRaw("doc")
+	assert.Equals(t, string(value), `{"n":3}`)
+
+	count, err := bucket.Incr("counter", 1, 10, 0)
+	assert.Equals(t, count, uint64(10))
+	count, err = bucket.Incr("counter", 5, 10, 0)
+	assert.Equals(t, count, uint64(15))
+	count, err = bucket.Incr("nocounter", 0, 0, 0)
+	assert.Equals(t, count, uint64(0))
+	_, _, err = bucket.GetRaw("nocounter")
+	assert.True(t, IsDocNotFoundError(err))
+
+	// An absolute expiry in the past makes the doc disappear:
+	assert.Equals(t, bucket.SetRaw("expiring", int(time.Now().Unix()-10), []byte(`{}`)), nil)
+	_, _, err = bucket.GetRaw("expiring")
+	assert.True(t, IsDocNotFoundError(err))
+}
+
+func TestLocalBucketRecovery(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "localbucket")
+	defer os.RemoveAll(dir)
+	bucket := openTestLocalBucket(t, dir)
+	bucket.SetRaw("doc1", 0, []byte(`"one"`))
+	bucket.SetRaw("doc2", 0, []byte(`"two"`))
+	bucket.Delete("doc1")
+	assert.Equals(t, bucket.PutDDoc("ddoc", sgbucket.DesignDoc{
+		Views: sgbucket.ViewMap{"all": sgbucket.ViewDef{Map: `function(doc, meta) {emit(meta.id, doc);}`}},
+	}), nil)
+	_, cas, _ := bucket.GetRaw("doc2")
+	bucket.Close()
+
+	// Simulate a crash during a write, which leaves part of a record at the end of the log:
+	path := filepath.Join(dir, "test.sgdb")
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	record := encodeLocalRecord(localRecordSet, "doc3", &localItem{value: []byte(`"three"`), cas: cas + 1})
+	file.Write(record[:len(record)-3])
+	file.Close()
+
+	bucket = openTestLocalBucket(t, dir)
+	_, _, err := bucket.GetRaw("doc1")
+	assert.True(t, IsDocNotFoundError(err))
+	value, cas2, err := bucket.GetRaw("doc2")
+	assert.Equals(t, string(value), `"two"`)
+	assert.Equals(t, cas2, cas)
+	_, _, err = bucket.GetRaw("doc3")
+	assert.True(t, IsDocNotFoundError(err))
+
+	// The partial record was discarded, so later writes survive another reopen:
+	bucket.SetRaw("doc4", 0, []byte(`"four"`))
+	bucket.Close()
+	bucket = openTestLocalBucket(t, dir)
+	defer bucket.Close()
+	value, _, _ = bucket.GetRaw("doc4")
+	assert.Equals(t, string(value), `"four"`)
+	result, err := bucket.View("ddoc", "all", nil)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(result.Rows), 2)
+}
+
+func TestLocalBucketCompaction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "localbucket")
+	defer os.RemoveAll(dir)
+	bucket := openTestLocalBucket(t, dir)
+	value := make([]byte, 64*1024)
+	for i := 0; i < 100; i++ {
+		bucket.SetRaw("doc", 0, value)
+	}
+	bucket.Delete("doc")
+	bucket.SetRaw("other", 0, []byte(`{}`))
+	assert.True(t, bucket.logSize < kLocalCompactMinSize)
+	vbSeq := bucket.vbSeqs[bucket.VBHash("doc")]
+	bucket.Close()
+
+	// Deleted docs' sequences aren't reused after compaction:
+	bucket = openTestLocalBucket(t, dir)
+	defer bucket.Close()
+	assert.Equals(t, bucket.vbSeqs[bucket.VBHash("doc")], vbSeq)
+	_, _, err := bucket.GetRaw("doc")
+	assert.True(t, IsDocNotFoundError(err))
+}
+
+func TestLocalBucketFeed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "localbucket")
+	defer os.RemoveAll(dir)
+	bucket := openTestLocalBucket(t, dir)
+	defer bucket.Close()
+	bucket.SetRaw("doc1", 0, []byte(`{}`))
+
+	feed, err := bucket.StartTapFeed(sgbucket.TapArguments{Backfill: 0})
+	assert.Equals(t, err, nil)
+	defer feed.Close()
+	bucket.SetRaw("doc2", 0, []byte(`{}`))
+	bucket.SetRaw("doc1", 0, []byte(`{"v":2}`))
+	bucket.Delete("doc2")
+
+	var events []sgbucket.TapEvent
+	for len(events) < 6 {
+		select {
+		case event := <-feed.Events():
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for events; got %d", len(events))
+		}
+	}
+	assert.Equals(t, events[0].Opcode, sgbucket.TapBeginBackfill)
+	assert.Equals(t, string(events[1].Key), "doc1")
+	assert.Equals(t, events[2].Opcode, sgbucket.TapEndBackfill)
+	assert.Equals(t, events[4].Opcode, sgbucket.TapMutation)
+	assert.Equals(t, events[4].VbNo, events[1].VbNo)
+	assert.Equals(t, events[4].Sequence, events[1].Sequence+1)
+	assert.Equals(t, string(events[5].Key), "doc2")
+	assert.Equals(t, events[5].Opcode, sgbucket.TapDeletion)
+}
+
+func TestLocalBucketViews(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "localbucket")
+	defer os.RemoveAll(dir)
+	bucket := openTestLocalBucket(t, dir)
+	defer bucket.Close()
+	err := bucket.PutDDoc("ddoc", sgbucket.DesignDoc{
+		Views: sgbucket.ViewMap{"by_n": sgbucket.ViewDef{
+			Map:    `function(doc, meta) {if (doc.n) emit([doc.type, doc.n], null);}`,
+			Reduce: "_count",
+		}},
+	})
+	assert.Equals(t, err, nil)
+	bucket.Set("a", 0, map[string]interface{}{"type": "x", "n": 10})
+	bucket.Set("b", 0, map[string]interface{}{"type": "x", "n": 2})
+	bucket.Set("c", 0, map[string]interface{}{"type": "y", "n": 5})
+	bucket.SetRaw("binary", 0, []byte{0xff, 0x00})
+
+	result, err := bucket.View("ddoc", "by_n", map[string]interface{}{"reduce": false})
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(result.Rows), 3)
+	assert.Equals(t, result.Rows[0].ID, "b")
+	assert.Equals(t, result.Rows[1].ID, "a")
+
+	params := map[string]interface{}{"reduce": false, "startkey": []interface{}{"x", 5},
+		"endkey": []interface{}{"x", map[string]interface{}{}}}
+	result, _ = bucket.View("ddoc", "by_n", params)
+	assert.Equals(t, len(result.Rows), 1)
+	assert.Equals(t, result.Rows[0].ID, "a")
+
+	result, _ = bucket.View("ddoc", "by_n", map[string]interface{}{"reduce": false, "descending": true, "limit": 1})
+	assert.Equals(t, result.Rows[0].ID, "c")
+
+	result, _ = bucket.View("ddoc", "by_n", nil)
+	assert.Equals(t, result.Rows[0].Value, 3.0)
+	result, _ = bucket.View("ddoc", "by_n", map[string]interface{}{"group_level": 1})
+	assert.Equals(t, len(result.Rows), 2)
+	assert.Equals(t, result.Rows[0].Value, 2.0)
+
+	// Updates and deletions are reflected on the next query:
+	bucket.Delete("a")
+	bucket.Set("b", 0, map[string]interface{}{"type": "y", "n": 1})
+	result, _ = bucket.View("ddoc", "by_n", map[string]interface{}{"reduce": false})
+	assert.Equals(t, len(result.Rows), 2)
+	assert.Equals(t, result.Rows[0].ID, "b")
+	assert.DeepEquals(t, result.Rows[0].Key, []interface{}{"y", 1.0})
+}
@@ -0,0 +1,473 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/robertkrimen/otto"
+)
+
+// A LocalBucket's view.  Its index is brought up to date when it's queried, by re-running the
+// map function on the docs written since the last query.  Only the built-in reduce functions
+// _count and _sum are supported, which is all Sync Gateway's own design docs use.
+type localView struct {
+	lock    sync.Mutex // Guards everything below; acquired before the bucket's lock
+	mapFn   *localMapRunner
+	reduce  string
+	lastCas uint64                         // The index includes changes up to this CAS
+	rows    map[string][]*sgbucket.ViewRow // Emitted rows, by doc ID
+}
+
+// Runs a view's map function on a doc, collecting the rows it emits.
+type localMapRunner struct {
+	sgbucket.JSRunner
+	rows []*sgbucket.ViewRow
+}
+
+func newLocalMapRunner(funcSource string) (*localMapRunner, error) {
+	runner := &localMapRunner{}
+	if err := runner.Init(funcSource); err != nil {
+		return nil, err
+	}
+	runner.DefineNativeFunction("emit", func(call otto.FunctionCall) otto.Value {
+		runner.rows = append(runner.rows, &sgbucket.ViewRow{
+			Key:   exportJSValue(call.Argument(0)),
+			Value: exportJSValue(call.Argument(1)),
+		})
+		return otto.UndefinedValue()
+	})
+	runner.Before = func() {
+		runner.rows = nil
+	}
+	runner.After = func(result otto.Value, err error) (interface{}, error) {
+		rows := runner.rows
+		runner.rows = nil
+		return rows, err
+	}
+	return runner, nil
+}
+
+// Converts a JavaScript value to the form it would have after a round trip through JSON, so
+// that keys collate and compare consistently.
+func exportJSValue(value otto.Value) interface{} {
+	if value.IsUndefined() || value.IsNull() {
+		return nil
+	}
+	exported, err := value.Export()
+	if err != nil {
+		return nil
+	}
+	return normalizeJSON(exported)
+}
+
+func normalizeJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var result interface{}
+	json.Unmarshal(data, &result)
+	return result
+}
+
+// Compiles the views of a design doc, replacing any it had before.  Caller must hold the lock.
+func (bucket *LocalBucket) compileViews(ddocName string, data []byte) error {
+	var ddoc sgbucket.DesignDoc
+	if err := json.Unmarshal(data, &ddoc); err != nil {
+		return err
+	}
+	views := map[string]*localView{}
+	for viewName, viewDef := range ddoc.Views {
+		switch viewDef.Reduce {
+		case "", "_count", "_sum":
+		default:
+			return HTTPErrorf(http.StatusBadRequest, "View %s: reduce function %q is not supported",
+				viewName, viewDef.Reduce)
+		}
+		mapFn, err := newLocalMapRunner(viewDef.Map)
+		if err != nil {
+			return HTTPErrorf(http.StatusBadRequest, "View %s: invalid map function: %v", viewName, err)
+		}
+		views[ddocName+"/"+viewName] = &localView{mapFn: mapFn, reduce: viewDef.Reduce}
+	}
+	for name := range bucket.views {
+		if strings.HasPrefix(name, ddocName+"/") {
+			delete(bucket.views, name)
+		}
+	}
+	for name, view := range views {
+		bucket.views[name] = view
+	}
+	return nil
+}
+
+func (bucket *LocalBucket) GetDDoc(docname string, value interface{}) error {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	ddoc, ok := bucket.ddocs[docname]
+	if !ok {
+		return sgbucket.MissingError{Key: docname}
+	}
+	return json.Unmarshal(ddoc, value)
+}
+
+func (bucket *LocalBucket) PutDDoc(docname string, value interface{}) error {
+	ddoc, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if string(bucket.ddocs[docname]) == string(ddoc) {
+		return nil // Unchanged; keep the existing index
+	}
+	if err = bucket.compileViews(docname, ddoc); err != nil {
+		return err
+	}
+	if _, err = bucket.writeRecord(localRecordDDoc, docname, &localItem{value: ddoc}); err != nil {
+		return err
+	}
+	bucket.ddocs[docname] = ddoc
+	return nil
+}
+
+func (bucket *LocalBucket) DeleteDDoc(docname string) error {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if _, ok := bucket.ddocs[docname]; !ok {
+		return sgbucket.MissingError{Key: docname}
+	}
+	if _, err := bucket.writeRecord(localRecordDeleteDDoc, docname, &localItem{}); err != nil {
+		return err
+	}
+	delete(bucket.ddocs, docname)
+	for name := range bucket.views {
+		if strings.HasPrefix(name, docname+"/") {
+			delete(bucket.views, name)
+		}
+	}
+	return nil
+}
+
+func (bucket *LocalBucket) ViewCustom(ddoc, name string, params map[string]interface{}, vres interface{}) error {
+	result, err := bucket.View(ddoc, name, params)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, vres)
+}
+
+// Queries a view.  Supports the key, keys, startkey, endkey, inclusive_end, descending, skip,
+// limit, reduce, group, group_level and include_docs parameters; stale is ignored, since the
+// index is always brought up to date.
+func (bucket *LocalBucket) View(ddoc, name string, params map[string]interface{}) (sgbucket.ViewResult, error) {
+	bucket.lock.Lock()
+	view := bucket.views[ddoc+"/"+name]
+	bucket.lock.Unlock()
+	if view == nil {
+		return sgbucket.ViewResult{}, sgbucket.MissingError{Key: ddoc + "/" + name}
+	}
+
+	view.lock.Lock()
+	defer view.lock.Unlock()
+	bucket.updateView(view)
+
+	var rows sgbucket.ViewRows
+	for _, docRows := range view.rows {
+		for _, row := range docRows {
+			rowCopy := *row
+			rows = append(rows, &rowCopy)
+		}
+	}
+	result := sgbucket.ViewResult{TotalRows: len(rows)}
+	sort.Sort(localViewRows(rows))
+
+	// Parameters are normalized like keys, so that e.g. integer sequences compare as numbers:
+	query := map[string]interface{}{}
+	for key, value := range params {
+		query[key] = normalizeJSON(value)
+	}
+	rows = filterLocalViewRows(rows, query)
+
+	if reduce, ok := query["reduce"].(bool); view.reduce != "" && (!ok || reduce) {
+		groupLevel := 0
+		if group, _ := query["group"].(bool); group {
+			groupLevel = -1
+		} else if level, ok := query["group_level"].(float64); ok {
+			groupLevel = int(level)
+		}
+		rows = reduceLocalViewRows(rows, view.reduce, groupLevel)
+	} else if includeDocs, _ := query["include_docs"].(bool); includeDocs {
+		for _, row := range rows {
+			var doc interface{}
+			if _, err := bucket.Get(row.ID, &doc); err == nil {
+				row.Doc = &doc
+			}
+		}
+	}
+
+	if skip, ok := query["skip"].(float64); ok {
+		if int(skip) >= len(rows) {
+			rows = nil
+		} else if skip > 0 {
+			rows = rows[int(skip):]
+		}
+	}
+	if limit, ok := query["limit"].(float64); ok && int(limit) >= 0 && int(limit) < len(rows) {
+		rows = rows[:int(limit)]
+	}
+	result.Rows = rows
+	return result, nil
+}
+
+// Re-runs the map function on the docs changed since the view was last updated.  Caller must
+// hold the view's lock.
+func (bucket *LocalBucket) updateView(view *localView) {
+	type changedDoc struct {
+		id    string
+		value []byte
+		vbNo  uint32
+		vbSeq uint64
+	}
+	var changed []changedDoc
+	var removed []string
+
+	bucket.lock.Lock()
+	now := time.Now()
+	for key, item := range bucket.items {
+		if item.cas > view.lastCas && !item.expired(now) {
+			changed = append(changed, changedDoc{key, item.value, VBHash(key, kLocalNumVbuckets), item.vbSeq})
+		}
+	}
+	for key := range view.rows {
+		if item := bucket.items[key]; item == nil || item.expired(now) {
+			removed = append(removed, key)
+		}
+	}
+	lastCas := bucket.lastCas
+	bucket.lock.Unlock()
+
+	if view.rows == nil {
+		view.rows = map[string][]*sgbucket.ViewRow{}
+	}
+	for _, key := range removed {
+		delete(view.rows, key)
+	}
+	for _, doc := range changed {
+		var jsDoc interface{}
+		var jsonValue json.RawMessage
+		if json.Unmarshal(doc.value, &jsonValue) == nil {
+			jsDoc = sgbucket.JSONString(doc.value)
+		} else {
+			jsDoc = base64.StdEncoding.EncodeToString(doc.value)
+		}
+		meta := map[string]interface{}{
+			"id":  doc.id,
+			"vb":  strconv.FormatUint(uint64(doc.vbNo), 10),
+			"seq": strconv.FormatUint(doc.vbSeq, 10),
+		}
+		result, err := view.mapFn.Call(jsDoc, meta)
+		if err != nil {
+			Warn("LocalBucket %s: Map function failed on doc %q: %v", bucket.name, doc.id, err)
+			delete(view.rows, doc.id)
+			continue
+		}
+		rows, _ := result.([]*sgbucket.ViewRow)
+		for _, row := range rows {
+			row.ID = doc.id
+		}
+		if len(rows) > 0 {
+			view.rows[doc.id] = rows
+		} else {
+			delete(view.rows, doc.id)
+		}
+	}
+	view.lastCas = lastCas
+}
+
+// Applies the key, keys, startkey, endkey, inclusive_end and descending parameters to sorted rows.
+func filterLocalViewRows(rows sgbucket.ViewRows, query map[string]interface{}) sgbucket.ViewRows {
+	descending, _ := query["descending"].(bool)
+	inclusiveEnd := true
+	if inclusive, ok := query["inclusive_end"].(bool); ok {
+		inclusiveEnd = inclusive
+	}
+	keys, hasKeys := query["keys"].([]interface{})
+	key, hasKey := query["key"]
+	startKey, hasStart := query["startkey"]
+	endKey, hasEnd := query["endkey"]
+	if descending {
+		startKey, endKey = endKey, startKey
+		hasStart, hasEnd = hasEnd, hasStart
+	}
+
+	var result sgbucket.ViewRows
+	for _, row := range rows {
+		if hasKeys {
+			found := false
+			for _, k := range keys {
+				if CollateJSON(row.Key, k) == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		if hasKey && CollateJSON(row.Key, key) != 0 {
+			continue
+		}
+		if hasStart {
+			if cmp := CollateJSON(row.Key, startKey); cmp < 0 || (cmp == 0 && descending && !inclusiveEnd) {
+				continue
+			}
+		}
+		if hasEnd {
+			if cmp := CollateJSON(row.Key, endKey); cmp > 0 || (cmp == 0 && !descending && !inclusiveEnd) {
+				continue
+			}
+		}
+		result = append(result, row)
+	}
+	if descending {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+	return result
+}
+
+// Reduces rows with _count or _sum.  A groupLevel of 0 reduces all rows to one; -1 groups rows
+// by their exact key; a positive level groups array keys by that many leading elements.
+func reduceLocalViewRows(rows sgbucket.ViewRows, reduce string, groupLevel int) sgbucket.ViewRows {
+	var result sgbucket.ViewRows
+	for _, row := range rows {
+		var groupKey interface{}
+		if groupLevel < 0 {
+			groupKey = row.Key
+		} else if array, ok := row.Key.([]interface{}); ok && groupLevel > 0 {
+			if len(array) > groupLevel {
+				array = array[:groupLevel]
+			}
+			groupKey = array
+		} else if groupLevel > 0 {
+			groupKey = row.Key
+		}
+		var amount float64 = 1
+		if reduce == "_sum" {
+			amount, _ = row.Value.(float64)
+		}
+		if n := len(result); n > 0 && CollateJSON(result[n-1].Key, groupKey) == 0 {
+			result[n-1].Value = result[n-1].Value.(float64) + amount
+		} else {
+			result = append(result, &sgbucket.ViewRow{Key: groupKey, Value: amount})
+		}
+	}
+	return result
+}
+
+// Sorts view rows by key, then doc ID.
+type localViewRows sgbucket.ViewRows
+
+func (rows localViewRows) Len() int      { return len(rows) }
+func (rows localViewRows) Swap(i, j int) { rows[i], rows[j] = rows[j], rows[i] }
+func (rows localViewRows) Less(i, j int) bool {
+	if cmp := CollateJSON(rows[i].Key, rows[j].Key); cmp != 0 {
+		return cmp < 0
+	}
+	return rows[i].ID < rows[j].ID
+}
+
+// Compares JSON values in view collation order: null, false, true, numbers, strings, arrays,
+// then objects.  Strings are compared by code point rather than with Unicode collation.
+func CollateJSON(a, b interface{}) int {
+	if typeA, typeB := collationType(a), collationType(b); typeA != typeB {
+		return typeA - typeB
+	}
+	switch a := a.(type) {
+	case bool:
+		if a == b.(bool) {
+			return 0
+		} else if a {
+			return 1
+		}
+		return -1
+	case float64:
+		if b := b.(float64); a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if cmp := CollateJSON(a[i], b[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		return len(a) - len(b)
+	case map[string]interface{}:
+		b := b.(map[string]interface{})
+		keysA, keysB := sortedMapKeys(a), sortedMapKeys(b)
+		for i := 0; i < len(keysA) && i < len(keysB); i++ {
+			if cmp := strings.Compare(keysA[i], keysB[i]); cmp != 0 {
+				return cmp
+			} else if cmp = CollateJSON(a[keysA[i]], b[keysB[i]]); cmp != 0 {
+				return cmp
+			}
+		}
+		return len(keysA) - len(keysB)
+	}
+	return 0
+}
+
+func collationType(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case []interface{}:
+		return 4
+	case map[string]interface{}:
+		return 5
+	}
+	return 6
+}
+
+func sortedMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,169 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a running replication, as reported in its ActiveTask
+const (
+	ReplicationStateRunning    = "running"     // Transferring changes
+	ReplicationStateIdle       = "idle"        // Continuous replication that's caught up
+	ReplicationStateBackingOff = "backing-off" // Aborted after an error; waiting to retry
+	ReplicationStateError      = "error"       // Failed
+	ReplicationStatePaused     = "paused"      // Continuous replication outside its schedule
+	ReplicationStateThrottled  = "throttled"   // Waiting to get back within its rate limits
+)
+
+const (
+	kMaxRecentReplicationErrors = 10               // Size of a replication's error history
+	kReplicationSampleInterval  = 10 * time.Second // Min interval over which throughput is measured
+)
+
+// An error that occurred during a replication
+type ReplicationError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// A document that a replication failed to write.  The document is only known when the target
+// is a database on this server; for other targets sg-replicate only reports the number of
+// failures, so there's one entry giving the Count of the failures since the previous sample.
+type ReplicationDocFailure struct {
+	Time  time.Time `json:"time"`
+	DocID string    `json:"doc_id,omitempty"`
+	RevID string    `json:"rev,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Count uint32    `json:"count,omitempty"`
+}
+
+// Tracks the state, throughput and recent errors of a replication, from sg-replicate's
+// notifications and stats.  Throughput is measured between samples, which are taken when the
+// status is read, at most every kReplicationSampleInterval.
+type replicationStatus struct {
+	lock        sync.Mutex
+	continuous  bool
+	state       string
+	errors      []ReplicationError      // Oldest first
+	docFailures []ReplicationDocFailure // Oldest first
+	sampleTime  time.Time
+	docsRead    uint32 // as of sampleTime
+	docsWritten uint32
+	failures    uint32
+	recorded    uint32 // Failures recorded by recordDocFailure since sampleTime
+	docsPerSec  float64
+}
+
+func newReplicationStatus(continuous bool) *replicationStatus {
+	return &replicationStatus{
+		continuous: continuous,
+		state:      ReplicationStateRunning,
+		sampleTime: time.Now(),
+	}
+}
+
+func (status *replicationStatus) setState(state string) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+	status.state = state
+}
+
+// Records an error, and sets the state to backing-off or error.
+func (status *replicationStatus) recordError(state string, format string, args ...interface{}) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+	status.state = state
+	status.errors = append(status.errors, ReplicationError{Time: time.Now(), Message: fmt.Sprintf(format, args...)})
+	if len(status.errors) > kMaxRecentReplicationErrors {
+		status.errors = status.errors[1:]
+	}
+}
+
+// Records a document that failed to be written to the target.
+func (status *replicationStatus) recordDocFailure(docID, revID, message string) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+	status.addDocFailure(ReplicationDocFailure{Time: time.Now(), DocID: docID, RevID: revID, Error: message})
+	status.recorded++
+}
+
+func (status *replicationStatus) addDocFailure(failure ReplicationDocFailure) {
+	status.docFailures = append(status.docFailures, failure)
+	if len(status.docFailures) > kMaxRecentReplicationErrors {
+		status.docFailures = status.docFailures[1:]
+	}
+}
+
+// Samples the replication's stats, updating the throughput and state.
+func (status *replicationStatus) sample(docsRead, docsWritten, failures uint32, now time.Time) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+	elapsed := now.Sub(status.sampleTime)
+	if elapsed < kReplicationSampleInterval {
+		return
+	}
+	status.docsPerSec = float64(docsWritten-status.docsWritten) / elapsed.Seconds()
+	// Failures that weren't recorded individually are only known by their number:
+	if failures > status.failures+status.recorded {
+		status.addDocFailure(ReplicationDocFailure{Time: now, Count: failures - status.failures - status.recorded})
+	}
+	if docsRead != status.docsRead || docsWritten != status.docsWritten {
+		status.state = ReplicationStateRunning
+	} else if status.continuous && status.state == ReplicationStateRunning {
+		status.state = ReplicationStateIdle
+	}
+	status.sampleTime = now
+	status.docsRead = docsRead
+	status.docsWritten = docsWritten
+	status.failures = failures
+	status.recorded = 0
+}
+
+// Copies the status into an ActiveTask.
+func (status *replicationStatus) populate(task *ActiveTask) {
+	status.lock.Lock()
+	defer status.lock.Unlock()
+	task.State = status.state
+	task.DocsPerSecond = status.docsPerSec
+	if n := len(status.errors); n > 0 {
+		lastError := status.errors[n-1]
+		task.LastError = &lastError
+		task.RecentErrors = append([]ReplicationError(nil), status.errors...)
+	}
+	if len(status.docFailures) > 0 {
+		task.DocFailures = append([]ReplicationDocFailure(nil), status.docFailures...)
+	}
+}
+
+// Parses a replication checkpoint sequence, which may be a number or a Sync Gateway sequence ID
+// like "12:34", into the numeric sequence.  Returns false if it can't be parsed.
+func ParseCheckpointSequence(seq interface{}) (uint64, bool) {
+	var str string
+	switch seq := seq.(type) {
+	case nil:
+		return 0, false
+	case float64:
+		return uint64(seq), true
+	case string:
+		str = seq
+	default:
+		str = fmt.Sprint(seq)
+	}
+	if i := strings.LastIndex(str, ":"); i >= 0 {
+		str = str[i+1:]
+	}
+	n, err := strconv.ParseUint(str, 10, 64)
+	return n, err == nil
+}
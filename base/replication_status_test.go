@@ -0,0 +1,102 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestReplicationStatusSampling(t *testing.T) {
+	status := newReplicationStatus(true)
+	start := status.sampleTime
+
+	// Samples closer together than the interval are ignored:
+	status.sample(10, 10, 0, start.Add(time.Second))
+	var task ActiveTask
+	status.populate(&task)
+	assert.Equals(t, task.State, ReplicationStateRunning)
+	assert.Equals(t, task.DocsPerSecond, 0.0)
+
+	status.sample(20, 20, 0, start.Add(kReplicationSampleInterval))
+	status.populate(&task)
+	assert.Equals(t, task.State, ReplicationStateRunning)
+	assert.Equals(t, task.DocsPerSecond, 2.0)
+
+	// No progress means a continuous replication is idle:
+	status.sample(20, 20, 0, start.Add(2*kReplicationSampleInterval))
+	status.populate(&task)
+	assert.Equals(t, task.State, ReplicationStateIdle)
+	assert.Equals(t, task.DocsPerSecond, 0.0)
+
+	status.sample(25, 23, 2, start.Add(3*kReplicationSampleInterval))
+	status.populate(&task)
+	assert.Equals(t, task.State, ReplicationStateRunning)
+	assert.Equals(t, len(task.DocFailures), 1)
+	assert.Equals(t, task.DocFailures[0].Count, uint32(2))
+
+	// Failures recorded individually aren't counted again:
+	status.recordDocFailure("doc1", "2-abc", "Forbidden")
+	status.sample(30, 27, 4, start.Add(4*kReplicationSampleInterval))
+	status.populate(&task)
+	assert.Equals(t, len(task.DocFailures), 3)
+	assert.Equals(t, task.DocFailures[1].DocID, "doc1")
+	assert.Equals(t, task.DocFailures[1].RevID, "2-abc")
+	assert.Equals(t, task.DocFailures[1].Error, "Forbidden")
+	assert.Equals(t, task.DocFailures[2].Count, uint32(1))
+}
+
+func TestReplicationStatusErrors(t *testing.T) {
+	status := newReplicationStatus(true)
+	for i := 0; i < kMaxRecentReplicationErrors+5; i++ {
+		status.recordError(ReplicationStateBackingOff, "error %d", i)
+	}
+	var task ActiveTask
+	status.populate(&task)
+	assert.Equals(t, task.State, ReplicationStateBackingOff)
+	assert.Equals(t, len(task.RecentErrors), kMaxRecentReplicationErrors)
+	assert.Equals(t, task.RecentErrors[0].Message, "error 5")
+	assert.Equals(t, task.LastError.Message, "error 14")
+}
+
+func TestParseCheckpointSequence(t *testing.T) {
+	seq, ok := ParseCheckpointSequence("123")
+	assert.True(t, ok)
+	assert.Equals(t, seq, uint64(123))
+	seq, ok = ParseCheckpointSequence("12:34")
+	assert.True(t, ok)
+	assert.Equals(t, seq, uint64(34))
+	seq, ok = ParseCheckpointSequence(float64(7))
+	assert.True(t, ok)
+	assert.Equals(t, seq, uint64(7))
+	_, ok = ParseCheckpointSequence(nil)
+	assert.False(t, ok)
+	_, ok = ParseCheckpointSequence("bogus")
+	assert.False(t, ok)
+}
+
+func TestRecordDocFailure(t *testing.T) {
+	r := NewReplicator()
+	r.statuses["r1"] = newReplicationStatus(true)
+	r.statuses["r2"] = newReplicationStatus(true)
+
+	// Failures are only recorded for the replication they're attributed to:
+	r.RecordDocFailure("r1", "doc1", "1-abc", "Forbidden")
+	r.RecordDocFailure("unknown", "doc2", "1-abc", "Forbidden")
+	var task ActiveTask
+	r.statuses["r1"].populate(&task)
+	assert.Equals(t, len(task.DocFailures), 1)
+	assert.Equals(t, task.DocFailures[0].DocID, "doc1")
+	task = ActiveTask{}
+	r.statuses["r2"].populate(&task)
+	assert.Equals(t, len(task.DocFailures), 0)
+}
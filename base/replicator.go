@@ -16,7 +16,11 @@ const (
 type Replicator struct {
 	replications      map[string]sgreplicate.SGReplication
 	replicationParams map[string]sgreplicate.ReplicationParameters
+	statuses          map[string]*replicationStatus
 	lock              sync.RWMutex
+
+	// If set, called after a replication is stopped or finishes, with its parameters.
+	OnRemove func(params sgreplicate.ReplicationParameters)
 }
 
 type ActiveTask struct {
@@ -30,12 +34,23 @@ type ActiveTask struct {
 	DocWriteFailures uint32      `json:"doc_write_failures"`
 	StartLastSeq     uint32      `json:"start_last_seq"`
 	EndLastSeq       interface{} `json:"end_last_seq"`
+
+	State          string                  `json:"state"`                     // See ReplicationState constants
+	CheckpointSeq  interface{}             `json:"checkpoint_seq,omitempty"`  // Last sequence checkpointed
+	PendingChanges *uint64                 `json:"pending_changes,omitempty"` // Estimate, if the source is local
+	DocsPerSecond  float64                 `json:"docs_per_sec"`              // Recent write throughput
+	LastError      *ReplicationError       `json:"last_error,omitempty"`
+	RecentErrors   []ReplicationError      `json:"recent_errors,omitempty"`
+	DocFailures    []ReplicationDocFailure `json:"doc_failures,omitempty"`
+	MaxDocsPerSec  float64                 `json:"max_docs_per_sec,omitempty"` // Rate limits, if any
+	MaxBytesPerSec int64                   `json:"max_bytes_per_sec,omitempty"`
 }
 
 func NewReplicator() *Replicator {
 	return &Replicator{
 		replications:      make(map[string]sgreplicate.SGReplication),
 		replicationParams: make(map[string]sgreplicate.ReplicationParameters),
+		statuses:          make(map[string]*replicationStatus),
 	}
 }
 
@@ -63,11 +78,16 @@ func (r *Replicator) Replicate(params sgreplicate.ReplicationParameters, isCance
 
 func (r *Replicator) ActiveTasks() (tasks []ActiveTask) {
 	r.lock.RLock()
-	defer r.lock.RUnlock()
+	replications := make(map[string]sgreplicate.SGReplication, len(r.replications))
+	for replicationId, replication := range r.replications {
+		replications[replicationId] = replication
+	}
+	r.lock.RUnlock()
 
+	// Populating a task reads the replication's status, which takes the lock
 	tasks = make([]ActiveTask, 0)
-	for replicationId, replication := range r.replications {
-		params := r.replicationParams[replicationId]
+	for replicationId, replication := range replications {
+		params := r.getReplicationParams(replicationId)
 		task := r.populateActiveTaskFromReplication(replication, params)
 		tasks = append(tasks, *task)
 	}
@@ -75,11 +95,50 @@ func (r *Replicator) ActiveTasks() (tasks []ActiveTask) {
 
 }
 
+// Returns the status of a running replication, or nil if it isn't running.
+func (r *Replicator) ActiveTask(repId string) *ActiveTask {
+	replication := r.getReplication(repId)
+	if replication == nil {
+		return nil
+	}
+	return r.populateActiveTaskFromReplication(replication, r.getReplicationParams(repId))
+}
+
+// Returns true if a replication with the given ID is running.
+func (r *Replicator) HasReplication(repId string) bool {
+	return r.getReplication(repId) != nil
+}
+
+// Returns the parameters of the running replications.
+func (r *Replicator) AllParams() []sgreplicate.ReplicationParameters {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	params := make([]sgreplicate.ReplicationParameters, 0, len(r.replicationParams))
+	for _, p := range r.replicationParams {
+		params = append(params, p)
+	}
+	return params
+}
+
+// Stops the replication with the given ID.
+func (r *Replicator) StopReplication(repId string) (task *ActiveTask, err error) {
+	return r.stopReplication(repId)
+}
+
+// Records a document that the replication with the given ID failed to write to a database on
+// this server.
+func (r *Replicator) RecordDocFailure(repId string, docID, revID, message string) {
+	if status := r.getReplicationStatus(repId); status != nil {
+		status.recordDocFailure(docID, revID, message)
+	}
+}
+
 func (r *Replicator) addReplication(rep sgreplicate.SGReplication, parameters sgreplicate.ReplicationParameters) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 	r.replications[parameters.ReplicationId] = rep
 	r.replicationParams[parameters.ReplicationId] = parameters
+	r.statuses[parameters.ReplicationId] = newReplicationStatus(parameters.Lifecycle == sgreplicate.CONTINUOUS)
 }
 
 func (r *Replicator) getReplication(repId string) sgreplicate.SGReplication {
@@ -102,6 +161,12 @@ func (r *Replicator) getReplicationParams(repId string) sgreplicate.ReplicationP
 	}
 }
 
+func (r *Replicator) getReplicationStatus(repId string) *replicationStatus {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.statuses[repId]
+}
+
 func (r *Replicator) getReplicationForParams(queryParams sgreplicate.ReplicationParameters) (replicationId string, found bool) {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
@@ -126,9 +191,16 @@ func (r *Replicator) getReplicationForParams(queryParams sgreplicate.Replication
 
 func (r *Replicator) removeReplication(repId string) {
 	r.lock.Lock()
-	defer r.lock.Unlock()
+	params, found := r.replicationParams[repId]
 	delete(r.replications, repId)
 	delete(r.replicationParams, repId)
+	delete(r.statuses, repId)
+	r.lock.Unlock()
+
+	// A replication can be removed twice, by a stop and then by its goroutine ending
+	if found && r.OnRemove != nil {
+		r.OnRemove(params)
+	}
 }
 
 // Starts a replication based on the provided replication config.
@@ -188,6 +260,12 @@ func (r *Replicator) startOneShotReplication(parameters sgreplicate.ReplicationP
 func (r *Replicator) runOneShotReplication(replication *sgreplicate.Replication, parameters sgreplicate.ReplicationParameters) error {
 	defer r.removeReplication(parameters.ReplicationId)
 	_, err := replication.WaitUntilDone()
+	if err != nil {
+		if status := r.getReplicationStatus(parameters.ReplicationId); status != nil {
+			status.recordError(ReplicationStateError, "%v", err)
+		}
+		Warn("Replication %s failed: %v", parameters.ReplicationId, err)
+	}
 	return err
 }
 
@@ -216,6 +294,18 @@ func (r *Replicator) startContinuousReplication(parameters sgreplicate.Replicati
 					return
 				}
 				LogTo("Replicate+", "Got notification %v", notification)
+				if status := r.getReplicationStatus(parameters.ReplicationId); status != nil {
+					switch notification {
+					case sgreplicate.CATCHING_UP:
+						status.setState(ReplicationStateRunning)
+					case sgreplicate.CAUGHT_UP:
+						status.setState(ReplicationStateIdle)
+					case sgreplicate.ABORTED_WAITING_TO_RETRY:
+						status.recordError(ReplicationStateBackingOff, "Replication aborted; retrying in %v", retryTime)
+					case sgreplicate.FAILED:
+						status.recordError(ReplicationStateError, "Replication failed")
+					}
+				}
 			}
 		}
 	}(replication, notificationChan)
@@ -238,6 +328,11 @@ func (r *Replicator) populateActiveTaskFromReplication(replication sgreplicate.S
 		DocWriteFailures: stats.GetDocWriteFailures(),
 		StartLastSeq:     stats.GetStartLastSeq(),
 		EndLastSeq:       stats.GetEndLastSeq(),
+		CheckpointSeq:    stats.GetEndLastSeq(),
+	}
+	if status := r.getReplicationStatus(params.ReplicationId); status != nil {
+		status.sample(task.DocsRead, task.DocsWritten, task.DocWriteFailures, time.Now())
+		status.populate(task)
 	}
 
 	return
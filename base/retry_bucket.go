@@ -0,0 +1,320 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	sgbucket "github.com/couchbase/sg-bucket"
+)
+
+// How a RetryBucket retries operations, and when its circuit breaker opens.
+type BucketRetryPolicy struct {
+	MaxRetries       int           // Retries of an operation after its first attempt
+	InitialBackoff   time.Duration // Delay before the first retry; it doubles for each one after...
+	MaxBackoff       time.Duration // ...up to this
+	BreakerThreshold int           // Consecutive failed operations that open the breaker (0 = never)
+	BreakerOpenTime  time.Duration // How long the breaker stays open before an operation is tried
+}
+
+var DefaultBucketRetryPolicy = BucketRetryPolicy{
+	MaxRetries:       4,
+	InitialBackoff:   10 * time.Millisecond,
+	MaxBackoff:       time.Second,
+	BreakerThreshold: 10,
+	BreakerOpenTime:  10 * time.Second,
+}
+
+// Returned by a RetryBucket, without trying the operation, while its circuit breaker is open.
+type BucketUnavailableError struct {
+	RetryAfter time.Duration // When the breaker will let an operation through
+	Cause      error         // The failure that opened the breaker
+}
+
+func (err *BucketUnavailableError) Error() string {
+	return fmt.Sprintf("Bucket is unavailable (%v); retry after %v", err.Cause, err.RetryAfter)
+}
+
+// Returns true if a bucket operation failed for a reason that's likely to be transient: the
+// server is overloaded, a vbucket is moving during a rebalance, or the request timed out.
+func IsRetryableBucketError(err error) bool {
+	switch err := err.(type) {
+	case nil:
+		return false
+	case *gomemcached.MCResponse:
+		return err.Status == gomemcached.TMPFAIL || err.Status == gomemcached.NOT_MY_VBUCKET
+	case net.Error:
+		return err.Timeout() || err.Temporary()
+	}
+	return isRecoverableGoCBError(err)
+}
+
+// Called when a RetryBucket's circuit breaker opens (with the failure that opened it) or closes.
+type BreakerStateChangeFunc func(open bool, cause error)
+
+// A wrapper around a Bucket that retries operations that fail with retryable errors, with
+// exponential backoff.  If operations keep failing even so, a circuit breaker opens and they
+// fail straight away with a BucketUnavailableError, until one tried after BreakerOpenTime
+// succeeds.  Only reads and idempotent writes are retried: a failed attempt at Add, WriteCas,
+// Incr, Append, Update or WriteUpdate may still have been applied, so those go through the
+// breaker but aren't retried.
+// Feeds and design docs bypass it altogether.
+type RetryBucket struct {
+	Bucket
+	policy        BucketRetryPolicy
+	lock          sync.Mutex // Guards the breaker state below
+	failures      int        // Consecutive failed operations
+	open          bool       // Is the breaker open?
+	openUntil     time.Time  // When to let a trial operation through
+	trialRunning  bool       // Is a trial operation in progress?
+	cause         error      // Failure that opened the breaker
+	onStateChange BreakerStateChangeFunc
+}
+
+func NewRetryBucket(bucket Bucket, policy BucketRetryPolicy) *RetryBucket {
+	return &RetryBucket{Bucket: bucket, policy: policy}
+}
+
+// Returns the bucket underneath any Retry, Leaky, Logging or Stats bucket wrappers, however they're nested.
+// Use this before checking the concrete type of a database's bucket.
+func UnwrapBucket(bucket Bucket) Bucket {
+	for {
+		switch wrapper := bucket.(type) {
+		case *RetryBucket:
+			bucket = wrapper.Bucket
+		case *LeakyBucket:
+			bucket = wrapper.bucket
+		case *LoggingBucket:
+			bucket = wrapper.bucket
+		case *StatsBucket:
+			bucket = wrapper.bucket
+		default:
+			return bucket
+		}
+	}
+}
+
+// Sets a function to be called when the circuit breaker opens or closes.
+func (bucket *RetryBucket) SetBreakerStateChangeCallback(callback BreakerStateChangeFunc) {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	bucket.onStateChange = callback
+}
+
+// Returns true if the circuit breaker is open.
+func (bucket *RetryBucket) BreakerOpen() bool {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	return bucket.open
+}
+
+// Returns an error if the breaker is open and it isn't time to try an operation yet.
+func (bucket *RetryBucket) checkBreaker() error {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	if !bucket.open {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(bucket.openUntil) || bucket.trialRunning {
+		retryAfter := bucket.openUntil.Sub(now)
+		if retryAfter < time.Second {
+			retryAfter = time.Second
+		}
+		return &BucketUnavailableError{RetryAfter: retryAfter, Cause: bucket.cause}
+	}
+	bucket.trialRunning = true
+	return nil
+}
+
+// Updates the breaker with the outcome of an operation.  Errors that aren't retryable, like
+// a missing doc, still mean the bucket is healthy.
+func (bucket *RetryBucket) recordResult(err error) {
+	bucket.lock.Lock()
+	wasOpen := bucket.open
+	bucket.trialRunning = false
+	if IsRetryableBucketError(err) {
+		bucket.failures++
+		if bucket.open || (bucket.policy.BreakerThreshold > 0 && bucket.failures >= bucket.policy.BreakerThreshold) {
+			bucket.open = true
+			bucket.openUntil = time.Now().Add(bucket.policy.BreakerOpenTime)
+			bucket.cause = err
+		}
+	} else {
+		bucket.failures = 0
+		bucket.open = false
+		bucket.cause = nil
+	}
+	isOpen, callback := bucket.open, bucket.onStateChange
+	bucket.lock.Unlock()
+
+	if isOpen != wasOpen {
+		if isOpen {
+			Warn("RetryBucket %s: Circuit breaker opened after %d failed operations: %v",
+				bucket.GetName(), bucket.policy.BreakerThreshold, err)
+		} else {
+			Logf("RetryBucket %s: Circuit breaker closed", bucket.GetName())
+		}
+		if callback != nil {
+			callback(isOpen, err)
+		}
+	}
+}
+
+// Runs an operation, retrying it per the policy, unless the breaker is open.
+func (bucket *RetryBucket) retry(description string, op func() error) error {
+	if err := bucket.checkBreaker(); err != nil {
+		return err
+	}
+	worker := func() (shouldRetry bool, err error, value interface{}) {
+		err = op()
+		return IsRetryableBucketError(err), err, nil
+	}
+	sleeper := CreateBoundedDoublingSleeperFunc(bucket.policy.MaxRetries,
+		int(bucket.policy.InitialBackoff/time.Millisecond), int(bucket.policy.MaxBackoff/time.Millisecond))
+	err, _ := RetryLoop(description, worker, sleeper)
+	bucket.recordResult(err)
+	return err
+}
+
+// Runs an operation that isn't safe to retry once, unless the breaker is open.
+func (bucket *RetryBucket) try(op func() error) error {
+	if err := bucket.checkBreaker(); err != nil {
+		return err
+	}
+	err := op()
+	bucket.recordResult(err)
+	return err
+}
+
+func (bucket *RetryBucket) Get(k string, rv interface{}) (cas uint64, err error) {
+	err = bucket.retry("Get "+k, func() (err error) {
+		cas, err = bucket.Bucket.Get(k, rv)
+		return err
+	})
+	return cas, err
+}
+
+func (bucket *RetryBucket) GetRaw(k string) (v []byte, cas uint64, err error) {
+	err = bucket.retry("GetRaw "+k, func() (err error) {
+		v, cas, err = bucket.Bucket.GetRaw(k)
+		return err
+	})
+	return v, cas, err
+}
+
+func (bucket *RetryBucket) GetBulkRaw(keys []string) (result map[string][]byte, err error) {
+	err = bucket.retry("GetBulkRaw", func() (err error) {
+		result, err = bucket.Bucket.GetBulkRaw(keys)
+		return err
+	})
+	return result, err
+}
+
+func (bucket *RetryBucket) GetAndTouchRaw(k string, exp int) (v []byte, cas uint64, err error) {
+	err = bucket.retry("GetAndTouchRaw "+k, func() (err error) {
+		v, cas, err = bucket.Bucket.GetAndTouchRaw(k, exp)
+		return err
+	})
+	return v, cas, err
+}
+
+func (bucket *RetryBucket) Add(k string, exp int, v interface{}) (added bool, err error) {
+	err = bucket.try(func() (err error) {
+		added, err = bucket.Bucket.Add(k, exp, v)
+		return err
+	})
+	return added, err
+}
+
+func (bucket *RetryBucket) AddRaw(k string, exp int, v []byte) (added bool, err error) {
+	err = bucket.try(func() (err error) {
+		added, err = bucket.Bucket.AddRaw(k, exp, v)
+		return err
+	})
+	return added, err
+}
+
+func (bucket *RetryBucket) Set(k string, exp int, v interface{}) error {
+	return bucket.retry("Set "+k, func() error {
+		return bucket.Bucket.Set(k, exp, v)
+	})
+}
+
+func (bucket *RetryBucket) SetRaw(k string, exp int, v []byte) error {
+	return bucket.retry("SetRaw "+k, func() error {
+		return bucket.Bucket.SetRaw(k, exp, v)
+	})
+}
+
+func (bucket *RetryBucket) Delete(k string) error {
+	return bucket.retry("Delete "+k, func() error {
+		return bucket.Bucket.Delete(k)
+	})
+}
+
+func (bucket *RetryBucket) Write(k string, flags int, exp int, v interface{}, opt sgbucket.WriteOptions) error {
+	if opt&(sgbucket.Append|sgbucket.AddOnly) != 0 {
+		return bucket.try(func() error {
+			return bucket.Bucket.Write(k, flags, exp, v, opt)
+		})
+	}
+	return bucket.retry("Write "+k, func() error {
+		return bucket.Bucket.Write(k, flags, exp, v, opt)
+	})
+}
+
+func (bucket *RetryBucket) WriteCas(k string, flags int, exp int, cas uint64, v interface{}, opt sgbucket.WriteOptions) (casOut uint64, err error) {
+	err = bucket.try(func() (err error) {
+		casOut, err = bucket.Bucket.WriteCas(k, flags, exp, cas, v, opt)
+		return err
+	})
+	return casOut, err
+}
+
+// Not retried, since the callback may have side effects, like allocating a sequence, and a failed
+// write may still have been applied.
+func (bucket *RetryBucket) Update(k string, exp int, callback sgbucket.UpdateFunc) error {
+	return bucket.try(func() error {
+		return bucket.Bucket.Update(k, exp, callback)
+	})
+}
+
+func (bucket *RetryBucket) WriteUpdate(k string, exp int, callback sgbucket.WriteUpdateFunc) error {
+	return bucket.try(func() error {
+		return bucket.Bucket.WriteUpdate(k, exp, callback)
+	})
+}
+
+func (bucket *RetryBucket) Incr(k string, amt, def uint64, exp int) (result uint64, err error) {
+	err = bucket.try(func() (err error) {
+		result, err = bucket.Bucket.Incr(k, amt, def, exp)
+		return err
+	})
+	return result, err
+}
+
+func (bucket *RetryBucket) View(ddoc, name string, params map[string]interface{}) (result sgbucket.ViewResult, err error) {
+	err = bucket.retry("View "+ddoc+"/"+name, func() (err error) {
+		result, err = bucket.Bucket.View(ddoc, name, params)
+		return err
+	})
+	return result, err
+}
+
+func (bucket *RetryBucket) ViewCustom(ddoc, name string, params map[string]interface{}, vres interface{}) error {
+	return bucket.retry("ViewCustom "+ddoc+"/"+name, func() error {
+		return bucket.Bucket.ViewCustom(ddoc, name, params, vres)
+	})
+}
@@ -0,0 +1,126 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestRetryBucket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "retrybucket")
+	defer os.RemoveAll(dir)
+	localBucket, err := GetLocalBucket(LocalBucketScheme+dir, "retry")
+	assert.Equals(t, err, nil)
+	leakyBucket := NewLeakyBucket(localBucket, LeakyBucketConfig{}).(*LeakyBucket)
+	bucket := NewRetryBucket(leakyBucket, BucketRetryPolicy{
+		MaxRetries:       2,
+		InitialBackoff:   time.Millisecond,
+		MaxBackoff:       2 * time.Millisecond,
+		BreakerThreshold: 2,
+		BreakerOpenTime:  50 * time.Millisecond,
+	})
+	defer bucket.Close()
+	var stateChanges []bool
+	bucket.SetBreakerStateChangeCallback(func(open bool, cause error) {
+		stateChanges = append(stateChanges, open)
+	})
+	bucket.SetRaw("doc", 0, []byte(`{}`))
+
+	// Errors that aren't retryable are returned as-is, and don't count as failures:
+	_, _, err = bucket.GetRaw("missing")
+	assert.True(t, IsDocNotFoundError(err))
+
+	// Retryable errors are retried until they give up:
+	leakyBucket.SetFaults(&LeakyFaults{
+		Ops:     map[string]*LeakyOpFault{LeakyOpGet: {ErrorRate: 1}},
+		Expires: time.Now().Add(time.Minute),
+	})
+	_, _, err = bucket.GetRaw("doc")
+	assert.True(t, IsRetryableBucketError(err))
+	assert.False(t, bucket.BreakerOpen())
+
+	// ...and enough failed operations in a row open the breaker:
+	_, _, err = bucket.GetRaw("doc")
+	assert.True(t, bucket.BreakerOpen())
+	_, err = bucket.Incr("counter", 1, 1, 0)
+	unavailable, ok := err.(*BucketUnavailableError)
+	assert.True(t, ok)
+	assert.True(t, unavailable.RetryAfter > 0)
+	status, _ := ErrorAsHTTPStatus(err)
+	assert.Equals(t, status, 503)
+
+	// After the open time, a successful operation closes the breaker:
+	leakyBucket.SetFaults(nil)
+	time.Sleep(60 * time.Millisecond)
+	value, _, err := bucket.GetRaw("doc")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, string(value), `{}`)
+	assert.False(t, bucket.BreakerOpen())
+	assert.DeepEquals(t, stateChanges, []bool{true, false})
+}
+
+// A bucket whose updates are applied, but then time out as far as the caller can tell.
+type lostReplyBucket struct {
+	Bucket
+}
+
+func (bucket lostReplyBucket) Update(k string, exp int, callback sgbucket.UpdateFunc) error {
+	if err := bucket.Bucket.Update(k, exp, callback); err != nil {
+		return err
+	}
+	return &gomemcached.MCResponse{Status: gomemcached.TMPFAIL}
+}
+
+func TestRetryBucketDoesntRetryUpdates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "retrybucket")
+	defer os.RemoveAll(dir)
+	localBucket, err := GetLocalBucket(LocalBucketScheme+dir, "update")
+	assert.Equals(t, err, nil)
+	bucket := NewRetryBucket(lostReplyBucket{localBucket}, BucketRetryPolicy{
+		MaxRetries:     2,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	})
+	defer bucket.Close()
+
+	// The callback increments a counter; retrying it after the write landed would count twice:
+	calls := 0
+	err = bucket.Update("counter", 0, func(current []byte) ([]byte, error) {
+		calls++
+		count, _ := strconv.Atoi(string(current))
+		return []byte(strconv.Itoa(count + 1)), nil
+	})
+	assert.True(t, IsRetryableBucketError(err))
+	assert.Equals(t, calls, 1)
+	value, _, err := localBucket.GetRaw("counter")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, string(value), "1")
+}
+
+func TestUnwrapBucket(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "retrybucket")
+	defer os.RemoveAll(dir)
+	localBucket, err := GetLocalBucket(LocalBucketScheme+dir, "unwrap")
+	assert.Equals(t, err, nil)
+	defer localBucket.Close()
+
+	// Fault injection puts a LeakyBucket under the RetryBucket; both have to come off:
+	var bucket Bucket = NewRetryBucket(NewLeakyBucket(localBucket, LeakyBucketConfig{}), DefaultBucketRetryPolicy)
+	assert.True(t, UnwrapBucket(bucket) == localBucket)
+	assert.True(t, UnwrapBucket(localBucket) == localBucket)
+}
@@ -16,13 +16,16 @@ func init() {
 }
 
 const (
-	KIndexPartitionKey       = "_idxPartitionMap"
-	KIndexPrefix             = "_idx"
-	kCountKeyFormat          = "_idx_c:%s:count"    // key
-	kClockPartitionKeyFormat = "_idx_c:%s:clock-%d" // key, partition index
-	KPrincipalCountKeyFormat = "_idx_p_count:%s"    // key for principal count
-	KPrincipalCountKeyPrefix = "_idx_p_count:"      // key prefix for principal count
-	KTotalPrincipalCountKey  = "_idx_p_count_all"   // key for overall principal count
+	KIndexPartitionKey        = "_idxPartitionMap"
+	KIndexPartitionVersionKey = "_idxPartitionMapVersion" // Version of the partition map in use, after a reshard
+	KIndexPendingVersionKey   = "_idxPartitionMapPending" // Version of the partition map index writers should switch to
+	KIndexWriterVersionKey    = "_idxPartitionMapWriters" // Version of the partition map index writers have switched to
+	KIndexPrefix              = "_idx"
+	kCountKeyFormat           = "_idx_c:%s:count"    // key
+	kClockPartitionKeyFormat  = "_idx_c:%s:clock-%d" // key, partition index
+	KPrincipalCountKeyFormat  = "_idx_p_count:%s"    // key for principal count
+	KPrincipalCountKeyPrefix  = "_idx_p_count:"      // key prefix for principal count
+	KTotalPrincipalCountKey   = "_idx_p_count_all"   // key for overall principal count
 )
 
 const (
@@ -64,6 +67,7 @@ type IndexPartitionMap map[uint16]uint16 // Maps vbuckets to index partition val
 type VbPositionMap map[uint16]uint64     // Map from vbucket to position within partition.  Stored as uint64 to avoid cast during arithmetic
 
 type IndexPartitions struct {
+	Version        uint32                   // Partition map version - incremented by each reshard of the index
 	PartitionDefs  PartitionStorageSet      // Partition definitions, as stored in bucket _idxPartitionMap
 	VbMap          IndexPartitionMap        // Map from vbucket to partition
 	VbPositionMaps map[uint16]VbPositionMap // VBPositionMaps, keyed by partition
@@ -575,9 +579,85 @@ func LoadClockCounter(baseKey string, bucket Bucket) (uint64, error) {
 	return bucket.Incr(countKey, 0, 0, 0)
 }
 
-// Index partitions for unit tests
-func SeedTestPartitionMap(bucket Bucket, numPartitions uint16) (PartitionStorageSet, error) {
-	maxVbNo := uint16(1024)
+// Returns the key of the partition map for a version.  Version zero is the original map written
+// when the index was created; each reshard of the index writes a new version alongside it.
+func IndexPartitionKey(version uint32) string {
+	if version == 0 {
+		return KIndexPartitionKey
+	}
+	return fmt.Sprintf("%s:v%d", KIndexPartitionKey, version)
+}
+
+// Returns the base key of the stable sequence clock for a partition map version.  The clock is sharded
+// by partition, so each version needs its own.
+func StableSequenceKey(version uint32) string {
+	if version == 0 {
+		return KStableSequenceKey
+	}
+	return fmt.Sprintf("%s:v%d", KStableSequenceKey, version)
+}
+
+type partitionVersion struct {
+	Version uint32 `json:"version"`
+}
+
+// Loads the version of the partition map currently in use.  Returns zero if the index has never been resharded.
+func LoadIndexPartitionVersion(bucket Bucket) (uint32, error) {
+	return loadPartitionVersion(bucket, KIndexPartitionVersionKey)
+}
+
+// Switches the index to a partition map version.
+func WriteIndexPartitionVersion(bucket Bucket, version uint32) error {
+	return writePartitionVersion(bucket, KIndexPartitionVersionKey, version)
+}
+
+// Asks the index writers to switch to a partition map version.  Writers switch by writing their
+// blocks and stable sequence under the new version, then acknowledge with WriteIndexWriterVersion.
+func WriteIndexPendingVersion(bucket Bucket, version uint32) error {
+	return writePartitionVersion(bucket, KIndexPendingVersionKey, version)
+}
+
+// Loads the partition map version the index writers have been asked to switch to.
+func LoadIndexPendingVersion(bucket Bucket) (uint32, error) {
+	return loadPartitionVersion(bucket, KIndexPendingVersionKey)
+}
+
+// Loads the partition map version the index writers have switched to.  Returns zero if they've never switched.
+func LoadIndexWriterVersion(bucket Bucket) (uint32, error) {
+	return loadPartitionVersion(bucket, KIndexWriterVersionKey)
+}
+
+// Records that the index writers have switched to a partition map version.  Nothing is written under
+// the previous version after this.
+func WriteIndexWriterVersion(bucket Bucket, version uint32) error {
+	return writePartitionVersion(bucket, KIndexWriterVersionKey, version)
+}
+
+func loadPartitionVersion(bucket Bucket, key string) (uint32, error) {
+	value, _, err := bucket.GetRaw(key)
+	if err != nil {
+		if IsDocNotFoundError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var pv partitionVersion
+	if err := json.Unmarshal(value, &pv); err != nil {
+		return 0, err
+	}
+	return pv.Version, nil
+}
+
+func writePartitionVersion(bucket Bucket, key string, version uint32) error {
+	value, err := json.Marshal(partitionVersion{Version: version})
+	if err != nil {
+		return err
+	}
+	return bucket.SetRaw(key, 0, value)
+}
+
+// Builds partition definitions that assign an equal, contiguous range of vbuckets to each partition.
+func NewPartitionStorageSet(maxVbNo uint16, numPartitions uint16) PartitionStorageSet {
 	partitionDefs := make(PartitionStorageSet, numPartitions)
 	vbPerPartition := maxVbNo / numPartitions
 	for partition := uint16(0); partition < numPartitions; partition++ {
@@ -591,6 +671,12 @@ func SeedTestPartitionMap(bucket Bucket, numPartitions uint16) (PartitionStorage
 		}
 		partitionDefs[partition] = storage
 	}
+	return partitionDefs
+}
+
+// Index partitions for unit tests
+func SeedTestPartitionMap(bucket Bucket, numPartitions uint16) (PartitionStorageSet, error) {
+	partitionDefs := NewPartitionStorageSet(1024, numPartitions)
 
 	// Persist to bucket
 	value, err := json.Marshal(partitionDefs)
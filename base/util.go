@@ -364,6 +364,19 @@ func CreateDoublingSleeperFunc(maxNumAttempts, initialTimeToSleepMs int) RetrySl
 
 }
 
+// Create a RetrySleeper like CreateDoublingSleeperFunc's, whose retry time stops doubling once it
+// reaches maxTimeToSleepMs.
+func CreateBoundedDoublingSleeperFunc(maxNumAttempts, initialTimeToSleepMs, maxTimeToSleepMs int) RetrySleeper {
+	doublingSleeper := CreateDoublingSleeperFunc(maxNumAttempts, initialTimeToSleepMs)
+	return func(numAttempts int) (bool, int) {
+		shouldContinue, timeToSleepMs := doublingSleeper(numAttempts)
+		if timeToSleepMs > maxTimeToSleepMs {
+			timeToSleepMs = maxTimeToSleepMs
+		}
+		return shouldContinue, timeToSleepMs
+	}
+}
+
 // Uint64Slice attaches the methods of sort.Interface to []uint64, sorting in increasing order.
 type Uint64Slice []uint64
 
@@ -1,8 +1,6 @@
 package db
 
 import (
-	"github.com/couchbase/go-couchbase"
-
 	"github.com/couchbase/sync_gateway/base"
 )
 
@@ -32,18 +30,7 @@ func (c *DatabaseContext) watchDocChanges() {
 
 // Adds sync metadata to a Couchbase document
 func (c *DatabaseContext) assimilate(docid string) {
-	base.LogTo("CRUD", "Importing new doc %q", docid)
-	db := Database{DatabaseContext: c, user: nil}
-	_, err := db.updateDoc(docid, true, 0, func(doc *document) (Body, AttachmentData, error) {
-		if doc.HasValidSyncData(c.writeSequences()) {
-			return nil, nil, couchbase.UpdateCancel // someone beat me to it
-		}
-		if err := db.initializeSyncData(doc); err != nil {
-			return nil, nil, err
-		}
-		return doc.body, nil, nil
-	})
-	if err != nil && err != couchbase.UpdateCancel {
+	if err := c.importDoc(docid, false); err != nil && err != errImportRejected {
 		base.Warn("Failed to import new doc %q: %v", docid, err)
 	}
 }
@@ -34,20 +34,23 @@ func init() {
 
 // Manages a cache of the recent change history of all channels.
 type changeCache struct {
-	context         *DatabaseContext
-	logsDisabled    bool                     // If true, ignore incoming tap changes
-	nextSequence    uint64                   // Next consecutive sequence number to add
-	initialSequence uint64                   // DB's current sequence at startup time
-	receivedSeqs    map[uint64]struct{}      // Set of all sequences received
-	pendingLogs     LogPriorityQueue         // Out-of-sequence entries waiting to be cached
-	channelCaches   map[string]*channelCache // A cache of changes for each channel
-	onChange        func(base.Set)           // Client callback that notifies of channel changes
-	stopped         bool                     // Set by the Stop method
-	skippedSeqs     SkippedSequenceQueue     // Skipped sequences still pending on the TAP feed
-	skippedSeqLock  sync.RWMutex             // Coordinates access to skippedSeqs queue
-	lock            sync.RWMutex             // Coordinates access to struct fields
-	lateSeqLock     sync.RWMutex             // Coordinates access to late sequence caches
-	options         CacheOptions             // Cache config
+	context          *DatabaseContext
+	logsDisabled     bool                     // If true, ignore incoming tap changes
+	nextSequence     uint64                   // Next consecutive sequence number to add
+	initialSequence  uint64                   // DB's current sequence at startup time
+	receivedSeqs     map[uint64]struct{}      // Set of all sequences received
+	pendingLogs      LogPriorityQueue         // Out-of-sequence entries waiting to be cached
+	channelCaches    map[string]*channelCache // A cache of changes for each channel
+	onChange         func(base.Set)           // Client callback that notifies of channel changes
+	stopped          bool                     // Set by the Stop method
+	skippedSeqs      SkippedSequenceQueue     // Skipped sequences still pending on the TAP feed
+	skippedSeqLock   sync.RWMutex             // Coordinates access to skippedSeqs queue
+	lock             sync.RWMutex             // Coordinates access to struct fields
+	lateSeqLock      sync.RWMutex             // Coordinates access to late sequence caches
+	options          CacheOptions             // Cache config
+	budget           *channelCacheBudget      // Memory used by channelCaches
+	evictedBefore    uint64                   // Channel caches may have been evicted before this sequence
+	budgetEnforcedAt time.Time                // When _enforceMemoryBudget last ran while over budget
 }
 
 type LogEntry channels.LogEntry
@@ -70,6 +73,9 @@ type CacheOptions struct {
 	CachePendingSeqMaxWait time.Duration // Max wait for pending sequence before skipping
 	CachePendingSeqMaxNum  int           // Max number of pending sequences before skipping
 	CacheSkippedSeqMaxWait time.Duration // Max wait for skipped sequence before abandoning
+	ChannelCacheMaxBytes   int64         // Max estimated memory used by all channel caches (0 = unlimited)
+	SnapshotDir            string        // Directory to save channel caches in when the database closes
+	WarmupChannels         int           // Number of most-requested channels to warm up at startup
 }
 
 //////// HOUSEKEEPING:
@@ -105,6 +111,27 @@ func (c *changeCache) Init(context *DatabaseContext, lastSequence SequenceID, on
 			c.options.CacheSkippedSeqMaxWait = options.CacheSkippedSeqMaxWait
 		}
 		c.options.ChannelCacheOptions = options.ChannelCacheOptions
+		c.options.ChannelCacheMaxBytes = options.ChannelCacheMaxBytes
+		c.options.SnapshotDir = options.SnapshotDir
+		c.options.WarmupChannels = options.WarmupChannels
+	}
+	c.budget = &channelCacheBudget{maxBytes: c.options.ChannelCacheMaxBytes}
+
+	if c.options.SnapshotDir != "" {
+		notLoaded, err := c.loadSnapshot(lastSequence.Seq)
+		if err != nil {
+			base.Warn("Unable to reload channel caches: %v", err)
+		}
+		if len(notLoaded) > c.options.WarmupChannels {
+			notLoaded = notLoaded[0:c.options.WarmupChannels]
+		}
+		if len(notLoaded) > 0 {
+			warmupChannels := make([]string, len(notLoaded))
+			for i, channel := range notLoaded {
+				warmupChannels[i] = channel.Name
+			}
+			go c.warmUp(warmupChannels)
+		}
 	}
 
 	base.LogTo("Cache", "Initializing changes cache with options %+v", c.options)
@@ -133,8 +160,14 @@ func (c *changeCache) Init(context *DatabaseContext, lastSequence SequenceID, on
 // Stops the cache. Clears its state and tells the housekeeping task to stop.
 func (c *changeCache) Stop() {
 	c.lock.Lock()
+	if c.options.SnapshotDir != "" && !c.stopped {
+		if err := c._writeSnapshot(); err != nil {
+			base.Warn("Unable to save channel caches: %v", err)
+		}
+	}
 	c.stopped = true
 	c.logsDisabled = true
+	c.budget.add(-c.budget.used()) // Don't count this database in the stats any more
 	c.lock.Unlock()
 }
 
@@ -148,7 +181,11 @@ func (c *changeCache) IsStopped() bool {
 func (c *changeCache) Clear() {
 	c.lock.Lock()
 	c.initialSequence, _ = c.context.LastSequence()
+	for _, cache := range c.channelCaches {
+		cache.evict()
+	}
 	c.channelCaches = make(map[string]*channelCache, 10)
+	c.evictedBefore = 0
 	c.pendingLogs = nil
 	heap.Init(&c.pendingLogs)
 	c.lock.Unlock()
@@ -182,6 +219,7 @@ func (c *changeCache) CleanUp() bool {
 	for channelName := range c.channelCaches {
 		c._getChannelCache(channelName).pruneCache()
 	}
+	c._enforceMemoryBudget()
 	return true
 }
 
@@ -321,6 +359,10 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte, seq uint64, vbNo
 			return
 		}
 
+		if len(docJSON) == 0 {
+			return // Doc was deleted from the bucket, e.g. a purged tombstone; nothing to cache
+		}
+
 		// First unmarshal the doc (just its metadata, to save time/memory):
 		doc, err := UnmarshalDocumentSyncData(docJSON, false)
 		if err != nil || !doc.HasValidSyncData(c.context.writeSequences()) {
@@ -337,6 +379,10 @@ func (c *changeCache) DocChanged(docID string, docJSON []byte, seq uint64, vbNo
 		lagMs := int(tapLag/(100*time.Millisecond)) * 100
 		changeCacheExpvars.Add(fmt.Sprintf("lag-tap-%04dms", lagMs), 1)
 
+		if c.context.searchIndex != nil {
+			c.context.searchIndex.docChanged(docID, docJSON)
+		}
+
 		// If the doc update wasted any sequences due to conflicts, add empty entries for them:
 		for _, seq := range doc.UnusedSequences {
 			base.LogTo("Cache", "Received unused #%d for (%q / %q)", seq, docID, doc.CurrentRev)
@@ -540,6 +586,7 @@ func (c *changeCache) _addToCache(change *LogEntry) base.Set {
 	lagMs = int(lag/(100*time.Millisecond)) * 100
 	changeCacheExpvars.Add(fmt.Sprintf("lag-queue-%04dms", lagMs), 1)
 
+	c._enforceMemoryBudgetAfterChange()
 	return base.SetFromArray(addedTo)
 }
 
@@ -592,7 +639,12 @@ func (c *changeCache) GetStableClock(stale bool) (clock base.SequenceClock, err
 func (c *changeCache) _getChannelCache(channelName string) *channelCache {
 	cache := c.channelCaches[channelName]
 	if cache == nil {
-		cache = newChannelCacheWithOptions(c.context, channelName, c.initialSequence+1, c.options)
+		validFrom := c.initialSequence + 1
+		if c.evictedBefore > validFrom {
+			validFrom = c.evictedBefore
+		}
+		cache = newChannelCacheWithOptions(c.context, channelName, validFrom, c.options)
+		cache.budget = c.budget
 		c.channelCaches[channelName] = cache
 	}
 	return cache
@@ -0,0 +1,205 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// The state of the in-memory change cache, for diagnosing stalled changes feeds.
+type ChangeCacheState struct {
+	NextSequence    uint64                 `json:"next_seq"`    // Next sequence the cache is waiting for
+	InitialSequence uint64                 `json:"initial_seq"` // Database's last sequence at startup
+	NumChannels     int                    `json:"num_channels"`
+	CacheBytes      int64                  `json:"cache_bytes"`
+	Pending         []PendingSequenceState `json:"pending"` // Received out of order, waiting for next_seq
+	Skipped         []SkippedSequenceState `json:"skipped"` // Given up waiting for; will be cached if they arrive late
+}
+
+type PendingSequenceState struct {
+	Sequence uint64 `json:"seq"`
+	DocID    string `json:"doc_id"`
+	AgeMs    int64  `json:"age_ms"`
+}
+
+type SkippedSequenceState struct {
+	Sequence uint64 `json:"seq"`
+	AgeMs    int64  `json:"age_ms"`
+}
+
+// The state of a single channel's cache.
+type ChannelCacheState struct {
+	Name              string `json:"name"`
+	ValidFrom         uint64 `json:"valid_from"`
+	Length            int    `json:"length"`
+	OldestSequence    uint64 `json:"oldest_seq,omitempty"`
+	NewestSequence    uint64 `json:"newest_seq,omitempty"`
+	LateSequences     int    `json:"late_seqs"`          // Late-arriving sequences held for continuous feeds
+	LateSeqListeners  uint64 `json:"late_seq_listeners"` // Continuous feeds following late-arriving sequences
+	Requests          uint64 `json:"requests"`
+	Bytes             int64  `json:"bytes"`
+	LastAccessSeconds int64  `json:"last_access_secs"` // Time since the channel was last read
+}
+
+func ageMs(t time.Time) int64 {
+	return int64(time.Since(t) / time.Millisecond)
+}
+
+func (c *channelCache) state() *ChannelCacheState {
+	state := &ChannelCacheState{
+		Name:              c.channelName,
+		Requests:          atomic.LoadUint64(&c.requests),
+		LastAccessSeconds: int64(time.Since(time.Unix(0, atomic.LoadInt64(&c.lastAccess))) / time.Second),
+	}
+	c.lock.RLock()
+	state.ValidFrom = c.validFrom
+	state.Length = len(c.logs)
+	if len(c.logs) > 0 {
+		state.OldestSequence = c.logs[0].Sequence
+		state.NewestSequence = c.logs[len(c.logs)-1].Sequence
+	}
+	state.Bytes = c.bytes
+	c.lock.RUnlock()
+
+	c.lateLogLock.RLock()
+	state.LateSequences = len(c.lateLogs) - 1 // The first entry is just a placeholder
+	for _, lateLog := range c.lateLogs {
+		state.LateSeqListeners += lateLog.getListenerCount()
+	}
+	c.lateLogLock.RUnlock()
+	return state
+}
+
+func (c *changeCache) state() *ChangeCacheState {
+	state := &ChangeCacheState{
+		Pending: []PendingSequenceState{},
+		Skipped: []SkippedSequenceState{},
+	}
+	c.lock.RLock()
+	state.NextSequence = c.nextSequence
+	state.InitialSequence = c.initialSequence
+	state.NumChannels = len(c.channelCaches)
+	state.CacheBytes = c.budget.used()
+	for _, entry := range c.pendingLogs {
+		state.Pending = append(state.Pending, PendingSequenceState{
+			Sequence: entry.Sequence,
+			DocID:    entry.DocID,
+			AgeMs:    ageMs(entry.TimeReceived),
+		})
+	}
+	c.lock.RUnlock()
+	sort.Sort(pendingSequenceStates(state.Pending)) // pendingLogs is a heap, so only partly sorted
+
+	c.skippedSeqLock.RLock()
+	for _, skipped := range c.skippedSeqs {
+		state.Skipped = append(state.Skipped, SkippedSequenceState{
+			Sequence: skipped.seq,
+			AgeMs:    ageMs(skipped.timeAdded),
+		})
+	}
+	c.skippedSeqLock.RUnlock()
+	return state
+}
+
+type pendingSequenceStates []PendingSequenceState
+
+func (s pendingSequenceStates) Len() int           { return len(s) }
+func (s pendingSequenceStates) Less(i, j int) bool { return s[i].Sequence < s[j].Sequence }
+func (s pendingSequenceStates) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type channelCacheStates []*ChannelCacheState
+
+func (s channelCacheStates) Len() int           { return len(s) }
+func (s channelCacheStates) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s channelCacheStates) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (db *DatabaseContext) inMemoryChangeCache() (*changeCache, error) {
+	cache, ok := db.changeCache.(*changeCache)
+	if !ok {
+		return nil, errors.New("No in-memory channel cache in use")
+	}
+	return cache, nil
+}
+
+// Returns the state of the change cache, including its pending and skipped sequences.
+func (db *DatabaseContext) ChangeCacheState() (*ChangeCacheState, error) {
+	cache, err := db.inMemoryChangeCache()
+	if err != nil {
+		return nil, err
+	}
+	return cache.state(), nil
+}
+
+// Returns the state of a channel's cache.
+func (db *DatabaseContext) ChannelCacheState(channelName string) (*ChannelCacheState, error) {
+	cache, err := db.inMemoryChangeCache()
+	if err != nil {
+		return nil, err
+	}
+	cache.lock.RLock()
+	channelCache := cache.channelCaches[channelName]
+	cache.lock.RUnlock()
+	if channelCache == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Channel isn't cached")
+	}
+	return channelCache.state(), nil
+}
+
+// Returns the states of all cached channels, sorted by name.
+func (db *DatabaseContext) AllChannelCacheStates() ([]*ChannelCacheState, error) {
+	cache, err := db.inMemoryChangeCache()
+	if err != nil {
+		return nil, err
+	}
+	cache.lock.RLock()
+	channelCaches := make([]*channelCache, 0, len(cache.channelCaches))
+	for _, channelCache := range cache.channelCaches {
+		channelCaches = append(channelCaches, channelCache)
+	}
+	cache.lock.RUnlock()
+
+	states := make(channelCacheStates, len(channelCaches))
+	for i, channelCache := range channelCaches {
+		states[i] = channelCache.state()
+	}
+	sort.Sort(states)
+	return states, nil
+}
+
+// Stops waiting for a skipped sequence, so that changes feeds' low sequence can move past it.
+// If the sequence does arrive later, feeds that have already moved past it won't send it.
+func (db *DatabaseContext) AbandonSkippedSequence(sequence uint64) error {
+	cache, err := db.inMemoryChangeCache()
+	if err != nil {
+		return err
+	}
+	if err := cache.RemoveSkipped(sequence); err != nil {
+		return base.HTTPErrorf(http.StatusNotFound, "Sequence %d isn't skipped", sequence)
+	}
+	base.Warn("Skipped sequence %d abandoned by admin request", sequence)
+	dbExpvars.Add("abandoned_seqs", 1)
+	return nil
+}
+
+// Runs the periodic check of the skipped sequence queue now, instead of waiting for it.
+func (db *DatabaseContext) CleanSkippedSequences() error {
+	cache, err := db.inMemoryChangeCache()
+	if err != nil {
+		return err
+	}
+	cache.CleanSkippedSequenceQueue()
+	return nil
+}
@@ -12,7 +12,11 @@ package db
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -875,6 +879,120 @@ func TestChannelCacheSize(t *testing.T) {
 	assert.Equals(t, len(abcCache.logs), 600)
 }
 
+// Test that channel caches are kept within the memory budget, and that an evicted channel's
+// changes are still available from the view.
+func TestChannelCacheMemoryBudget(t *testing.T) {
+
+	options := CacheOptions{
+		ChannelCacheMaxBytes: 50 * logEntrySize(e(1, "doc-1", "1-a")),
+	}
+	db := setupTestDBWithCacheOptions(t, options)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	// Write 100 docs, each to its own channel.  With the star channel, that's 200 cache entries:
+	for i := 1; i <= 100; i++ {
+		WriteDirect(db, []string{fmt.Sprintf("ch%d", i)}, uint64(i))
+	}
+	db.changeCache.waitForSequence(100)
+
+	changeCache, ok := db.changeCache.(*changeCache)
+	assertTrue(t, ok, "Testing memory budget without a change cache")
+
+	// New changes only enforce the budget once per ChannelCacheBudgetCheckInterval, but CleanUp
+	// always does:
+	changeCache.lock.Lock()
+	assert.True(t, time.Since(changeCache.budgetEnforcedAt) < ChannelCacheBudgetCheckInterval)
+	changeCache.lock.Unlock()
+	changeCache.CleanUp()
+	changeCache.lock.RLock()
+	numCaches := len(changeCache.channelCaches)
+	changeCache.lock.RUnlock()
+	assert.True(t, changeCache.budget.used() <= options.ChannelCacheMaxBytes)
+	assert.True(t, numCaches < 101)
+
+	// ch1 was least recently used, so it was evicted:
+	changes, err := db.changeCache.GetChanges("ch1", ChangesOptions{Since: SequenceID{Seq: 0}})
+	assertNoError(t, err, "Couldn't GetChanges")
+	assert.Equals(t, len(changes), 1)
+	assert.Equals(t, changes[0].DocID, "doc-1")
+}
+
+// Test reloading channel caches from a snapshot, and warming them up when the snapshot is stale.
+func TestChannelCacheSnapshot(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "cachesnapshot")
+	defer os.RemoveAll(dir)
+	options := shortWaitCache()
+	options.SnapshotDir = dir
+	db := setupTestDBWithCacheOptions(t, options)
+	defer tearDownTestDB(t, db)
+
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC", "NBC"}, 2)
+	db.changeCache.waitForSequence(2)
+	db.changeCache.GetChanges("NBC", ChangesOptions{Since: SequenceID{Seq: 0}})
+
+	// Stop the cache, as when the database closes, and start a new one as when it reopens:
+	db.changeCache.Stop()
+	cache := &changeCache{}
+	cache.Init(db.DatabaseContext, SequenceID{Seq: 2}, nil, &options, nil)
+	assert.True(t, verifyCacheSequences(cache.getChannelCache("ABC"), []uint64{1, 2}))
+	assert.True(t, verifyCacheSequences(cache.getChannelCache("NBC"), []uint64{2}))
+	assert.Equals(t, atomic.LoadUint64(&cache.getChannelCache("NBC").requests), uint64(1))
+	// The snapshot can only be used once:
+	_, err := os.Stat(filepath.Join(dir, "db.cachesnap"))
+	assert.True(t, os.IsNotExist(err))
+
+	// If a sequence was allocated since the snapshot, the caches aren't reloaded, but the
+	// most-requested channel is warmed up from the view:
+	cache.Stop()
+	options.WarmupChannels = 1
+	cache = &changeCache{}
+	cache.Init(db.DatabaseContext, SequenceID{Seq: 3}, nil, &options, nil)
+	defer cache.Stop()
+	assert.Equals(t, len(cache.getChannelCache("ABC").logs), 0)
+	for i := 0; i < 100 && len(cache.getChannelCache("NBC").logs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, verifyCacheSequences(cache.getChannelCache("NBC"), []uint64{2}))
+}
+
+// Test inspecting the cache's state, and abandoning a skipped sequence.
+func TestChangeCacheState(t *testing.T) {
+
+	db := setupTestDBWithCacheOptions(t, shortWaitCache())
+	defer tearDownTestDB(t, db)
+
+	WriteDirect(db, []string{"ABC"}, 1)
+	WriteDirect(db, []string{"ABC", "NBC"}, 2)
+	WriteDirect(db, []string{"ABC"}, 4)
+	db.changeCache.waitForSequenceWithMissing(4)
+
+	state, err := db.ChangeCacheState()
+	assertNoError(t, err, "Couldn't get cache state")
+	assert.Equals(t, state.NextSequence, uint64(5))
+	assert.Equals(t, len(state.Skipped), 1)
+	assert.Equals(t, state.Skipped[0].Sequence, uint64(3))
+
+	channelState, err := db.ChannelCacheState("ABC")
+	assertNoError(t, err, "Couldn't get channel cache state")
+	assert.Equals(t, channelState.Length, 3)
+	assert.Equals(t, channelState.OldestSequence, uint64(1))
+	assert.Equals(t, channelState.NewestSequence, uint64(4))
+	_, err = db.ChannelCacheState("CBS")
+	assertHTTPError(t, err, 404)
+	channelStates, err := db.AllChannelCacheStates()
+	assertNoError(t, err, "Couldn't get channel cache states")
+	assert.Equals(t, channelStates[0].Name, "*")
+	assert.Equals(t, channelStates[2].Name, "NBC")
+
+	assertNoError(t, db.AbandonSkippedSequence(3), "Couldn't abandon sequence")
+	state, _ = db.ChangeCacheState()
+	assert.Equals(t, len(state.Skipped), 0)
+	assertHTTPError(t, db.AbandonSkippedSequence(3), 404)
+}
+
 func shortWaitCache() CacheOptions {
 
 	return CacheOptions{
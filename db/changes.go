@@ -14,6 +14,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
@@ -31,6 +32,15 @@ type ChangesOptions struct {
 	HeartbeatMs uint64     // How often to send a heartbeat to the client
 	TimeoutMs   uint64     // After this amount of time, close the longpoll connection
 	ActiveOnly  bool       // If true, only return information on non-deleted, non-removed revisions
+
+	Filter *ChangesFilter // If non-nil, restricts the feed to matching docs
+}
+
+// Restricts a changes feed to some of the documents in its channels.  Used by filtered
+// replications.
+type ChangesFilter struct {
+	DocIDs   base.Set         // If non-nil, only these docs are included
+	Function *JSEventFunction // If non-nil, only docs the function returns true for are included
 }
 
 // A changes entry; Database.GetChanges returns an array of these.
@@ -104,6 +114,38 @@ func (db *Database) AddDocInstanceToChangeEntry(entry *ChangeEntry, doc *documen
 	}
 }
 
+// Returns true if a change entry passes the options' filter.  Entries for user docs always pass.
+// The filter function sees the revision's body from the revision cache, which already has the
+// revisions that were just saved; deletions get a stub body made from the entry.
+func (db *Database) changeEntryMatchesFilter(entry *ChangeEntry, options ChangesOptions) bool {
+	filter := options.Filter
+	if filter == nil || strings.HasPrefix(entry.ID, "_user/") {
+		return true
+	}
+	if filter.DocIDs != nil && !filter.DocIDs.Contains(entry.ID) {
+		return false
+	}
+	if filter.Function != nil {
+		revID := entry.Changes[0]["rev"]
+		body := entry.Doc
+		if entry.Deleted {
+			body = Body{"_id": entry.ID, "_rev": revID, "_deleted": true}
+		} else if body == nil {
+			var err error
+			if body, _, _, err = db.revisionCache.Get(entry.ID, revID); body == nil {
+				base.Warn("Changes feed: error getting doc %q/%q to filter: %v", entry.ID, revID, err)
+				return false
+			}
+		}
+		matches, err := filter.Function.CallValidateFunction(&DocumentChangeEvent{Doc: body})
+		if err != nil {
+			base.Warn("Changes feed: error calling filter function on doc %q: %v", entry.ID, err)
+		}
+		return matches
+	}
+	return true
+}
+
 // Creates a Go-channel of all the changes made on a channel.
 // Does NOT handle the Wait option. Does NOT check authorization.
 func (db *Database) changesFeed(channel string, options ChangesOptions) (<-chan *ChangeEntry, error) {
@@ -191,6 +233,9 @@ func (db *Database) MultiChangesFeed(chans base.Set, options ChangesOptions) (<-
 	if (options.Continuous || options.Wait) && options.Terminator == nil {
 		base.Warn("MultiChangesFeed: Terminator missing for Continuous/Wait mode")
 	}
+	if err := db.checkSinceNotPurged(options.Since); err != nil {
+		return nil, err
+	}
 	if db.SequenceType == IntSequenceType {
 		base.LogTo("Changes+", "Int sequence multi changes feed...")
 		return db.SimpleMultiChangesFeed(chans, options)
@@ -467,6 +512,10 @@ func (db *Database) SimpleMultiChangesFeed(chans base.Set, options ChangesOption
 					}
 				}
 
+				if !db.changeEntryMatchesFilter(minEntry, options) {
+					continue
+				}
+
 				// Update options.Since for use in the next outer loop iteration.  Only update
 				// when minSeq is greater than the previous options.Since value - we don't want to
 				// roll back the Since value when we get an late sequence is processed.
@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/couchbase/go-couchbase"
@@ -29,13 +30,18 @@ type channelsViewRow struct {
 // Queries the 'channels' view to get a range of sequences of a single channel as LogEntries.
 func (dbc *DatabaseContext) getChangesInChannelFromView(
 	channelName string, endSeq uint64, options ChangesOptions) (LogEntries, error) {
+	optMap := changesViewOptions(channelName, endSeq, options)
+	base.LogTo("Cache", "  Querying 'channels' view for %q (start=#%d, end=#%d, limit=%d)", channelName, options.Since.SafeSequence()+1, endSeq, options.Limit)
+	return dbc.queryChannelsView(channelName, optMap)
+}
+
+// Queries the 'channels' view with the given options, returning the rows as LogEntries.
+func (dbc *DatabaseContext) queryChannelsView(channelName string, optMap Body) (LogEntries, error) {
 	if dbc.Bucket == nil {
 		return nil, errors.New("No bucket available for channel view query")
 	}
 	start := time.Now()
 	// Query the view:
-	optMap := changesViewOptions(channelName, endSeq, options)
-	base.LogTo("Cache", "  Querying 'channels' view for %q (start=#%d, end=#%d, limit=%d)", channelName, options.Since.SafeSequence()+1, endSeq, options.Limit)
 	vres := channelsViewResult{}
 	err := dbc.Bucket.ViewCustom(DesignDocSyncGateway, ViewChannels, optMap, &vres)
 	if err != nil {
@@ -70,6 +76,34 @@ func (dbc *DatabaseContext) getChangesInChannelFromView(
 	return entries, nil
 }
 
+// Returns the names of all channels in the 'channels' view, in order.  Skips from each channel's first
+// row to the next channel's, so makes one query per channel rather than reading every row.
+func (dbc *DatabaseContext) channelNamesFromView() ([]string, error) {
+	if dbc.Bucket == nil {
+		return nil, errors.New("No bucket available for channel view query")
+	}
+	var names []string
+	for {
+		optMap := Body{"stale": false, "limit": 1}
+		if len(names) > 0 {
+			// {} collates after every sequence, so this starts at the next channel:
+			optMap["startkey"] = []interface{}{names[len(names)-1], map[string]interface{}{}}
+		}
+		vres := channelsViewResult{}
+		if err := dbc.Bucket.ViewCustom(DesignDocSyncGateway, ViewChannels, optMap, &vres); err != nil {
+			return nil, err
+		}
+		if len(vres.Rows) == 0 {
+			return names, nil
+		}
+		name, ok := vres.Rows[0].Key[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected key in 'channels' view: %v", vres.Rows[0].Key)
+		}
+		names = append(names, name)
+	}
+}
+
 func changesViewOptions(channelName string, endSeq uint64, options ChangesOptions) Body {
 	endKey := []interface{}{channelName, endSeq}
 	if endSeq == 0 {
@@ -3,6 +3,7 @@ package db
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -29,12 +30,18 @@ type channelCache struct {
 	lateLogLock      sync.RWMutex         // Controls access to lateLogs
 	options          *ChannelCacheOptions // Cache size/expiry settings
 	cachedDocIDs     map[string]struct{}
+	bytes            int64               // Estimated memory used by logs
+	budget           *channelCacheBudget // Database-wide memory budget, if any
+	lastAccess       int64               // Time of last read, in Unix nanoseconds (accessed atomically)
+	requests         uint64              // Number of GetChanges calls (accessed atomically)
+	evicted          bool                // Set when removed from the changeCache to free memory
 }
 
 func newChannelCache(context *DatabaseContext, channelName string, validFrom uint64) *channelCache {
 	cache := &channelCache{context: context, channelName: channelName, validFrom: validFrom}
 	cache.initializeLateLogs()
 	cache.cachedDocIDs = make(map[string]struct{})
+	cache.touch()
 	cache.options = &ChannelCacheOptions{
 		ChannelCacheMinLength: DefaultChannelCacheMinLength,
 		ChannelCacheMaxLength: DefaultChannelCacheMaxLength,
@@ -97,6 +104,7 @@ func (c *channelCache) _pruneCache() {
 		pruned = len(c.logs) - c.options.ChannelCacheMaxLength
 		for i := 0; i < pruned; i++ {
 			delete(c.cachedDocIDs, c.logs[i].DocID)
+			c._addBytes(-logEntrySize(c.logs[i]))
 		}
 		c.validFrom = c.logs[pruned-1].Sequence + 1
 		c.logs = c.logs[pruned:]
@@ -107,6 +115,7 @@ func (c *channelCache) _pruneCache() {
 	for len(c.logs) > c.options.ChannelCacheMinLength && time.Since(c.logs[0].TimeReceived) > c.options.ChannelCacheAge {
 		c.validFrom = c.logs[0].Sequence + 1
 		delete(c.cachedDocIDs, c.logs[0].DocID)
+		c._addBytes(-logEntrySize(c.logs[0]))
 		c.logs = c.logs[1:]
 		pruned++
 	}
@@ -124,6 +133,7 @@ func (c *channelCache) pruneCache() {
 // Returns all of the cached entries for sequences greater than 'since' in the given channel.
 // Entries are returned in increasing-sequence order.
 func (c *channelCache) getCachedChanges(options ChangesOptions) (validFrom uint64, result []*LogEntry) {
+	c.touch()
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 	return c._getCachedChanges(options)
@@ -163,6 +173,8 @@ func (c *channelCache) _getCachedChanges(options ChangesOptions) (validFrom uint
 // view should be queried, because we don't want the view query to outrun the chanceCache's
 // nextSequence.
 func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
+	atomic.AddUint64(&c.requests, 1)
+
 	// Use the cache, and return if it fulfilled the entire request:
 	cacheValidFrom, resultFromCache := c.getCachedChanges(options)
 	numFromCache := len(resultFromCache)
@@ -202,8 +214,8 @@ func (c *channelCache) GetChanges(options ChangesOptions) ([]*LogEntry, error) {
 		return nil, err
 	}
 
-	// Cache some of the view results, if there's room in the cache:
-	if len(resultFromCache) < c.options.ChannelCacheMaxLength {
+	// Cache some of the view results, if there's room in the cache and in the memory budget:
+	if len(resultFromCache) < c.options.ChannelCacheMaxLength && !c.budget.overBudget() {
 		c.prependChanges(resultFromView, startSeq, options.Limit == 0)
 	}
 
@@ -249,6 +261,7 @@ func (c *channelCache) _appendChange(change *LogEntry) {
 		if _, found := c.cachedDocIDs[change.DocID]; found {
 			for i := end; i >= 0; i-- {
 				if log[i].DocID == change.DocID {
+					c._addBytes(logEntrySize(change) - logEntrySize(log[i]))
 					copy(log[i:], log[i+1:])
 					log[end] = change
 					return
@@ -261,6 +274,7 @@ func (c *channelCache) _appendChange(change *LogEntry) {
 	}
 	c.logs = append(log, change)
 	c.cachedDocIDs[change.DocID] = struct{}{}
+	c._addBytes(logEntrySize(change))
 }
 
 // Insert out-of-sequence entry into the cache.  If the docId is already present in a later
@@ -292,6 +306,7 @@ func (c *channelCache) insertChange(log *LogEntries, change *LogEntry) {
 					return
 				} else {
 					// found existing prior to insert position
+					c._addBytes(logEntrySize(change) - logEntrySize(currLog))
 					if i == insertAtIndex-1 {
 						// The sequence is adjacent to another with the same docId - replace it
 						// instead of inserting
@@ -312,6 +327,7 @@ func (c *channelCache) insertChange(log *LogEntries, change *LogEntry) {
 	*log = append(*log, nil)
 	copy((*log)[insertAtIndex+1:], (*log)[insertAtIndex:])
 	(*log)[insertAtIndex] = change
+	c._addBytes(logEntrySize(change))
 
 	return
 }
@@ -325,6 +341,10 @@ func (c *channelCache) prependChanges(changes LogEntries, changesValidFrom uint6
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if c.evicted {
+		return 0 // Nobody else will read from this cache
+	}
+
 	log := c.logs
 	if len(log) == 0 {
 		// If my cache is empty, just copy the new changes:
@@ -338,6 +358,7 @@ func (c *channelCache) prependChanges(changes LogEntries, changesValidFrom uint6
 			}
 			c.logs = make(LogEntries, len(changes))
 			copy(c.logs, changes)
+			c._addBytes(changes.size())
 			base.LogTo("Cache", "  Initialized cache of %q with %d entries from view (#%d--#%d)",
 				c.channelName, len(changes), changes[0].Sequence, changes[len(changes)-1].Sequence)
 		}
@@ -367,6 +388,7 @@ func (c *channelCache) prependChanges(changes LogEntries, changesValidFrom uint6
 						newLog = append(newLog, changes[0:i]...)
 						newLog = append(newLog, log...)
 						c.logs = newLog
+						c._addBytes(changes[0:i].size())
 						base.LogTo("Cache", "  Added %d entries from view (#%d--#%d) to cache of %q",
 							i, changes[0].Sequence, changes[i-1].Sequence, c.channelName)
 					}
@@ -525,6 +547,14 @@ func (c *channelCache) mostRecentLateLog() *lateLogEntry {
 	return nil
 }
 
+// Returns the estimated memory used by the entries.
+func (entries LogEntries) size() (total int64) {
+	for _, entry := range entries {
+		total += logEntrySize(entry)
+	}
+	return total
+}
+
 func (c *channelCache) addDocIDs(changes LogEntries) {
 	for _, change := range changes {
 		c.cachedDocIDs[change.DocID] = struct{}{}
@@ -0,0 +1,178 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Estimated memory used by a cached LogEntry, besides its strings: the struct itself, its
+// pointer in the channel's log, and its docID's entry in cachedDocIDs.
+const kLogEntryOverhead = 160
+
+// When the budget is exceeded, caches are evicted until usage drops to this fraction of it,
+// so that every new change doesn't trigger another eviction.
+const kChannelCacheBudgetLowWater = 0.9
+
+// While over budget, new changes only trigger an eviction pass this often, since each pass sorts
+// every channel cache.  CleanUp runs one regardless.
+var ChannelCacheBudgetCheckInterval = 1 * time.Second
+
+func logEntrySize(entry *LogEntry) int64 {
+	return int64(kLogEntryOverhead + len(entry.DocID) + len(entry.RevID))
+}
+
+// Tracks the memory used by all of a database's channel caches, against an optional limit.
+type channelCacheBudget struct {
+	maxBytes  int64 // Limit on usedBytes; 0 if unlimited
+	usedBytes int64 // Estimated memory used by all channel caches (accessed atomically)
+}
+
+func (b *channelCacheBudget) add(delta int64) {
+	if b == nil || delta == 0 {
+		return
+	}
+	atomic.AddInt64(&b.usedBytes, delta)
+	changeCacheExpvars.Add("channelCache_bytes", delta)
+}
+
+func (b *channelCacheBudget) used() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.usedBytes)
+}
+
+func (b *channelCacheBudget) overBudget() bool {
+	return b != nil && b.maxBytes > 0 && b.used() > b.maxBytes
+}
+
+// Records that the channel was just read from, for LRU eviction.
+func (c *channelCache) touch() {
+	atomic.StoreInt64(&c.lastAccess, time.Now().UnixNano())
+}
+
+// Adjusts the estimated memory used by the cache. Caller MUST be holding the lock.
+func (c *channelCache) _addBytes(delta int64) {
+	c.bytes += delta
+	c.budget.add(delta)
+}
+
+// Drops the oldest entries until the cache is down to its minimum length, regardless of their
+// age.  Returns the number of entries dropped.
+func (c *channelCache) shrinkToMinLength() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	excess := len(c.logs) - c.options.ChannelCacheMinLength
+	if excess <= 0 {
+		return 0
+	}
+	for _, entry := range c.logs[0:excess] {
+		delete(c.cachedDocIDs, entry.DocID)
+		c._addBytes(-logEntrySize(entry))
+	}
+	c.validFrom = c.logs[excess-1].Sequence + 1
+	// Copy what's left, so the dropped entries can be garbage collected now:
+	logs := make(LogEntries, len(c.logs)-excess, c.options.ChannelCacheMinLength)
+	copy(logs, c.logs[excess:])
+	c.logs = logs
+	return excess
+}
+
+// Empties the cache, which is being removed from the changeCache.
+func (c *channelCache) evict() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c._addBytes(-c.bytes)
+	c.logs = nil
+	c.cachedDocIDs = make(map[string]struct{})
+	c.evicted = true
+}
+
+// Returns true if a continuous changes feed is following the channel's late-arriving sequences.
+// The cache can't be replaced while that's the case, or the feed would lose its place.
+func (c *channelCache) hasLateSequenceClients() bool {
+	c.lateLogLock.RLock()
+	defer c.lateLogLock.RUnlock()
+	for _, lateLog := range c.lateLogs {
+		if lateLog.getListenerCount() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorts channel caches from least to most recently read.
+type channelCachesByAccess []*channelCache
+
+func (caches channelCachesByAccess) Len() int { return len(caches) }
+func (caches channelCachesByAccess) Less(i, j int) bool {
+	return atomic.LoadInt64(&caches[i].lastAccess) < atomic.LoadInt64(&caches[j].lastAccess)
+}
+func (caches channelCachesByAccess) Swap(i, j int) { caches[i], caches[j] = caches[j], caches[i] }
+
+// Enforces the memory budget after a change is added, unless it was enforced less than
+// ChannelCacheBudgetCheckInterval ago.  Caller MUST be holding the lock.
+func (c *changeCache) _enforceMemoryBudgetAfterChange() {
+	if !c.budget.overBudget() || time.Since(c.budgetEnforcedAt) < ChannelCacheBudgetCheckInterval {
+		return
+	}
+	c._enforceMemoryBudget()
+}
+
+// If the channel caches are using more memory than the budget allows, frees some, least
+// recently read channels first: first by shrinking caches to their minimum length, then by
+// evicting whole caches.  An evicted channel's changes are read from the view until it's cached
+// again.  Caller MUST be holding the lock.
+func (c *changeCache) _enforceMemoryBudget() {
+	if !c.budget.overBudget() {
+		return
+	}
+	c.budgetEnforcedAt = time.Now()
+	target := int64(float64(c.budget.maxBytes) * kChannelCacheBudgetLowWater)
+	caches := make(channelCachesByAccess, 0, len(c.channelCaches))
+	for _, cache := range c.channelCaches {
+		caches = append(caches, cache)
+	}
+	sort.Sort(caches)
+
+	shrunk := 0
+	for _, cache := range caches {
+		if c.budget.used() <= target {
+			break
+		}
+		shrunk += cache.shrinkToMinLength()
+	}
+	evicted := 0
+	for _, cache := range caches {
+		if c.budget.used() <= target {
+			break
+		}
+		if cache.hasLateSequenceClients() {
+			continue
+		}
+		cache.evict()
+		delete(c.channelCaches, cache.channelName)
+		evicted++
+	}
+	if evicted > 0 {
+		// Caches created from now on can't assume they've seen every change since startup:
+		c.evictedBefore = c.nextSequence
+	}
+
+	changeCacheExpvars.Add("channelCache_evictedEntries", int64(shrunk))
+	changeCacheExpvars.Add("channelCache_evictions", int64(evicted))
+	base.LogTo("Cache", "Over memory budget of %d bytes: dropped %d entries and evicted %d channels; now using %d",
+		c.budget.maxBytes, shrunk, evicted, c.budget.used())
+}
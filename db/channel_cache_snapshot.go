@@ -0,0 +1,252 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A snapshot of a database's channel caches, written to local disk when the database is closed
+// so that the caches can be reloaded when it reopens instead of refilled from the view.
+type cacheSnapshot struct {
+	Bucket       string            `json:"bucket"`
+	LastSequence uint64            `json:"last_seq"` // The caches are complete up to this sequence
+	Channels     []channelSnapshot `json:"channels"`
+}
+
+type channelSnapshot struct {
+	Name      string          `json:"name"`
+	ValidFrom uint64          `json:"valid_from"`
+	Requests  uint64          `json:"requests,omitempty"` // Number of GetChanges calls, to pick channels to warm up
+	Entries   []snapshotEntry `json:"entries,omitempty"`
+}
+
+type snapshotEntry struct {
+	Sequence uint64 `json:"seq"`
+	DocID    string `json:"id"`
+	RevID    string `json:"rev"`
+	Flags    uint8  `json:"flags,omitempty"`
+	VbNo     uint16 `json:"vb,omitempty"`
+}
+
+// Sorts channel snapshots by decreasing number of requests.
+type channelSnapshotsByRequests []channelSnapshot
+
+func (s channelSnapshotsByRequests) Len() int           { return len(s) }
+func (s channelSnapshotsByRequests) Less(i, j int) bool { return s[i].Requests > s[j].Requests }
+func (s channelSnapshotsByRequests) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (c *changeCache) snapshotPath() string {
+	return filepath.Join(c.options.SnapshotDir, c.context.Name+".cachesnap")
+}
+
+func (c *channelCache) snapshot(includeEntries bool) channelSnapshot {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	snapshot := channelSnapshot{
+		Name:      c.channelName,
+		ValidFrom: c.validFrom,
+		Requests:  atomic.LoadUint64(&c.requests),
+	}
+	if includeEntries {
+		snapshot.Entries = make([]snapshotEntry, len(c.logs))
+		for i, entry := range c.logs {
+			snapshot.Entries[i] = snapshotEntry{
+				Sequence: entry.Sequence,
+				DocID:    entry.DocID,
+				RevID:    entry.RevID,
+				Flags:    entry.Flags,
+				VbNo:     entry.VbNo,
+			}
+		}
+	}
+	return snapshot
+}
+
+// Writes the channel caches to the snapshot file.  Caller MUST be holding the lock.
+// If sequences are still pending or skipped, the caches would be missing them after a restart,
+// so only the channels' request counts are saved.
+func (c *changeCache) _writeSnapshot() error {
+	c.skippedSeqLock.RLock()
+	complete := len(c.pendingLogs) == 0 && len(c.skippedSeqs) == 0
+	c.skippedSeqLock.RUnlock()
+
+	snapshot := cacheSnapshot{
+		LastSequence: c.nextSequence - 1,
+		Channels:     make([]channelSnapshot, 0, len(c.channelCaches)),
+	}
+	if c.context.Bucket != nil {
+		snapshot.Bucket = c.context.Bucket.GetName()
+	}
+	for _, cache := range c.channelCaches {
+		snapshot.Channels = append(snapshot.Channels, cache.snapshot(complete))
+	}
+
+	// Write to a temporary file and rename it, so a crash can't leave a partial snapshot:
+	path := c.snapshotPath()
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(file).Encode(&snapshot)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	base.LogTo("Cache", "Wrote snapshot of %d channel caches (complete=%v) to %s", len(snapshot.Channels), complete, path)
+	return nil
+}
+
+// Reloads the channel caches from the snapshot file, if there is one and no sequences have been
+// allocated since it was written, then deletes the file.  Returns the channels that weren't
+// reloaded, most requested first, as candidates for warming up.
+func (c *changeCache) loadSnapshot(lastSequence uint64) ([]channelSnapshot, error) {
+	path := c.snapshotPath()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// It's only valid once; if we crash later, the caches will be out of date:
+	defer os.Remove(path)
+	defer file.Close()
+
+	var snapshot cacheSnapshot
+	if err = json.NewDecoder(file).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("Invalid channel cache snapshot %s: %v", path, err)
+	}
+	valid := snapshot.LastSequence == lastSequence
+	if c.context.Bucket != nil && snapshot.Bucket != c.context.Bucket.GetName() {
+		valid = false
+	}
+	if !valid {
+		base.LogTo("Cache", "Channel cache snapshot is out of date (last seq #%d, database is at #%d); not reloading caches",
+			snapshot.LastSequence, lastSequence)
+	}
+
+	var notLoaded []channelSnapshot
+	entriesLoaded := 0
+	sharedEntries := make(map[snapshotEntry]*LogEntry) // Channels can share LogEntries, as when they were cached
+	now := time.Now()
+	for _, channel := range snapshot.Channels {
+		if !valid || len(channel.Entries) == 0 {
+			notLoaded = append(notLoaded, channel)
+			continue
+		}
+		cache := newChannelCacheWithOptions(c.context, channel.Name, channel.ValidFrom, c.options)
+		cache.budget = c.budget
+		cache.requests = channel.Requests
+		for _, snapEntry := range channel.Entries {
+			entry := sharedEntries[snapEntry]
+			if entry == nil {
+				entry = &LogEntry{
+					Sequence:     snapEntry.Sequence,
+					DocID:        snapEntry.DocID,
+					RevID:        snapEntry.RevID,
+					Flags:        snapEntry.Flags,
+					VbNo:         snapEntry.VbNo,
+					TimeReceived: now,
+				}
+				sharedEntries[snapEntry] = entry
+			}
+			cache.logs = append(cache.logs, entry)
+			cache.cachedDocIDs[entry.DocID] = struct{}{}
+		}
+		cache._addBytes(cache.logs.size())
+		c.channelCaches[channel.Name] = cache
+		entriesLoaded += len(channel.Entries)
+	}
+	c._enforceMemoryBudget()
+
+	loaded := len(snapshot.Channels) - len(notLoaded)
+	changeCacheExpvars.Add("snapshot_channels_loaded", int64(loaded))
+	changeCacheExpvars.Add("snapshot_entries_loaded", int64(entriesLoaded))
+	base.LogTo("Cache", "Reloaded %d channel caches (%d entries) from snapshot %s", loaded, entriesLoaded, path)
+	sort.Sort(channelSnapshotsByRequests(notLoaded))
+	return notLoaded, nil
+}
+
+// Fills the caches of the given channels from the view, one at a time, so that clients
+// reconnecting after a restart don't all query the view at once.  Progress is reported in the
+// warmup_channels_pending/done stats.
+func (c *changeCache) warmUp(channelNames []string) {
+	pending := int64(len(channelNames))
+	changeCacheExpvars.Add("warmup_channels_pending", pending)
+	defer func() {
+		changeCacheExpvars.Add("warmup_channels_pending", -pending)
+	}()
+	start := time.Now()
+	for _, channelName := range channelNames {
+		if c.IsStopped() {
+			return
+		}
+		if err := c.getChannelCache(channelName).warmUp(); err != nil {
+			base.Warn("Unable to warm up cache for channel %q: %v", channelName, err)
+		}
+		pending--
+		changeCacheExpvars.Add("warmup_channels_pending", -1)
+		changeCacheExpvars.Add("warmup_channels_done", 1)
+	}
+	base.LogTo("Cache", "Warmed up %d channel caches in %v", len(channelNames), time.Since(start))
+}
+
+// Fills the cache with the channel's most recent changes from the view, up to its max length.
+func (c *channelCache) warmUp() error {
+	c.viewLock.Lock()
+	defer c.viewLock.Unlock()
+
+	// The view results need to overlap what's already cached, for prependChanges:
+	c.lock.RLock()
+	endSeq := c.validFrom
+	if len(c.logs) > 0 {
+		endSeq = c.logs[0].Sequence
+	}
+	c.lock.RUnlock()
+
+	limit := c.options.ChannelCacheMaxLength
+	optMap := Body{
+		"stale":      false,
+		"descending": true,
+		"startkey":   []interface{}{c.channelName, endSeq},
+		"endkey":     []interface{}{c.channelName, 0},
+		"limit":      limit,
+	}
+	entries, err := c.context.queryChannelsView(c.channelName, optMap)
+	if err != nil {
+		return err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	validFrom := uint64(1) // Got the channel's entire history...
+	if len(entries) >= limit {
+		validFrom = entries[0].Sequence // ...or only the most recent part of it
+	}
+	c.prependChanges(entries, validFrom, true)
+	return nil
+}
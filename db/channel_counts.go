@@ -0,0 +1,546 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// The per-channel counts are spread over this many docs, to limit both their size and the
+// contention between nodes updating them.
+const kChannelCountsShards = 16
+
+const kChannelCountsKeyPrefix = "_sync:chcounts:"
+
+// Key of the marker doc recording that the counts have been seeded from the docs in the bucket
+const kChannelCountsSeededKey = kChannelCountsKeyPrefix + "seeded"
+
+// Number of docs read from the import view at a time while seeding the counts
+const kChannelCountsSeedPageSize = 1000
+
+// How often each node adds the counter changes it's made to the counters stored in the bucket
+var ChannelCountsFlushInterval = 1 * time.Second
+
+// Counts of the documents in a channel.
+type ChannelCounts struct {
+	Name       string `json:"name,omitempty"`
+	Docs       int64  `json:"docs"`       // Live docs in the channel
+	Tombstones int64  `json:"tombstones"` // Deleted docs whose tombstones are in the channel
+	Removals   int64  `json:"removals"`   // Docs that have been removed from the channel
+	LastSeq    uint64 `json:"last_seq"`   // Sequence of the latest change in the channel
+}
+
+func (stats *ChannelCounts) add(delta *ChannelCounts) {
+	stats.Docs += delta.Docs
+	stats.Tombstones += delta.Tombstones
+	stats.Removals += delta.Removals
+	if delta.LastSeq > stats.LastSeq {
+		stats.LastSeq = delta.LastSeq
+	}
+}
+
+func (stats *ChannelCounts) isEmpty() bool {
+	return stats.Docs == 0 && stats.Tombstones == 0 && stats.Removals == 0
+}
+
+// How a document appears in one of its channels
+const (
+	channelStateLive = iota + 1
+	channelStateTombstone
+	channelStateRemoved
+)
+
+// Returns the state of the document in each channel it's in or has been removed from.
+func (doc *document) channelStates() map[string]int {
+	states := make(map[string]int, len(doc.Channels))
+	deleted := doc.hasFlag(channels.Deleted)
+	for channelName, removal := range doc.Channels {
+		if removal == nil && !deleted {
+			states[channelName] = channelStateLive
+		} else if removal == nil || removal.Deleted {
+			states[channelName] = channelStateTombstone
+		} else {
+			states[channelName] = channelStateRemoved
+		}
+	}
+	return states
+}
+
+// Keeps the per-channel counts up to date.  Changes made by this node are accumulated in
+// memory and periodically added to the counters in the bucket, so that updating a document
+// doesn't cost an extra write per channel.
+type channelCountsTracker struct {
+	context *DatabaseContext
+	pending map[string]*ChannelCounts // Changes not yet flushed to the bucket
+	stopped bool
+	seed    *channelCountsSeed // Set while the counts are being seeded
+	lock    sync.Mutex
+}
+
+// State of a running seed, which records the changes this node makes while it runs, to apply
+// the ones it didn't see once it's done.
+type channelCountsSeed struct {
+	startSeq uint64              // The database's last sequence when the seed started
+	docsRead int                 // Docs read from the bucket so far
+	lastRead string              // ID of the last doc read, since they're read in view order
+	finished bool                // Has every doc been read?
+	readSeqs map[string]uint64   // Sequences of docs read that were changed after startSeq
+	changes  []channelCountsDiff // Changes made since the seed started
+}
+
+// A change to the counts made by updating or purging one document.
+type channelCountsDiff struct {
+	docID  string
+	seq    uint64 // Sequence of the update, if it isn't a purge
+	purged bool
+	unread bool // Purged before the seed read it, so the seed won't count it
+	deltas map[string]*ChannelCounts
+}
+
+func newChannelCountsTracker(context *DatabaseContext) *channelCountsTracker {
+	tracker := &channelCountsTracker{context: context, pending: map[string]*ChannelCounts{}}
+	seedErr := tracker.startSeed()
+	go func() {
+		if seedErr == nil {
+			seedErr = tracker.runSeed()
+		}
+		if seedErr != nil {
+			base.Warn("Couldn't seed channel counts of db %q; will retry at next startup: %v", context.Name, seedErr)
+		}
+		for !tracker.isStopped() {
+			time.Sleep(ChannelCountsFlushInterval)
+			tracker.flush()
+		}
+	}()
+	return tracker
+}
+
+// Records the change to a document's channels made by saving a new revision.
+func (tracker *channelCountsTracker) docChanged(doc *document, oldStates map[string]int) {
+	newStates := doc.channelStates()
+	deltas := map[string]*ChannelCounts{}
+	for channelName, oldState := range oldStates {
+		if newStates[channelName] != oldState {
+			addToCount(deltas, channelName, oldState, -1)
+		}
+	}
+	for channelName, newState := range newStates {
+		if oldStates[channelName] != newState {
+			addToCount(deltas, channelName, newState, 1)
+		}
+		// The revision shows up in the changes feed of every channel the doc is in, and of any
+		// channel it was just removed from:
+		if removal := doc.Channels[channelName]; removal == nil || removal.Seq == doc.Sequence {
+			countsFor(deltas, channelName).add(&ChannelCounts{LastSeq: doc.Sequence})
+		}
+	}
+	tracker.record(channelCountsDiff{docID: doc.ID, seq: doc.Sequence, deltas: deltas})
+}
+
+// Records the purge of a document, which had the given states in its channels.
+func (tracker *channelCountsTracker) docPurged(docID string, oldStates map[string]int) {
+	deltas := map[string]*ChannelCounts{}
+	for channelName, oldState := range oldStates {
+		addToCount(deltas, channelName, oldState, -1)
+	}
+	tracker.record(channelCountsDiff{docID: docID, purged: true, deltas: deltas})
+}
+
+func (tracker *channelCountsTracker) record(diff channelCountsDiff) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	seed := tracker.seed
+	if seed == nil {
+		tracker._addPending(diff.deltas)
+		return
+	}
+	if diff.purged && !seed.finished && base.CollateJSON(diff.docID, seed.lastRead) > 0 {
+		// The seed will find the doc gone, or as it is when recreated, so none of the changes
+		// made to it so far count:
+		diff.unread = true
+		for _, earlier := range seed.changes {
+			if earlier.docID == diff.docID && earlier.seq > seed.readSeqs[diff.docID] {
+				seed.readSeqs[diff.docID] = earlier.seq
+			}
+		}
+	}
+	seed.changes = append(seed.changes, diff)
+}
+
+// Ends the seed, adding the changes recorded while it ran to the pending ones.  If it succeeded,
+// the changes it saw when it read their docs are skipped, as they're already counted.
+func (tracker *channelCountsTracker) finishSeed(succeeded bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	seed := tracker.seed
+	tracker.seed = nil
+	for _, diff := range seed.changes {
+		if !succeeded || (diff.purged && !diff.unread) || (!diff.purged && diff.seq > seed.readSeqs[diff.docID]) {
+			tracker._addPending(diff.deltas)
+		}
+	}
+}
+
+func (tracker *channelCountsTracker) _addPending(deltas map[string]*ChannelCounts) {
+	for channelName, delta := range deltas {
+		countsFor(tracker.pending, channelName).add(delta)
+	}
+}
+
+func addToCount(counts map[string]*ChannelCounts, channelName string, state int, delta int64) {
+	stats := countsFor(counts, channelName)
+	switch state {
+	case channelStateLive:
+		stats.Docs += delta
+	case channelStateTombstone:
+		stats.Tombstones += delta
+	case channelStateRemoved:
+		stats.Removals += delta
+	}
+}
+
+func countsFor(counts map[string]*ChannelCounts, channelName string) *ChannelCounts {
+	stats := counts[channelName]
+	if stats == nil {
+		stats = &ChannelCounts{}
+		counts[channelName] = stats
+	}
+	return stats
+}
+
+func (tracker *channelCountsTracker) isStopped() bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.stopped
+}
+
+// Flushes any remaining changes and stops the background task.  Called before the bucket closes.
+func (tracker *channelCountsTracker) stop() {
+	tracker.flush()
+	tracker.lock.Lock()
+	tracker.stopped = true
+	tracker.lock.Unlock()
+}
+
+// Adds the pending changes to the counters stored in the bucket.  Changes that can't be saved
+// are kept, to be retried on the next flush.
+func (tracker *channelCountsTracker) flush() {
+	tracker.lock.Lock()
+	pending := tracker.pending
+	tracker.pending = map[string]*ChannelCounts{}
+	tracker.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	shards := map[int]map[string]*ChannelCounts{}
+	for channelName, delta := range pending {
+		shard := channelCountsShard(channelName)
+		if shards[shard] == nil {
+			shards[shard] = map[string]*ChannelCounts{}
+		}
+		shards[shard][channelName] = delta
+	}
+
+	tracker.context.BucketLock.RLock()
+	defer tracker.context.BucketLock.RUnlock()
+	bucket := tracker.context.Bucket
+	for shard, deltas := range shards {
+		var err error
+		if bucket == nil {
+			err = fmt.Errorf("bucket is closed")
+		} else {
+			err = bucket.Update(channelCountsKey(shard), 0, func(currentValue []byte) ([]byte, error) {
+				counts := map[string]*ChannelCounts{}
+				if currentValue != nil {
+					if err := json.Unmarshal(currentValue, &counts); err != nil {
+						return nil, err
+					}
+				}
+				for channelName, delta := range deltas {
+					if counts[channelName] == nil {
+						counts[channelName] = &ChannelCounts{}
+					}
+					counts[channelName].add(delta)
+					if counts[channelName].isEmpty() {
+						delete(counts, channelName)
+					}
+				}
+				return json.Marshal(counts)
+			})
+		}
+		if err != nil {
+			base.Warn("Couldn't save channel counts: %v", err)
+			tracker.lock.Lock()
+			for channelName, delta := range deltas {
+				countsFor(tracker.pending, channelName).add(delta)
+			}
+			tracker.lock.Unlock()
+		}
+	}
+}
+
+// Starts recording the changes made by this node, for runSeed to reconcile with the docs it reads.
+func (tracker *channelCountsTracker) startSeed() error {
+	startSeq, err := tracker.context.LastSequence()
+	if err != nil {
+		return err
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.seed = &channelCountsSeed{startSeq: startSeq, readSeqs: map[string]uint64{}}
+	return nil
+}
+
+// Runs fn with the database's bucket, unless it's been closed or the tracker stopped.
+func (tracker *channelCountsTracker) withBucket(fn func(base.Bucket) error) error {
+	tracker.context.BucketLock.RLock()
+	defer tracker.context.BucketLock.RUnlock()
+	if tracker.context.Bucket == nil || tracker.isStopped() {
+		return fmt.Errorf("Database was closed")
+	}
+	return fn(tracker.context.Bucket)
+}
+
+// The counts are only kept up to date by changes made after they were added, so the first time
+// a database starts with them -- or after an offline import -- they're computed from every doc
+// in the bucket.  A marker doc records that this has been done.  Runs in the background; the
+// changes this node makes meanwhile are applied when it's done, but changes made by other nodes
+// may be missed.
+func (tracker *channelCountsTracker) runSeed() error {
+	succeeded := false
+	defer func() {
+		tracker.finishSeed(succeeded)
+	}()
+	seeded := false
+	err := tracker.withBucket(func(bucket base.Bucket) error {
+		_, _, err := bucket.GetRaw(kChannelCountsSeededKey)
+		if err == nil {
+			seeded = true
+		} else if !base.IsDocNotFoundError(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil || seeded {
+		return err
+	}
+	base.Logf("Seeding channel counts of db %q...", tracker.context.Name)
+
+	shards := map[int]map[string]*ChannelCounts{}
+	docCount := 0
+	lastDocID := ""
+	for {
+		var rows sgbucket.ViewRows
+		err := tracker.withBucket(func(bucket base.Bucket) error {
+			// Keys are [hasSyncData, docID]; only docs with sync data are in any channels
+			opts := Body{"stale": false, "reduce": false, "limit": kChannelCountsSeedPageSize,
+				"startkey": []interface{}{true, lastDocID}, "endkey": []interface{}{true, map[string]interface{}{}}}
+			vres, err := bucket.View(DesignDocSyncHousekeeping, ViewImport, opts)
+			if err != nil {
+				return err
+			}
+			rows = vres.Rows
+			if len(rows) > 0 && rows[0].ID == lastDocID {
+				rows = rows[1:] // startkey is inclusive
+			}
+			for _, row := range rows {
+				doc, err := tracker.readSeedDoc(bucket, row.ID)
+				if err != nil {
+					return err
+				} else if doc != nil {
+					addSeedDoc(shards, doc)
+					docCount++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		lastDocID = rows[len(rows)-1].ID
+	}
+	tracker.lock.Lock()
+	tracker.seed.finished = true
+	tracker.lock.Unlock()
+
+	// Replaces whatever counts were there before:
+	err = tracker.withBucket(func(bucket base.Bucket) error {
+		for shard := 0; shard < kChannelCountsShards; shard++ {
+			var err error
+			if len(shards[shard]) > 0 {
+				err = bucket.Set(channelCountsKey(shard), 0, shards[shard])
+			} else if err = bucket.Delete(channelCountsKey(shard)); base.IsDocNotFoundError(err) {
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return bucket.Set(kChannelCountsSeededKey, 0, Body{"docs": docCount, "seeded_at": time.Now()})
+	})
+	if err != nil {
+		return err
+	}
+	succeeded = true
+	base.Logf("Seeded channel counts of db %q from %d docs", tracker.context.Name, docCount)
+	return nil
+}
+
+// Reads a doc for the seed, recording that it's been read.  Returns nil if the doc is gone or
+// has no sync data.
+func (tracker *channelCountsTracker) readSeedDoc(bucket base.Bucket, docID string) (*document, error) {
+	tracker.lock.Lock()
+	tracker.seed.docsRead++
+	tracker.seed.lastRead = docID
+	tracker.lock.Unlock()
+
+	value, _, err := bucket.GetRaw(docID)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	doc, err := unmarshalDocument(docID, value)
+	if err != nil || !doc.HasValidSyncData(tracker.context.writeSequences()) {
+		return nil, nil
+	}
+	tracker.lock.Lock()
+	if doc.Sequence > tracker.seed.startSeq {
+		tracker.seed.readSeqs[docID] = doc.Sequence
+	}
+	tracker.lock.Unlock()
+	return doc, nil
+}
+
+// Adds a doc read by the seed to the per-shard counts.
+func addSeedDoc(shards map[int]map[string]*ChannelCounts, doc *document) {
+	for channelName, state := range doc.channelStates() {
+		shard := channelCountsShard(channelName)
+		if shards[shard] == nil {
+			shards[shard] = map[string]*ChannelCounts{}
+		}
+		delta := &ChannelCounts{LastSeq: doc.Sequence}
+		if removal := doc.Channels[channelName]; removal != nil && removal.Seq > 0 {
+			delta.LastSeq = removal.Seq
+		}
+		switch state {
+		case channelStateLive:
+			delta.Docs = 1
+		case channelStateTombstone:
+			delta.Tombstones = 1
+		case channelStateRemoved:
+			delta.Removals = 1
+		}
+		countsFor(shards[shard], channelName).add(delta)
+	}
+}
+
+// Makes the counts be seeded again from the docs in the bucket the next time the database starts.
+// Called after writing to the bucket directly, as an offline import does.
+func resetChannelCounts(bucket base.Bucket) error {
+	if err := bucket.Delete(kChannelCountsSeededKey); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+func channelCountsShard(channelName string) int {
+	return int(crc32.ChecksumIEEE([]byte(channelName)) % kChannelCountsShards)
+}
+
+func channelCountsKey(shard int) string {
+	return fmt.Sprintf("%s%d", kChannelCountsKeyPrefix, shard)
+}
+
+// Returns the counts of every channel that has any docs, tombstones or removals, sorted by
+// name.  Includes changes made by this node that haven't been saved to the bucket yet; changes
+// made by other nodes show up once they've been saved.  While the counts are being seeded,
+// they're the ones stored before, which may be missing or out of date.
+func (context *DatabaseContext) AllChannelCounts() ([]*ChannelCounts, error) {
+	counts := map[string]*ChannelCounts{}
+	for shard := 0; shard < kChannelCountsShards; shard++ {
+		var shardCounts map[string]*ChannelCounts
+		if _, err := context.Bucket.Get(channelCountsKey(shard), &shardCounts); err != nil {
+			if base.IsDocNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		for channelName, stats := range shardCounts {
+			counts[channelName] = stats
+		}
+	}
+
+	tracker := context.channelCounts
+	tracker.lock.Lock()
+	for channelName, delta := range tracker.pending {
+		if counts[channelName] == nil {
+			counts[channelName] = &ChannelCounts{}
+		}
+		counts[channelName].add(delta)
+	}
+	tracker.lock.Unlock()
+
+	result := make([]*ChannelCounts, 0, len(counts))
+	for channelName, stats := range counts {
+		if !stats.isEmpty() {
+			stats.Name = channelName
+			result = append(result, stats)
+		}
+	}
+	sort.Sort(channelCountsByName(result))
+	return result, nil
+}
+
+// Returns true, and the number of docs read so far, if the counts are being seeded.
+func (context *DatabaseContext) ChannelCountsSeeding() (seeding bool, docsRead int) {
+	tracker := context.channelCounts
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.seed == nil {
+		return false, 0
+	}
+	return true, tracker.seed.docsRead
+}
+
+// Returns the counts of the channels the user can read; all of them for an admin.
+func (db *Database) ChannelCounts() ([]*ChannelCounts, error) {
+	all, err := db.AllChannelCounts()
+	if err != nil {
+		return nil, err
+	}
+	canSee := db.channelAccessFilter()
+	result := make([]*ChannelCounts, 0, len(all))
+	for _, stats := range all {
+		if canSee([]string{stats.Name}) {
+			result = append(result, stats)
+		}
+	}
+	return result, nil
+}
+
+type channelCountsByName []*ChannelCounts
+
+func (s channelCountsByName) Len() int           { return len(s) }
+func (s channelCountsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s channelCountsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
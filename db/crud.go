@@ -51,11 +51,25 @@ func (db *DatabaseContext) GetDoc(docid string) (*document, error) {
 	if err != nil {
 		return nil, err
 	} else if !doc.HasValidSyncData(db.writeSequences()) {
-		return nil, base.HTTPErrorf(404, "Not imported")
+		return nil, errNotImported
 	}
 	return doc, nil
 }
 
+// Like GetDoc, but first imports the doc if it hasn't been and on-demand import is enabled.
+// Only used to read docs for REST clients; internal readers like the changes feed and the
+// search index use GetDoc, so they never write to the bucket.
+func (db *DatabaseContext) GetDocImportingOnDemand(docid string) (*document, error) {
+	doc, err := db.GetDoc(docid)
+	if err != errNotImported || !db.Options.ImportOptions.OnDemand {
+		return doc, err
+	}
+	if err = db.importDoc(docid, true); err != nil {
+		return nil, err
+	}
+	return db.GetDoc(docid)
+}
+
 // This is the RevisionCacheLoaderFunc callback for the context's RevisionCache.
 // Its job is to load a revision from the bucket when there's a cache miss.
 func (context *DatabaseContext) revCacheLoader(id IDAndRev) (body Body, history Body, channels base.Set, err error) {
@@ -108,6 +122,11 @@ func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, histo
 		// Get a specific revision body and history from the revision cache
 		// (which will load them if necessary, by calling revCacheLoader, above)
 		body, revisions, inChannels, err = db.revisionCache.Get(docid, revid)
+		if err == errNotImported && db.Options.ImportOptions.OnDemand {
+			if err = db.importDoc(docid, true); err == nil {
+				body, revisions, inChannels, err = db.revisionCache.Get(docid, revid)
+			}
+		}
 		if body == nil {
 			if err == nil {
 				err = base.HTTPErrorf(404, "missing")
@@ -119,7 +138,7 @@ func (db *Database) GetRevWithHistory(docid, revid string, maxHistory int, histo
 		}
 	} else {
 		// No rev ID given, so load doc and get its current revision:
-		if doc, err = db.GetDoc(docid); doc == nil {
+		if doc, err = db.GetDocImportingOnDemand(docid); doc == nil {
 			return nil, err
 		}
 		revid = doc.CurrentRev
@@ -531,16 +550,23 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 	var unusedSequences []uint64
 	var oldBodyJSON string
 	var newAttachments AttachmentData
+	var oldChannelStates map[string]int
 
 	err := db.Bucket.WriteUpdate(key, int(expiry), func(currentValue []byte) (raw []byte, writeOpts sgbucket.WriteOptions, err error) {
 		// Be careful: this block can be invoked multiple times if there are races!
 		if doc, err = unmarshalDocument(docid, currentValue); err != nil {
 			return
 		} else if !allowImport && currentValue != nil && !doc.HasValidSyncData(db.writeSequences()) {
-			err = base.HTTPErrorf(409, "Not imported")
+			if db.Options.ImportOptions.OnDemand {
+				err = errNeedsImport
+			} else {
+				err = base.HTTPErrorf(409, "Not imported")
+			}
 			return
 		}
 
+		oldChannelStates = doc.channelStates()
+
 		// Invoke the callback to update the document and return a new revision body:
 		body, newAttachments, err = callback(doc)
 		if err != nil {
@@ -701,7 +727,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 			changedRoleUsers = doc.RoleAccess.updateAccess(doc, roles)
 
 			if len(changedPrincipals) > 0 || len(changedRoleUsers) > 0 {
-				if cbb, ok := db.Bucket.(base.CouchbaseBucket); ok { //Backing store is Couchbase Server
+				if cbb, ok := base.UnwrapBucket(db.Bucket).(base.CouchbaseBucket); ok { //Backing store is Couchbase Server
 					if major, _, _, err := cbb.CBSVersion(); err == nil && major >= 3 {
 						base.LogTo("CRUD+", "Optimizing write for Couchbase Server >= 3.0")
 					} else {
@@ -742,6 +768,14 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 
 	if err == couchbase.UpdateCancel {
 		return "", nil
+	} else if err == errNeedsImport {
+		// Import the existing doc, then apply the update to it:
+		if err = db.importDoc(docid, true); err == errImportRejected {
+			return "", base.HTTPErrorf(409, "Not imported")
+		} else if err != nil {
+			return "", err
+		}
+		return db.updateDoc(docid, allowImport, expiry, callback)
 	} else if err == couchbase.ErrOverwritten {
 		// ErrOverwritten is ok; if a later revision got persisted, that's fine too
 		base.LogTo("CRUD+", "Note: Rev %q/%q was overwritten in RAM before becoming indexable",
@@ -751,6 +785,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 	}
 
 	dbExpvars.Add("revs_added", 1)
+	db.channelCounts.docChanged(doc, oldChannelStates)
 
 	if doc.History[newRevID] != nil {
 		// Store the new revision in the cache
@@ -783,7 +818,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 			db.invalUserOrRoleChannels(name)
 			//If this is the current in memory db.user, reload to generate updated channels
 			if db.user != nil && db.user.Name() == name {
-				user, err := db.Authenticator().GetUser(db.user.Name())
+				user, err := db.Authenticator().ReloadUser(db.user)
 				if err != nil {
 					base.Warn("Error reloading db.user[%s], channels list is out of date --> %+v", db.user.Name(), err)
 				} else {
@@ -799,7 +834,7 @@ func (db *Database) updateDoc(docid string, allowImport bool, expiry uint32, cal
 			db.invalUserRoles(name)
 			//If this is the current in memory db.user, reload to generate updated roles
 			if db.user != nil && db.user.Name() == name {
-				user, err := db.Authenticator().GetUser(db.user.Name())
+				user, err := db.Authenticator().ReloadUser(db.user)
 				if err != nil {
 					base.Warn("Error reloading db.user[%s], roles list is out of date --> %+v", db.user.Name(), err)
 				} else {
@@ -837,6 +872,27 @@ func (db *Database) DeleteDoc(docid string, revid string) (string, error) {
 	return db.Put(docid, body)
 }
 
+// Removes a document from the bucket altogether, leaving no tombstone.  Used by the _purge API,
+// which takes bucket keys rather than doc IDs.
+func (db *Database) Purge(key string) error {
+	var oldStates map[string]int
+	err := db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
+		if currentValue == nil {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+		}
+		oldStates = nil
+		if doc, err := unmarshalDocument(key, currentValue); err == nil && doc.HasValidSyncData(db.writeSequences()) {
+			oldStates = doc.channelStates()
+		}
+		return nil, nil // deletes the doc
+	})
+	if err != nil {
+		return err
+	}
+	db.channelCounts.docPurged(key, oldStates)
+	return nil
+}
+
 //////// CHANNELS:
 
 // Calls the JS sync function to assign the doc to channels, grant users
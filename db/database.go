@@ -72,6 +72,11 @@ type DatabaseContext struct {
 	State              uint32                  // The runtime state of the DB from a service perspective
 	ExitChanges        chan struct{}           // Active _changes feeds on the DB will close when this channel is closed
 	OIDCProviders      auth.OIDCProviderMap    // OIDC clients
+	LoginThrottle      *auth.LoginThrottle     // Tracks failed logins; nil if throttling is disabled
+	searchIndex        *searchIndex            // Full-text search index; nil if search is disabled
+	channelCounts      *channelCountsTracker   // Maintains the per-channel doc counts
+	tombstonePurger    *tombstonePurger        // Purges expired tombstones; nil if they're kept forever
+	purgeMarker        purgeMarkerCache        // Purge marker as checked by changes feeds
 }
 
 type DatabaseContextOptions struct {
@@ -83,6 +88,12 @@ type DatabaseContextOptions struct {
 	UnsupportedOptions    *UnsupportedOptions
 	TrackDocs             bool // Whether doc tracking channel should be created (used for autoImport, shadowing)
 	OIDCOptions           *auth.OIDCOptions
+	LoginThrottleOptions  *auth.LoginThrottleOptions
+	SessionOptions        *auth.SessionOptions
+	ImportOptions         ImportOptions
+	QueryIndexes          []*QueryIndexDef       // Secondary indexes used by _find queries
+	SearchOptions         *SearchOptions         // Full-text search settings; nil if search is disabled
+	TombstonePurgeOptions *TombstonePurgeOptions // Tombstone retention; nil if tombstones are kept forever
 }
 
 type OidcTestProviderOptions struct {
@@ -161,6 +172,17 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 	context.revisionCache = NewRevisionCache(int(options.RevisionCacheCapacity), context.revCacheLoader)
 
 	context.EventMgr = NewEventManager()
+	if retryBucket, ok := bucket.(*base.RetryBucket); ok {
+		retryBucket.SetBreakerStateChangeCallback(func(open bool, cause error) {
+			if context.EventMgr.HasHandlerForEvent(DBStateChange) {
+				if open {
+					context.EventMgr.RaiseDBStateChangeEvent(context.Name, "unavailable", fmt.Sprintf("Bucket unavailable: %v", cause), *context.Options.AdminInterface)
+				} else {
+					context.EventMgr.RaiseDBStateChangeEvent(context.Name, "online", "Bucket available", *context.Options.AdminInterface)
+				}
+			}
+		})
+	}
 
 	var err error
 	context.sequences, err = newSequenceAllocator(bucket)
@@ -186,6 +208,17 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		}
 	}
 
+	// The search index is fed by the change cache, so it has to exist before the first change
+	// arrives; it's filled in by rebuilding it once the database is up.
+	if options.SearchOptions != nil {
+		if options.IndexOptions != nil {
+			return nil, errors.New("Full-text search can't be used with a channel index")
+		}
+		if context.searchIndex, err = newSearchIndex(context, options.SearchOptions); err != nil {
+			return nil, err
+		}
+	}
+
 	context.changeCache.Init(context, SequenceID{Seq: lastSeq}, func(changedChannels base.Set) {
 		context.tapListener.Notify(changedChannels)
 	}, options.CacheOptions, options.IndexOptions)
@@ -217,6 +250,9 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 				return nil, fmt.Errorf("OpenID Connect provider names cannot contain underscore:%s", name)
 			}
 			provider.Name = name
+			if err := provider.ValidateClaimMappings(); err != nil {
+				return nil, err
+			}
 			if _, ok := context.OIDCProviders[provider.Issuer]; ok {
 				base.Warn("Multiple OIDC providers defined for issuer %v", provider.Issuer)
 				return nil, fmt.Errorf("Multiple OIDC providers defined for issuer %v", provider.Issuer)
@@ -246,6 +282,34 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 
 	}
 
+	if len(options.QueryIndexes) > 0 {
+		if err := installQueryIndexes(bucket, options.QueryIndexes); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := options.SessionOptions.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := options.TombstonePurgeOptions.Validate(); err != nil {
+		return nil, err
+	}
+
+	if options.LoginThrottleOptions != nil {
+		context.LoginThrottle = auth.NewLoginThrottle(bucket, options.LoginThrottleOptions)
+	}
+
+	if context.searchIndex != nil {
+		if _, err := context.StartSearchIndexRebuild(); err != nil {
+			return nil, err
+		}
+	}
+
+	context.channelCounts = newChannelCountsTracker(context)
+	if options.TombstonePurgeOptions != nil {
+		context.tombstonePurger = newTombstonePurger(context, options.TombstonePurgeOptions)
+	}
 	go context.watchDocChanges()
 	return context, nil
 }
@@ -295,6 +359,10 @@ func (context *DatabaseContext) TapListener() changeListener {
 }
 
 func (context *DatabaseContext) Close() {
+	if context.tombstonePurger != nil {
+		context.tombstonePurger.stop()
+	}
+	context.channelCounts.stop() // flushes to the bucket, so has to happen before it's closed
 	context.BucketLock.Lock()
 	defer context.BucketLock.Unlock()
 
@@ -359,7 +427,9 @@ func (dc *DatabaseContext) TakeDbOffline(reason string) error {
 
 func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 	// Authenticators are lightweight & stateless, so it's OK to return a new one every time
-	return auth.NewAuthenticator(context.Bucket, context)
+	authenticator := auth.NewAuthenticator(context.Bucket, context)
+	authenticator.SessionOptions = context.Options.SessionOptions
+	return authenticator
 }
 
 // Makes a Database object given its name and bucket.
@@ -381,7 +451,7 @@ func (db *Database) ReloadUser() error {
 	if db.user == nil {
 		return nil
 	}
-	user, err := db.Authenticator().GetUser(db.user.Name())
+	user, err := db.Authenticator().ReloadUser(db.user)
 	if err != nil {
 		return err
 	}
@@ -440,6 +510,15 @@ func installViews(bucket base.Bucket) error {
                      if (meta.id.substring(0,10) == "_sync:rev:")
 	                     emit("",null); }`
 
+	// View for purging tombstones -- finds all deleted docs
+	// Key is docid; value is {t: time saved, s: sequence}
+	tombstones_map := `function (doc, meta) {
+                     var sync = doc._sync;
+                     if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+                       return;
+                     if ((sync.flags & 1) || sync.deleted)
+                       emit(meta.id, {t:sync.time_saved, s:sync.sequence}); }`
+
 	// Sessions view - used for session delete
 	// Key is username; value is docid
 	sessions_map := `function (doc, meta) {
@@ -556,11 +635,12 @@ func installViews(bucket base.Bucket) error {
 
 	designDocMap[DesignDocSyncHousekeeping] = sgbucket.DesignDoc{
 		Views: sgbucket.ViewMap{
-			ViewAllBits:  sgbucket.ViewDef{Map: allbits_map},
-			ViewAllDocs:  sgbucket.ViewDef{Map: alldocs_map, Reduce: "_count"},
-			ViewImport:   sgbucket.ViewDef{Map: import_map, Reduce: "_count"},
-			ViewOldRevs:  sgbucket.ViewDef{Map: oldrevs_map, Reduce: "_count"},
-			ViewSessions: sgbucket.ViewDef{Map: sessions_map},
+			ViewAllBits:    sgbucket.ViewDef{Map: allbits_map},
+			ViewAllDocs:    sgbucket.ViewDef{Map: alldocs_map, Reduce: "_count"},
+			ViewImport:     sgbucket.ViewDef{Map: import_map, Reduce: "_count"},
+			ViewOldRevs:    sgbucket.ViewDef{Map: oldrevs_map, Reduce: "_count"},
+			ViewSessions:   sgbucket.ViewDef{Map: sessions_map},
+			ViewTombstones: sgbucket.ViewDef{Map: tombstones_map},
 		},
 	}
 
@@ -600,14 +680,21 @@ type IDAndRev struct {
 
 // The ForEachDocID options for limiting query results
 type ForEachDocIDOptions struct {
-	Startkey string
-	Endkey   string
-	Limit    uint64
+	Startkey     string
+	Endkey       string
+	Limit        uint64
+	Descending   bool   // Iterate in reverse docID order (Startkey is then the upper bound)
+	ExclusiveEnd bool   // Leave out the doc whose ID is Endkey
+	ResumeAfter  string // Start just after this docID, instead of at Startkey
 }
 
 type ForEachDocIDFunc func(id IDAndRev, channels []string) bool
 
-// Iterates over all documents in the database, calling the callback function on each
+// Number of rows ForEachDocID requests from the view at a time (a variable so tests can lower it)
+var allDocsPageSize = 1000
+
+// Iterates over all documents in the database, calling the callback function on each.  The view
+// is read a page at a time, so the whole result never has to be held in memory.
 func (db *Database) ForEachDocID(callback ForEachDocIDFunc, resultsOpts ForEachDocIDOptions) error {
 	type viewRow struct {
 		Key   string
@@ -617,38 +704,81 @@ func (db *Database) ForEachDocID(callback ForEachDocIDFunc, resultsOpts ForEachD
 			Channels []string `json:"c"`
 		}
 	}
-	var vres struct {
-		Rows []viewRow
-	}
-	opts := Body{"stale": false, "reduce": false}
 
-	if resultsOpts.Startkey != "" {
-		opts["startkey"] = resultsOpts.Startkey
+	startKey := resultsOpts.Startkey
+	resumeAfter := resultsOpts.ResumeAfter
+	if resumeAfter != "" {
+		startKey = resumeAfter
 	}
+	count := uint64(0)
+	for {
+		var vres struct {
+			Rows []viewRow
+		}
+		opts := Body{"stale": false, "reduce": false, "limit": allDocsPageSize}
+		if startKey != "" {
+			opts["startkey"] = startKey
+		}
+		if resultsOpts.Endkey != "" {
+			opts["endkey"] = resultsOpts.Endkey
+			if resultsOpts.ExclusiveEnd {
+				opts["inclusive_end"] = false
+			}
+		}
+		if resultsOpts.Descending {
+			opts["descending"] = true
+		}
 
-	if resultsOpts.Endkey != "" {
-		opts["endkey"] = resultsOpts.Endkey
-	}
+		err := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAllDocs, opts, &vres)
+		if err != nil {
+			base.Warn("all_docs got error: %v", err)
+			return err
+		}
 
-	err := db.Bucket.ViewCustom(DesignDocSyncHousekeeping, ViewAllDocs, opts, &vres)
-	if err != nil {
-		base.Warn("all_docs got error: %v", err)
-		return err
+		rows := vres.Rows
+		if len(rows) > 0 && resumeAfter != "" && rows[0].Key == resumeAfter {
+			rows = rows[1:] // startkey is inclusive
+		}
+		for _, row := range rows {
+			if callback(IDAndRev{row.Key, row.Value.RevID, row.Value.Sequence}, row.Value.Channels) {
+				count++
+			}
+			//We have to apply limit check after callback has been called
+			//to account for rows that are not in the current users channels
+			if resultsOpts.Limit > 0 && count == resultsOpts.Limit {
+				return nil
+			}
+		}
+		if len(vres.Rows) < allDocsPageSize || len(rows) == 0 {
+			return nil
+		}
+		startKey = rows[len(rows)-1].Key
+		resumeAfter = startKey
 	}
+}
 
-	count := uint64(0)
-	for _, row := range vres.Rows {
-		if callback(IDAndRev{row.Key, row.Value.RevID, row.Value.Sequence}, row.Value.Channels) {
-			count++
+// Returns a function that tells whether the user can read a doc in any of the given channels,
+// filtering the same way _all_docs does.  Admins and users with access to "*" can read anything.
+func (db *Database) channelAccessFilter() func(channelNames []string) bool {
+	// Get the set of channels the user has access to; nil if user is admin or has access to user "*"
+	var availableChannels channels.TimedSet
+	if db.user != nil {
+		availableChannels = db.user.InheritedChannels()
+		if availableChannels.Contains(channels.UserStarChannel) {
+			availableChannels = nil
 		}
-		//We have to apply limit check after callback has been called
-		//to account for rows that are not in the current users channels
-		if resultsOpts.Limit > 0 && count == resultsOpts.Limit {
-			break
+	}
+	return func(channelNames []string) bool {
+		if availableChannels == nil {
+			return true
 		}
+		for _, channelName := range channelNames {
+			if availableChannels.Contains(channelName) {
+				return true
+			}
+		}
+		return false
 	}
-
-	return nil
 }
 
 // Returns the IDs of all users and roles
@@ -729,6 +859,34 @@ func (db *DatabaseContext) DeleteUserSessions(userName string) error {
 	return nil
 }
 
+// Returns a user's login sessions that haven't expired.
+func (db *DatabaseContext) GetUserSessions(userName string) ([]*auth.LoginSession, error) {
+	opts := Body{"stale": false}
+	opts["startkey"] = userName
+	opts["endkey"] = userName
+	vres, err := db.Bucket.View(DesignDocSyncHousekeeping, ViewSessions, opts)
+	if err != nil {
+		base.Warn("sessions view returned %v", err)
+		return nil, err
+	}
+
+	now := time.Now()
+	sessions := make([]*auth.LoginSession, 0, len(vres.Rows))
+	for _, row := range vres.Rows {
+		var session auth.LoginSession
+		if _, err := db.Bucket.Get(row.Value.(string), &session); err != nil {
+			if !base.IsDocNotFoundError(err) {
+				base.Warn("Error reading session %q: %v", row.ID, err)
+			}
+			continue
+		}
+		if session.Expiration.After(now) {
+			sessions = append(sessions, &session)
+		}
+	}
+	return sessions, nil
+}
+
 // Deletes old revisions that have been moved to individual docs
 func (db *Database) Compact() (int, error) {
 	opts := Body{"stale": false, "reduce": false}
@@ -841,6 +999,9 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 		docid := rowKey[1].(string)
 		key := realDocID(docid)
 		//base.Log("\tupdating %q", docid)
+		imported := false
+		var updatedDoc *document
+		var oldChannelStates map[string]int
 		err := db.Bucket.Update(key, 0, func(currentValue []byte) ([]byte, error) {
 			// Be careful: this block can be invoked multiple times if there are races!
 			if currentValue == nil {
@@ -851,10 +1012,11 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 				return nil, err
 			}
 
-			imported := false
+			imported = false
+			oldChannelStates = nil
 			if !doc.HasValidSyncData(db.writeSequences()) {
 				// This is a document not known to the sync gateway. Ignore or import it:
-				if !doImportDocs {
+				if !doImportDocs || !db.importAllowed(docid, doc.body) {
 					return nil, couchbase.UpdateCancel
 				}
 				imported = true
@@ -867,6 +1029,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 					return nil, couchbase.UpdateCancel
 				}
 				base.LogTo("CRUD", "\tRe-syncing document %q", docid)
+				oldChannelStates = doc.channelStates()
 			}
 
 			// Run the sync fn over each current/leaf revision, in case there are conflicts:
@@ -891,6 +1054,7 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 
 			if changed > 0 || imported {
 				base.LogTo("Access", "Saving updated channels and access grants of %q", docid)
+				updatedDoc = doc
 				return json.Marshal(doc)
 			} else {
 				return nil, couchbase.UpdateCancel
@@ -898,6 +1062,10 @@ func (db *Database) UpdateAllDocChannels(doCurrentDocs bool, doImportDocs bool)
 		})
 		if err == nil {
 			changeCount++
+			db.channelCounts.docChanged(updatedDoc, oldChannelStates)
+			if imported {
+				dbExpvars.Add("document_imports", 1)
+			}
 		} else if err != couchbase.UpdateCancel {
 			base.Warn("Error updating doc %q: %v", docid, err)
 		}
@@ -350,6 +350,131 @@ func TestAllDocs(t *testing.T) {
 	}
 }
 
+func TestForEachDocIDPaging(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	// Read the view two rows at a time, so every query below spans several pages:
+	oldPageSize := allDocsPageSize
+	allDocsPageSize = 2
+	defer func() { allDocsPageSize = oldPageSize }()
+
+	for i := 0; i < 9; i++ {
+		_, err := db.Put(fmt.Sprintf("doc%d", i), Body{"n": i})
+		assertNoError(t, err, "Couldn't create document")
+	}
+
+	docIDs := func(options ForEachDocIDOptions, accept func(docID string) bool) (ids []string) {
+		err := db.ForEachDocID(func(doc IDAndRev, channels []string) bool {
+			if !accept(doc.DocID) {
+				return false
+			}
+			ids = append(ids, doc.DocID)
+			return true
+		}, options)
+		assertNoError(t, err, "ForEachDocID failed")
+		return
+	}
+	all := func(docID string) bool { return true }
+
+	assert.DeepEquals(t, docIDs(ForEachDocIDOptions{}, all),
+		[]string{"doc0", "doc1", "doc2", "doc3", "doc4", "doc5", "doc6", "doc7", "doc8"})
+	assert.DeepEquals(t, docIDs(ForEachDocIDOptions{ResumeAfter: "doc3", Endkey: "doc6", ExclusiveEnd: true}, all),
+		[]string{"doc4", "doc5"})
+	assert.DeepEquals(t, docIDs(ForEachDocIDOptions{Startkey: "doc7", Descending: true, Limit: 4}, all),
+		[]string{"doc7", "doc6", "doc5", "doc4"})
+
+	// The limit only counts docs the callback accepts, even across pages:
+	odd := func(docID string) bool { return docID[3]%2 == 1 }
+	assert.DeepEquals(t, docIDs(ForEachDocIDOptions{Limit: 3}, odd), []string{"doc1", "doc3", "doc5"})
+}
+
+func waitForChannelCountsSeed(t *testing.T, db *Database) {
+	for i := 0; i < 100; i++ {
+		if seeding, _ := db.ChannelCountsSeeding(); !seeding {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Seeding channel counts didn't finish")
+}
+
+func seedChannelCounts(db *Database) error {
+	if err := db.channelCounts.startSeed(); err != nil {
+		return err
+	}
+	return db.channelCounts.runSeed()
+}
+
+func TestChannelCounts(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	rev1, err := db.Put("doc1", Body{"channels": []string{"A", "B"}})
+	assertNoError(t, err, "Couldn't create doc1")
+	rev2, err := db.Put("doc2", Body{"channels": []string{"A"}})
+	assertNoError(t, err, "Couldn't create doc2")
+	_, err = db.Put("doc3", Body{"channels": []string{"B"}})
+	assertNoError(t, err, "Couldn't create doc3")
+	_, err = db.Put("doc1", Body{"_rev": rev1, "channels": []string{"A"}}) // seq 4: removed from B
+	assertNoError(t, err, "Couldn't update doc1")
+	_, err = db.DeleteDoc("doc2", rev2) // seq 5: tombstone in A
+	assertNoError(t, err, "Couldn't delete doc2")
+
+	expected := []*ChannelCounts{
+		{Name: "A", Docs: 1, Tombstones: 1, Removals: 0, LastSeq: 5},
+		{Name: "B", Docs: 1, Tombstones: 0, Removals: 1, LastSeq: 4},
+	}
+
+	// The counts are the same before and after this node's changes are saved to the bucket:
+	waitForChannelCountsSeed(t, db)
+	counts, err := db.AllChannelCounts()
+	assertNoError(t, err, "AllChannelCounts failed")
+	assert.DeepEquals(t, counts, expected)
+	db.channelCounts.flush()
+	counts, err = db.AllChannelCounts()
+	assertNoError(t, err, "AllChannelCounts failed")
+	assert.DeepEquals(t, counts, expected)
+
+	// Seeding the counts from the docs in the bucket, as after an import, comes up with the same:
+	assertNoError(t, db.Bucket.Set(channelCountsKey(channelCountsShard("A")), 0, Body{}), "Couldn't clear counts")
+	assertNoError(t, seedChannelCounts(db), "Seeding counts failed")
+	counts, _ = db.AllChannelCounts()
+	assert.Equals(t, len(counts), 1) // Already seeded, so nothing changes
+	assertNoError(t, resetChannelCounts(db.Bucket), "Couldn't reset counts")
+	assertNoError(t, seedChannelCounts(db), "Seeding counts failed")
+	counts, err = db.AllChannelCounts()
+	assertNoError(t, err, "AllChannelCounts failed")
+	assert.DeepEquals(t, counts, expected)
+
+	// Changes made while seeding, which the seed also reads, are only counted once:
+	assertNoError(t, resetChannelCounts(db.Bucket), "Couldn't reset counts")
+	assertNoError(t, db.channelCounts.startSeed(), "Couldn't start seeding counts")
+	seeding, _ := db.ChannelCountsSeeding()
+	assert.True(t, seeding)
+	_, err = db.Put("doc4", Body{"channels": []string{"C"}}) // seq 6
+	assertNoError(t, err, "Couldn't create doc4")
+	assertNoError(t, db.channelCounts.runSeed(), "Seeding counts failed")
+	counts, _ = db.AllChannelCounts()
+	assert.DeepEquals(t, counts, []*ChannelCounts{expected[0], expected[1], {Name: "C", Docs: 1, LastSeq: 6}})
+	assertNoError(t, db.Purge("doc4"), "Couldn't purge doc4")
+
+	// A user only sees the channels they have access to:
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("B"))
+	authenticator.Save(user)
+	db.user, _ = authenticator.GetUser("naomi")
+	counts, err = db.ChannelCounts()
+	assertNoError(t, err, "ChannelCounts failed")
+	assert.DeepEquals(t, counts, expected[1:])
+
+	// Purging a doc takes it out of the counts:
+	assertNoError(t, db.Purge("doc3"), "Couldn't purge doc3")
+	counts, _ = db.ChannelCounts()
+	assert.DeepEquals(t, counts, []*ChannelCounts{{Name: "B", Docs: 0, Tombstones: 0, Removals: 1, LastSeq: 4}})
+}
+
 // Unit test for bug #673
 func TestUpdatePrincipal(t *testing.T) {
 
@@ -711,6 +836,61 @@ func TestImport(t *testing.T) {
 	assertNoError(t, err, "can't get doc")
 }
 
+func TestImportFilter(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.Options.ImportOptions.Filter = NewJSEventFunction(`function(doc) { return doc.type == "mobile"; }`)
+
+	db.Bucket.Add("mobile1", 0, Body{"type": "mobile"})
+	db.Bucket.Add("mobile2", 0, Body{"type": "mobile"})
+	db.Bucket.Add("server1", 0, Body{"type": "server"})
+
+	count, err := db.UpdateAllDocChannels(false, true)
+	assertNoError(t, err, "UpdateAllDocChannels")
+	assert.Equals(t, count, 2)
+
+	_, err = db.GetDoc("mobile1")
+	assertNoError(t, err, "can't get imported doc")
+	_, err = db.GetDoc("server1")
+	assertHTTPError(t, err, 404)
+}
+
+func TestImportOnDemand(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.Options.ImportOptions.OnDemand = true
+	db.Options.ImportOptions.Filter = NewJSEventFunction(`function(doc) { return doc._id.indexOf("private") != 0; }`)
+
+	db.Bucket.Add("sdkDoc1", 0, Body{"key1": 1})
+	db.Bucket.Add("sdkDoc2", 0, Body{"key1": 2})
+	db.Bucket.Add("private1", 0, Body{"key1": 3})
+
+	// Internal reads don't import a doc, but client reads do:
+	_, err := db.GetDoc("sdkDoc1")
+	assertHTTPError(t, err, 404)
+	body, err := db.Get("sdkDoc1")
+	assertNoError(t, err, "can't get doc body")
+	assert.Equals(t, body["key1"], float64(1))
+	doc, err := db.GetDoc("sdkDoc1")
+	assertNoError(t, err, "can't get imported doc")
+	assert.True(t, doc.CurrentRev != "")
+
+	// Updating a doc imports it, then applies the update as a new revision:
+	_, err = db.Put("sdkDoc2", Body{"key1": 20})
+	assertHTTPError(t, err, 409) // conflicts with the imported revision
+	doc, err = db.GetDoc("sdkDoc2")
+	assertNoError(t, err, "can't get doc")
+	rev2, err := db.Put("sdkDoc2", Body{"_rev": doc.CurrentRev, "key1": 20})
+	assertNoError(t, err, "can't update imported doc")
+	assert.Equals(t, rev2[:2], "2-")
+
+	// Docs the filter rejects aren't imported:
+	_, err = db.Get("private1")
+	assertHTTPError(t, err, 404)
+	_, err = db.Put("private1", Body{"key1": 30})
+	assertHTTPError(t, err, 409)
+}
+
 func TestPostWithExistingId(t *testing.T) {
 	db := setupTestDB(t)
 	defer tearDownTestDB(t, db)
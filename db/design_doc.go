@@ -15,6 +15,7 @@ type DesignDoc sgbucket.DesignDoc
 const (
 	DesignDocSyncGateway      = "sync_gateway"
 	DesignDocSyncHousekeeping = "sync_housekeeping"
+	DesignDocSyncFind         = "sync_find"
 	ViewPrincipals            = "principals"
 	ViewChannels              = "channels"
 	ViewAccess                = "access"
@@ -25,6 +26,7 @@ const (
 	ViewImport                = "import"
 	ViewOldRevs               = "old_revs"
 	ViewSessions              = "sessions"
+	ViewTombstones            = "tombstones"
 )
 
 func isInternalDDoc(ddocName string) bool {
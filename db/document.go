@@ -35,8 +35,9 @@ type syncData struct {
 	Expiry          *time.Time          `json:"exp,omitempty"` // Document expiry.  Information only - actual expiry/delete handling is done by bucket storage.  Needs to be pointer for omitempty to work (see https://github.com/golang/go/issues/4357)
 
 	// Fields used by bucket-shadowing:
-	UpstreamCAS *uint64 `json:"upstream_cas,omitempty"` // CAS value of remote doc
-	UpstreamRev string  `json:"upstream_rev,omitempty"` // Rev ID remote doc was saved as
+	UpstreamCAS    *uint64 `json:"upstream_cas,omitempty"`    // CAS value of remote doc
+	UpstreamRev    string  `json:"upstream_rev,omitempty"`    // Rev ID remote doc was saved as
+	UpstreamDigest string  `json:"upstream_digest,omitempty"` // Digest of remote doc's body
 
 	// Only used for performance metrics:
 	TimeSaved time.Time `json:"time_saved,omitempty"` // Timestamp of save.
@@ -0,0 +1,369 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Version of the export format written by ExportDatabase
+const kExportFormat = 1
+
+// Number of keys read from the all_bits view at a time while exporting
+const kExportPageSize = 1000
+
+// How often (in records) an import saves its progress
+const kImportCheckpointInterval = 1000
+
+// Key of the doc that records the progress of an import, so it can be resumed
+const kImportStateKey = "_sync:import"
+
+// Types of records in an export
+const (
+	ExportHeader     = "header"     // First record: format and last sequence of the source db
+	ExportDoc        = "doc"        // A document, with its sync metadata
+	ExportOldRev     = "rev"        // The body of a non-current revision of a document
+	ExportAttachment = "attachment" // An attachment's data
+	ExportLocal      = "local"      // A _local doc, such as a replication checkpoint
+	ExportUser       = "user"
+	ExportRole       = "role"
+	ExportAPIKey     = "apikey" // An API key, or a user's list of them
+	ExportEnd        = "end"    // Last record: the source db's last sequence, at the end
+)
+
+// A line of an NDJSON database export.
+type ExportRecord struct {
+	Type    string          `json:"type"`
+	Key     string          `json:"key,omitempty"`      // Bucket key
+	Value   json.RawMessage `json:"value,omitempty"`    // Value, if it's JSON
+	Data    []byte          `json:"data,omitempty"`     // Value, if it isn't JSON (base64-encoded)
+	Format  int             `json:"format,omitempty"`   // Header only
+	Source  string          `json:"source,omitempty"`   // Header only: name of the source bucket
+	LastSeq uint64          `json:"last_seq,omitempty"` // Header & end: source db's last sequence
+}
+
+// Options for ExportDatabase.
+type ExportOptions struct {
+	After string // Resumes an earlier export that got as far as this key
+}
+
+// The progress of an import, saved in the target bucket.  The export's source and last sequence,
+// from its header, identify which export it is.
+type importState struct {
+	Offset  uint64 `json:"offset"`           // Amount sequences are shifted by
+	Source  string `json:"source,omitempty"` // Source bucket of the export
+	LastSeq uint64 `json:"last_seq"`         // Last source sequence reserved for
+	Applied int    `json:"applied"`          // Number of records applied so far
+}
+
+// Returns the type of export record a bucket key goes in, or "" if it isn't exported.  Sessions,
+// sequence counters and other housekeeping docs aren't exported.
+func exportRecordType(key string) string {
+	switch {
+	case !strings.HasPrefix(key, KSyncKeyPrefix):
+		return ExportDoc
+	case strings.HasPrefix(key, "_sync:rev:"):
+		return ExportOldRev
+	case strings.HasPrefix(key, "_sync:att:"):
+		return ExportAttachment
+	case strings.HasPrefix(key, "_sync:local:"):
+		return ExportLocal
+	case strings.HasPrefix(key, auth.UserKeyPrefix):
+		return ExportUser
+	case strings.HasPrefix(key, auth.RoleKeyPrefix):
+		return ExportRole
+	case strings.HasPrefix(key, auth.APIKeyKeyPrefix), strings.HasPrefix(key, auth.APIKeyListKeyPrefix):
+		return ExportAPIKey
+	}
+	return ""
+}
+
+// Writes the documents of the database in a bucket -- with their sync metadata and old revisions
+// -- and its attachments, users, roles and _local docs, as NDJSON ExportRecords.  The database
+// shouldn't be in use.  Returns the number of records written.
+func ExportDatabase(bucket base.Bucket, w io.Writer, options ExportOptions) (int, error) {
+	encoder := json.NewEncoder(w)
+	count := 0
+	if options.After == "" {
+		lastSeq, err := bucket.Incr(kSyncSeqKey, 0, 0, 0)
+		if err != nil {
+			return count, err
+		}
+		header := ExportRecord{Type: ExportHeader, Format: kExportFormat, Source: bucket.GetName(), LastSeq: lastSeq}
+		if err := encoder.Encode(header); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	startKey := options.After
+	for {
+		opts := Body{"stale": false, "limit": kExportPageSize}
+		if startKey != "" {
+			opts["startkey"] = startKey
+		}
+		vres, err := bucket.View(DesignDocSyncHousekeeping, ViewAllBits, opts)
+		if err != nil {
+			return count, err
+		}
+		rows := vres.Rows
+		if len(rows) > 0 && rows[0].ID == startKey {
+			rows = rows[1:] // startkey is inclusive
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			record, err := exportKey(bucket, row.ID)
+			if err != nil {
+				return count, err
+			} else if record == nil {
+				continue
+			}
+			if err := encoder.Encode(record); err != nil {
+				return count, err
+			}
+			count++
+		}
+		startKey = rows[len(rows)-1].ID
+	}
+
+	lastSeq, err := bucket.Incr(kSyncSeqKey, 0, 0, 0)
+	if err != nil {
+		return count, err
+	}
+	if err := encoder.Encode(ExportRecord{Type: ExportEnd, LastSeq: lastSeq}); err != nil {
+		return count, err
+	}
+	count++
+	base.Logf("Exported %d records", count)
+	return count, nil
+}
+
+// Reads a bucket key into an ExportRecord, or returns nil if it isn't exported.
+func exportKey(bucket base.Bucket, key string) (*ExportRecord, error) {
+	recordType := exportRecordType(key)
+	if recordType == "" {
+		return nil, nil
+	}
+	value, _, err := bucket.GetRaw(key)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	record := &ExportRecord{Type: recordType, Key: key}
+	var jsonValue json.RawMessage
+	if recordType != ExportAttachment && json.Unmarshal(value, &jsonValue) == nil {
+		record.Value = jsonValue
+	} else {
+		record.Data = value
+	}
+	return record, nil
+}
+
+// Reads ExportRecords written by ExportDatabase into a bucket.  Sequences are shifted past any
+// the bucket has already allocated, so the target can be a new bucket (where they're unchanged)
+// or one already holding docs.  An import of the same export that was interrupted is resumed;
+// an interrupted import of a different export is abandoned, and this one starts from the top.
+// Returns the number of records applied.
+func ImportDatabase(bucket base.Bucket, r io.Reader) (int, error) {
+	var state importState
+	count := 0
+	resuming := false
+	if _, err := bucket.Get(kImportStateKey, &state); err == nil {
+		resuming = true
+	} else if !base.IsDocNotFoundError(err) {
+		return 0, err
+	}
+
+	// If the import fails, saves how far it got so it can be resumed
+	failed := func(err error) (int, error) {
+		if state.Applied > 0 {
+			bucket.Set(kImportStateKey, 0, state)
+		}
+		return count, err
+	}
+
+	decoder := json.NewDecoder(r)
+	for n := 0; ; n++ {
+		var record ExportRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			return failed(errors.New("Export ends without an end record; it may be incomplete"))
+		} else if err != nil {
+			return failed(err)
+		}
+
+		if n == 0 {
+			if record.Type != ExportHeader {
+				return count, errors.New("Export doesn't start with a header record")
+			} else if record.Format != kExportFormat {
+				return count, fmt.Errorf("Unsupported export format %d", record.Format)
+			}
+			if resuming && (record.Source != state.Source || record.LastSeq != state.LastSeq) {
+				base.Warn("Abandoning interrupted import of a different export (source %q, last_seq %d)",
+					state.Source, state.LastSeq)
+				state = importState{}
+				resuming = false
+			} else if resuming {
+				base.Logf("Resuming import after %d records", state.Applied)
+			}
+			if !resuming {
+				// Reserve a block of sequences for the imported ones, after the bucket's own:
+				if record.LastSeq > 0 {
+					max, err := bucket.Incr(kSyncSeqKey, record.LastSeq, record.LastSeq, 0)
+					if err != nil {
+						return count, err
+					}
+					state.Offset = max - record.LastSeq
+				}
+				state.Source = record.Source
+				state.LastSeq = record.LastSeq
+				if err := bucket.Set(kImportStateKey, 0, state); err != nil {
+					return count, err
+				}
+			}
+			continue
+		} else if record.Type == ExportEnd {
+			if extra := record.LastSeq - state.LastSeq; record.LastSeq > state.LastSeq {
+				// The source allocated more sequences during the export:
+				if _, err := bucket.Incr(kSyncSeqKey, extra, extra, 0); err != nil {
+					return count, err
+				}
+			}
+			base.Logf("Imported %d records", count)
+			if err := resetChannelCounts(bucket); err != nil {
+				return count, err
+			}
+			return count, bucket.Delete(kImportStateKey)
+		} else if n <= state.Applied {
+			continue // Already applied before the import was interrupted
+		}
+
+		if err := importRecord(bucket, &record, state.Offset); err != nil {
+			return failed(fmt.Errorf("Error importing %q: %v", record.Key, err))
+		}
+		count++
+		state.Applied = n
+		if n%kImportCheckpointInterval == 0 {
+			if err := bucket.Set(kImportStateKey, 0, state); err != nil {
+				return count, err
+			}
+		}
+	}
+}
+
+// Writes a record to the bucket, shifting its sequences by offset.
+func importRecord(bucket base.Bucket, record *ExportRecord, offset uint64) (err error) {
+	value := []byte(record.Value)
+	if value == nil {
+		value = record.Data
+	}
+	switch record.Type {
+	case ExportDoc:
+		if offset > 0 && record.Value != nil {
+			var doc *document
+			if doc, err = unmarshalDocument(record.Key, value); err != nil {
+				return err
+			} else if doc.Sequence > 0 {
+				doc.shiftSequences(offset)
+				value, err = json.Marshal(doc)
+			}
+		}
+	case ExportUser, ExportRole:
+		if offset > 0 {
+			value, err = shiftPrincipalSequences(value, offset)
+		}
+	case ExportOldRev, ExportAttachment, ExportLocal, ExportAPIKey:
+	default:
+		return fmt.Errorf("Unknown export record type %q", record.Type)
+	}
+	if err != nil {
+		return err
+	}
+	return bucket.SetRaw(record.Key, 0, value)
+}
+
+// Zero sequences mean "none", so they aren't shifted.
+func shiftSequence(seq uint64, offset uint64) uint64 {
+	if seq == 0 {
+		return 0
+	}
+	return seq + offset
+}
+
+func shiftTimedSet(set channels.TimedSet, offset uint64) {
+	for name, vbSeq := range set {
+		vbSeq.Sequence = shiftSequence(vbSeq.Sequence, offset)
+		set[name] = vbSeq
+	}
+}
+
+// Shifts every sequence in the doc's sync metadata by offset.
+func (doc *document) shiftSequences(offset uint64) {
+	doc.Sequence = shiftSequence(doc.Sequence, offset)
+	for i, seq := range doc.UnusedSequences {
+		doc.UnusedSequences[i] = shiftSequence(seq, offset)
+	}
+	for i, seq := range doc.RecentSequences {
+		doc.RecentSequences[i] = shiftSequence(seq, offset)
+	}
+	for _, removal := range doc.Channels {
+		if removal != nil {
+			removal.Seq = shiftSequence(removal.Seq, offset)
+		}
+	}
+	for _, set := range doc.Access {
+		shiftTimedSet(set, offset)
+	}
+	for _, set := range doc.RoleAccess {
+		shiftTimedSet(set, offset)
+	}
+}
+
+// The properties of user and role docs that are TimedSets.
+var kPrincipalTimedSets = []string{"admin_channels", "all_channels", "previous_channels",
+	"explicit_roles", "rolesSince", "jwt_roles", "jwt_channels"}
+
+// Shifts the sequences in the JSON of a user or role by offset.
+func shiftPrincipalSequences(data []byte, offset uint64) ([]byte, error) {
+	var principal map[string]json.RawMessage
+	if err := json.Unmarshal(data, &principal); err != nil {
+		return nil, err
+	}
+	if raw := principal["sequence"]; raw != nil {
+		var seq uint64
+		if err := json.Unmarshal(raw, &seq); err != nil {
+			return nil, err
+		}
+		principal["sequence"], _ = json.Marshal(shiftSequence(seq, offset))
+	}
+	for _, property := range kPrincipalTimedSets {
+		if raw := principal[property]; raw != nil {
+			var set channels.TimedSet
+			if err := json.Unmarshal(raw, &set); err != nil {
+				return nil, err
+			} else if set != nil {
+				shiftTimedSet(set, offset)
+				principal[property], _ = json.Marshal(set)
+			}
+		}
+	}
+	return json.Marshal(principal)
+}
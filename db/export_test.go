@@ -0,0 +1,150 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func makeImportBucket(name string) base.Bucket {
+	bucket, err := ConnectToBucket(base.BucketSpec{
+		Server:     kTestURL,
+		BucketName: name}, nil)
+	if err != nil {
+		log.Fatalf("Couldn't connect to bucket: %v", err)
+	}
+	return bucket
+}
+
+// Creates a db with a doc with an attachment, a user and a _local doc, and exports it.
+func exportTestDB(t *testing.T) (*Database, []byte) {
+	db := setupTestDB(t)
+	_, err := db.Put("doc1", Body{"channels": []string{"ABC"}})
+	assertNoError(t, err, "Put")
+	_, err = db.Put("doc2", unjson(`{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ="}}}`))
+	assertNoError(t, err, "Put")
+	_, err = db.putSpecial("local", "checkpoint", "", Body{"seq": 2})
+	assertNoError(t, err, "putSpecial")
+	name, password := "naomi", "letmein"
+	_, err = db.UpdatePrincipal(PrincipalConfig{Name: &name, Password: &password, ExplicitChannels: base.SetOf("ABC")}, true, true)
+	assertNoError(t, err, "UpdatePrincipal")
+
+	var out bytes.Buffer
+	count, err := ExportDatabase(db.Bucket, &out, ExportOptions{})
+	assertNoError(t, err, "ExportDatabase")
+	assert.Equals(t, count, strings.Count(out.String(), "\n"))
+	return db, out.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	db, export := exportTestDB(t)
+	defer tearDownTestDB(t, db)
+
+	var types []string
+	for _, line := range strings.Split(strings.TrimSpace(string(export)), "\n") {
+		var record ExportRecord
+		assertNoError(t, json.Unmarshal([]byte(line), &record), "Unmarshal record")
+		types = append(types, record.Type)
+	}
+	assert.Equals(t, types[0], ExportHeader)
+	assert.Equals(t, types[len(types)-1], ExportEnd)
+	for _, recordType := range []string{ExportDoc, ExportAttachment, ExportLocal, ExportUser} {
+		assert.True(t, strings.Contains(strings.Join(types, ","), recordType))
+	}
+
+	// Importing into a new bucket reproduces the db as-is:
+	target := makeImportBucket("import_new")
+	defer target.Close()
+	count, err := ImportDatabase(target, bytes.NewReader(export))
+	assertNoError(t, err, "ImportDatabase")
+	assert.Equals(t, count, len(types)-2)
+	for _, key := range []string{"doc1", "doc2", "_sync:local:checkpoint", "_sync:user:naomi"} {
+		source, _, _ := db.Bucket.GetRaw(key)
+		imported, _, err := target.GetRaw(key)
+		assertNoError(t, err, "GetRaw")
+		assert.Equals(t, string(imported), string(source))
+	}
+	lastSeq, _ := db.Bucket.Incr(kSyncSeqKey, 0, 0, 0)
+	targetSeq, _ := target.Incr(kSyncSeqKey, 0, 0, 0)
+	assert.Equals(t, targetSeq, lastSeq)
+	_, _, err = target.GetRaw(kImportStateKey)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// Importing into a bucket that has allocated sequences shifts them:
+	target = makeImportBucket("import_shifted")
+	defer target.Close()
+	target.Incr(kSyncSeqKey, 100, 100, 0)
+	_, err = ImportDatabase(target, bytes.NewReader(export))
+	assertNoError(t, err, "ImportDatabase")
+	sourceDoc, _ := db.GetDoc("doc1")
+	raw, _, _ := target.GetRaw("doc1")
+	importedDoc, _ := unmarshalDocument("doc1", raw)
+	assert.Equals(t, importedDoc.Sequence, sourceDoc.Sequence+100)
+	assert.Equals(t, importedDoc.CurrentRev, sourceDoc.CurrentRev)
+	var user struct {
+		Sequence uint64 `json:"sequence"`
+	}
+	target.Get("_sync:user:naomi", &user)
+	assert.Equals(t, user.Sequence, lastSeq+100)
+	targetSeq, _ = target.Incr(kSyncSeqKey, 0, 0, 0)
+	assert.Equals(t, targetSeq, lastSeq+100)
+}
+
+func TestResumeExportImport(t *testing.T) {
+	db, export := exportTestDB(t)
+	defer tearDownTestDB(t, db)
+	lines := strings.SplitAfter(string(export), "\n")
+
+	// Resuming after a key writes the records after it:
+	var record ExportRecord
+	json.Unmarshal([]byte(lines[2]), &record)
+	var out bytes.Buffer
+	_, err := ExportDatabase(db.Bucket, &out, ExportOptions{After: record.Key})
+	assertNoError(t, err, "ExportDatabase")
+	assert.Equals(t, out.String(), strings.Join(lines[3:], ""))
+
+	// An incomplete import fails, and a later one resumes where it stopped:
+	target := makeImportBucket("import_resumed")
+	defer target.Close()
+	_, err = ImportDatabase(target, strings.NewReader(strings.Join(lines[:3], "")))
+	assert.True(t, err != nil)
+	count, err := ImportDatabase(target, bytes.NewReader(export))
+	assertNoError(t, err, "ImportDatabase")
+	assert.Equals(t, count, len(lines)-1-4) // The last "line" is empty
+}
+
+func TestImportAbandonsDifferentExport(t *testing.T) {
+	db, export := exportTestDB(t)
+	defer tearDownTestDB(t, db)
+	lines := strings.SplitAfter(string(export), "\n")
+
+	// Another export of the same db, taken later, has a different header:
+	var header ExportRecord
+	json.Unmarshal([]byte(lines[0]), &header)
+	header.LastSeq += 5
+	headerJSON, _ := json.Marshal(header)
+	other := string(headerJSON) + "\n" + strings.Join(lines[1:], "")
+
+	// An interrupted import of the first export isn't resumed by importing the other one:
+	target := makeImportBucket("import_different")
+	defer target.Close()
+	_, err := ImportDatabase(target, strings.NewReader(strings.Join(lines[:3], "")))
+	assert.True(t, err != nil)
+	count, err := ImportDatabase(target, strings.NewReader(other))
+	assertNoError(t, err, "ImportDatabase")
+	assert.Equals(t, count, len(lines)-1-2) // The last "line" is empty
+}
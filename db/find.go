@@ -0,0 +1,774 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Default number of docs returned by a _find query that doesn't specify a limit
+const kDefaultFindLimit = 25
+
+// Warning returned with _find results that had to be computed by scanning every document
+const kFindNoIndexWarning = "no matching index found, create an index to optimize query time"
+
+// A secondary index used by _find queries, as declared in the database config.  Each index is
+// a view in the sync_find design doc whose keys are the values of the indexed fields; documents
+// that are missing any of the fields aren't indexed.
+type QueryIndexDef struct {
+	Name   string   `json:"name"`   // Index name, also used as the view name
+	Fields []string `json:"fields"` // Indexed fields, as dot-separated property paths
+}
+
+// A Mango-style query, as POSTed to the _find endpoint.
+type FindQuery struct {
+	Selector map[string]interface{} `json:"selector"`            // Conditions a doc must match
+	Fields   []string               `json:"fields,omitempty"`    // Fields to return; all if empty
+	Sort     []interface{}          `json:"sort,omitempty"`      // Field names, or {field: "asc"|"desc"} objects
+	Limit    *int                   `json:"limit,omitempty"`     // Max number of docs to return
+	Skip     int                    `json:"skip,omitempty"`      // Number of matching docs to skip
+	UseIndex string                 `json:"use_index,omitempty"` // Name of the index to use
+}
+
+// The response to a _find query.
+type FindResult struct {
+	Docs    []Body `json:"docs"`
+	Warning string `json:"warning,omitempty"`
+}
+
+// Validates the query index definitions from the config and installs the sync_find design doc
+// that backs them.
+func installQueryIndexes(bucket base.Bucket, indexes []*QueryIndexDef) error {
+	designDoc := sgbucket.DesignDoc{Views: sgbucket.ViewMap{}}
+	for _, index := range indexes {
+		if index == nil || index.Name == "" {
+			return fmt.Errorf("Query indexes must have a name")
+		} else if _, exists := designDoc.Views[index.Name]; exists {
+			return fmt.Errorf("Duplicate query index name %q", index.Name)
+		} else if len(index.Fields) == 0 {
+			return fmt.Errorf("Query index %q has no fields", index.Name)
+		}
+		paths := make([][]string, len(index.Fields))
+		for i, field := range index.Fields {
+			if paths[i] = fieldPath(field); paths[i] == nil {
+				return fmt.Errorf("Query index %q has an invalid field %q", index.Name, field)
+			}
+		}
+		pathsJSON, _ := json.Marshal(paths)
+
+		// Key is the array of indexed field values; value is {rev, sequence, channels} like all_docs
+		designDoc.Views[index.Name] = sgbucket.ViewDef{Map: `function (doc, meta) {
+                     var sync = doc._sync;
+                     if (sync === undefined || meta.id.substring(0,6) == "_sync:")
+                       return;
+                     if ((sync.flags & 1) || sync.deleted)
+                       return;
+                     var paths = ` + string(pathsJSON) + `;
+                     var key = [];
+                     for (var i = 0; i < paths.length; i++) {
+                       var value = doc;
+                       for (var j = 0; j < paths[i].length; j++) {
+                         if (value === null || typeof value !== "object" || !(paths[i][j] in value))
+                           return;
+                         value = value[paths[i][j]];
+                       }
+                       key.push(value);
+                     }
+                     var channels = sync.channels;
+                     var channelNames = [];
+                     for (ch in channels) {
+                     	if (channels[ch] == null)
+                     		channelNames.push(ch);
+                     }
+                     emit(key, {r:sync.rev, s:sync.sequence, c:channelNames}); }`}
+	}
+
+	sleeper := base.CreateDoublingSleeperFunc(
+		11, //MaxNumRetries approx 10 seconds total retry duration
+		5,  //InitialRetrySleepTimeMS
+	)
+	worker := func() (shouldRetry bool, err error, value interface{}) {
+		err = bucket.PutDDoc(DesignDocSyncFind, designDoc)
+		if err != nil {
+			base.Warn("Error installing Couchbase design doc: %v", err)
+		}
+		return err != nil, err, nil
+	}
+	description := fmt.Sprintf("Attempt to install Couchbase design doc bucket : %v", DesignDocSyncFind)
+	err, _ := base.RetryLoop(description, worker, sleeper)
+	return err
+}
+
+// Runs a _find query.  Results are filtered by the user's channel access exactly as _all_docs
+// filters them: docs the user can't see are silently skipped.
+func (db *Database) Find(query FindQuery) (*FindResult, error) {
+	selector, err := parseFindSelector(query.Selector)
+	if err != nil {
+		return nil, err
+	}
+	sortFields, err := parseFindSort(query.Sort)
+	if err != nil {
+		return nil, err
+	}
+	limit := kDefaultFindLimit
+	if query.Limit != nil {
+		limit = *query.Limit
+	}
+	if limit < 0 || query.Skip < 0 {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "limit and skip must be non-negative")
+	}
+
+	index, err := db.chooseQueryIndex(selector, query.UseIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	canSee := db.channelAccessFilter()
+
+	// If the index order already satisfies the sort, results can be returned as they're found:
+	descending := false
+	sortedByIndex := len(sortFields) == 0
+	if index != nil && !sortedByIndex {
+		sortedByIndex, descending = index.satisfiesSort(sortFields)
+	}
+	wanted := -1
+	if sortedByIndex {
+		wanted = query.Skip + limit
+	}
+
+	var docs []Body
+	addDoc := func(docID string, channelNames []string) bool {
+		if !canSee(channelNames) {
+			return false
+		}
+		body, channelSet, _, _, _, _, err := db.GetRevAndChannels(docID, "", false)
+		if err != nil || body["_removed"] != nil {
+			return false
+		}
+		var current []string
+		for channelName, removal := range channelSet {
+			if removal == nil {
+				current = append(current, channelName)
+			}
+		}
+		if !canSee(current) || !selector.matches(map[string]interface{}(body)) {
+			return false
+		}
+		docs = append(docs, body)
+		return true
+	}
+
+	result := &FindResult{}
+	if index != nil {
+		if err = db.scanQueryIndex(index, descending, wanted, addDoc); err != nil {
+			return nil, err
+		}
+	} else {
+		result.Warning = kFindNoIndexWarning
+		options := ForEachDocIDOptions{}
+		if wanted >= 0 {
+			options.Limit = uint64(wanted)
+		}
+		err = db.ForEachDocID(func(doc IDAndRev, channelNames []string) bool {
+			return addDoc(doc.DocID, channelNames)
+		}, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !sortedByIndex {
+		sort.Stable(findSorter{docs: docs, fields: sortFields})
+	}
+	if query.Skip >= len(docs) {
+		docs = nil
+	} else {
+		docs = docs[query.Skip:]
+	}
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+
+	result.Docs = make([]Body, 0, len(docs))
+	for _, body := range docs {
+		if len(query.Fields) > 0 {
+			body = projectFindFields(body, query.Fields)
+		}
+		result.Docs = append(result.Docs, body)
+	}
+	return result, nil
+}
+
+//////// INDEX SELECTION:
+
+// A query index chosen to run a query, with the key range to scan.
+type findIndexPlan struct {
+	def      *QueryIndexDef
+	startKey []interface{}
+	endKey   []interface{}
+	eqPrefix int // Number of leading index fields constrained to a single value
+}
+
+// Picks the index that best narrows the query, or nil if none can be used.  An index can only be
+// used if every one of its fields is required to exist by the selector; otherwise docs missing
+// one of the fields would be wrongly left out of the results.
+func (db *Database) chooseQueryIndex(selector *findSelector, useIndex string) (*findIndexPlan, error) {
+	var best *findIndexPlan
+	bestScore := 0
+	for _, def := range db.Options.QueryIndexes {
+		if useIndex != "" && def.Name != useIndex {
+			continue
+		}
+		plan, score := planQueryIndex(def, selector)
+		if useIndex != "" {
+			if plan == nil {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Index %q can't be used for this selector", useIndex)
+			}
+			return plan, nil
+		}
+		if plan != nil && score > bestScore {
+			best, bestScore = plan, score
+		}
+	}
+	if useIndex != "" {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "No such index %q", useIndex)
+	}
+	return best, nil
+}
+
+// Works out the key range of an index to scan for a selector.  Returns a nil plan if the index
+// can't be used, otherwise a score that's higher the more of the key range is constrained.
+func planQueryIndex(def *QueryIndexDef, selector *findSelector) (*findIndexPlan, int) {
+	for _, field := range def.Fields {
+		if !selector.requiresField(field) {
+			return nil, 0
+		}
+	}
+	plan := &findIndexPlan{def: def, startKey: []interface{}{}}
+	for _, field := range def.Fields {
+		value, ok := selector.equalityValue(field)
+		if !ok {
+			break
+		}
+		plan.startKey = append(plan.startKey, value)
+		plan.eqPrefix++
+	}
+	plan.endKey = append([]interface{}{}, plan.startKey...)
+	score := 2 * plan.eqPrefix
+
+	// The first field that isn't an equality match may still restrict the range.  An end key
+	// that stops short of the last field gets {} appended, which collates after everything, so
+	// that longer keys with the same prefix are still in range.
+	if plan.eqPrefix < len(def.Fields) {
+		low, high := selector.rangeValues(def.Fields[plan.eqPrefix])
+		if low != nil {
+			plan.startKey = append(plan.startKey, *low)
+			score++
+		}
+		if high != nil {
+			plan.endKey = append(plan.endKey, *high)
+			score++
+		}
+		if len(plan.endKey) < len(def.Fields) {
+			plan.endKey = append(plan.endKey, map[string]interface{}{})
+		}
+	}
+	return plan, score
+}
+
+// Returns whether scanning the index returns docs in the order the sort asks for, and if so
+// whether the scan needs to be descending.  Sorting by a field pinned to a single value by the
+// selector is a no-op; the remaining sort fields have to follow the pinned ones in the index,
+// all in the same direction.
+func (plan *findIndexPlan) satisfiesSort(sortFields []findSortField) (ok bool, descending bool) {
+	fields := plan.def.Fields
+	pos := plan.eqPrefix
+	for _, sortField := range sortFields {
+		if plan.isPinned(sortField.field) {
+			continue
+		}
+		if pos >= len(fields) || fields[pos] != sortField.field {
+			return false, false
+		} else if pos > plan.eqPrefix && sortField.descending != descending {
+			return false, false
+		}
+		descending = sortField.descending
+		pos++
+	}
+	return true, descending
+}
+
+func (plan *findIndexPlan) isPinned(field string) bool {
+	for _, pinned := range plan.def.Fields[:plan.eqPrefix] {
+		if pinned == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Queries an index view and calls the callback for every row in the plan's key range, until
+// 'wanted' callbacks have returned true (or forever if wanted is negative).  The view is read a
+// page at a time; since many docs can share a key, each page starts after the last row's key and
+// doc ID.
+func (db *Database) scanQueryIndex(plan *findIndexPlan, descending bool, wanted int, callback func(docID string, channelNames []string) bool) error {
+	type viewRow struct {
+		ID    string      `json:"id"`
+		Key   interface{} `json:"key"`
+		Value struct {
+			Channels []string `json:"c"`
+		} `json:"value"`
+	}
+	startKey, endKey := plan.startKey, plan.endKey
+	if descending {
+		startKey, endKey = endKey, startKey
+	}
+	var last *viewRow
+	lastKeyRows := 0 // Rows read so far with the last row's key
+	found := 0
+	for {
+		// Views that ignore startkey_docid return the key's earlier rows again, so leave room
+		// for them:
+		limit := allDocsPageSize + lastKeyRows
+		opts := Body{"stale": false, "reduce": false, "startkey": startKey, "endkey": endKey, "limit": limit}
+		if descending {
+			opts["descending"] = true
+		}
+		if last != nil {
+			opts["startkey"] = last.Key
+			opts["startkey_docid"] = last.ID
+		}
+		var vres struct {
+			Rows []viewRow `json:"rows"`
+		}
+		if err := db.Bucket.ViewCustom(DesignDocSyncFind, plan.def.Name, opts, &vres); err != nil {
+			base.Warn("Error querying index %q: %v", plan.def.Name, err)
+			return err
+		}
+		base.LogTo("Query", "Index %q returned %d rows", plan.def.Name, len(vres.Rows))
+
+		// startkey is inclusive, and rows with the same key are ordered by doc ID:
+		rows := vres.Rows
+		for last != nil && len(rows) > 0 && reflect.DeepEqual(rows[0].Key, last.Key) &&
+			(rows[0].ID == last.ID || (rows[0].ID < last.ID) != descending) {
+			rows = rows[1:]
+		}
+		for _, row := range rows {
+			if wanted >= 0 && found >= wanted {
+				return nil
+			}
+			if callback(row.ID, row.Value.Channels) {
+				found++
+			}
+		}
+		if (wanted >= 0 && found >= wanted) || len(vres.Rows) < limit || len(rows) == 0 {
+			return nil
+		}
+
+		next := &rows[len(rows)-1]
+		sameKey := 0
+		for i := len(rows) - 1; i >= 0 && reflect.DeepEqual(rows[i].Key, next.Key); i-- {
+			sameKey++
+		}
+		if last != nil && reflect.DeepEqual(next.Key, last.Key) {
+			lastKeyRows += sameKey
+		} else {
+			lastKeyRows = sameKey
+		}
+		last = next
+	}
+}
+
+//////// SELECTORS:
+
+// A parsed selector.  Every node is either a boolean combination of child selectors, or a
+// condition on a single field.
+type findSelector struct {
+	op       string          // "$and", "$or", "$not", or a field operator like "$eq"
+	children []*findSelector // Operands of $and, $or, $not
+	field    string          // Field the condition applies to
+	path     []string        // Field, split into property names
+	arg      interface{}     // Operator argument
+	regexp   *regexp.Regexp  // Compiled $regex argument
+}
+
+func parseFindSelector(selector map[string]interface{}) (*findSelector, error) {
+	if selector == nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Missing selector")
+	}
+	result := &findSelector{op: "$and"}
+	for key, value := range selector {
+		switch key {
+		case "$and", "$or":
+			operands, ok := value.([]interface{})
+			if !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "%s requires an array", key)
+			}
+			node := &findSelector{op: key}
+			for _, operand := range operands {
+				operandMap, ok := operand.(map[string]interface{})
+				if !ok {
+					return nil, base.HTTPErrorf(http.StatusBadRequest, "%s requires an array of objects", key)
+				}
+				child, err := parseFindSelector(operandMap)
+				if err != nil {
+					return nil, err
+				}
+				node.children = append(node.children, child)
+			}
+			result.children = append(result.children, node)
+		case "$not":
+			operand, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "$not requires an object")
+			}
+			child, err := parseFindSelector(operand)
+			if err != nil {
+				return nil, err
+			}
+			result.children = append(result.children, &findSelector{op: "$not", children: []*findSelector{child}})
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Unknown selector operator %q", key)
+			}
+			node, err := parseFieldCondition(key, value)
+			if err != nil {
+				return nil, err
+			}
+			result.children = append(result.children, node)
+		}
+	}
+	return result, nil
+}
+
+// Parses the condition on a field: either an object of operators, or a value to match exactly.
+func parseFieldCondition(field string, value interface{}) (*findSelector, error) {
+	path := fieldPath(field)
+	if path == nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid field %q", field)
+	}
+	operators, ok := value.(map[string]interface{})
+	if !ok || !isOperatorObject(operators) {
+		return &findSelector{op: "$eq", field: field, path: path, arg: value}, nil
+	}
+	result := &findSelector{op: "$and"}
+	for op, arg := range operators {
+		node := &findSelector{op: op, field: field, path: path, arg: arg}
+		switch op {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		case "$in", "$nin":
+			if _, ok := arg.([]interface{}); !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "%s requires an array", op)
+			}
+		case "$exists":
+			if _, ok := arg.(bool); !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "$exists requires a boolean")
+			}
+		case "$regex":
+			pattern, ok := arg.(string)
+			if !ok {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "$regex requires a string")
+			}
+			var err error
+			if node.regexp, err = regexp.Compile(pattern); err != nil {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid $regex: %v", err)
+			}
+		case "$not":
+			child, err := parseFieldCondition(field, arg)
+			if err != nil {
+				return nil, err
+			}
+			node = &findSelector{op: "$not", children: []*findSelector{child}}
+		default:
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Unknown selector operator %q", op)
+		}
+		result.children = append(result.children, node)
+	}
+	return result, nil
+}
+
+func isOperatorObject(value map[string]interface{}) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for key := range value {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits a dot-separated field name into property names; returns nil if it's invalid.
+func fieldPath(field string) []string {
+	path := strings.Split(field, ".")
+	for _, name := range path {
+		if name == "" {
+			return nil
+		}
+	}
+	return path
+}
+
+func (sel *findSelector) matches(doc interface{}) bool {
+	switch sel.op {
+	case "$and":
+		for _, child := range sel.children {
+			if !child.matches(doc) {
+				return false
+			}
+		}
+		return true
+	case "$or":
+		for _, child := range sel.children {
+			if child.matches(doc) {
+				return true
+			}
+		}
+		return false
+	case "$not":
+		return !sel.children[0].matches(doc)
+	}
+
+	value, found := lookupField(doc, sel.path)
+	switch sel.op {
+	case "$exists":
+		return found == sel.arg.(bool)
+	case "$in", "$nin":
+		if !found {
+			return false
+		}
+		in := false
+		for _, item := range sel.arg.([]interface{}) {
+			if compareJSON(value, item) == 0 {
+				in = true
+				break
+			}
+		}
+		return in == (sel.op == "$in")
+	case "$regex":
+		str, ok := value.(string)
+		return found && ok && sel.regexp.MatchString(str)
+	}
+	if !found {
+		return false
+	}
+	cmp := compareJSON(value, sel.arg)
+	switch sel.op {
+	case "$eq":
+		return cmp == 0
+	case "$ne":
+		return cmp != 0
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+// Returns the conditions that every matching doc must satisfy: the children of top-level $ands.
+func (sel *findSelector) requiredConditions() []*findSelector {
+	if sel.op != "$and" {
+		return []*findSelector{sel}
+	}
+	var result []*findSelector
+	for _, child := range sel.children {
+		result = append(result, child.requiredConditions()...)
+	}
+	return result
+}
+
+// Returns true if the selector can only match docs that have the given field.
+func (sel *findSelector) requiresField(field string) bool {
+	for _, cond := range sel.requiredConditions() {
+		if cond.field == field && (cond.op != "$exists" || cond.arg == true) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the single value the selector requires a field to have, if any.
+func (sel *findSelector) equalityValue(field string) (interface{}, bool) {
+	for _, cond := range sel.requiredConditions() {
+		if cond.field == field && cond.op == "$eq" {
+			return cond.arg, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the tightest inclusive bounds the selector puts on a field; nil if unbounded.
+func (sel *findSelector) rangeValues(field string) (low, high *interface{}) {
+	for _, cond := range sel.requiredConditions() {
+		if cond.field != field {
+			continue
+		}
+		arg := cond.arg
+		switch cond.op {
+		case "$gt", "$gte":
+			if low == nil || compareJSON(arg, *low) > 0 {
+				low = &arg
+			}
+		case "$lt", "$lte":
+			if high == nil || compareJSON(arg, *high) < 0 {
+				high = &arg
+			}
+		}
+	}
+	return
+}
+
+// Looks up a property path in a JSON value.
+func lookupField(value interface{}, path []string) (interface{}, bool) {
+	for _, name := range path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			if body, isBody := value.(Body); isBody {
+				object = body
+			} else {
+				return nil, false
+			}
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Compares JSON values in view collation order, treating all numeric types alike.
+func compareJSON(a, b interface{}) int {
+	return base.CollateJSON(normalizeJSONNumbers(a), normalizeJSONNumbers(b))
+}
+
+// Converts the numeric types that can appear in doc bodies to float64, as CollateJSON expects.
+func normalizeJSONNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case int:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case uint64:
+		return float64(value)
+	case json.Number:
+		f, _ := value.Float64()
+		return f
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, item := range value {
+			result[i] = normalizeJSONNumbers(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			result[key] = normalizeJSONNumbers(item)
+		}
+		return result
+	}
+	return value
+}
+
+//////// SORTING & PROJECTION:
+
+type findSortField struct {
+	field      string
+	path       []string
+	descending bool
+}
+
+func parseFindSort(sortSpec []interface{}) ([]findSortField, error) {
+	result := make([]findSortField, 0, len(sortSpec))
+	for _, item := range sortSpec {
+		var sortField findSortField
+		switch item := item.(type) {
+		case string:
+			sortField.field = item
+		case map[string]interface{}:
+			if len(item) != 1 {
+				return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid sort field %v", item)
+			}
+			for field, direction := range item {
+				sortField.field = field
+				switch direction {
+				case "asc":
+				case "desc":
+					sortField.descending = true
+				default:
+					return nil, base.HTTPErrorf(http.StatusBadRequest, "Sort direction must be \"asc\" or \"desc\"")
+				}
+			}
+		default:
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid sort field %v", item)
+		}
+		if sortField.path = fieldPath(sortField.field); sortField.path == nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid sort field %q", sortField.field)
+		}
+		result = append(result, sortField)
+	}
+	return result, nil
+}
+
+// Implements sort.Interface for docs; missing fields sort before all other values.
+type findSorter struct {
+	docs   []Body
+	fields []findSortField
+}
+
+func (s findSorter) Len() int      { return len(s.docs) }
+func (s findSorter) Swap(i, j int) { s.docs[i], s.docs[j] = s.docs[j], s.docs[i] }
+func (s findSorter) Less(i, j int) bool {
+	for _, sortField := range s.fields {
+		a, _ := lookupField(s.docs[i], sortField.path)
+		b, _ := lookupField(s.docs[j], sortField.path)
+		if cmp := compareJSON(a, b); cmp != 0 {
+			return (cmp < 0) != sortField.descending
+		}
+	}
+	return false
+}
+
+// Returns a copy of a doc body containing only the given fields.
+func projectFindFields(body Body, fields []string) Body {
+	result := Body{}
+	for _, field := range fields {
+		path := fieldPath(field)
+		value, found := lookupField(body, path)
+		if path == nil || !found {
+			continue
+		}
+		dst := map[string]interface{}(result)
+		for _, name := range path[:len(path)-1] {
+			child, ok := dst[name].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				dst[name] = child
+			}
+			dst = child
+		}
+		dst[path[len(path)-1]] = value
+	}
+	return result
+}
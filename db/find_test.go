@@ -0,0 +1,198 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+func parseTestSelector(t *testing.T, selectorJSON string) *findSelector {
+	var selector map[string]interface{}
+	assertNoError(t, json.Unmarshal([]byte(selectorJSON), &selector), "Bad selector JSON")
+	result, err := parseFindSelector(selector)
+	assertNoError(t, err, "Couldn't parse selector")
+	return result
+}
+
+func TestFindSelectorMatches(t *testing.T) {
+	doc := map[string]interface{}{
+		"type":  "order",
+		"total": 42.0,
+		"tags":  []interface{}{"a", "b"},
+		"ship":  map[string]interface{}{"city": "Oslo"},
+		"count": int64(7),
+	}
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{`{}`, true},
+		{`{"type": "order"}`, true},
+		{`{"type": "invoice"}`, false},
+		{`{"total": {"$gt": 40, "$lte": 42}}`, true},
+		{`{"total": {"$lt": 42}}`, false},
+		{`{"count": 7}`, true},
+		{`{"ship.city": "Oslo"}`, true},
+		{`{"ship": {"city": "Oslo"}}`, true},
+		{`{"type": {"$in": ["order", "invoice"]}}`, true},
+		{`{"type": {"$nin": ["order", "invoice"]}}`, false},
+		{`{"missing": {"$exists": false}}`, true},
+		{`{"missing": {"$ne": 1}}`, false},
+		{`{"type": {"$regex": "^ord"}}`, true},
+		{`{"tags": ["a", "b"]}`, true},
+		{`{"$or": [{"type": "invoice"}, {"total": 42}]}`, true},
+		{`{"$and": [{"type": "order"}, {"total": 41}]}`, false},
+		{`{"$not": {"type": "order"}}`, false},
+		{`{"total": {"$not": {"$gt": 50}}}`, true},
+	}
+	for _, test := range tests {
+		selector := parseTestSelector(t, test.selector)
+		assert.Equals(t, selector.matches(doc), test.matches)
+	}
+
+	for _, bad := range []string{`{"$foo": 1}`, `{"a": {"$in": 1}}`, `{"a": {"$regex": "("}}`, `{"a..b": 1}`} {
+		var selector map[string]interface{}
+		json.Unmarshal([]byte(bad), &selector)
+		_, err := parseFindSelector(selector)
+		assertHTTPError(t, err, 400)
+	}
+}
+
+func TestFindIndexPlan(t *testing.T) {
+	index := &QueryIndexDef{Name: "by_type_date", Fields: []string{"type", "date"}}
+
+	// Equality on the first field, range on the second:
+	plan, score := planQueryIndex(index, parseTestSelector(t, `{"type": "order", "date": {"$gte": "2016"}}`))
+	assert.True(t, plan != nil)
+	assert.Equals(t, score, 3)
+	assert.DeepEquals(t, plan.startKey, []interface{}{"order", "2016"})
+	assert.DeepEquals(t, plan.endKey, []interface{}{"order", map[string]interface{}{}})
+
+	ok, descending := plan.satisfiesSort([]findSortField{{field: "type"}, {field: "date", descending: true}})
+	assert.True(t, ok)
+	assert.True(t, descending)
+	ok, _ = plan.satisfiesSort([]findSortField{{field: "total"}})
+	assert.False(t, ok)
+
+	// The index can't be used if the selector doesn't require every indexed field:
+	plan, _ = planQueryIndex(index, parseTestSelector(t, `{"type": "order"}`))
+	assert.True(t, plan == nil)
+	plan, _ = planQueryIndex(index, parseTestSelector(t, `{"type": "order", "date": {"$exists": false}}`))
+	assert.True(t, plan == nil)
+}
+
+func TestFind(t *testing.T) {
+	dbcOptions := DatabaseContextOptions{
+		QueryIndexes: []*QueryIndexDef{{Name: "by_type_total", Fields: []string{"type", "total"}}},
+	}
+	context, err := NewDatabaseContext("db", testBucket(), false, dbcOptions)
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	for i := 0; i < 20; i++ {
+		channel := "even"
+		if i%2 == 1 {
+			channel = "odd"
+		}
+		body := Body{"type": "order", "total": i, "channels": []string{channel}}
+		if i%5 == 0 {
+			body["type"] = "invoice"
+		}
+		_, err := db.Put(fmt.Sprintf("doc%02d", i), body)
+		assertNoError(t, err, "Couldn't create document")
+	}
+
+	docIDs := func(result *FindResult) (ids []string) {
+		for _, doc := range result.Docs {
+			ids = append(ids, doc["_id"].(string))
+		}
+		return
+	}
+	limit := 3
+
+	// Indexed query, sorted in index order:
+	result, err := db.Find(FindQuery{
+		Selector: map[string]interface{}{"type": "order", "total": map[string]interface{}{"$gt": 10}},
+		Sort:     []interface{}{map[string]interface{}{"total": "desc"}},
+		Limit:    &limit,
+		Fields:   []string{"_id", "total"},
+	})
+	assertNoError(t, err, "Find failed")
+	assert.Equals(t, result.Warning, "")
+	assert.DeepEquals(t, docIDs(result), []string{"doc19", "doc18", "doc17"})
+	assert.DeepEquals(t, result.Docs[0], Body{"_id": "doc19", "total": int64(19)})
+
+	// Unindexed query falls back to a scan, and warns about it:
+	result, err = db.Find(FindQuery{
+		Selector: map[string]interface{}{"total": map[string]interface{}{"$lt": 4}},
+		Sort:     []interface{}{"total"},
+	})
+	assertNoError(t, err, "Find failed")
+	assert.Equals(t, result.Warning, kFindNoIndexWarning)
+	assert.DeepEquals(t, docIDs(result), []string{"doc00", "doc01", "doc02", "doc03"})
+
+	_, err = db.Find(FindQuery{Selector: map[string]interface{}{"type": "order"}, UseIndex: "by_type_total"})
+	assertHTTPError(t, err, 400)
+
+	// A user only sees docs in channels they have access to; of doc17 and doc19, the first is skipped:
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("naomi", "letmein", channels.SetOf("odd"))
+	authenticator.Save(user)
+	db.user, _ = authenticator.GetUser("naomi")
+	result, err = db.Find(FindQuery{
+		Selector: map[string]interface{}{"type": "order", "total": map[string]interface{}{"$gte": 14}},
+		Skip:     1,
+	})
+	assertNoError(t, err, "Find failed")
+	assert.DeepEquals(t, docIDs(result), []string{"doc19"})
+}
+
+func TestFindPagesThroughIndex(t *testing.T) {
+	dbcOptions := DatabaseContextOptions{
+		QueryIndexes: []*QueryIndexDef{{Name: "by_type", Fields: []string{"type"}}},
+	}
+	context, err := NewDatabaseContext("db", testBucket(), false, dbcOptions)
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	defer tearDownTestDB(t, db)
+
+	for i := 0; i < 10; i++ {
+		body := Body{"type": "order"}
+		if i%4 == 0 {
+			body["type"] = "invoice"
+		}
+		_, err := db.Put(fmt.Sprintf("doc%02d", i), body)
+		assertNoError(t, err, "Couldn't create document")
+	}
+
+	// Many docs share each key, so pages have to start after the last doc ID as well:
+	oldPageSize := allDocsPageSize
+	allDocsPageSize = 2
+	defer func() { allDocsPageSize = oldPageSize }()
+
+	result, err := db.Find(FindQuery{Selector: map[string]interface{}{"type": "order"}, Fields: []string{"_id"}})
+	assertNoError(t, err, "Find failed")
+	assert.Equals(t, result.Warning, "")
+	var ids []string
+	for _, doc := range result.Docs {
+		ids = append(ids, doc["_id"].(string))
+	}
+	assert.DeepEquals(t, ids, []string{"doc01", "doc02", "doc03", "doc05", "doc06", "doc07", "doc09"})
+}
@@ -0,0 +1,88 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/couchbase/go-couchbase"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Options for importing documents written to the bucket by other Couchbase apps, which don't
+// have the gateway's sync metadata.
+type ImportOptions struct {
+	Filter   *JSEventFunction // function(doc) returning true if a doc should be imported; nil imports all
+	OnDemand bool             // Import docs when clients read or update them through the gateway
+}
+
+// Returned by updateDoc's callback when the doc needs to be imported before it can be updated
+var errNeedsImport = errors.New("Document needs to be imported")
+
+// Returned by GetDoc when a doc in the bucket has no sync metadata
+var errNotImported = base.HTTPErrorf(http.StatusNotFound, "Not imported")
+
+// Returned by importDoc when the import filter rejects a doc
+var errImportRejected = base.HTTPErrorf(http.StatusNotFound, "Not imported")
+
+// Returns true if the import filter allows a document to be imported.  Docs the filter fails on
+// aren't imported.
+func (c *DatabaseContext) importAllowed(docid string, body Body) bool {
+	filter := c.Options.ImportOptions.Filter
+	if filter == nil {
+		return true
+	}
+	body = body.ShallowCopy()
+	body["_id"] = docid
+	allowed, err := filter.CallValidateFunction(&DocumentChangeEvent{Doc: body})
+	if err != nil {
+		base.Warn("Error calling import filter on doc %q: %v", docid, err)
+		allowed = false
+	}
+	if !allowed {
+		base.LogTo("CRUD+", "Import filter rejected doc %q", docid)
+		dbExpvars.Add("import_filter_rejections", 1)
+	}
+	return allowed
+}
+
+// Adds sync metadata to a document in the bucket that doesn't have any, if the import filter
+// allows it.  Returns errImportRejected if it doesn't, or if the doc isn't a JSON object; it's
+// not an error if the doc has already been imported.
+func (c *DatabaseContext) importDoc(docid string, onDemand bool) error {
+	base.LogTo("CRUD", "Importing new doc %q", docid)
+	db := Database{DatabaseContext: c, user: nil}
+	imported := false
+	_, err := db.updateDoc(docid, true, 0, func(doc *document) (Body, AttachmentData, error) {
+		imported = false
+		if doc.HasValidSyncData(c.writeSequences()) {
+			return nil, nil, couchbase.UpdateCancel // someone beat me to it
+		}
+		if doc.body == nil || !c.importAllowed(docid, doc.body) {
+			return nil, nil, errImportRejected
+		}
+		if err := db.initializeSyncData(doc); err != nil {
+			return nil, nil, err
+		}
+		imported = true
+		return doc.body, nil, nil
+	})
+	if err == nil && imported {
+		dbExpvars.Add("document_imports", 1)
+		if onDemand {
+			dbExpvars.Add("document_imports_on_demand", 1)
+		}
+	} else if err != nil && err != errImportRejected {
+		dbExpvars.Add("import_errors", 1)
+	}
+	return err
+}
@@ -109,6 +109,10 @@ func (db *Database) VectorMultiChangesFeed(chans base.Set, options ChangesOption
 					continue
 				}
 
+				if !db.changeEntryMatchesFilter(minEntry, options) {
+					continue
+				}
+
 				// Add the doc body or the conflicting rev IDs, if those options are set:
 				if options.IncludeDocs || options.Conflicts {
 					db.addDocToChangeEntry(minEntry, options)
@@ -35,6 +35,9 @@ type kvChangeIndex struct {
 	indexPartitions     *base.IndexPartitions // Partitioning of vbuckets in the index
 	indexPartitionsLock sync.RWMutex          // Manages access to indexPartitions
 	reader              *kvChangeIndexReader  // Index reader
+	reshard             *indexReshard         // Most recent reshard of the index started by this node
+	compaction          *indexCompaction      // Most recent compaction of the index started by this node
+	maintenanceLock     sync.Mutex            // Manages access to reshard and compaction
 }
 
 type IndexPartitionsFunc func() (*base.IndexPartitions, error)
@@ -49,7 +52,7 @@ func (k *kvChangeIndex) Init(context *DatabaseContext, lastSequence SequenceID,
 
 	k.context = context
 	k.reader = &kvChangeIndexReader{}
-	err = k.reader.Init(options, indexOptions, onChange, k.getIndexPartitions)
+	err = k.reader.Init(options, indexOptions, onChange, k.getIndexPartitions, k.resetIndexPartitions)
 	if err != nil {
 		return err
 	}
@@ -130,7 +133,7 @@ func (k *kvChangeIndex) initIndexPartitions() (*base.IndexPartitions, error) {
 	}
 
 	// First attempt to load from the bucket
-	partitionDef, err := k.loadIndexPartitionsFromBucket()
+	partitionDef, version, err := k.loadIndexPartitionsFromBucket()
 	if err != nil {
 		return nil, err
 	}
@@ -144,18 +147,32 @@ func (k *kvChangeIndex) initIndexPartitions() (*base.IndexPartitions, error) {
 
 	// Create k.indexPartitions based on partitionDef
 	k.indexPartitions = base.NewIndexPartitions(partitionDef)
+	k.indexPartitions.Version = version
 	return k.indexPartitions, nil
 }
 
-func (k *kvChangeIndex) loadIndexPartitionsFromBucket() (base.PartitionStorageSet, error) {
+// Discards the cached index partitions, so that the current version is loaded from the bucket on next use.
+// Called by the reader when a reshard switches the index to a new partition map.
+func (k *kvChangeIndex) resetIndexPartitions() {
+	k.indexPartitionsLock.Lock()
+	defer k.indexPartitionsLock.Unlock()
+	k.indexPartitions = nil
+}
+
+func (k *kvChangeIndex) loadIndexPartitionsFromBucket() (base.PartitionStorageSet, uint32, error) {
+	// After a reshard, the partition map in use is a later version
+	version, err := base.LoadIndexPartitionVersion(k.reader.indexReadBucket)
+	if err != nil {
+		return nil, 0, err
+	}
 	var partitionDef base.PartitionStorageSet
-	value, _, err := k.reader.indexReadBucket.GetRaw(base.KIndexPartitionKey)
+	value, _, err := k.reader.indexReadBucket.GetRaw(base.IndexPartitionKey(version))
 	if err == nil {
 		if err = json.Unmarshal(value, &partitionDef); err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 	}
-	return partitionDef, nil
+	return partitionDef, version, nil
 }
 
 func (k *kvChangeIndex) getIndexPartitionMap() (base.IndexPartitionMap, error) {
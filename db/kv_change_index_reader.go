@@ -30,16 +30,18 @@ type kvChangeIndexReader struct {
 	pollingActive             chan struct{}              // Detects polling closed
 	maxVbNo                   uint16                     // Number of vbuckets
 	indexPartitionsCallback   IndexPartitionsFunc        // callback to retrieve the index partition map
+	resetPartitionsCallback   func()                     // callback to discard the index partition map, when its version changes
 	overallPrincipalCount     uint64                     // Counter for all principals
 	activePrincipalCounts     map[string]uint64          // Counters for principals with active changes feeds
 	activePrincipalCountsLock sync.RWMutex               // Coordinates access to active principals map
 
 }
 
-func (k *kvChangeIndexReader) Init(options *CacheOptions, indexOptions *ChangeIndexOptions, onChange func(base.Set), indexPartitionsCallback IndexPartitionsFunc) (err error) {
+func (k *kvChangeIndexReader) Init(options *CacheOptions, indexOptions *ChangeIndexOptions, onChange func(base.Set), indexPartitionsCallback IndexPartitionsFunc, resetPartitionsCallback func()) (err error) {
 
 	k.channelIndexReaders = make(map[string]*KvChannelIndex)
 	k.indexPartitionsCallback = indexPartitionsCallback
+	k.resetPartitionsCallback = resetPartitionsCallback
 	k.activePrincipalCounts = make(map[string]uint64)
 
 	// Initialize notification Callback
@@ -82,6 +84,7 @@ func (k *kvChangeIndexReader) Init(options *CacheOptions, indexOptions *ChangeIn
 				//       stable sequence polling each poll interval, even if we *actually* don't have any
 				//       active readers.
 				pollStart = time.Now()
+				k.checkPartitionVersion()
 				if k.hasActiveReaders() && k.stableSequenceChanged() {
 					var wg sync.WaitGroup
 					wg.Add(2)
@@ -145,11 +148,48 @@ func (k *kvChangeIndexReader) loadStableSequence() (*base.ShardedClock, error) {
 	if err != nil {
 		return nil, err
 	}
-	stableSequence := base.NewShardedClockWithPartitions(base.KStableSequenceKey, partitions, k.indexReadBucket)
+	stableSequence := base.NewShardedClockWithPartitions(base.StableSequenceKey(partitions.Version), partitions, k.indexReadBucket)
 	_, err = stableSequence.Load()
 	return stableSequence, err
 }
 
+// Checks whether a reshard has switched the index to a new partition map version.  If so, discards
+// everything that depends on the old partition map: the partition map itself, the stable sequence and
+// the channel readers.  Channels being polled are notified, so that their changes feeds recreate their
+// readers under the new version.
+func (k *kvChangeIndexReader) checkPartitionVersion() {
+	version, err := base.LoadIndexPartitionVersion(k.indexReadBucket)
+	if err != nil {
+		base.Warn("Error loading index partition version: %v", err)
+		return
+	}
+	partitions, err := k.indexPartitionsCallback()
+	if err != nil || partitions.Version == version {
+		return
+	}
+
+	base.Logf("Channel index switched from partition map version %d to %d", partitions.Version, version)
+	IndexExpvars.Add("partitionVersion_changes", 1)
+	k.resetPartitionsCallback()
+
+	k.readerStableSequenceLock.Lock()
+	k.readerStableSequence = nil
+	k.readerStableSequenceLock.Unlock()
+
+	k.channelIndexReaderLock.Lock()
+	channels := make([]string, 0, len(k.channelIndexReaders))
+	for channelName := range k.channelIndexReaders {
+		channels = append(channels, channelName)
+	}
+	IndexExpvars.Add("pollingChannels_active", -int64(len(channels)))
+	k.channelIndexReaders = make(map[string]*KvChannelIndex)
+	k.channelIndexReaderLock.Unlock()
+
+	if len(channels) > 0 && k.onChange != nil {
+		k.onChange(base.SetFromArray(channels))
+	}
+}
+
 func (k *kvChangeIndexReader) stableSequenceChanged() bool {
 
 	k.readerStableSequenceLock.Lock()
@@ -190,7 +230,11 @@ func (k *kvChangeIndexReader) GetStableClock() (clock base.SequenceClock, err er
 	_, err = k.indexPartitionsCallback()
 	if err != nil {
 		// Unable to load partitions.  Check whether the index has data (stable counter is non-zero)
-		count, err := base.LoadClockCounter(base.KStableSequenceKey, k.indexReadBucket)
+		version, err := base.LoadIndexPartitionVersion(k.indexReadBucket)
+		if err != nil {
+			return nil, err
+		}
+		count, err := base.LoadClockCounter(base.StableSequenceKey(version), k.indexReadBucket)
 		// Index has data, but we can't get partition map.  Return error
 		if err == nil && count > 0 {
 			return nil, errors.New("Error: Unable to retrieve index partition map, but index counter exists")
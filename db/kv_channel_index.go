@@ -516,7 +516,16 @@ func getIndexCountKey(channelName string) string {
 
 // Get the key for the cache block, based on the block index
 func GetIndexBlockKey(channelName string, blockIndex uint16, partition uint16) string {
-	return fmt.Sprintf("%s:%s:block%d:%s", base.KIndexPrefix, channelName, blockIndex, vbSuffixMap[partition])
+	return getVersionedIndexBlockKey(channelName, 0, blockIndex, partition)
+}
+
+// Get the key for the cache block under a partition map version.  Blocks written after a reshard
+// include the version, so they don't collide with the blocks of the previous partition map.
+func getVersionedIndexBlockKey(channelName string, version uint32, blockIndex uint16, partition uint16) string {
+	if version == 0 {
+		return fmt.Sprintf("%s:%s:block%d:%s", base.KIndexPrefix, channelName, blockIndex, vbSuffixMap[partition])
+	}
+	return fmt.Sprintf("%s:%s:v%d:block%d:%s", base.KIndexPrefix, channelName, version, blockIndex, vbSuffixMap[partition])
 }
 
 // Get the key for the cache block, based on the block index
@@ -142,7 +142,7 @@ func (b *BitFlagStorage) AddEntrySet(entries []*LogEntry) (clockUpdates base.Seq
 	for _, entry := range entries {
 		// Update the sequence in the appropriate cache block
 		base.LogTo("DIndex+", "Add to channel index [%s], vbNo=%d, isRemoval:%v", b.channelName, entry.VbNo, entry.IsRemoved())
-		blockKey := GenerateBlockKey(b.channelName, entry.Sequence, b.partitions.VbMap[entry.VbNo])
+		blockKey := b.blockKey(entry.Sequence, b.partitions.VbMap[entry.VbNo])
 		if _, ok := blockSets[blockKey]; !ok {
 			blockSets[blockKey] = make([]*LogEntry, 0)
 		}
@@ -349,7 +349,7 @@ func (b *BitFlagStorage) calculateChangedBlocks(fromSeq base.SequenceClock, chan
 		blockSet := vbBlockSet{vbNo: uint16(vbNo)}
 		partition := b.partitions.VbMap[uint16(vbNo)]
 		for _, blockIndex := range generateBitFlagBlockIndexes(b.channelName, fromVbSeq, clockVbSeq, partition) {
-			blockKey := GetIndexBlockKey(b.channelName, blockIndex, partition)
+			blockKey := getVersionedIndexBlockKey(b.channelName, b.partitions.Version, blockIndex, partition)
 			block, found := blocksByKey[blockKey]
 			if !found {
 				block = newBitFlagBufferBlockForKey(blockKey, b.channelName, blockIndex, partition, b.partitions.VbPositionMaps[partition])
@@ -451,7 +451,7 @@ func (b *BitFlagStorage) bulkLoadEntries(keySet []string, blockEntries []*LogEnt
 func (b *BitFlagStorage) getIndexBlockForEntry(entry *LogEntry) IndexBlock {
 
 	partition := b.partitions.VbMap[entry.VbNo]
-	key := GenerateBlockKey(b.channelName, entry.Sequence, partition)
+	key := b.blockKey(entry.Sequence, partition)
 
 	// First attempt to retrieve from the cache of recently accessed blocks
 	block := b.getIndexBlockFromCache(key)
@@ -506,7 +506,14 @@ type IndexBlock interface {
 }
 
 func NewIndexBlock(channelName string, sequence uint64, partition uint16, partitions *base.IndexPartitions) IndexBlock {
-	return newBitFlagBufferBlock(channelName, sequence, partition, partitions.VbPositionMaps[partition])
+	index := GenerateBitFlagIndex(sequence)
+	key := getVersionedIndexBlockKey(channelName, partitions.Version, index, partition)
+	return newBitFlagBufferBlockForKey(key, channelName, index, partition, partitions.VbPositionMaps[partition])
+}
+
+// Returns the key of the block holding a sequence, under the storage's partition map version
+func (b *BitFlagStorage) blockKey(sequence uint64, partition uint16) string {
+	return getVersionedIndexBlockKey(b.channelName, b.partitions.Version, GenerateBitFlagIndex(sequence), partition)
 }
 
 func GenerateBlockKey(channelName string, sequence uint64, partition uint16) string {
@@ -805,6 +812,26 @@ func (b *BitFlagBufferBlock) AddEntry(entry *LogEntry) error {
 	return nil
 }
 
+// Clears an entry from the block.  Returns false if it wasn't set.
+func (b *BitFlagBufferBlock) removeEntry(vbNo uint16, sequence uint64) bool {
+	index, err := b.getIndexForSequence(vbNo, sequence)
+	if err != nil || index >= uint64(len(b.value)) || b.value[index] == byte(0) {
+		return false
+	}
+	b.value[index] = byte(0)
+	return true
+}
+
+// Returns true if no entries are set in the block.
+func (b *BitFlagBufferBlock) isEmpty() bool {
+	for _, entry := range b.value[kSequenceOffsetLength:] {
+		if entry != byte(0) {
+			return false
+		}
+	}
+	return true
+}
+
 func (b *BitFlagBufferBlock) GetAllEntries() []*LogEntry {
 	results := make([]*LogEntry, 0)
 	// Iterate over all vbuckets, returning entries for each.
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
 	"github.com/couchbaselabs/go.assert"
 )
 
@@ -217,6 +218,174 @@ func TestChannelStorageCorrectness(t *testing.T) {
 
 }
 
+func TestChannelStorageReshard(t *testing.T) {
+
+	indexBucket := testIndexBucket()
+	defer indexBucket.Close()
+
+	fromPartitions := testPartitionMapWithShards(64)
+	toPartitions := testPartitionMapWithShards(16)
+	toPartitions.Version = 1
+	channelStorage := NewBitFlagStorage(indexBucket, "ABC", fromPartitions)
+
+	generator := LogEntryGenerator{
+		SequenceGap: 79,
+	}
+	defer generator.Close()
+	generator.Start()
+
+	entryCount := 2000
+	_, stableClock, err := WriteEntries(channelStorage, generator, entryCount)
+	assertNoError(t, err, "Error writing entries")
+	clockBytes, err := stableClock.Marshal()
+	assertNoError(t, err, "Error marshalling channel clock")
+	indexBucket.SetRaw(GetChannelClockKey("ABC"), 0, clockBytes)
+
+	reshard := &indexReshard{
+		bucket:   indexBucket,
+		from:     fromPartitions,
+		to:       toPartitions,
+		copiedTo: make(map[string]base.SequenceClock),
+	}
+	copied, err := reshard.copyChannel("ABC")
+	assertNoError(t, err, "Error copying channel")
+	assert.True(t, copied > 0)
+
+	// Everything can be read back under the new partition map...
+	newStorage := NewBitFlagStorage(indexBucket, "ABC", toPartitions)
+	retrievedEntries, err := newStorage.GetChanges(base.NewSequenceClockImpl(), stableClock)
+	assertNoError(t, err, "Error retrieving entries")
+	assert.Equals(t, len(retrievedEntries), entryCount)
+
+	// ...a second pass has nothing new to copy...
+	copied, err = reshard.copyChannel("ABC")
+	assertNoError(t, err, "Error copying channel")
+	assert.Equals(t, copied, 0)
+
+	// ...and deleting the old blocks leaves the new ones alone.
+	assert.True(t, reshard.deleteBlocks("ABC", fromPartitions) > 0)
+	retrievedEntries, _ = channelStorage.GetChanges(base.NewSequenceClockImpl(), stableClock)
+	assert.Equals(t, len(retrievedEntries), 0)
+	retrievedEntries, err = newStorage.GetChanges(base.NewSequenceClockImpl(), stableClock)
+	assertNoError(t, err, "Error retrieving entries")
+	assert.Equals(t, len(retrievedEntries), entryCount)
+}
+
+func TestReshardFencesWriters(t *testing.T) {
+
+	indexBucket := testIndexBucket()
+	defer indexBucket.Close()
+
+	defer func(timeout, interval time.Duration) {
+		ReshardWriterTimeout, ReshardWriterPollInterval = timeout, interval
+	}(ReshardWriterTimeout, ReshardWriterPollInterval)
+	ReshardWriterTimeout, ReshardWriterPollInterval = 50*time.Millisecond, 10*time.Millisecond
+
+	fromPartitions := testPartitionMapWithShards(64)
+	toPartitions := testPartitionMapWithShards(16)
+	toPartitions.Version = 1
+	reshard := &indexReshard{
+		db:       &DatabaseContext{Bucket: indexBucket},
+		bucket:   indexBucket,
+		from:     fromPartitions,
+		to:       toPartitions,
+		copiedTo: make(map[string]base.SequenceClock),
+	}
+
+	// Writers that never acknowledge the new version time out the reshard, and the request is withdrawn:
+	assert.True(t, reshard.fenceWriters() != nil)
+	assert.False(t, reshard.fenced)
+	pending, _ := base.LoadIndexPendingVersion(indexBucket)
+	assert.Equals(t, pending, uint32(1))
+	reshard.rollback()
+	pending, _ = base.LoadIndexPendingVersion(indexBucket)
+	assert.Equals(t, pending, uint32(0))
+
+	// Once they acknowledge, the reshard can go on to switch readers:
+	assertNoError(t, base.WriteIndexWriterVersion(indexBucket, 1), "Error writing writer version")
+	assertNoError(t, reshard.fenceWriters(), "Error fencing writers")
+	assert.True(t, reshard.fenced)
+	version, _ := base.LoadIndexPartitionVersion(indexBucket)
+	assert.Equals(t, version, uint32(0))
+}
+
+func TestReshardAddsNewChannels(t *testing.T) {
+
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	indexBucket := testIndexBucket()
+	defer indexBucket.Close()
+
+	reshard := &indexReshard{
+		db:       db.DatabaseContext,
+		bucket:   indexBucket,
+		channels: []string{"ABC"},
+		copiedTo: make(map[string]base.SequenceClock),
+	}
+
+	// A channel that gets its first doc while the reshard is running is copied by the final pass:
+	_, err := db.Put("doc1", Body{"channels": []string{"NBC", "ABC"}})
+	assertNoError(t, err, "Couldn't create document")
+	assertNoError(t, reshard.addNewChannels(), "Error listing channels")
+	assert.DeepEquals(t, reshard.channels, []string{"ABC", "NBC"})
+	assert.Equals(t, reshard.getStatus().ChannelsTotal, 2)
+}
+
+func TestChannelStorageCompaction(t *testing.T) {
+
+	indexBucket := testIndexBucket()
+	defer indexBucket.Close()
+
+	partitions := testPartitionMapWithShards(64)
+	channelStorage := NewBitFlagStorage(indexBucket, "ABC", partitions)
+
+	// doc1 is updated 600 times, over three blocks; doc2 once, in the first block.
+	var entries []*LogEntry
+	for seq := 1; seq <= 600; seq++ {
+		entries = append(entries, makeEntryForDoc("doc1", fmt.Sprintf("%d-abc", seq), 5, seq, false))
+	}
+	entries = append(entries, makeEntryForDoc("doc2", "1-abc", 7, 10, false))
+	for _, entry := range entries {
+		channelStorage.WriteLogEntry(entry)
+	}
+	channelClock, err := channelStorage.AddEntrySet(entries)
+	assertNoError(t, err, "Error writing entries")
+	clockBytes, _ := channelClock.Marshal()
+	indexBucket.SetRaw(GetChannelClockKey("ABC"), 0, clockBytes)
+
+	countBlockEntries := func() int {
+		blocks, _, _ := channelStorage.calculateChangedBlocks(base.NewSequenceClockImpl(), channelClock)
+		channelStorage.bulkLoadBlocks(blocks)
+		count := 0
+		for _, block := range blocks {
+			count += len(block.GetAllEntries())
+		}
+		return count
+	}
+	assert.Equals(t, countBlockEntries(), 601)
+
+	compaction := &indexCompaction{bucket: indexBucket, partitions: partitions}
+	assertNoError(t, compaction.compactChannel("ABC"), "Error compacting channel")
+	assert.Equals(t, countBlockEntries(), 2)
+	status := compaction.getStatus()
+	assert.Equals(t, status.EntriesDropped, 599)
+	assert.Equals(t, status.BlocksExpired, 1) // Only the middle block is left empty
+	assert.Equals(t, status.BlocksRewritten, 2)
+	assert.True(t, status.BytesReclaimed > 0)
+
+	changes, err := channelStorage.GetChanges(base.NewSequenceClockImpl(), channelClock)
+	assertNoError(t, err, "Error retrieving entries")
+	assert.Equals(t, len(changes), 2)
+
+	// Deleting the channel removes its clock along with its blocks
+	freed, err := compaction.deleteChannel("ABC")
+	assertNoError(t, err, "Error deleting channel")
+	assert.True(t, freed > 0)
+	_, _, err = indexBucket.GetRaw(GetChannelClockKey("ABC"))
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
 // ------------------------------------------------
 //  Ops benchmark tests
 // ------------------------------------------------
@@ -0,0 +1,415 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Phases of an index compaction
+const (
+	CompactionPhaseCompact  = "compact" // Dropping superseded entries from channels' blocks
+	CompactionPhaseDelete   = "delete"  // Deleting the index data of channels that no longer exist
+	CompactionPhaseComplete = "complete"
+	CompactionPhaseFailed   = "failed"
+)
+
+// Key of the list of channels seen by the last compaction.  The index has no way to list its channels,
+// so this is how a later compaction finds the channels that have since disappeared.
+const kIndexCompactChannelsKey = base.KIndexPrefix + "_compactChannels"
+
+// Expiry (in seconds) of a block that compaction has emptied.  The block is expired rather than deleted,
+// so that if the index writer adds an entry to it meanwhile, the write cancels the expiry.
+const kEmptyIndexBlockExpiry = 10
+
+// Number of times to retry a cas write of a block that the index writer keeps updating
+const kCompactionMaxCasRetries = 10
+
+// Progress of an index compaction, as reported by the _index/compact admin endpoint.
+type IndexCompactionStatus struct {
+	Phase           string     `json:"phase"`
+	ChannelsTotal   int        `json:"channels_total"`
+	ChannelsDone    int        `json:"channels_done"`
+	ChannelsDeleted int        `json:"channels_deleted"`
+	EntriesDropped  int        `json:"entries_dropped"`  // Entries superseded by a later sequence for the same doc
+	BlocksRewritten int        `json:"blocks_rewritten"` // Blocks with entries dropped that still hold others
+	BlocksExpired   int        `json:"blocks_expired"`   // Blocks left empty by dropping entries
+	BytesReclaimed  int64      `json:"bytes_reclaimed"`
+	StartTime       time.Time  `json:"start_time"`
+	EndTime         *time.Time `json:"end_time,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// An indexCompaction reclaims space in the channel index bucket.  For each channel, it drops entries
+// for a doc that are superseded by a later entry for the same doc, which is what changes feeds would
+// return anyway; the latest entry is kept even if it's a removal, since feeds need it to tell clients
+// the doc left the channel.  Blocks are fixed size, so space is only freed when a block is left empty.
+// It also deletes all the index data of channels that no longer appear in the 'channels' view.
+// Entry docs (getEntryKey) are shared by all channels, so they're left alone.
+type indexCompaction struct {
+	db         *DatabaseContext
+	bucket     base.Bucket
+	partitions *base.IndexPartitions
+	channels   []string // Channels to compact; all channels if not given
+	status     IndexCompactionStatus
+	statusLock sync.RWMutex // Guards status
+}
+
+// A sequence within a vbucket
+type vbSeq struct {
+	vbNo uint16
+	seq  uint64
+}
+
+// Returns an error if a reshard or compaction of the index is running.  Caller MUST be holding maintenanceLock.
+func (k *kvChangeIndex) _checkNoMaintenanceRunning() error {
+	if k.reshard != nil && k.reshard.running() {
+		return base.HTTPErrorf(http.StatusConflict, "A reshard of the index is running")
+	}
+	if k.compaction != nil && k.compaction.running() {
+		return base.HTTPErrorf(http.StatusConflict, "A compaction of the index is running")
+	}
+	return nil
+}
+
+// Starts compacting the channel index in the background.  Compacts the given channels, or every
+// channel in the 'channels' view if none are given.
+func (db *DatabaseContext) StartIndexCompaction(channelNames []string) (*IndexCompactionStatus, error) {
+	kvIndex, ok := db.changeCache.(*kvChangeIndex)
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "No channel index in use")
+	}
+	kvIndex.maintenanceLock.Lock()
+	defer kvIndex.maintenanceLock.Unlock()
+	if err := kvIndex._checkNoMaintenanceRunning(); err != nil {
+		return nil, err
+	}
+	partitions, err := kvIndex.getIndexPartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	compaction := &indexCompaction{
+		db:         db,
+		bucket:     kvIndex.reader.indexReadBucket,
+		partitions: partitions,
+		channels:   channelNames,
+		status: IndexCompactionStatus{
+			Phase:     CompactionPhaseCompact,
+			StartTime: time.Now(),
+		},
+	}
+	kvIndex.compaction = compaction
+	base.Logf("Compacting channel index of db %q", db.Name)
+	go compaction.run()
+
+	status := compaction.getStatus()
+	return &status, nil
+}
+
+// Returns the progress of the most recent compaction of the index started on this node.
+func (db *DatabaseContext) IndexCompactionStatus() (*IndexCompactionStatus, error) {
+	kvIndex, ok := db.changeCache.(*kvChangeIndex)
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "No channel index in use")
+	}
+	kvIndex.maintenanceLock.Lock()
+	compaction := kvIndex.compaction
+	kvIndex.maintenanceLock.Unlock()
+	if compaction == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "The index hasn't been compacted")
+	}
+	status := compaction.getStatus()
+	return &status, nil
+}
+
+func (c *indexCompaction) running() bool {
+	phase := c.getStatus().Phase
+	return phase != CompactionPhaseComplete && phase != CompactionPhaseFailed
+}
+
+func (c *indexCompaction) getStatus() IndexCompactionStatus {
+	c.statusLock.RLock()
+	defer c.statusLock.RUnlock()
+	return c.status
+}
+
+func (c *indexCompaction) updateStatus(update func(status *IndexCompactionStatus)) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	update(&c.status)
+}
+
+func (c *indexCompaction) run() {
+	err := c.compact()
+	if err != nil {
+		base.Warn("Compaction of channel index of db %q failed: %v", c.db.Name, err)
+	}
+	c.updateStatus(func(status *IndexCompactionStatus) {
+		if err != nil {
+			status.Phase = CompactionPhaseFailed
+			status.Error = err.Error()
+		} else {
+			status.Phase = CompactionPhaseComplete
+		}
+		endTime := time.Now()
+		status.EndTime = &endTime
+		base.Logf("Compaction of channel index of db %q reclaimed %d bytes: dropped %d entries, expired %d blocks, deleted %d channels",
+			c.db.Name, status.BytesReclaimed, status.EntriesDropped, status.BlocksExpired, status.ChannelsDeleted)
+	})
+}
+
+func (c *indexCompaction) compact() error {
+	existingChannels, err := c.db.channelNamesFromView()
+	if err != nil {
+		return err
+	}
+	existing := base.SetFromArray(existingChannels)
+
+	// Channels that were seen before (or were asked for) but are gone now:
+	var seenChannels []string
+	if value, _, err := c.bucket.GetRaw(kIndexCompactChannelsKey); err == nil {
+		if err := json.Unmarshal(value, &seenChannels); err != nil {
+			base.Warn("Invalid list of compacted channels in index: %v", err)
+		}
+	} else if !base.IsDocNotFoundError(err) {
+		return err
+	}
+	var deletedChannels []string
+	for channelName := range base.SetFromArray(append(seenChannels, c.channels...)) {
+		if !existing.Contains(channelName) && channelName != channels.UserStarChannel {
+			deletedChannels = append(deletedChannels, channelName)
+		}
+	}
+	sort.Strings(deletedChannels)
+
+	compactChannels := existingChannels
+	if len(c.channels) > 0 {
+		compactChannels = nil
+		for _, channelName := range c.channels {
+			if existing.Contains(channelName) {
+				compactChannels = append(compactChannels, channelName)
+			}
+		}
+	}
+	c.updateStatus(func(status *IndexCompactionStatus) {
+		status.ChannelsTotal = len(compactChannels) + len(deletedChannels)
+	})
+
+	for _, channelName := range compactChannels {
+		if c.db.IsClosed() {
+			return base.HTTPErrorf(http.StatusServiceUnavailable, "Database is closed")
+		}
+		if err := c.compactChannel(channelName); err != nil {
+			return fmt.Errorf("Error compacting channel %q: %v", channelName, err)
+		}
+		c.updateStatus(func(status *IndexCompactionStatus) {
+			status.ChannelsDone++
+		})
+	}
+
+	c.updateStatus(func(status *IndexCompactionStatus) {
+		status.Phase = CompactionPhaseDelete
+	})
+	for _, channelName := range deletedChannels {
+		freed, err := c.deleteChannel(channelName)
+		if err != nil {
+			return fmt.Errorf("Error deleting index data of channel %q: %v", channelName, err)
+		}
+		c.updateStatus(func(status *IndexCompactionStatus) {
+			status.ChannelsDone++
+			status.ChannelsDeleted++
+			status.BytesReclaimed += freed
+		})
+		IndexExpvars.Add("compaction_bytesReclaimed", freed)
+	}
+
+	value, err := json.Marshal(existingChannels)
+	if err != nil {
+		return err
+	}
+	return c.bucket.SetRaw(kIndexCompactChannelsKey, 0, value)
+}
+
+// Drops the entries in the channel's blocks that are superseded by a later entry for the same doc.
+func (c *indexCompaction) compactChannel(channelName string) error {
+	channelClock, err := loadIndexChannelClock(c.bucket, channelName)
+	if err != nil || channelClock == nil {
+		return err
+	}
+	storage := NewBitFlagStorage(c.bucket, channelName, c.partitions)
+	blocksByKey, _, err := storage.calculateChangedBlocks(base.NewSequenceClockImpl(), channelClock)
+	if err != nil {
+		return err
+	}
+
+	// Find each doc's latest sequence in the channel, reading doc IDs from the entry docs:
+	docIDs := make(map[vbSeq]string)
+	latest := make(map[string]uint64)
+	blockSeqs := make(map[string][]vbSeq)
+	for _, batch := range batchIndexBlocks(blocksByKey, kReshardBlockBatchSize) {
+		storage.bulkLoadBlocks(batch)
+		entrySeqs := make(map[string]vbSeq)
+		entryKeys := make([]string, 0)
+		for key, block := range batch {
+			for _, entry := range block.GetAllEntries() {
+				if entry.Sequence > channelClock.GetSequence(entry.VbNo) {
+					continue // Still being written
+				}
+				entrySeq := vbSeq{entry.VbNo, entry.Sequence}
+				blockSeqs[key] = append(blockSeqs[key], entrySeq)
+				entryKey := getEntryKey(entry.VbNo, entry.Sequence)
+				entrySeqs[entryKey] = entrySeq
+				entryKeys = append(entryKeys, entryKey)
+			}
+		}
+		if len(entryKeys) == 0 {
+			continue
+		}
+		entryDocs, err := c.bucket.GetBulkRaw(entryKeys)
+		if err != nil {
+			return err
+		}
+		for entryKey, value := range entryDocs {
+			var entry LogEntry
+			if err := json.Unmarshal(value, &entry); err != nil || entry.DocID == "" {
+				continue
+			}
+			entrySeq := entrySeqs[entryKey]
+			docIDs[entrySeq] = entry.DocID
+			if entrySeq.seq > latest[entry.DocID] {
+				latest[entry.DocID] = entrySeq.seq
+			}
+		}
+	}
+
+	for key, seqs := range blockSeqs {
+		var drop []vbSeq
+		for _, entrySeq := range seqs {
+			if docID, found := docIDs[entrySeq]; found && latest[docID] > entrySeq.seq {
+				drop = append(drop, entrySeq)
+			}
+		}
+		if len(drop) == 0 {
+			continue
+		}
+		block, ok := blocksByKey[key].(*BitFlagBufferBlock)
+		if !ok {
+			continue
+		}
+		dropped, freed, err := c.dropEntries(block, drop)
+		if err != nil {
+			return err
+		}
+		c.updateStatus(func(status *IndexCompactionStatus) {
+			status.EntriesDropped += dropped
+			if freed > 0 {
+				status.BlocksExpired++
+				status.BytesReclaimed += int64(freed)
+			} else if dropped > 0 {
+				status.BlocksRewritten++
+			}
+		})
+		IndexExpvars.Add("compaction_entriesDropped", int64(dropped))
+		IndexExpvars.Add("compaction_bytesReclaimed", int64(freed))
+	}
+	return nil
+}
+
+// Clears entries from a block, with a cas write so that entries the index writer adds meanwhile aren't
+// lost.  Returns the number of entries dropped, and the size of the block if it was left empty.
+func (c *indexCompaction) dropEntries(block *BitFlagBufferBlock, drop []vbSeq) (dropped int, freed int, err error) {
+	for attempt := 0; attempt < kCompactionMaxCasRetries; attempt++ {
+		value, cas, err := c.bucket.GetRaw(block.Key())
+		if err != nil {
+			if base.IsDocNotFoundError(err) {
+				return 0, 0, nil
+			}
+			return 0, 0, err
+		}
+		block.Unmarshal(value)
+		dropped = 0
+		for _, entrySeq := range drop {
+			if block.removeEntry(entrySeq.vbNo, entrySeq.seq) {
+				dropped++
+			}
+		}
+		if dropped == 0 {
+			return 0, 0, nil
+		}
+		exp := 0
+		if block.isEmpty() {
+			exp = kEmptyIndexBlockExpiry
+		}
+		if _, err = c.bucket.WriteCas(block.Key(), 0, exp, cas, value, sgbucket.Raw); err == nil {
+			if exp > 0 {
+				freed = len(value)
+			}
+			return dropped, freed, nil
+		}
+		// Cas failure - the writer updated the block, so reload it and try again
+	}
+	return 0, 0, fmt.Errorf("Unable to update index block %s: too many cas failures", block.Key())
+}
+
+// Deletes a channel's blocks, clock and counter.  Returns the number of bytes freed.
+func (c *indexCompaction) deleteChannel(channelName string) (int64, error) {
+	clockKey := GetChannelClockKey(channelName)
+	clockValue, _, err := c.bucket.GetRaw(clockKey)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	channelClock, err := base.NewSequenceClockForBytes(clockValue)
+	if err != nil {
+		return 0, err
+	}
+
+	freed := int64(0)
+	storage := NewBitFlagStorage(c.bucket, channelName, c.partitions)
+	blocksByKey, _, err := storage.calculateChangedBlocks(base.NewSequenceClockImpl(), channelClock)
+	if err != nil {
+		return 0, err
+	}
+	for _, batch := range batchIndexBlocks(blocksByKey, kReshardBlockBatchSize) {
+		keys := make([]string, 0, len(batch))
+		for key := range batch {
+			keys = append(keys, key)
+		}
+		blocks, err := c.bucket.GetBulkRaw(keys)
+		if err != nil {
+			return freed, err
+		}
+		for key, value := range blocks {
+			if err := c.bucket.Delete(key); err == nil {
+				freed += int64(len(value))
+			} else if !base.IsDocNotFoundError(err) {
+				return freed, err
+			}
+		}
+	}
+
+	c.bucket.Delete(getIndexCountKey(channelName))
+	if err := c.bucket.Delete(clockKey); err != nil && !base.IsDocNotFoundError(err) {
+		return freed, err
+	}
+	return freed + int64(len(clockValue)), nil
+}
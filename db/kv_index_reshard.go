@@ -0,0 +1,469 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Phases of an index reshard
+const (
+	ReshardPhaseBackfill = "backfill" // Copying index blocks into the new partition map
+	ReshardPhaseWriters  = "writers"  // Waiting for the index writers to switch to the new partition map
+	ReshardPhaseSwitch   = "switch"   // Switching readers to the new partition map
+	ReshardPhaseCleanup  = "cleanup"  // Deleting the old partition map's blocks
+	ReshardPhaseComplete = "complete"
+	ReshardPhaseFailed   = "failed"
+)
+
+// Maximum number of backfill passes before switching.  Each pass copies what the index writers added
+// during the previous one, so they should get shorter; if they don't, the switch goes ahead anyway and
+// a final pass after it picks up the rest.
+const kReshardMaxPasses = 3
+
+// Number of blocks loaded from the index bucket at a time while copying a channel
+const kReshardBlockBatchSize = 100
+
+// How long to wait after the switch before deleting the old blocks, so that readers on every node have
+// seen the new partition map version.  Readers check it on every poll.
+var ReshardCleanupDelay = 10 * time.Second
+
+// How long to wait for the index writers to switch to the new partition map before giving up on the
+// reshard, and how often to check whether they have.
+var ReshardWriterTimeout = 5 * time.Minute
+var ReshardWriterPollInterval = time.Second
+
+// Progress of an index reshard.
+type IndexReshardStatus struct {
+	Phase         string     `json:"phase"`
+	FromVersion   uint32     `json:"from_version"`
+	ToVersion     uint32     `json:"to_version"`
+	FromShards    int        `json:"from_shards"`
+	ToShards      int        `json:"to_shards"`
+	ChannelsTotal int        `json:"channels_total"`
+	ChannelsDone  int        `json:"channels_done"` // Channels copied in the current pass, or cleaned up
+	Passes        int        `json:"passes"`
+	BlocksCopied  int        `json:"blocks_copied"`
+	BlocksDeleted int        `json:"blocks_deleted"`
+	StartTime     time.Time  `json:"start_time"`
+	EndTime       *time.Time `json:"end_time,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// An indexReshard moves the channel index to a new partition map with a different number of shards,
+// while the index stays online.  The new map is written as a new version alongside the old one, and
+// every channel's blocks are copied into it.  The index writers are then asked to switch to the new
+// map, and once they've acknowledged, a final pass copies what they added to the old blocks before
+// switching.  Bumping the partition map version then switches readers on all nodes to the new map,
+// after which the old blocks are deleted.  If the writers never acknowledge, readers aren't switched
+// and the reshard is rolled back.
+//
+// The index writers (sg_accel) don't take part in that handshake yet, so a reshard would always time
+// out waiting for them; it isn't exposed through the admin API until they do.
+type indexReshard struct {
+	db         *DatabaseContext
+	bucket     base.Bucket
+	from       *base.IndexPartitions
+	to         *base.IndexPartitions
+	channels   []string                      // Channels to copy; new ones are added before the final pass
+	copiedTo   map[string]base.SequenceClock // Channel clock each channel has been copied up to
+	fenced     bool                          // Whether the index writers have switched to the new partition map
+	switched   bool                          // Whether readers have been switched to the new partition map
+	status     IndexReshardStatus
+	statusLock sync.RWMutex // Guards status
+}
+
+// Starts resharding the channel index to numShards partitions in the background.  Copies the given
+// channels, or every channel in the 'channels' view if none are given.
+func (db *DatabaseContext) StartIndexReshard(numShards uint16, channelNames []string) (*IndexReshardStatus, error) {
+	kvIndex, ok := db.changeCache.(*kvChangeIndex)
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "No channel index in use")
+	}
+	maxVbNo := kvIndex.reader.maxVbNo
+	if numShards == 0 || !base.IsPowerOfTwo(numShards) || numShards > maxVbNo || int(numShards) > len(vbSuffixMap) {
+		return nil, base.HTTPErrorf(http.StatusBadRequest,
+			"num_shards must be a power of 2, no more than the number of vbuckets (%d)", maxVbNo)
+	}
+
+	kvIndex.maintenanceLock.Lock()
+	defer kvIndex.maintenanceLock.Unlock()
+	if err := kvIndex._checkNoMaintenanceRunning(); err != nil {
+		return nil, err
+	}
+
+	from, err := kvIndex.getIndexPartitions()
+	if err != nil {
+		return nil, err
+	}
+	if len(from.PartitionDefs) == int(numShards) {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "The index already has %d shards", numShards)
+	}
+
+	// Adding the new partition map fails if another node has already started a reshard to this version:
+	toDefs := base.NewPartitionStorageSet(maxVbNo, numShards)
+	value, err := json.Marshal(toDefs)
+	if err != nil {
+		return nil, err
+	}
+	to := base.NewIndexPartitions(toDefs)
+	to.Version = from.Version + 1
+	added, err := kvIndex.reader.indexReadBucket.AddRaw(base.IndexPartitionKey(to.Version), 0, value)
+	if err != nil {
+		return nil, err
+	} else if !added {
+		return nil, base.HTTPErrorf(http.StatusConflict,
+			"Partition map version %d already exists; another reshard may be running", to.Version)
+	}
+
+	reshard := &indexReshard{
+		db:       db,
+		bucket:   kvIndex.reader.indexReadBucket,
+		from:     from,
+		to:       to,
+		channels: channelNames,
+		copiedTo: make(map[string]base.SequenceClock),
+		status: IndexReshardStatus{
+			Phase:       ReshardPhaseBackfill,
+			FromVersion: from.Version,
+			ToVersion:   to.Version,
+			FromShards:  len(from.PartitionDefs),
+			ToShards:    int(numShards),
+			StartTime:   time.Now(),
+		},
+	}
+	kvIndex.reshard = reshard
+	base.Logf("Resharding channel index of db %q from %d to %d shards (partition map version %d)",
+		db.Name, len(from.PartitionDefs), numShards, to.Version)
+	go reshard.run()
+
+	status := reshard.getStatus()
+	return &status, nil
+}
+
+// Returns the progress of the most recent reshard of the index started on this node.
+func (db *DatabaseContext) IndexReshardStatus() (*IndexReshardStatus, error) {
+	kvIndex, ok := db.changeCache.(*kvChangeIndex)
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "No channel index in use")
+	}
+	kvIndex.maintenanceLock.Lock()
+	reshard := kvIndex.reshard
+	kvIndex.maintenanceLock.Unlock()
+	if reshard == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "The index hasn't been resharded")
+	}
+	status := reshard.getStatus()
+	return &status, nil
+}
+
+func (r *indexReshard) running() bool {
+	phase := r.getStatus().Phase
+	return phase != ReshardPhaseComplete && phase != ReshardPhaseFailed
+}
+
+func (r *indexReshard) getStatus() IndexReshardStatus {
+	r.statusLock.RLock()
+	defer r.statusLock.RUnlock()
+	return r.status
+}
+
+func (r *indexReshard) updateStatus(update func(status *IndexReshardStatus)) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	update(&r.status)
+}
+
+func (r *indexReshard) run() {
+	err := r.reshard()
+	if err != nil {
+		base.Warn("Reshard of channel index of db %q failed: %v", r.db.Name, err)
+		if !r.fenced {
+			r.rollback()
+		} else if !r.switched {
+			base.Warn("Index writers of db %q have switched to partition map version %d but readers haven't; "+
+				"changes feeds won't see new entries until they do", r.db.Name, r.to.Version)
+		}
+	} else {
+		base.Logf("Reshard of channel index of db %q complete", r.db.Name)
+	}
+	r.updateStatus(func(status *IndexReshardStatus) {
+		if err != nil {
+			status.Phase = ReshardPhaseFailed
+			status.Error = err.Error()
+		} else {
+			status.Phase = ReshardPhaseComplete
+		}
+		endTime := time.Now()
+		status.EndTime = &endTime
+	})
+}
+
+func (r *indexReshard) reshard() error {
+	if len(r.channels) == 0 {
+		var err error
+		if r.channels, err = r.db.channelNamesFromView(); err != nil {
+			return err
+		}
+	}
+	sort.Strings(r.channels)
+	r.updateStatus(func(status *IndexReshardStatus) {
+		status.ChannelsTotal = len(r.channels)
+	})
+
+	// Backfill until a pass finds nothing new:
+	for pass := 0; pass < kReshardMaxPasses; pass++ {
+		copied, err := r.copyChannels()
+		if err != nil {
+			return err
+		}
+		if copied == 0 {
+			break
+		}
+	}
+
+	// The new stable sequence starts where the old one is now; the writers advance it once they've switched.
+	r.updateStatus(func(status *IndexReshardStatus) {
+		status.Phase = ReshardPhaseWriters
+	})
+	oldStableSequence := base.NewShardedClockWithPartitions(base.StableSequenceKey(r.from.Version), r.from, r.bucket)
+	if _, err := oldStableSequence.Load(); err != nil {
+		return err
+	}
+	newStableSequence := base.NewShardedClock(base.StableSequenceKey(r.to.Version), r.to, r.bucket)
+	if err := newStableSequence.UpdateAndWrite(oldStableSequence.AsClock()); err != nil {
+		return err
+	}
+	if err := r.fenceWriters(); err != nil {
+		return err
+	}
+
+	// Nothing more is written to the old blocks; pick up whatever was added to them in the meantime,
+	// including channels that got their first entries during the backfill, then bumping the version
+	// switches readers over.
+	r.updateStatus(func(status *IndexReshardStatus) {
+		status.Phase = ReshardPhaseSwitch
+	})
+	if err := r.addNewChannels(); err != nil {
+		return err
+	}
+	if _, err := r.copyChannels(); err != nil {
+		return err
+	}
+	if err := base.WriteIndexPartitionVersion(r.bucket, r.to.Version); err != nil {
+		return err
+	}
+	r.switched = true
+	IndexExpvars.Add("reshard_switches", 1)
+
+	r.updateStatus(func(status *IndexReshardStatus) {
+		status.Phase = ReshardPhaseCleanup
+		status.ChannelsDone = 0
+	})
+	time.Sleep(ReshardCleanupDelay)
+	for _, channelName := range r.channels {
+		deleted := r.deleteBlocks(channelName, r.from)
+		r.updateStatus(func(status *IndexReshardStatus) {
+			status.ChannelsDone++
+			status.BlocksDeleted += deleted
+		})
+	}
+	return nil
+}
+
+// Asks the index writers to switch to the new partition map, and waits until they've acknowledged.
+// Readers can only follow the new version once nothing more is being written under the old one.
+func (r *indexReshard) fenceWriters() error {
+	if err := base.WriteIndexPendingVersion(r.bucket, r.to.Version); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(ReshardWriterTimeout)
+	for {
+		version, err := base.LoadIndexWriterVersion(r.bucket)
+		if err != nil {
+			return err
+		}
+		if version >= r.to.Version {
+			r.fenced = true
+			return nil
+		}
+		if r.db.IsClosed() {
+			return base.HTTPErrorf(http.StatusServiceUnavailable, "Database is closed")
+		}
+		if time.Now().After(deadline) {
+			return base.HTTPErrorf(http.StatusGatewayTimeout,
+				"Index writers didn't switch to partition map version %d within %v", r.to.Version, ReshardWriterTimeout)
+		}
+		time.Sleep(ReshardWriterPollInterval)
+	}
+}
+
+// Adds the channels in the 'channels' view that aren't being copied yet, so that the final pass copies
+// them and cleanup deletes their old blocks.
+func (r *indexReshard) addNewChannels() error {
+	names, err := r.db.channelNamesFromView()
+	if err != nil {
+		return err
+	}
+	known := base.SetFromArray(r.channels)
+	for _, name := range names {
+		if !known.Contains(name) {
+			r.channels = append(r.channels, name)
+		}
+	}
+	sort.Strings(r.channels)
+	r.updateStatus(func(status *IndexReshardStatus) {
+		status.ChannelsTotal = len(r.channels)
+	})
+	return nil
+}
+
+// Makes a backfill pass over all the channels.  Returns the number of blocks copied.
+func (r *indexReshard) copyChannels() (int, error) {
+	r.updateStatus(func(status *IndexReshardStatus) {
+		status.Passes++
+		status.ChannelsDone = 0
+	})
+	total := 0
+	for _, channelName := range r.channels {
+		if r.db.IsClosed() {
+			return total, base.HTTPErrorf(http.StatusServiceUnavailable, "Database is closed")
+		}
+		copied, err := r.copyChannel(channelName)
+		if err != nil {
+			return total, err
+		}
+		total += copied
+		r.updateStatus(func(status *IndexReshardStatus) {
+			status.ChannelsDone++
+			status.BlocksCopied += copied
+		})
+	}
+	return total, nil
+}
+
+// Copies the channel's entries added since its last copy into blocks under the new partition map.
+// Returns the number of old blocks they were read from.
+func (r *indexReshard) copyChannel(channelName string) (int, error) {
+	channelClock, err := loadIndexChannelClock(r.bucket, channelName)
+	if err != nil || channelClock == nil {
+		return 0, err
+	}
+	since := r.copiedTo[channelName]
+	if since == nil {
+		since = base.NewSequenceClockImpl()
+	}
+
+	oldStorage := NewBitFlagStorage(r.bucket, channelName, r.from)
+	newStorage := NewBitFlagStorage(r.bucket, channelName, r.to)
+	blocksByKey, _, err := oldStorage.calculateChangedBlocks(since, channelClock)
+	if err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for _, batch := range batchIndexBlocks(blocksByKey, kReshardBlockBatchSize) {
+		oldStorage.bulkLoadBlocks(batch)
+		var entries []*LogEntry
+		for _, block := range batch {
+			for _, entry := range block.GetAllEntries() {
+				// Blocks span more sequences than the clocks; copy just the ones this pass is responsible for
+				if entry.Sequence > since.GetSequence(entry.VbNo) && entry.Sequence <= channelClock.GetSequence(entry.VbNo) {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		if _, err := newStorage.AddEntrySet(entries); err != nil {
+			return copied, err
+		}
+		copied += len(batch)
+	}
+	r.copiedTo[channelName] = channelClock
+	return copied, nil
+}
+
+// Deletes the channel's blocks under a partition map, up to the clock it's been copied to.
+// Returns the number of blocks deleted.
+func (r *indexReshard) deleteBlocks(channelName string, partitions *base.IndexPartitions) int {
+	copiedTo := r.copiedTo[channelName]
+	if copiedTo == nil {
+		return 0
+	}
+	storage := NewBitFlagStorage(r.bucket, channelName, partitions)
+	blocksByKey, _, err := storage.calculateChangedBlocks(base.NewSequenceClockImpl(), copiedTo)
+	if err != nil {
+		base.Warn("Unable to determine index blocks of channel %q to delete: %v", channelName, err)
+		return 0
+	}
+	deleted := 0
+	for key := range blocksByKey {
+		if err := r.bucket.Delete(key); err == nil {
+			deleted++
+		} else if !base.IsDocNotFoundError(err) {
+			base.Warn("Unable to delete index block %q: %v", key, err)
+		}
+	}
+	return deleted
+}
+
+// Undoes a reshard that failed before the index writers switched, so that it can be retried: withdraws
+// the request to the writers, and deletes the blocks copied so far and the new partition map.
+func (r *indexReshard) rollback() {
+	if pending, err := base.LoadIndexPendingVersion(r.bucket); err == nil && pending == r.to.Version {
+		if err := base.WriteIndexPendingVersion(r.bucket, r.from.Version); err != nil {
+			base.Warn("Unable to withdraw partition map version %d from index writers: %v", r.to.Version, err)
+		}
+	}
+	for channelName := range r.copiedTo {
+		r.deleteBlocks(channelName, r.to)
+	}
+	if err := r.bucket.Delete(base.IndexPartitionKey(r.to.Version)); err != nil {
+		base.Warn("Unable to delete partition map version %d: %v", r.to.Version, err)
+	}
+}
+
+// Loads a channel's clock from the index.  Returns nil if the channel has nothing indexed.
+func loadIndexChannelClock(bucket base.Bucket, channelName string) (base.SequenceClock, error) {
+	value, _, err := bucket.GetRaw(GetChannelClockKey(channelName))
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	clock, err := base.NewSequenceClockForBytes(value)
+	if err != nil {
+		return nil, err
+	}
+	return clock, nil
+}
+
+// Splits a set of blocks into batches of at most batchSize.
+func batchIndexBlocks(blocksByKey map[string]IndexBlock, batchSize int) []map[string]IndexBlock {
+	var batches []map[string]IndexBlock
+	batch := make(map[string]IndexBlock, batchSize)
+	for key, block := range blocksByKey {
+		batch[key] = block
+		if len(batch) == batchSize {
+			batches = append(batches, batch)
+			batch = make(map[string]IndexBlock, batchSize)
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
@@ -0,0 +1,382 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Default number of hits returned by a search that doesn't specify a limit
+const kDefaultSearchLimit = 25
+
+// Search index states
+const (
+	SearchIndexBuilding = "building"
+	SearchIndexReady    = "ready"
+	SearchIndexFailed   = "failed"
+)
+
+// Options for the embedded full-text search index, from the database config.
+type SearchOptions struct {
+	Fields []string `json:"fields"` // Document fields to index, as dot-separated property paths
+}
+
+// Reported by the admin API's _search_index endpoint.
+type SearchIndexStatus struct {
+	State        string     `json:"state"`
+	Fields       []string   `json:"fields"`
+	DocCount     int        `json:"doc_count"`
+	TermCount    int        `json:"term_count"`
+	BuildStarted time.Time  `json:"build_started"`
+	BuildEnded   *time.Time `json:"build_ended,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// A document matching a search, in order of decreasing score.
+type SearchHit struct {
+	DocID string  `json:"id"`
+	RevID string  `json:"rev"`
+	Score float64 `json:"score"`
+}
+
+// An in-memory inverted index of the configured fields of every document, along with the
+// channels each doc is in so that hits can be filtered by the user's access.  It's kept up to
+// date from the change cache's feed, and rebuilt from the all_docs view when the database
+// starts (it isn't persisted) or when an admin asks for it.
+type searchIndex struct {
+	context  *DatabaseContext
+	fields   [][]string        // Indexed fields, split into property names
+	data     *searchIndexData  // The index that's searched
+	building *searchIndexData  // Index being rebuilt, if any; it also receives live changes
+	status   SearchIndexStatus // Current state
+	lock     sync.RWMutex      // Protects the fields above
+}
+
+type searchIndexData struct {
+	postings map[string]map[string]int // term -> docID -> number of occurrences
+	docs     map[string]*searchDoc     // docID -> indexed state
+}
+
+type searchDoc struct {
+	sequence uint64
+	revID    string
+	channels []string
+	terms    map[string]int // nil for a doc deleted while a rebuild is in progress
+}
+
+func newSearchIndex(context *DatabaseContext, options *SearchOptions) (*searchIndex, error) {
+	if len(options.Fields) == 0 {
+		return nil, fmt.Errorf("Search index has no fields")
+	}
+	idx := &searchIndex{
+		context: context,
+		data:    newSearchIndexData(),
+		status:  SearchIndexStatus{State: SearchIndexReady, Fields: options.Fields},
+	}
+	for _, field := range options.Fields {
+		path := fieldPath(field)
+		if path == nil {
+			return nil, fmt.Errorf("Search index has an invalid field %q", field)
+		}
+		idx.fields = append(idx.fields, path)
+	}
+	return idx, nil
+}
+
+func newSearchIndexData() *searchIndexData {
+	return &searchIndexData{
+		postings: map[string]map[string]int{},
+		docs:     map[string]*searchDoc{},
+	}
+}
+
+//////// INDEXING:
+
+// Called by the change cache for every document revision it receives.
+func (idx *searchIndex) docChanged(docID string, docJSON []byte) {
+	doc, err := unmarshalDocument(docID, docJSON)
+	if err != nil {
+		base.Warn("Search: Error unmarshaling doc %q: %v", docID, err)
+		return
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	entry := idx.makeSearchDoc(doc)
+	idx.data.update(docID, entry, false)
+	if idx.building != nil {
+		idx.building.update(docID, entry, true)
+	}
+}
+
+// Extracts the terms and channels of a document's current revision.
+func (idx *searchIndex) makeSearchDoc(doc *document) *searchDoc {
+	entry := &searchDoc{sequence: doc.Sequence, revID: doc.CurrentRev}
+	if doc.hasFlag(channels.Deleted) {
+		return entry
+	}
+	for channelName, removal := range doc.Channels {
+		if removal == nil {
+			entry.channels = append(entry.channels, channelName)
+		}
+	}
+	entry.terms = map[string]int{}
+	for _, path := range idx.fields {
+		if value, found := lookupField(map[string]interface{}(doc.body), path); found {
+			addSearchTerms(entry.terms, value)
+		}
+	}
+	return entry
+}
+
+// Adds the terms of every string in a JSON value to the map.
+func addSearchTerms(terms map[string]int, value interface{}) {
+	switch value := value.(type) {
+	case string:
+		for _, term := range searchTerms(value) {
+			terms[term]++
+		}
+	case []interface{}:
+		for _, item := range value {
+			addSearchTerms(terms, item)
+		}
+	case map[string]interface{}:
+		for _, item := range value {
+			addSearchTerms(terms, item)
+		}
+	}
+}
+
+// Splits text into lowercased words, ignoring punctuation.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Replaces a doc's entry in the index.  Entries without terms (deleted docs) are removed, unless
+// keepTombstones is set; a rebuild needs them so it doesn't resurrect docs deleted while it ran.
+// Entries older than the one already in the index are ignored.
+func (data *searchIndexData) update(docID string, entry *searchDoc, keepTombstones bool) {
+	if old := data.docs[docID]; old != nil {
+		if old.sequence > entry.sequence {
+			return
+		}
+		for term := range old.terms {
+			if postings := data.postings[term]; postings != nil {
+				delete(postings, docID)
+				if len(postings) == 0 {
+					delete(data.postings, term)
+				}
+			}
+		}
+		delete(data.docs, docID)
+	}
+	if len(entry.terms) == 0 {
+		if entry.terms == nil && keepTombstones {
+			data.docs[docID] = entry
+		}
+		return
+	}
+	for term, count := range entry.terms {
+		postings := data.postings[term]
+		if postings == nil {
+			postings = map[string]int{}
+			data.postings[term] = postings
+		}
+		postings[docID] = count
+	}
+	data.docs[docID] = entry
+}
+
+func (data *searchIndexData) purgeTombstones() {
+	for docID, entry := range data.docs {
+		if entry.terms == nil {
+			delete(data.docs, docID)
+		}
+	}
+}
+
+//////// REBUILDING:
+
+// Starts rebuilding the search index in the background.  The existing index keeps serving
+// searches until the rebuild finishes.
+func (context *DatabaseContext) StartSearchIndexRebuild() (*SearchIndexStatus, error) {
+	idx := context.searchIndex
+	if idx == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Full-text search isn't enabled for this database")
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if idx.building != nil {
+		return nil, base.HTTPErrorf(http.StatusConflict, "Search index is already being rebuilt")
+	}
+	idx.building = newSearchIndexData()
+	idx.status.State = SearchIndexBuilding
+	idx.status.BuildStarted = time.Now()
+	idx.status.BuildEnded = nil
+	idx.status.Error = ""
+	go idx.rebuild()
+	return idx._status(), nil
+}
+
+func (idx *searchIndex) rebuild() {
+	base.Logf("Search: Rebuilding index of %q", idx.context.Name)
+	db := &Database{idx.context, nil}
+	closed := false
+	err := db.ForEachDocID(func(doc IDAndRev, channelNames []string) bool {
+		idx.context.BucketLock.RLock()
+		defer idx.context.BucketLock.RUnlock()
+		if closed = closed || idx.context.Bucket == nil; closed {
+			return false
+		}
+		fullDoc, err := idx.context.GetDoc(doc.DocID)
+		if err != nil {
+			base.Warn("Search: Couldn't index doc %q: %v", doc.DocID, err)
+			return false
+		}
+		idx.lock.Lock()
+		defer idx.lock.Unlock()
+		idx.building.update(doc.DocID, idx.makeSearchDoc(fullDoc), true)
+		return true
+	}, ForEachDocIDOptions{})
+	if err == nil && closed {
+		err = fmt.Errorf("Database was closed")
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	now := time.Now()
+	idx.status.BuildEnded = &now
+	if err != nil {
+		base.Warn("Search: Rebuilding index of %q failed: %v", idx.context.Name, err)
+		idx.status.State = SearchIndexFailed
+		idx.status.Error = err.Error()
+	} else {
+		idx.building.purgeTombstones()
+		idx.data = idx.building
+		idx.status.State = SearchIndexReady
+		base.Logf("Search: Rebuilt index of %q: %d docs, %d terms", idx.context.Name, len(idx.data.docs), len(idx.data.postings))
+	}
+	idx.building = nil
+}
+
+// Returns the state of the search index.
+func (context *DatabaseContext) SearchIndexStatus() (*SearchIndexStatus, error) {
+	idx := context.searchIndex
+	if idx == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Full-text search isn't enabled for this database")
+	}
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return idx._status(), nil
+}
+
+func (idx *searchIndex) _status() *SearchIndexStatus {
+	status := idx.status
+	status.DocCount = len(idx.data.docs)
+	status.TermCount = len(idx.data.postings)
+	return &status
+}
+
+//////// SEARCHING:
+
+// Searches the index for docs containing every word of the query; a word ending in "*" matches
+// any term it's a prefix of.  Hits are ranked by TF-IDF, and docs the user can't read are left
+// out, as in _all_docs.
+func (db *Database) Search(query string, limit int) ([]SearchHit, error) {
+	idx := db.searchIndex
+	if idx == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Full-text search isn't enabled for this database")
+	}
+	if limit <= 0 {
+		limit = kDefaultSearchLimit
+	}
+
+	type queryTerm struct {
+		term   string
+		prefix bool
+	}
+	var queryTerms []queryTerm
+	for _, word := range strings.Fields(query) {
+		terms := searchTerms(word)
+		for i, term := range terms {
+			queryTerms = append(queryTerms, queryTerm{term, i == len(terms)-1 && strings.HasSuffix(word, "*")})
+		}
+	}
+	if len(queryTerms) == 0 {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Missing search terms")
+	}
+
+	canSee := db.channelAccessFilter()
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	data := idx.data
+	numDocs := float64(len(data.docs))
+
+	// Score the docs matching each query term, keeping only those that match all of them:
+	var scores map[string]float64
+	for _, qt := range queryTerms {
+		termScores := map[string]float64{}
+		addPostings := func(postings map[string]int) {
+			idf := math.Log(1 + numDocs/float64(len(postings)))
+			for docID, count := range postings {
+				if scores == nil || scores[docID] > 0 {
+					termScores[docID] += float64(count) * idf
+				}
+			}
+		}
+		if qt.prefix {
+			for term, postings := range data.postings {
+				if strings.HasPrefix(term, qt.term) {
+					addPostings(postings)
+				}
+			}
+		} else if postings := data.postings[qt.term]; postings != nil {
+			addPostings(postings)
+		}
+		for docID := range termScores {
+			termScores[docID] += scores[docID]
+		}
+		scores = termScores
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for docID, score := range scores {
+		if entry := data.docs[docID]; canSee(entry.channels) {
+			hits = append(hits, SearchHit{DocID: docID, RevID: entry.revID, Score: score})
+		}
+	}
+	sort.Sort(searchHitsByScore(hits))
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+type searchHitsByScore []SearchHit
+
+func (hits searchHitsByScore) Len() int      { return len(hits) }
+func (hits searchHitsByScore) Swap(i, j int) { hits[i], hits[j] = hits[j], hits[i] }
+func (hits searchHitsByScore) Less(i, j int) bool {
+	if hits[i].Score != hits[j].Score {
+		return hits[i].Score > hits[j].Score
+	}
+	return hits[i].DocID < hits[j].DocID
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+func TestSearchTerms(t *testing.T) {
+	assert.DeepEquals(t, searchTerms("Hello, World! It's 2016 -- Ünïcode"),
+		[]string{"hello", "world", "it", "s", "2016", "ünïcode"})
+
+	terms := map[string]int{}
+	addSearchTerms(terms, []interface{}{"red fish", map[string]interface{}{"x": "blue fish"}, 3.0})
+	assert.DeepEquals(t, terms, map[string]int{"red": 1, "blue": 1, "fish": 2})
+}
+
+func waitForSearchIndex(t *testing.T, db *Database) *SearchIndexStatus {
+	for i := 0; i < 100; i++ {
+		status, err := db.SearchIndexStatus()
+		assertNoError(t, err, "SearchIndexStatus failed")
+		if status.State != SearchIndexBuilding {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Search index rebuild didn't finish")
+	return nil
+}
+
+func TestSearch(t *testing.T) {
+	dbcOptions := DatabaseContextOptions{
+		SearchOptions: &SearchOptions{Fields: []string{"title", "note.text"}},
+	}
+	context, err := NewDatabaseContext("db", testBucket(), false, dbcOptions)
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+	waitForSearchIndex(t, db)
+
+	rev1, err := db.Put("doc1", Body{"title": "Shopping list", "note": map[string]interface{}{"text": "Apples and pears"}, "channels": []string{"alice"}})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("doc2", Body{"title": "Pears, pears, pears", "channels": []string{"bob"}})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("doc3", Body{"title": "Apple pie", "author": "pears", "channels": []string{"alice"}})
+	assertNoError(t, err, "Couldn't create document")
+	db.changeCache.waitForSequence(3)
+
+	hitIDs := func(query string) (ids []string) {
+		hits, err := db.Search(query, 0)
+		assertNoError(t, err, "Search failed")
+		for _, hit := range hits {
+			ids = append(ids, hit.DocID)
+		}
+		return
+	}
+
+	// Unindexed fields aren't searched, and docs with more occurrences rank higher:
+	assert.DeepEquals(t, hitIDs("pears"), []string{"doc2", "doc1"})
+	assert.DeepEquals(t, hitIDs("PEARS apples"), []string{"doc1"})
+	assert.DeepEquals(t, hitIDs("app*"), []string{"doc1", "doc3"})
+	assert.DeepEquals(t, hitIDs("cherries"), []string(nil))
+	_, err = db.Search("  ", 0)
+	assertHTTPError(t, err, 400)
+
+	// Updates and deletions are picked up from the change feed:
+	_, err = db.Put("doc1", Body{"_rev": rev1, "title": "Groceries", "channels": []string{"alice"}})
+	assertNoError(t, err, "Couldn't update document")
+	db.changeCache.waitForSequence(4)
+	assert.DeepEquals(t, hitIDs("pears"), []string{"doc2"})
+	assert.DeepEquals(t, hitIDs("groceries"), []string{"doc1"})
+
+	// A user only gets hits in channels they can read:
+	authenticator := db.Authenticator()
+	user, _ := authenticator.NewUser("alice", "letmein", channels.SetOf("alice"))
+	authenticator.Save(user)
+	db.user, _ = authenticator.GetUser("alice")
+	assert.DeepEquals(t, hitIDs("pears"), []string(nil))
+	assert.DeepEquals(t, hitIDs("apple"), []string{"doc3"})
+	db.user = nil
+
+	// A rebuild produces the same index:
+	before, _ := db.SearchIndexStatus()
+	_, err = db.StartSearchIndexRebuild()
+	assertNoError(t, err, "Couldn't start rebuild")
+	after := waitForSearchIndex(t, db)
+	assert.Equals(t, after.State, SearchIndexReady)
+	assert.Equals(t, after.DocCount, 3)
+	assert.Equals(t, after.TermCount, before.TermCount)
+	assert.DeepEquals(t, hitIDs("groceries"), []string{"doc1"})
+}
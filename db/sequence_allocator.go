@@ -19,6 +19,7 @@ import (
 
 const (
 	kMaxIncrRetries = 3
+	kSyncSeqKey     = "_sync:seq" // Counter the sequences are allocated from
 )
 
 type sequenceAllocator struct {
@@ -35,7 +36,7 @@ func newSequenceAllocator(bucket base.Bucket) (*sequenceAllocator, error) {
 
 func (s *sequenceAllocator) lastSequence() (uint64, error) {
 	dbExpvars.Add("sequence_gets", 1)
-	last, err := s.incrWithRetry("_sync:seq", 0)
+	last, err := s.incrWithRetry(kSyncSeqKey, 0)
 	if err != nil {
 		base.Warn("Error from Incr in lastSequence(): %v", err)
 	}
@@ -60,7 +61,7 @@ func (s *sequenceAllocator) _reserveSequences(numToReserve uint64) error {
 		//OPT: Could remember multiple discontiguous ranges of free sequences
 	}
 	dbExpvars.Add("sequence_reserves", 1)
-	max, err := s.incrWithRetry("_sync:seq", numToReserve)
+	max, err := s.incrWithRetry(kSyncSeqKey, numToReserve)
 	if err != nil {
 		base.Warn("Error from Incr in _reserveSequences(%d): %v", numToReserve, err)
 		return err
@@ -83,7 +84,10 @@ func (s *sequenceAllocator) incrWithRetry(key string, numToReserve uint64) (uint
 	retries := 0
 	for retries < kMaxIncrRetries {
 		max, err = s.bucket.Incr(key, numToReserve, numToReserve, 0)
-		if err != nil {
+		if _, ok := err.(*base.BucketUnavailableError); ok {
+			// The bucket won't accept requests for a while
+			return 0, err
+		} else if err != nil {
 			retries++
 			base.Warn("Error from Incr in sequence allocator (%d) - attempt (%d/%d): %v", numToReserve, retries, kMaxIncrRetries, err)
 			time.Sleep(10 * time.Millisecond)
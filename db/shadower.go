@@ -1,12 +1,15 @@
 package db
 
 import (
+	"crypto/md5"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/couchbase/go-couchbase"
 
@@ -15,27 +18,89 @@ import (
 	"github.com/couchbase/sync_gateway/channels"
 )
 
+// Conflict policies for changes made to both the local and external bucket before either
+// change has been synced.  A policy can also be a JavaScript function(local, remote) that
+// returns the merged body.
+const (
+	ShadowRemoteWins = "remote_wins" // The external bucket's change replaces the local one (default)
+	ShadowLocalWins  = "local_wins"  // The local change is pushed back over the external one
+)
+
+// How often the shadower saves the position it's reached in the external bucket's feed
+const kShadowCheckpointInterval = 5 * time.Second
+
+// Options for a Shadower.
+type ShadowerOptions struct {
+	DocIDPattern   *regexp.Regexp // Optional regex that key/doc IDs must match
+	ConflictPolicy string         // ShadowRemoteWins, ShadowLocalWins or a JS function(local, remote)
+}
+
 // Bidirectional sync with an external Couchbase bucket.
-// Watches the bucket's tap feed and applies changes to the matching managed document.
+// Watches the bucket's DCP or tap feed and applies changes to the matching managed document.
 // Accepts local change notifications and makes equivalent changes to the external bucket.
 // See: https://github.com/couchbase/sync_gateway/wiki/Bucket-Shadowing
 type Shadower struct {
-	context              *DatabaseContext // Database
-	bucket               base.Bucket      // External bucket we sync with
-	tapFeed              base.TapFeed     // Observes changes to bucket
-	docIDPattern         *regexp.Regexp   // Optional regex that key/doc IDs must match
-	pullCount, pushCount uint64           // Used for testing
+	context              *DatabaseContext             // Database
+	bucket               base.Bucket                  // External bucket we sync with
+	tapFeed              base.TapFeed                 // Observes changes to bucket, if it can't checkpoint
+	checkpointFeed       base.CheckpointedFeed        // Observes changes to bucket from the saved checkpoints
+	docIDPattern         *regexp.Regexp               // Optional regex that key/doc IDs must match
+	conflictResolver     *JSEventFunction             // Conflict policy function, if any
+	localWins            bool                         // Conflict policy, if there's no function
+	checkpoints          shadowCheckpoints            // Positions of the changes pulled so far
+	checkpointsChanged   bool                         // True if the checkpoints changed since they were saved
+	checkpointLock       sync.Mutex                   // Protects checkpoints
+	pushed               map[string]map[string]string // Revs pushed but not yet echoed: docid -> digest -> revid
+	pushedLock           sync.Mutex                   // Protects pushed
+	pullCount, pushCount uint64                       // Used for testing
+}
+
+// The positions the shadower has reached in each vbucket of the external bucket's DCP feed,
+// as saved in the database's bucket.
+type shadowCheckpoints struct {
+	Bucket      string                            `json:"bucket"` // Name of the external bucket
+	Checkpoints map[uint16]base.VbucketCheckpoint `json:"-"`
+	List        []base.VbucketCheckpoint          `json:"checkpoints"`
 }
 
 // Creates a new Shadower.
-func NewShadower(context *DatabaseContext, bucket base.Bucket, docIDPattern *regexp.Regexp) (*Shadower, error) {
-	tapFeed, err := bucket.StartTapFeed(sgbucket.TapArguments{Backfill: 0, Notify: func(bucket string, err error) {
+func NewShadower(context *DatabaseContext, bucket base.Bucket, options ShadowerOptions) (*Shadower, error) {
+	s := &Shadower{
+		context:      context,
+		bucket:       bucket,
+		docIDPattern: options.DocIDPattern,
+		pushed:       make(map[string]map[string]string),
+	}
+	switch policy := strings.TrimSpace(options.ConflictPolicy); {
+	case policy == "" || policy == ShadowRemoteWins:
+	case policy == ShadowLocalWins:
+		s.localWins = true
+	case strings.HasPrefix(policy, "function"):
+		s.conflictResolver = NewJSEventFunction(policy)
+	default:
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid shadow conflict policy %q", policy)
+	}
+
+	notify := func(bucket string, err error) {
 		context.TakeDbOffline("Lost shadower TAP Feed")
-	}})
+	}
+	if checkpointBucket, ok := bucket.(base.CheckpointedFeedBucket); ok {
+		s.loadCheckpoints()
+		feed, err := checkpointBucket.StartCheckpointedFeed(s.checkpoints.List, notify)
+		if err == nil {
+			s.checkpointFeed = feed
+			go s.readCheckpointedFeed()
+			return s, nil
+		} else if err != base.ErrCheckpointsUnsupported {
+			return nil, err
+		}
+	}
+
+	tapFeed, err := bucket.StartTapFeed(sgbucket.TapArguments{Backfill: 0, Notify: notify})
 	if err != nil {
 		return nil, err
 	}
-	s := &Shadower{context: context, bucket: bucket, tapFeed: tapFeed, docIDPattern: docIDPattern}
+	s.tapFeed = tapFeed
 	go s.readTapFeed()
 	return s, nil
 }
@@ -45,6 +110,12 @@ func (s *Shadower) Stop() {
 	if s != nil && s.tapFeed != nil {
 		s.tapFeed.Close()
 	}
+	if s != nil && s.checkpointFeed != nil {
+		s.checkpointFeed.Close()
+		s.checkpointLock.Lock()
+		s.saveCheckpoints()
+		s.checkpointLock.Unlock()
+	}
 }
 
 func (s *Shadower) docIDMatches(docID string) bool {
@@ -69,19 +140,7 @@ func (s *Shadower) readTapFeed() {
 			vbucketsFilling++
 			//base.LogTo("Shadow", "Reading history of external bucket")
 		case sgbucket.TapMutation, sgbucket.TapDeletion:
-			key := string(event.Key)
-			if !s.docIDMatches(key) {
-				break
-			}
-			isDeletion := event.Opcode == sgbucket.TapDeletion
-			if !isDeletion && event.Expiry > 0 {
-				break // ignore ephemeral documents
-			}
-			err := s.pullDocument(key, event.Value, isDeletion, event.Sequence, event.Flags)
-			if err != nil {
-				base.Warn("Error applying change %q from external bucket: %v", key, err)
-			}
-			atomic.AddUint64(&s.pullCount, 1)
+			s.pullEvent(event)
 		case sgbucket.TapEndBackfill:
 			if vbucketsFilling--; vbucketsFilling == 0 {
 				base.LogTo("Shadow", "Caught up with history of external bucket")
@@ -91,6 +150,48 @@ func (s *Shadower) readTapFeed() {
 	base.LogTo("Shadow", "End of tap feed(?)")
 }
 
+// Main loop that pulls changes from the external bucket's DCP feed, saving its position every
+// kShadowCheckpointInterval. (Runs in its own goroutine.)
+func (s *Shadower) readCheckpointedFeed() {
+	ticker := time.NewTicker(kShadowCheckpointInterval)
+	defer ticker.Stop()
+	events := s.checkpointFeed.Events()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				base.LogTo("Shadow", "End of DCP feed(?)")
+				return
+			}
+			s.pullEvent(event.TapEvent)
+			s.setCheckpoint(event.Checkpoint)
+		case <-ticker.C:
+			s.checkpointLock.Lock()
+			if s.checkpointsChanged {
+				s.saveCheckpoints()
+			}
+			s.checkpointLock.Unlock()
+		}
+	}
+}
+
+// Applies a mutation or deletion from the external bucket's feed.
+func (s *Shadower) pullEvent(event sgbucket.TapEvent) {
+	key := string(event.Key)
+	if !s.docIDMatches(key) {
+		return
+	}
+	isDeletion := event.Opcode == sgbucket.TapDeletion
+	if !isDeletion && event.Expiry > 0 {
+		return // ignore ephemeral documents
+	}
+	err := s.pullDocument(key, event.Value, isDeletion, event.Sequence, event.Flags)
+	if err != nil {
+		base.Warn("Error applying change %q from external bucket: %v", key, err)
+	}
+	atomic.AddUint64(&s.pullCount, 1)
+}
+
 // Gets an external document and applies it as a new revision to the managed document.
 func (s *Shadower) pullDocument(key string, value []byte, isDeletion bool, cas uint64, flags uint32) error {
 	var body Body
@@ -102,6 +203,8 @@ func (s *Shadower) pullDocument(key string, value []byte, isDeletion bool, cas u
 			return nil
 		}
 	}
+	digest := upstreamDigest(body)
+	pushedRev := s.takePushedRev(key, digest)
 
 	db, _ := CreateDatabase(s.context)
 	expiry, err := body.getExpiry()
@@ -115,34 +218,47 @@ func (s *Shadower) pullDocument(key string, value []byte, isDeletion bool, cas u
 		}
 		base.LogTo("Shadow+", "Pulling %q, CAS=%x ... have UpstreamRev=%q, UpstreamCAS=%x", key, cas, doc.UpstreamRev, doc.UpstreamCAS)
 
-		// Compare this body to the current revision body to see if it's an echo:
-		parentRev := doc.UpstreamRev
-		newRev := doc.CurrentRev
-		if !reflect.DeepEqual(body, doc.getRevision(newRev)) {
-			// Nope, it's not. Assign it a new rev ID
-			generation, _ := parseRevID(parentRev)
-			newRev = createRevID(generation+1, parentRev, body)
+		// If the change is an echo of a revision pushed from here, or the remote body hasn't
+		// changed, just record the remote doc's new CAS:
+		upstreamRev := ""
+		if pushedRev != "" && doc.History.contains(pushedRev) {
+			upstreamRev = pushedRev
+		} else if doc.CurrentRev != "" && upstreamDigest(doc.currentRevisionBody()) == digest {
+			upstreamRev = doc.CurrentRev
+		} else if digest == doc.UpstreamDigest {
+			upstreamRev = doc.UpstreamRev
 		}
-		doc.UpstreamRev = newRev
-		doc.UpstreamCAS = &cas
-		body["_rev"] = newRev
-		if doc.History[newRev] == nil {
-			// It's a new rev, so add it to the history:
-			if parentRev != "" && !doc.History.contains(parentRev) {
-				// parent rev does not exist in the doc history
-				// set parentRev to "", this will create a  new conflicting
-				//branch in the revtree
-				base.Warn("Shadow: Adding revision as conflict branch, parent id %q is missing", parentRev)
-				parentRev = ""
+		if upstreamRev != "" {
+			base.LogTo("Shadow+", "Not pulling %q, CAS=%x (echo of rev %q)", key, cas, upstreamRev)
+			doc.setUpstream(upstreamRev, cas, digest)
+			return doc.currentRevisionBody(), nil, nil
+		}
+
+		// It's a real change.  If the local doc has changed too since they were last in sync,
+		// the conflict policy decides what the new revision is:
+		newBody := body
+		if doc.CurrentRev != doc.UpstreamRev {
+			newBody = s.resolveConflict(doc, body)
+			if newBody == nil {
+				base.LogTo("Shadow", "Not pulling %q, CAS=%x (local rev %q wins conflict)", key, cas, doc.CurrentRev)
+				doc.setUpstream(doc.UpstreamRev, cas, digest) // Local rev will be pushed again
+				return doc.currentRevisionBody(), nil, nil
 			}
-			doc.History.addRevision(RevInfo{ID: newRev, Parent: parentRev, Deleted: isDeletion})
-			base.LogTo("Shadow", "Pulling %q, CAS=%x --> rev %q", key, cas, newRev)
+		}
+		parentRev := doc.CurrentRev
+		generation, _ := parseRevID(parentRev)
+		newRev := createRevID(generation+1, parentRev, newBody)
+		newBody["_rev"] = newRev
+		if upstreamDigest(newBody) == digest {
+			doc.setUpstream(newRev, cas, digest)
 		} else {
-			// We already have this rev; but don't cancel, because we do need to update the
-			// doc's UpstreamRev/UpstreamCAS fields.
-			base.LogTo("Shadow+", "Not pulling %q, CAS=%x (echo of rev %q)", key, cas, newRev)
+			doc.setUpstream(doc.UpstreamRev, cas, digest) // Merged rev will be pushed
+		}
+		if doc.History[newRev] == nil {
+			doc.History.addRevision(RevInfo{ID: newRev, Parent: parentRev, Deleted: newBody["_deleted"] == true})
+			base.LogTo("Shadow", "Pulling %q, CAS=%x --> rev %q", key, cas, newRev)
 		}
-		return body, nil, nil
+		return newBody, nil, nil
 	})
 	if err == couchbase.UpdateCancel {
 		err = nil
@@ -150,6 +266,119 @@ func (s *Shadower) pullDocument(key string, value []byte, isDeletion bool, cas u
 	return err
 }
 
+// Returns the body that resolves a conflict between the local doc's current revision and a
+// change to the remote doc, or nil if the local revision wins.
+func (s *Shadower) resolveConflict(doc *document, remote Body) Body {
+	dbExpvars.Add("shadow_conflicts", 1)
+	if s.conflictResolver == nil {
+		if s.localWins {
+			return nil
+		}
+		return remote
+	}
+	local := stripSpecialProperties(doc.currentRevisionBody())
+	result, err := s.conflictResolver.Call(local, stripSpecialProperties(remote))
+	if merged, ok := result.(map[string]interface{}); ok && err == nil {
+		return stripSpecialProperties(Body(merged))
+	}
+	base.Warn("Shadow: Conflict resolver didn't return a body for doc %q (err=%v); using remote revision", doc.ID, err)
+	return remote
+}
+
+// Records the state of the remote doc.
+func (doc *document) setUpstream(revid string, cas uint64, digest string) {
+	doc.UpstreamRev = revid
+	doc.UpstreamCAS = &cas
+	doc.UpstreamDigest = digest
+}
+
+// Returns a copy of the current revision's body, for saving the doc without adding a revision.
+func (doc *document) currentRevisionBody() Body {
+	body := doc.body.ShallowCopy()
+	body["_rev"] = doc.CurrentRev
+	if doc.hasFlag(channels.Deleted) {
+		body["_deleted"] = true
+	}
+	return body
+}
+
+// Returns a digest of a document body, ignoring the special properties other than "_deleted"
+// and "_attachments", for telling whether the remote doc has changed.
+func upstreamDigest(body Body) string {
+	digester := md5.New()
+	digester.Write(canonicalEncoding(stripSpecialProperties(body)))
+	return fmt.Sprintf("%x", digester.Sum(nil))
+}
+
+// Remembers a revision pushed to the external bucket, so its echo can be recognized even if
+// the local doc has changed again by the time the echo arrives.
+func (s *Shadower) addPushedRev(docid string, digest string, revid string) {
+	s.pushedLock.Lock()
+	defer s.pushedLock.Unlock()
+	if s.pushed[docid] == nil {
+		s.pushed[docid] = make(map[string]string)
+	}
+	s.pushed[docid][digest] = revid
+}
+
+// Returns the pushed revision a remote change is an echo of, if any.  The feed may skip
+// earlier echoes, so those are forgotten too.
+func (s *Shadower) takePushedRev(docid string, digest string) string {
+	s.pushedLock.Lock()
+	defer s.pushedLock.Unlock()
+	revid, found := s.pushed[docid][digest]
+	if found {
+		delete(s.pushed, docid)
+	}
+	return revid
+}
+
+func (s *Shadower) checkpointsKey() string {
+	return KSyncKeyPrefix + "shadow_checkpoints"
+}
+
+// Loads the saved feed checkpoints, unless they're for a different external bucket.
+func (s *Shadower) loadCheckpoints() {
+	s.checkpoints = shadowCheckpoints{Bucket: s.bucket.GetName(), Checkpoints: make(map[uint16]base.VbucketCheckpoint)}
+	var saved shadowCheckpoints
+	if err := s.context.Bucket.Get(s.checkpointsKey(), &saved); err != nil {
+		if !base.IsDocNotFoundError(err) {
+			base.Warn("Shadow: Couldn't load checkpoints; reading whole external bucket: %v", err)
+		}
+		return
+	} else if saved.Bucket != s.checkpoints.Bucket {
+		base.LogTo("Shadow", "Checkpoints are for bucket %q; reading whole external bucket", saved.Bucket)
+		return
+	}
+	for _, checkpoint := range saved.List {
+		s.checkpoints.Checkpoints[checkpoint.VbNo] = checkpoint
+	}
+	s.checkpoints.List = saved.List
+	base.LogTo("Shadow", "Resuming external bucket feed from %d vbucket checkpoints", len(saved.List))
+}
+
+// Records that the change at a checkpoint has been pulled.  The checkpoints are saved by the
+// feed's loop every kShadowCheckpointInterval.
+func (s *Shadower) setCheckpoint(checkpoint base.VbucketCheckpoint) {
+	s.checkpointLock.Lock()
+	defer s.checkpointLock.Unlock()
+	s.checkpoints.Checkpoints[checkpoint.VbNo] = checkpoint
+	s.checkpointsChanged = true
+}
+
+// Saves the checkpoints to the database's bucket.  Caller must hold checkpointLock.
+func (s *Shadower) saveCheckpoints() {
+	s.checkpoints.List = make([]base.VbucketCheckpoint, 0, len(s.checkpoints.Checkpoints))
+	for _, checkpoint := range s.checkpoints.Checkpoints {
+		s.checkpoints.List = append(s.checkpoints.List, checkpoint)
+	}
+	if err := s.context.Bucket.Set(s.checkpointsKey(), 0, s.checkpoints); err != nil {
+		base.Warn("Shadow: Couldn't save checkpoints: %v", err)
+		return
+	}
+	s.checkpointsChanged = false
+}
+
 // Saves a new local revision to the external bucket.
 func (s *Shadower) PushRevision(doc *document) {
 	defer func() { atomic.AddUint64(&s.pushCount, 1) }()
@@ -160,12 +389,14 @@ func (s *Shadower) PushRevision(doc *document) {
 	}
 
 	var err error
+	var body Body
 	if doc.Flags&channels.Deleted != 0 {
 		base.LogTo("Shadow", "Pushing %q, rev %q [deletion]", doc.ID, doc.CurrentRev)
+		body = Body{"_deleted": true}
 		err = s.bucket.Delete(doc.ID)
 	} else {
 		base.LogTo("Shadow", "Pushing %q, rev %q", doc.ID, doc.CurrentRev)
-		body := doc.getRevision(doc.CurrentRev)
+		body = doc.getRevision(doc.CurrentRev)
 		if body == nil {
 			base.Warn("Can't get rev %q.%q to push to external bucket", doc.ID, doc.CurrentRev)
 			return
@@ -174,5 +405,7 @@ func (s *Shadower) PushRevision(doc *document) {
 	}
 	if err != nil {
 		base.Warn("Error pushing rev of %q to external bucket: %v", doc.ID, err)
+	} else {
+		s.addPushedRev(doc.ID, upstreamDigest(body), doc.CurrentRev)
 	}
 }
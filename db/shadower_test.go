@@ -47,7 +47,7 @@ func TestShadowerPull(t *testing.T) {
 	db := setupTestDBForShadowing(t)
 	defer tearDownTestDB(t, db)
 
-	shadower, err := NewShadower(db.DatabaseContext, bucket, nil)
+	shadower, err := NewShadower(db.DatabaseContext, bucket, ShadowerOptions{})
 	assertNoError(t, err, "NewShadower")
 	defer shadower.Stop()
 
@@ -91,7 +91,7 @@ func TestShadowerPush(t *testing.T) {
 	defer tearDownTestDB(t, db)
 
 	var err error
-	db.Shadower, err = NewShadower(db.DatabaseContext, bucket, nil)
+	db.Shadower, err = NewShadower(db.DatabaseContext, bucket, ShadowerOptions{})
 	assertNoError(t, err, "NewShadower")
 
 	key1rev1, err := db.Put("key1", Body{"aaa": "bbb"})
@@ -137,7 +137,7 @@ func TestShadowerPushEchoCancellation(t *testing.T) {
 	defer tearDownTestDB(t, db)
 
 	var err error
-	db.Shadower, err = NewShadower(db.DatabaseContext, bucket, nil)
+	db.Shadower, err = NewShadower(db.DatabaseContext, bucket, ShadowerOptions{})
 	assertNoError(t, err, "NewShadower")
 
 	// Push an existing doc revision (the way a client's push replicator would)
@@ -151,8 +151,9 @@ func TestShadowerPushEchoCancellation(t *testing.T) {
 	assert.Equals(t, len(doc.History), 1)
 }
 
-// Ensure that a new rev pushed from a shadow bucket update, wehre the UpstreamRev does not exist as a parent func init() {
-// the documents rev tree does not panic, it should generate a new conflicting branch instead.
+// Ensure that a new rev pulled from a shadow bucket update, where the UpstreamRev doesn't exist
+// in the document's rev tree, doesn't panic.  The pulled rev is added to the current revision,
+// since the doc has changed locally since it was in sync with the shadow bucket.
 // see #1603
 func TestShadowerPullRevisionWithMissingParentRev(t *testing.T) {
 
@@ -170,7 +171,7 @@ func TestShadowerPullRevisionWithMissingParentRev(t *testing.T) {
 	defer tearDownTestDB(t, db)
 
 	var err error
-	db.Shadower, err = NewShadower(db.DatabaseContext, bucket, nil)
+	db.Shadower, err = NewShadower(db.DatabaseContext, bucket, ShadowerOptions{})
 	assertNoError(t, err, "NewShadower")
 
 	// Push an existing doc revision (the way a client's push replicator would)
@@ -207,11 +208,16 @@ func TestShadowerPullRevisionWithMissingParentRev(t *testing.T) {
 		return atomic.LoadUint64(&db.Shadower.pullCount) >= 2
 	})
 
-	//Assert that we can get the two conflicing revisions
-	gotBody, err := db.GetRev("foo", "1-madeup", false, nil)
-	assert.DeepEquals(t, gotBody, Body{"_id": "foo", "a": "b", "_rev": "1-madeup"})
-	gotBody, err = db.GetRev("foo", "2-edce85747420ad6781bdfccdebf82180", false, nil)
-	assert.DeepEquals(t, gotBody, Body{"_id": "foo", "a": "c", "_rev": "2-edce85747420ad6781bdfccdebf82180"})
+	// The pulled revision is a child of the current one, not a conflicting branch:
+	newRev := createRevID(2, "1-madeup", Body{"a": "c"})
+	doc, err := db.GetDoc("foo")
+	assertNoError(t, err, "GetDoc")
+	assert.Equals(t, doc.CurrentRev, newRev)
+	assert.DeepEquals(t, doc.History.GetLeaves(), []string{newRev})
+	assert.Equals(t, doc.History[newRev].Parent, "1-madeup")
+	gotBody, err := db.GetRev("foo", newRev, false, nil)
+	assertNoError(t, err, "GetRev")
+	assert.DeepEquals(t, gotBody, Body{"_id": "foo", "a": "c", "_rev": newRev})
 }
 
 func TestShadowerPattern(t *testing.T) {
@@ -225,7 +231,7 @@ func TestShadowerPattern(t *testing.T) {
 	defer tearDownTestDB(t, db)
 
 	pattern, _ := regexp.Compile(`key\d+`)
-	shadower, err := NewShadower(db.DatabaseContext, bucket, pattern)
+	shadower, err := NewShadower(db.DatabaseContext, bucket, ShadowerOptions{DocIDPattern: pattern})
 	assertNoError(t, err, "NewShadower")
 	defer shadower.Stop()
 
@@ -241,3 +247,107 @@ func TestShadowerPattern(t *testing.T) {
 	assert.True(t, docI == nil)
 	assert.DeepEquals(t, doc2.body, Body{"bar": float64(-1)})
 }
+
+// Changes made in both buckets before they've been synced are resolved by the conflict policy,
+// instead of creating a conflicting branch.
+func TestShadowerConflictPolicy(t *testing.T) {
+	bucket := makeExternalBucket()
+	defer bucket.Close()
+
+	pullConflict := func(docid string, policy string) *document {
+		db := setupTestDBForShadowing(t)
+		defer tearDownTestDB(t, db)
+		shadower, err := NewShadower(db.DatabaseContext, bucket, ShadowerOptions{ConflictPolicy: policy})
+		assertNoError(t, err, "NewShadower")
+		defer shadower.Stop()
+
+		rev1, err := db.Put(docid, Body{"v": "one"})
+		assertNoError(t, err, "Put")
+		assertNoError(t, shadower.pullDocument(docid, []byte(`{"v":"one"}`), false, 1, 0), "pullDocument")
+		_, err = db.Put(docid, Body{"_rev": rev1, "v": "local"})
+		assertNoError(t, err, "Put")
+		assertNoError(t, shadower.pullDocument(docid, []byte(`{"v":"remote"}`), false, 2, 0), "pullDocument")
+		doc, err := db.GetDoc(docid)
+		assertNoError(t, err, "GetDoc")
+		assert.False(t, doc.hasFlag(channels.Conflict))
+		assert.Equals(t, *doc.UpstreamCAS, uint64(2))
+		return doc
+	}
+
+	doc := pullConflict("remote", "")
+	assert.DeepEquals(t, doc.body, Body{"v": "remote"})
+	assert.Equals(t, doc.UpstreamRev, doc.CurrentRev)
+	assert.Equals(t, len(doc.History), 3)
+
+	// The local rev stays current, and isn't marked as upstream so it'll be pushed again:
+	doc = pullConflict("local", ShadowLocalWins)
+	assert.DeepEquals(t, doc.body, Body{"v": "local"})
+	assert.True(t, doc.UpstreamRev != doc.CurrentRev)
+	assert.Equals(t, len(doc.History), 2)
+
+	doc = pullConflict("merged", `function(local, remote) { return {v: local.v + "+" + remote.v}; }`)
+	assert.DeepEquals(t, doc.body, Body{"v": "local+remote"})
+	assert.True(t, doc.UpstreamRev != doc.CurrentRev)
+	assert.Equals(t, len(doc.History), 3)
+
+	db := setupTestDBForShadowing(t)
+	defer tearDownTestDB(t, db)
+	_, err := NewShadower(db.DatabaseContext, bucket, ShadowerOptions{ConflictPolicy: "whatever"})
+	assert.True(t, err != nil)
+}
+
+// An echo of a pushed revision that arrives after the local doc has changed again isn't
+// mistaken for a conflicting remote change.
+func TestShadowerDelayedEcho(t *testing.T) {
+	bucket := makeExternalBucket()
+	defer bucket.Close()
+
+	db := setupTestDBForShadowing(t)
+	defer tearDownTestDB(t, db)
+	shadower, err := NewShadower(db.DatabaseContext, bucket, ShadowerOptions{})
+	assertNoError(t, err, "NewShadower")
+	defer shadower.Stop()
+
+	rev1, _ := db.Put("doc", Body{"v": "one"})
+	doc, _ := db.GetDoc("doc")
+	shadower.PushRevision(doc)
+	rev2, err := db.Put("doc", Body{"_rev": rev1, "v": "two"})
+	assertNoError(t, err, "Put")
+
+	assertNoError(t, shadower.pullDocument("doc", []byte(`{"v":"one"}`), false, 1, 0), "pullDocument")
+	doc, _ = db.GetDoc("doc")
+	assert.DeepEquals(t, doc.body, Body{"v": "two"})
+	assert.Equals(t, doc.CurrentRev, rev2)
+	assert.Equals(t, doc.UpstreamRev, rev1)
+	assert.Equals(t, len(doc.History), 2)
+}
+
+func TestShadowerCheckpoints(t *testing.T) {
+	bucket := makeExternalBucket()
+	defer bucket.Close()
+
+	db := setupTestDBForShadowing(t)
+	defer tearDownTestDB(t, db)
+	shadower, err := NewShadower(db.DatabaseContext, bucket, ShadowerOptions{})
+	assertNoError(t, err, "NewShadower")
+	defer shadower.Stop()
+
+	shadower.loadCheckpoints()
+	assert.Equals(t, len(shadower.checkpoints.List), 0)
+	shadower.setCheckpoint(base.VbucketCheckpoint{VbNo: 1, VbUUID: 1234, Seq: 10})
+	shadower.setCheckpoint(base.VbucketCheckpoint{VbNo: 1, VbUUID: 1234, Seq: 11})
+	shadower.checkpointLock.Lock()
+	shadower.saveCheckpoints()
+	shadower.checkpointLock.Unlock()
+
+	shadower.loadCheckpoints()
+	assert.DeepEquals(t, shadower.checkpoints.List, []base.VbucketCheckpoint{{VbNo: 1, VbUUID: 1234, Seq: 11}})
+
+	// Checkpoints of a different external bucket are ignored:
+	shadower.checkpoints.Bucket = "other_bucket"
+	shadower.checkpointLock.Lock()
+	shadower.saveCheckpoints()
+	shadower.checkpointLock.Unlock()
+	shadower.loadCheckpoints()
+	assert.Equals(t, len(shadower.checkpoints.List), 0)
+}
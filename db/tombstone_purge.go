@@ -0,0 +1,386 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// Key of the doc recording the latest sequence of any purged tombstone.
+const kPurgeMarkerKey = "_sync:purgemarker"
+
+// Default interval between runs of the background purge
+const kDefaultTombstonePurgeInterval = 1 * time.Hour
+
+// How long changes feeds rely on the cached purge marker before reloading it, to pick up purges
+// run by other nodes.  This node's own purges update the cache straight away.
+var PurgeMarkerRefreshInterval = 1 * time.Minute
+
+// Tombstone purging settings, from the database config.
+type TombstonePurgeOptions struct {
+	RetentionSecs int `json:"retention_secs"`          // Deleted docs are purged this long after their deletion
+	IntervalSecs  int `json:"interval_secs,omitempty"` // How often to look for expired tombstones (default 1 hour)
+}
+
+// Checks that the options are valid.
+func (options *TombstonePurgeOptions) Validate() error {
+	if options == nil {
+		return nil
+	}
+	if options.RetentionSecs <= 0 {
+		return fmt.Errorf("retention_secs must be positive")
+	}
+	if options.IntervalSecs < 0 {
+		return fmt.Errorf("interval_secs can't be negative")
+	}
+	return nil
+}
+
+// Stored in the bucket under kPurgeMarkerKey.  A changes feed starting before PurgeSeq may be
+// missing deletions, so clients have to resync from scratch instead.
+type PurgeMarker struct {
+	PurgeSeq uint64     `json:"purge_seq"`           // Highest sequence of any purged tombstone
+	PurgedAt *time.Time `json:"purged_at,omitempty"` // When PurgeSeq was last raised
+}
+
+// The purge marker as last loaded or raised by this node, so that changes requests don't each
+// have to read it from the bucket.
+type purgeMarkerCache struct {
+	marker   PurgeMarker
+	loadedAt time.Time // Zero if it's never been loaded
+	lock     sync.Mutex
+}
+
+// Reported by the admin API's _tombstone_purge endpoint.
+type TombstonePurgeStatus struct {
+	RetentionSecs int        `json:"retention_secs"`
+	PurgeSeq      uint64     `json:"purge_seq"`
+	Running       bool       `json:"running"`
+	Purged        int        `json:"purged"` // Tombstones purged by the current or last run
+	StartTime     *time.Time `json:"start_time,omitempty"`
+	EndTime       *time.Time `json:"end_time,omitempty"`
+	Error         string     `json:"error,omitempty"`
+}
+
+// Periodically deletes the documents whose current revision was deleted longer ago than the
+// retention period, sync metadata and all.  Before purging a tombstone it raises the purge marker
+// to the tombstone's sequence, so that clients that haven't yet seen the deletion are told to
+// resync rather than silently keeping the doc.  Tombstones without a time_saved, written by
+// versions that didn't record it, are kept, since there's no telling how old they are.
+type tombstonePurger struct {
+	context   *DatabaseContext
+	retention time.Duration
+	interval  time.Duration
+	status    TombstonePurgeStatus // State of the current or last run
+	stopped   bool
+	lock      sync.Mutex // Guards status and stopped
+}
+
+func newTombstonePurger(context *DatabaseContext, options *TombstonePurgeOptions) *tombstonePurger {
+	purger := &tombstonePurger{
+		context:   context,
+		retention: time.Duration(options.RetentionSecs) * time.Second,
+		interval:  kDefaultTombstonePurgeInterval,
+		status:    TombstonePurgeStatus{RetentionSecs: options.RetentionSecs},
+	}
+	if options.IntervalSecs > 0 {
+		purger.interval = time.Duration(options.IntervalSecs) * time.Second
+	}
+	go func() {
+		for !purger.isStopped() {
+			time.Sleep(purger.interval)
+			if purger.start() {
+				purger.run()
+			}
+		}
+	}()
+	return purger
+}
+
+func (purger *tombstonePurger) isStopped() bool {
+	purger.lock.Lock()
+	defer purger.lock.Unlock()
+	return purger.stopped
+}
+
+// Stops the background task.  A run in progress ends when it finds the bucket closed.
+func (purger *tombstonePurger) stop() {
+	purger.lock.Lock()
+	purger.stopped = true
+	purger.lock.Unlock()
+}
+
+// Marks a run as started; returns false if one is already running or the purger is stopped.
+func (purger *tombstonePurger) start() bool {
+	purger.lock.Lock()
+	defer purger.lock.Unlock()
+	if purger.status.Running || purger.stopped {
+		return false
+	}
+	now := time.Now()
+	purger.status = TombstonePurgeStatus{
+		RetentionSecs: purger.status.RetentionSecs,
+		Running:       true,
+		StartTime:     &now,
+	}
+	return true
+}
+
+func (purger *tombstonePurger) run() {
+	context := purger.context
+	base.Logf("Purging tombstones of %q older than %v", context.Name, purger.retention)
+	cutoff := time.Now().Add(-purger.retention)
+	err := purger.forEachExpiredPage(cutoff, func(docIDs []string, maxSeq uint64) error {
+		// The marker has to be raised before the tombstones go away, in case this node dies halfway:
+		if err := purger.raisePurgeMarker(maxSeq); err != nil {
+			return err
+		}
+		for _, docID := range docIDs {
+			purged, err := purger.purgeTombstone(docID, cutoff)
+			if err != nil {
+				base.Warn("Error purging tombstone %q: %v", docID, err)
+			} else if purged {
+				purger.lock.Lock()
+				purger.status.Purged++
+				purger.lock.Unlock()
+			}
+		}
+		return nil
+	})
+
+	purger.lock.Lock()
+	defer purger.lock.Unlock()
+	now := time.Now()
+	purger.status.Running = false
+	purger.status.EndTime = &now
+	if err != nil {
+		base.Warn("Purging tombstones of %q failed: %v", context.Name, err)
+		purger.status.Error = err.Error()
+	} else {
+		base.Logf("Purged %d tombstones of %q", purger.status.Purged, context.Name)
+	}
+}
+
+// Queries the tombstones view a page at a time, calling the callback with the IDs of the docs
+// deleted before the cutoff and the highest of their sequences.
+func (purger *tombstonePurger) forEachExpiredPage(cutoff time.Time, callback func([]string, uint64) error) error {
+	var vres struct {
+		Rows []struct {
+			Key   string
+			Value struct {
+				TimeSaved time.Time `json:"t"`
+				Sequence  uint64    `json:"s"`
+			}
+		}
+	}
+	startKey := ""
+	for {
+		opts := Body{"stale": false, "reduce": false, "limit": allDocsPageSize}
+		if startKey != "" {
+			opts["startkey"] = startKey
+		}
+		vres.Rows = nil
+		err := purger.withBucket(func(bucket base.Bucket) error {
+			return bucket.ViewCustom(DesignDocSyncHousekeeping, ViewTombstones, opts, &vres)
+		})
+		if err != nil {
+			return err
+		}
+
+		rows := vres.Rows
+		if len(rows) > 0 && startKey != "" && rows[0].Key == startKey {
+			rows = rows[1:] // startkey is inclusive
+		}
+		var docIDs []string
+		var maxSeq uint64
+		for _, row := range rows {
+			if !row.Value.TimeSaved.IsZero() && row.Value.TimeSaved.Before(cutoff) {
+				docIDs = append(docIDs, row.Key)
+				if row.Value.Sequence > maxSeq {
+					maxSeq = row.Value.Sequence
+				}
+			}
+		}
+		if len(docIDs) > 0 {
+			if err := callback(docIDs, maxSeq); err != nil {
+				return err
+			}
+		}
+		if len(vres.Rows) < allDocsPageSize || len(rows) == 0 {
+			return nil
+		}
+		startKey = rows[len(rows)-1].Key
+	}
+}
+
+// Calls the function with the database's bucket, while making sure it doesn't get closed.
+func (purger *tombstonePurger) withBucket(fn func(base.Bucket) error) error {
+	purger.context.BucketLock.RLock()
+	defer purger.context.BucketLock.RUnlock()
+	if purger.context.Bucket == nil {
+		return fmt.Errorf("Database was closed")
+	}
+	return fn(purger.context.Bucket)
+}
+
+// Deletes a doc from the bucket if it's still a tombstone saved before the cutoff; it may have
+// been updated since the view was queried.
+func (purger *tombstonePurger) purgeTombstone(docID string, cutoff time.Time) (bool, error) {
+	var oldStates map[string]int
+	err := purger.withBucket(func(bucket base.Bucket) error {
+		return bucket.Update(docID, 0, func(currentValue []byte) ([]byte, error) {
+			if currentValue == nil {
+				return nil, couchbase.UpdateCancel
+			}
+			doc, err := unmarshalDocument(docID, currentValue)
+			if err != nil {
+				return nil, err
+			}
+			if !doc.hasFlag(channels.Deleted) || doc.TimeSaved.IsZero() || !doc.TimeSaved.Before(cutoff) {
+				return nil, couchbase.UpdateCancel
+			}
+			oldStates = doc.channelStates()
+			return nil, nil // deletes the doc
+		})
+	})
+	if err == couchbase.UpdateCancel {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	base.LogTo("CRUD+", "Purged tombstone %q", docID)
+	purger.context.channelCounts.docPurged(docID, oldStates)
+	return true, nil
+}
+
+// Raises the purge marker's sequence to purgeSeq, unless it's already higher.
+func (purger *tombstonePurger) raisePurgeMarker(purgeSeq uint64) error {
+	err := purger.withBucket(func(bucket base.Bucket) error {
+		return bucket.Update(kPurgeMarkerKey, 0, func(currentValue []byte) ([]byte, error) {
+			var marker PurgeMarker
+			if currentValue != nil {
+				if err := json.Unmarshal(currentValue, &marker); err != nil {
+					return nil, err
+				}
+			}
+			if purgeSeq <= marker.PurgeSeq {
+				return nil, couchbase.UpdateCancel
+			}
+			now := time.Now()
+			marker.PurgeSeq = purgeSeq
+			marker.PurgedAt = &now
+			return json.Marshal(marker)
+		})
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	} else if err == nil {
+		purger.context.purgeMarker.raise(purgeSeq)
+	}
+	return err
+}
+
+// Returns the cached purge marker, reloading it from the bucket if it's older than
+// PurgeMarkerRefreshInterval.
+func (cache *purgeMarkerCache) get(bucket base.Bucket) (PurgeMarker, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.loadedAt.IsZero() || time.Since(cache.loadedAt) >= PurgeMarkerRefreshInterval {
+		var marker PurgeMarker
+		if _, err := bucket.Get(kPurgeMarkerKey, &marker); err != nil && !base.IsDocNotFoundError(err) {
+			return cache.marker, err
+		}
+		if marker.PurgeSeq > cache.marker.PurgeSeq {
+			cache.marker = marker
+		}
+		cache.loadedAt = time.Now()
+	}
+	return cache.marker, nil
+}
+
+// Records that this node has raised the purge marker to purgeSeq.
+func (cache *purgeMarkerCache) raise(purgeSeq uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if purgeSeq > cache.marker.PurgeSeq {
+		now := time.Now()
+		cache.marker = PurgeMarker{PurgeSeq: purgeSeq, PurgedAt: &now}
+	}
+}
+
+// Returns the purge marker; its PurgeSeq is 0 if no tombstones have ever been purged.
+func (context *DatabaseContext) GetPurgeMarker() (*PurgeMarker, error) {
+	var marker PurgeMarker
+	if _, err := context.Bucket.Get(kPurgeMarkerKey, &marker); err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	return &marker, nil
+}
+
+// Returns an error if tombstones later than the given sequence have been purged, since changes
+// since then would be missing those deletions.  The client has to discard its data and start
+// over from sequence 0.  Only integer sequences are checked.  Uses the cached purge marker, so
+// purges by other nodes may take up to PurgeMarkerRefreshInterval to be noticed.
+func (db *Database) checkSinceNotPurged(since SequenceID) error {
+	if db.SequenceType != IntSequenceType || since.SafeSequence() == 0 {
+		return nil
+	}
+	marker, err := db.purgeMarker.get(db.Bucket)
+	if err != nil {
+		return err
+	}
+	if since.SafeSequence() < marker.PurgeSeq {
+		return base.HTTPErrorf(http.StatusGone,
+			"Deletions up to sequence %d have been purged; discard local data and resync from since=0",
+			marker.PurgeSeq)
+	}
+	return nil
+}
+
+//////// ADMIN API:
+
+// Starts purging expired tombstones in the background, without waiting for the next scheduled run.
+func (context *DatabaseContext) StartTombstonePurge() (*TombstonePurgeStatus, error) {
+	purger := context.tombstonePurger
+	if purger == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Tombstone purging isn't enabled for this database")
+	}
+	if !purger.start() {
+		return nil, base.HTTPErrorf(http.StatusConflict, "Tombstones are already being purged")
+	}
+	go purger.run()
+	return context.TombstonePurgeStatus()
+}
+
+// Returns the state of the tombstone purger, and the current purge marker.
+func (context *DatabaseContext) TombstonePurgeStatus() (*TombstonePurgeStatus, error) {
+	purger := context.tombstonePurger
+	if purger == nil {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Tombstone purging isn't enabled for this database")
+	}
+	marker, err := context.GetPurgeMarker()
+	if err != nil {
+		return nil, err
+	}
+	purger.lock.Lock()
+	defer purger.lock.Unlock()
+	status := purger.status
+	status.PurgeSeq = marker.PurgeSeq
+	return &status, nil
+}
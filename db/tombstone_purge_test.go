@@ -0,0 +1,152 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package db
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/go.assert"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+func waitForTombstonePurge(t *testing.T, db *Database) *TombstonePurgeStatus {
+	for i := 0; i < 100; i++ {
+		status, err := db.TombstonePurgeStatus()
+		assertNoError(t, err, "TombstonePurgeStatus failed")
+		if !status.Running {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Tombstone purge didn't finish")
+	return nil
+}
+
+func TestTombstonePurgeOptions(t *testing.T) {
+	assertNoError(t, (*TombstonePurgeOptions)(nil).Validate(), "nil options should be valid")
+	assertNoError(t, (&TombstonePurgeOptions{RetentionSecs: 60}).Validate(), "Options should be valid")
+	assert.True(t, (&TombstonePurgeOptions{}).Validate() != nil)
+	assert.True(t, (&TombstonePurgeOptions{RetentionSecs: 60, IntervalSecs: -1}).Validate() != nil)
+}
+
+func TestTombstonePurge(t *testing.T) {
+	dbcOptions := DatabaseContextOptions{
+		TombstonePurgeOptions: &TombstonePurgeOptions{RetentionSecs: 3600, IntervalSecs: 3600},
+	}
+	context, err := NewDatabaseContext("db", testBucket(), false, dbcOptions)
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	defer tearDownTestDB(t, db)
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	rev1, err := db.Put("doc1", Body{"channels": []string{"A"}})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.Put("doc2", Body{"channels": []string{"A"}})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.DeleteDoc("doc1", rev1)
+	assertNoError(t, err, "Couldn't delete document")
+	db.changeCache.waitForSequence(3)
+
+	// The tombstone is newer than the retention period, so it's kept:
+	_, err = db.StartTombstonePurge()
+	assertNoError(t, err, "Couldn't start purge")
+	status := waitForTombstonePurge(t, db)
+	assert.Equals(t, status.Error, "")
+	assert.Equals(t, status.Purged, 0)
+	assert.Equals(t, status.PurgeSeq, uint64(0))
+	_, err = db.GetDoc("doc1")
+	assertNoError(t, err, "Tombstone was purged too soon")
+
+	// Once it's expired, it's purged and the purge marker moves to its sequence:
+	db.tombstonePurger.retention = 0
+	_, err = db.StartTombstonePurge()
+	assertNoError(t, err, "Couldn't start purge")
+	status = waitForTombstonePurge(t, db)
+	assert.Equals(t, status.Error, "")
+	assert.Equals(t, status.Purged, 1)
+	assert.Equals(t, status.PurgeSeq, uint64(3))
+	_, err = db.GetDoc("doc1")
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, err = db.GetDoc("doc2")
+	assertNoError(t, err, "Live doc was purged")
+
+	waitForChannelCountsSeed(t, db)
+	counts, err := db.AllChannelCounts()
+	assertNoError(t, err, "AllChannelCounts failed")
+	assert.DeepEquals(t, counts, []*ChannelCounts{{Name: "A", Docs: 1, LastSeq: 3}})
+
+	// Changes feeds that started before the purged deletion have to start over:
+	_, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 2}})
+	assertHTTPError(t, err, 410)
+	_, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 3}})
+	assertNoError(t, err, "Changes since the purge marker should succeed")
+	_, err = db.GetChanges(base.SetOf("*"), ChangesOptions{})
+	assertNoError(t, err, "Changes from the start should succeed")
+}
+
+func TestTombstonePurgeKeepsUndatedTombstones(t *testing.T) {
+	dbcOptions := DatabaseContextOptions{
+		TombstonePurgeOptions: &TombstonePurgeOptions{RetentionSecs: 3600, IntervalSecs: 3600},
+	}
+	context, err := NewDatabaseContext("db", testBucket(), false, dbcOptions)
+	assertNoError(t, err, "Couldn't create context for database 'db'")
+	db, err := CreateDatabase(context)
+	assertNoError(t, err, "Couldn't create database 'db'")
+	defer tearDownTestDB(t, db)
+
+	rev1, err := db.Put("doc1", Body{"channels": []string{"A"}})
+	assertNoError(t, err, "Couldn't create document")
+	_, err = db.DeleteDoc("doc1", rev1)
+	assertNoError(t, err, "Couldn't delete document")
+	db.changeCache.waitForSequence(2)
+
+	// Remove the tombstone's time_saved, as if it had been saved by an older version:
+	raw, _, err := db.Bucket.GetRaw("doc1")
+	assertNoError(t, err, "Couldn't get raw document")
+	var body map[string]interface{}
+	assertNoError(t, json.Unmarshal(raw, &body), "Couldn't parse raw document")
+	delete(body["_sync"].(map[string]interface{}), "time_saved")
+	raw, _ = json.Marshal(body)
+	assertNoError(t, db.Bucket.SetRaw("doc1", 0, raw), "Couldn't update raw document")
+
+	db.tombstonePurger.retention = 0
+	_, err = db.StartTombstonePurge()
+	assertNoError(t, err, "Couldn't start purge")
+	status := waitForTombstonePurge(t, db)
+	assert.Equals(t, status.Error, "")
+	assert.Equals(t, status.Purged, 0)
+	assert.Equals(t, status.PurgeSeq, uint64(0))
+	_, _, err = db.Bucket.GetRaw("doc1")
+	assertNoError(t, err, "Undated tombstone was purged")
+}
+
+func TestPurgeMarkerCache(t *testing.T) {
+	db := setupTestDB(t)
+	defer tearDownTestDB(t, db)
+	defer func(interval time.Duration) { PurgeMarkerRefreshInterval = interval }(PurgeMarkerRefreshInterval)
+	PurgeMarkerRefreshInterval = time.Hour
+
+	_, err := db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 2}})
+	assertNoError(t, err, "Changes should succeed before any purge")
+
+	// A purge by another node isn't noticed until the cached marker is refreshed:
+	assertNoError(t, db.Bucket.Set(kPurgeMarkerKey, 0, PurgeMarker{PurgeSeq: 5}), "Couldn't set purge marker")
+	_, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 2}})
+	assertNoError(t, err, "Cached purge marker should still be used")
+
+	PurgeMarkerRefreshInterval = 0
+	_, err = db.GetChanges(base.SetOf("*"), ChangesOptions{Since: SequenceID{Seq: 2}})
+	assertHTTPError(t, err, 410)
+}
@@ -21,6 +21,9 @@ type PrincipalConfig struct {
 	Password          *string  `json:"password,omitempty"`
 	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
 	RoleNames         []string `json:"roles,omitempty"`
+	// Read-only; granted by OpenID Connect ID token claims:
+	JWTRoleNames []string `json:"jwt_roles,omitempty"`
+	JWTChannels  base.Set `json:"jwt_channels,omitempty"`
 }
 
 // Check if the password in this PrincipalConfig is valid.  Only allow
@@ -75,12 +78,23 @@ func (dbc *DatabaseContext) GetPrincipal(name string, isUser bool) (info *Princi
 		info.Disabled = user.Disabled()
 		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
 		info.RoleNames = user.RoleNames().AllChannels()
+		info.JWTRoleNames = user.JWTRoles().AllChannels()
+		info.JWTChannels = user.JWTChannels().AsSet()
 	} else {
 		info.Channels = princ.Channels().AsSet()
 	}
 	return
 }
 
+// Allocates the sequence at which a change to a principal's grants takes effect, or 0 if
+// sequences are assigned by the change index.  Implements auth.PrincipalSequencer.
+func (dbc *DatabaseContext) NextPrincipalSequence() (uint64, error) {
+	if !dbc.writeSequences() {
+		return 0, nil
+	}
+	return dbc.sequences.nextSequence()
+}
+
 // Updates or creates a principal from a PrincipalConfig structure.
 func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool, allowReplace bool) (replaced bool, err error) {
 	// Get the existing principal, or if this is a POST make sure there isn't one:
@@ -21,6 +21,18 @@ import (
 // Simple Sync Gateway launcher tool.
 func main() {
 
+	// Commands that work on a database without running the server:
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			rest.ExportMain(os.Args[2:])
+			return
+		case "import":
+			rest.ImportMain(os.Args[2:])
+			return
+		}
+	}
+
 	signalchannel := make(chan os.Signal, 1)
 	signal.Notify(signalchannel, syscall.SIGHUP)
 
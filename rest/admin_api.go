@@ -12,6 +12,7 @@ package rest
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -168,13 +169,21 @@ type ReplicationConfig struct {
 	Continuous       bool        `json:"continuous"`
 	CreateTarget     bool        `json:"create_target"`
 	DocIds           []string    `json:"doc_ids"`
-	Filter           string      `json:"filter"`
+	Channels         []string    `json:"channels,omitempty"` // Same as the sync_gateway/bychannel filter
+	Filter           string      `json:"filter"`             // Built-in filter name, or a JavaScript function(doc)
 	Proxy            string      `json:"proxy"`
 	QueryParams      interface{} `json:"query_params"`
 	Cancel           bool        `json:"cancel"`
 	Async            bool        `json:"async"`
 	ChangesFeedLimit int         `json:"changes_feed_limit"`
 	ReplicationId    string      `json:"replication_id"`
+
+	// Rate limits and schedule, which can be changed without restarting the replication.
+	// Rate limits are enforced by this server, so need the source or target to be local.
+	MaxDocsPerSec    float64             `json:"max_docs_per_sec,omitempty"`
+	MaxBytesPerSec   int64               `json:"max_bytes_per_sec,omitempty"`
+	Schedule         []ReplicationWindow `json:"schedule,omitempty"`          // Runs only during these windows
+	ScheduleTimezone string              `json:"schedule_timezone,omitempty"` // IANA name; default UTC
 }
 
 func (h *handler) readReplicationParametersFromJSON(jsonData []byte) (params sgreplicate.ReplicationParameters, cancel bool, localdb bool, err error) {
@@ -193,11 +202,6 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 		return
 	}
 
-	if len(requestParams.DocIds) > 0 {
-		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate doc_ids option is not currently supported.")
-		return
-	}
-
 	if requestParams.Proxy != "" {
 		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate proxy option is not currently supported.")
 		return
@@ -249,8 +253,31 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 	params.Async = requestParams.Async
 	params.ChangesFeedLimit = requestParams.ChangesFeedLimit
 
+	// Filters other than channels are applied by a local source's _changes feed at a special
+	// URL (see replicationEndpoint), and passed to a remote source as the standard _changes
+	// parameters (see filteredSource):
+	var source replicationEndpoint
+	var namedFilter string
+	if len(requestParams.DocIds) > 0 {
+		source.DocIDs = requestParams.DocIds
+	}
+	if len(requestParams.Channels) > 0 {
+		params.Channels = requestParams.Channels
+	}
+
 	if requestParams.Filter != "" {
-		if requestParams.Filter == "sync_gateway/bychannel" {
+		if isFilterFunction(requestParams.Filter) {
+			if params.Source != nil {
+				err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate filter functions need a local source; use a design doc filter for a remote one")
+				return
+			}
+			source.Function = requestParams.Filter
+		} else if requestParams.Filter == "_doc_ids" {
+			if source.DocIDs == nil {
+				err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate _doc_ids filter; Missing doc_ids")
+				return
+			}
+		} else if requestParams.Filter == "sync_gateway/bychannel" {
 			if requestParams.QueryParams == "" {
 				err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate sync_gateway/bychannel filter; Missing query_params")
 				return
@@ -281,12 +308,61 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 						return
 					}
 				}
-				params.Channels = channels
+				params.Channels = append(params.Channels, channels...)
 			}
+		} else if params.Source != nil && strings.Contains(requestParams.Filter, "/") {
+			// A design doc filter, which only a remote source can run
+			namedFilter = requestParams.Filter
 		} else {
-			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate Unknown filter; try sync_gateway/bychannel")
+			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate Unknown filter; try sync_gateway/bychannel, _doc_ids or a JavaScript function")
+			return
+		}
+	}
+
+	var remoteSource *filteredSource
+	if params.Source != nil && (source.DocIDs != nil || namedFilter != "") {
+		if len(params.Channels) > 0 || (source.DocIDs != nil && namedFilter != "") {
+			err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate a remote source can only apply one of channels, doc_ids or a filter")
 			return
 		}
+		remoteSource = &filteredSource{URL: requestParams.Source, DocIDs: source.DocIDs, Filter: namedFilter}
+		if namedFilter != "" {
+			if remoteSource.QueryParams, err = filterQueryParams(requestParams.QueryParams); err != nil {
+				return
+			}
+		}
+		source.DocIDs = nil
+	}
+
+	// Rate limits are applied by this server's endpoint for the replication, so they need to
+	// identify it.  Only managed replications, which have stable IDs, can have limits.
+	if err = validateReplicationLimits(&requestParams); err != nil {
+		return
+	}
+	if requestParams.hasLimits() && !paramsFromConfig {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate rate limits and schedules are only supported by the _replication API")
+		return
+	}
+	// A local target's endpoint also names the replication, so that documents it fails to write
+	// are recorded for it.
+	var target replicationEndpoint
+	if requestParams.ReplicationId != "" {
+		if params.Target == nil {
+			target.Replication = requestParams.ReplicationId
+		} else if params.Source == nil && requestParams.hasRateLimits() {
+			source.Replication = requestParams.ReplicationId
+		}
+	}
+	if requestParams.hasRateLimits() && params.Source != nil && params.Target != nil {
+		err = base.HTTPErrorf(http.StatusBadRequest, "/_replicate rate limits need the source or target to be a local database")
+		return
+	}
+	params.SourceDb = source.dbPath(params.SourceDb)
+	params.TargetDb = target.dbPath(params.TargetDb)
+	if remoteSource != nil {
+		// Read the source through this server:
+		params.Source = nil
+		params.SourceDb = remoteSource.register()
 	}
 
 
@@ -306,10 +382,67 @@ func validateReplicationParameters(requestParams ReplicationConfig, paramsFromCo
 }
 
 func (h *handler) handleActiveTasks() error {
-	h.writeJSON(h.server.replicator.ActiveTasks())
+	tasks := h.server.replications.populateTasks(h.server.replicator.ActiveTasks())
+	for i := range tasks {
+		h.server.estimatePendingChanges(&tasks[i])
+	}
+	h.writeJSON(tasks)
 	return nil
 }
 
+// Estimates how many changes a replication has yet to read, if its source is a database on this
+// node.  The estimate counts every sequence since the checkpoint, including ones that won't be
+// replicated, like user updates.
+func (sc *ServerContext) estimatePendingChanges(task *base.ActiveTask) {
+	sourceURL, err := url.Parse(task.Source)
+	if err != nil || !isAdminInterfaceHost(sourceURL.Host, *sc.config.AdminInterface) {
+		return
+	}
+	// The source may be a replication endpoint like "db/_endpoint/<endpoint>":
+	dbName := strings.SplitN(strings.Trim(sourceURL.Path, "/"), "/", 2)[0]
+	database := sc.AllDatabases()[dbName]
+	if database == nil {
+		return
+	}
+	lastSeq, err := database.LastSequence()
+	if err != nil {
+		return
+	}
+	checkpoint, _ := base.ParseCheckpointSequence(task.CheckpointSeq)
+	if lastSeq >= checkpoint {
+		pending := lastSeq - checkpoint
+		task.PendingChanges = &pending
+	}
+}
+
+// Returns true if a "host:port" addresses this node's admin interface.  The interface is often
+// configured without a host, like ":4985", and a URL may call it "localhost" or "127.0.0.1".
+func isAdminInterfaceHost(host string, adminInterface string) bool {
+	adminHost, adminPort, err := net.SplitHostPort(adminInterface)
+	if err != nil {
+		return host == adminInterface
+	}
+	urlHost, urlPort, err := net.SplitHostPort(host)
+	if err != nil || urlPort != adminPort {
+		return false
+	}
+	switch urlHost {
+	case adminHost, "", "localhost", "127.0.0.1", "::1":
+		return true
+	}
+	return false
+}
+
+// Records a document that failed to be written by the replication named in the request's
+// endpoint, if any.  sg-replicate only counts the failures it sees in the target's responses.
+func (h *handler) recordReplicationDocFailure(docID, revID, message string) {
+	endpoint, err := h.getReplicationEndpoint()
+	if err != nil || endpoint == nil || endpoint.Replication == "" {
+		return
+	}
+	h.server.replicator.RecordDocFailure(endpoint.Replication, docID, revID, message)
+}
+
 // raw document access for admin api
 
 func (h *handler) handleGetRawDoc() error {
@@ -374,6 +507,8 @@ func marshalPrincipal(princ auth.Principal) ([]byte, error) {
 		info.Disabled = user.Disabled()
 		info.ExplicitRoleNames = user.ExplicitRoles().AllChannels()
 		info.RoleNames = user.RoleNames().AllChannels()
+		info.JWTRoleNames = user.JWTRoles().AllChannels()
+		info.JWTChannels = user.JWTChannels().AsSet()
 	} else {
 		info.Channels = princ.Channels().AsSet()
 	}
@@ -553,6 +688,128 @@ func (h *handler) handleIndexAllChannels() error {
 	return err
 }
 
+// HTTP handler for GET /_index/compact
+func (h *handler) handleGetIndexCompact() error {
+	status, err := h.db.IndexCompactionStatus()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// HTTP handler for POST /_index/compact
+func (h *handler) handlePostIndexCompact() error {
+	var body struct {
+		Channels []string `json:"channels,omitempty"`
+	}
+	if err := h.readJSONInto(&body); err != nil {
+		return err
+	}
+	status, err := h.db.StartIndexCompaction(body.Channels)
+	if err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, status)
+	return nil
+}
+
+// HTTP handler for GET /_search_index
+func (h *handler) handleGetSearchIndex() error {
+	status, err := h.db.SearchIndexStatus()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// HTTP handler for POST /_search_index/_rebuild
+func (h *handler) handlePostSearchIndexRebuild() error {
+	status, err := h.db.StartSearchIndexRebuild()
+	if err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, status)
+	return nil
+}
+
+// HTTP handler for GET /_tombstone_purge
+func (h *handler) handleGetTombstonePurge() error {
+	status, err := h.db.TombstonePurgeStatus()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// HTTP handler for POST /_tombstone_purge
+func (h *handler) handlePostTombstonePurge() error {
+	status, err := h.db.StartTombstonePurge()
+	if err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, status)
+	return nil
+}
+
+// HTTP handler for GET /_cache
+func (h *handler) handleGetCache() error {
+	state, err := h.db.ChangeCacheState()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(state)
+	return nil
+}
+
+// HTTP handler for GET /_cache/channels
+func (h *handler) handleGetCacheChannels() error {
+	states, err := h.db.AllChannelCacheStates()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(states)
+	return nil
+}
+
+// HTTP handler for GET /_cache/channel/{channel}
+func (h *handler) handleGetCacheChannel() error {
+	state, err := h.db.ChannelCacheState(h.PathVar("channel"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(state)
+	return nil
+}
+
+// HTTP handler for POST /_cache/skipped.  The body is {"action":"abandon", "seq":N} to stop
+// waiting for a skipped sequence, or {"action":"clean"} to check the skipped sequences now.
+// The response is the cache's state afterwards.
+func (h *handler) handlePostCacheSkipped() error {
+	var body struct {
+		Action   string `json:"action"`
+		Sequence uint64 `json:"seq"`
+	}
+	if err := h.readJSONInto(&body); err != nil {
+		return err
+	}
+	var err error
+	switch body.Action {
+	case "abandon":
+		err = h.db.AbandonSkippedSequence(body.Sequence)
+	case "clean":
+		err = h.db.CleanSkippedSequences()
+	default:
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown action %q", body.Action)
+	}
+	if err != nil {
+		return err
+	}
+	return h.handleGetCache()
+}
+
 func (h *handler) handlePurge() error {
 	h.assertAdminOnly()
 
@@ -588,7 +845,7 @@ func (h *handler) handlePurge() error {
 			}
 
 			//Attempt to delete document, if successful add to response, otherwise log warning
-			err = h.db.Bucket.Delete(key)
+			err = h.db.Purge(key)
 			if err == nil {
 
 				if first {
@@ -16,6 +16,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -527,6 +528,89 @@ func TestSessionExtension(t *testing.T) {
 	assert.True(t, response.Header().Get("Set-Cookie") != "")
 }
 
+func TestUserSessionList(t *testing.T) {
+	var rt restTester
+	a := rt.getDatabase().Authenticator()
+	user, _ := a.NewUser("pupshaw", "letmein", channels.SetOf("*"))
+	a.Save(user)
+
+	reqHeaders := map[string]string{"User-Agent": "TestClient/1.0"}
+	response := rt.sendUserRequestWithHeaders("POST", "/db/_session", "", reqHeaders, "pupshaw", "letmein")
+	assertStatus(t, response, 200)
+	sessionID := strings.TrimPrefix(strings.SplitN(response.Header().Get("Set-Cookie"), ";", 2)[0], auth.CookieName+"=")
+	rt.createSession(t, "pupshaw")
+
+	response = rt.sendAdminRequest("GET", "/db/_user/pupshaw/_session", "")
+	assertStatus(t, response, 200)
+	var sessions []sessionInfo
+	json.Unmarshal(response.Body.Bytes(), &sessions)
+	assert.Equals(t, len(sessions), 2)
+	userAgents := base.SetOf(sessions[0].UserAgent, sessions[1].UserAgent)
+	assert.True(t, userAgents.Contains("TestClient/1.0"))
+	for _, session := range sessions {
+		assert.True(t, session.Hash != "")
+		assert.True(t, session.Hash != sessionID) // The list mustn't reveal usable session IDs
+		assert.True(t, session.Created != nil)
+		assert.True(t, session.LastUsed != nil)
+		assert.True(t, session.Expiration.After(*session.Created))
+	}
+
+	// A session can be deleted by its hash:
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/pupshaw/_session/"+auth.SessionIDHash(sessionID), ""), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_session/"+sessionID, ""), 404)
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/nobody/_session/"+sessions[0].Hash, ""), 404)
+
+	// Deleting the user's sessions empties the list:
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/pupshaw/_session", ""), 200)
+	response = rt.sendAdminRequest("GET", "/db/_user/pupshaw/_session", "")
+	assertStatus(t, response, 200)
+	assert.Equals(t, response.Body.String(), "[]")
+
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_user/nobody/_session", ""), 404)
+	assertStatus(t, rt.sendRequest("GET", "/db/_user/pupshaw/_session", ""), 404)
+}
+
+func TestSessionOptions(t *testing.T) {
+	var rt restTester
+	database := rt.getDatabase()
+	absoluteTimeout := 1
+	database.Options.SessionOptions = &auth.SessionOptions{
+		AbsoluteTimeoutSecs: &absoluteTimeout,
+		CookieSecure:        true,
+		CookieSameSite:      "Strict",
+		CookieDomain:        "example.com",
+	}
+	a := database.Authenticator()
+	user, _ := a.NewUser("pupshaw", "letmein", channels.SetOf("*"))
+	a.Save(user)
+	guest, _ := a.GetUser("")
+	guest.SetDisabled(true)
+	a.Save(guest)
+
+	response := rt.sendUserRequestWithHeaders("POST", "/db/_session", "", nil, "pupshaw", "letmein")
+	assertStatus(t, response, 200)
+	cookie := response.Header().Get("Set-Cookie")
+	assert.True(t, strings.Contains(cookie, "Secure"))
+	assert.True(t, strings.Contains(cookie, "Domain=example.com"))
+	assert.True(t, strings.HasSuffix(cookie, "; SameSite=Strict"))
+
+	// The expiration is capped by the absolute timeout, not the default idle timeout:
+	sessionID := strings.TrimPrefix(strings.SplitN(cookie, ";", 2)[0], auth.CookieName+"=")
+	session, err := database.GetUserSessions("pupshaw")
+	assert.Equals(t, err, nil)
+	assert.Equals(t, len(session), 1)
+	assert.Equals(t, session[0].ID, sessionID)
+	assert.True(t, session[0].Expiration.Sub(session[0].Created) <= time.Second)
+
+	reqHeaders := map[string]string{"Cookie": auth.CookieName + "=" + sessionID}
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/", "", reqHeaders), 200)
+	time.Sleep(1500 * time.Millisecond)
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/", "", reqHeaders), 401)
+
+	invalid := auth.SessionOptions{CookieSameSite: "Sometimes"}
+	assert.True(t, invalid.Validate() != nil)
+}
+
 func TestSessionAPI(t *testing.T) {
 
 	var rt restTester
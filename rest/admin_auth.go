@@ -0,0 +1,331 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Creates an http.Handler for an admin API route.  When admin authentication is enabled, the
+// authenticated account must have at least the given role.
+func makeAdminHandler(server *ServerContext, role auth.AdminRole, method handlerMethod) http.Handler {
+	return http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
+		runOffline := false
+		h := newHandler(server, adminPrivs, r, rq, runOffline)
+		h.adminRole = role
+		err := h.invoke(method)
+		h.writeError(err)
+		h.logDuration(true)
+		h.writeAuditRecord()
+	})
+}
+
+// Same as makeAdminHandler, but the handler will run even if the target DB is offline
+func makeOfflineAdminHandler(server *ServerContext, role auth.AdminRole, method handlerMethod) http.Handler {
+	return http.HandlerFunc(func(r http.ResponseWriter, rq *http.Request) {
+		runOffline := true
+		h := newHandler(server, adminPrivs, r, rq, runOffline)
+		h.adminRole = role
+		err := h.invoke(method)
+		h.writeError(err)
+		h.logDuration(true)
+		h.writeAuditRecord()
+	})
+}
+
+// Validates the admin account definitions in the server config.
+func (authConfig *AdminAuthConfig) validate() error {
+	if authConfig == nil {
+		return nil
+	}
+	for name, account := range authConfig.Accounts {
+		if account == nil {
+			return fmt.Errorf("Admin account %q has no definition", name)
+		}
+		if _, err := auth.ParseAdminRole(account.Role); err != nil {
+			return fmt.Errorf("Admin account %q: %v", name, err)
+		}
+		if account.Password == nil && account.Token == nil {
+			return fmt.Errorf("Admin account %q needs a password or a token", name)
+		}
+	}
+	if authConfig.Enabled && len(authConfig.Accounts) == 0 {
+		base.Warn("Admin authentication is enabled but no admin accounts are defined in the config; only accounts stored in database buckets will be able to log in, and only on database endpoints")
+	}
+	return nil
+}
+
+func (authConfig *AdminAuthConfig) isEnabled() bool {
+	return authConfig != nil && authConfig.Enabled
+}
+
+func adminAccountFromConfig(name string, accountConfig *AdminAccountConfig) *auth.AdminAccount {
+	role, _ := auth.ParseAdminRole(accountConfig.Role) // already validated
+	return &auth.AdminAccount{Name: name, Role: role, RoleName: role.String()}
+}
+
+// Finds the config-defined admin account with the given name and password.
+func (authConfig *AdminAuthConfig) authenticatePassword(name, password string) *auth.AdminAccount {
+	accountConfig := authConfig.Accounts[name]
+	if accountConfig == nil || accountConfig.Password == nil || password == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(*accountConfig.Password), []byte(password)) != 1 {
+		return nil
+	}
+	return adminAccountFromConfig(name, accountConfig)
+}
+
+// Finds the config-defined admin account with the given bearer token.
+func (authConfig *AdminAuthConfig) authenticateToken(token string) *auth.AdminAccount {
+	for name, accountConfig := range authConfig.Accounts {
+		if accountConfig.Token == nil || *accountConfig.Token == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(*accountConfig.Token), []byte(token)) == 1 {
+			return adminAccountFromConfig(name, accountConfig)
+		}
+	}
+	return nil
+}
+
+// Authenticates a request to the admin API, if admin authentication is enabled, and checks that
+// the account's role allows the route being called.  Accounts in the server config are checked
+// first; on database endpoints, accounts stored in the database's bucket are checked next.
+func (h *handler) checkAdminAuth(dbName string) error {
+	authConfig := h.server.config.AdminAuth
+	if !authConfig.isEnabled() {
+		return nil
+	}
+
+	// Accounts stored in a database's bucket are only checked when the credentials don't match a
+	// config account.  An unknown database is treated like one without the account, so callers
+	// who can't log in can't probe for database names.
+	dbContext := func() *db.DatabaseContext {
+		if dbName == "" {
+			return nil
+		}
+		context, _ := h.server.GetDatabase(dbName)
+		return context
+	}
+
+	var account *auth.AdminAccount
+	if userName, password := h.getBasicAuth(); userName != "" {
+		account = authConfig.authenticatePassword(userName, password)
+		if account == nil {
+			if context := dbContext(); context != nil {
+				account = context.Authenticator().AuthenticateAdmin(userName, password)
+			}
+		}
+		if account == nil {
+			base.Logf("Admin HTTP auth failed for username=%q", userName)
+		}
+	} else if token := h.getBearerToken(); token != "" {
+		account = authConfig.authenticateToken(token)
+		if account == nil {
+			if context := dbContext(); context != nil {
+				var err error
+				if account, err = context.Authenticator().GetAdminAccountForToken(token); err != nil {
+					return err
+				}
+			}
+		}
+		if account == nil {
+			base.Logf("Admin HTTP auth failed for bearer token")
+		}
+	}
+
+	if account == nil {
+		h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway Admin"`)
+		return base.HTTPErrorf(http.StatusUnauthorized, "Admin login required")
+	}
+	h.adminAccount = account
+
+	if required := h.requiredAdminRole(); !account.Role.Allows(required) {
+		return base.HTTPErrorf(http.StatusForbidden, "Admin role %q required", required.String())
+	}
+	return nil
+}
+
+// The admin role required for the current request.  Routes registered with makeAdminHandler
+// declare their role; routes shared with the public API only need read-only access to read,
+// and db admin access for anything else.
+func (h *handler) requiredAdminRole() auth.AdminRole {
+	if h.adminRole != auth.AdminRoleNone {
+		return h.adminRole
+	} else if h.rq.Method == "GET" || h.rq.Method == "HEAD" {
+		return auth.AdminRoleReadOnly
+	}
+	return auth.AdminRoleDbAdmin
+}
+
+//////// AUDIT LOG:
+
+// Records every mutating request made on the admin API while admin authentication is enabled.
+type auditLogger struct {
+	lock sync.Mutex
+	file *os.File // nil if records go to the main log
+}
+
+type auditRecord struct {
+	Time    time.Time `json:"time"`
+	Account string    `json:"account,omitempty"`
+	Role    string    `json:"role,omitempty"`
+	Remote  string    `json:"remote"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Status  int       `json:"status"`
+}
+
+func newAuditLogger(path *string) (*auditLogger, error) {
+	logger := &auditLogger{}
+	if path != nil && *path != "" {
+		file, err := os.OpenFile(*path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		logger.file = file
+	}
+	return logger, nil
+}
+
+func (logger *auditLogger) write(record auditRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		base.Warn("Couldn't serialize audit record %+v: %v", record, err)
+		return
+	}
+	if logger.file == nil {
+		base.Logf("Audit: %s", data)
+		return
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	if _, err := logger.file.Write(append(data, '\n')); err != nil {
+		base.Warn("Couldn't write audit record %s: %v", data, err)
+	}
+}
+
+func (logger *auditLogger) close() {
+	if logger != nil && logger.file != nil {
+		logger.file.Close()
+	}
+}
+
+// Writes an audit record for the request if it was an admin mutation.
+func (h *handler) writeAuditRecord() {
+	if h.privs != adminPrivs || h.server.auditLog == nil {
+		return
+	}
+	if h.rq.Method == "GET" || h.rq.Method == "HEAD" || h.rq.Method == "OPTIONS" {
+		return
+	}
+	record := auditRecord{
+		Time:   time.Now(),
+		Remote: h.rq.RemoteAddr,
+		Method: h.rq.Method,
+		Path:   sanitizeRequestURL(h.rq.URL),
+		Status: h.status,
+	}
+	if h.adminAccount != nil {
+		record.Account = h.adminAccount.Name
+		record.Role = h.adminAccount.Role.String()
+	}
+	h.server.auditLog.write(record)
+}
+
+//////// ADMIN ACCOUNTS:
+
+type adminAccountInfo struct {
+	Name     string  `json:"name"`
+	Role     string  `json:"role"`
+	Password *string `json:"password,omitempty"`
+	Token    *string `json:"token,omitempty"`
+	HasToken bool    `json:"has_token,omitempty"`
+}
+
+// ADMIN API: returns an admin account stored in the database's bucket.
+func (h *handler) getAdminAccount() error {
+	h.assertAdminOnly()
+	account, err := h.db.Authenticator().GetAdminAccount(h.PathVar("name"))
+	if account == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	h.writeJSON(adminAccountInfo{
+		Name:     account.Name,
+		Role:     account.Role.String(),
+		HasToken: account.TokenHash_ != "",
+	})
+	return nil
+}
+
+// ADMIN API: creates or replaces an admin account stored in the database's bucket.
+func (h *handler) putAdminAccount() error {
+	h.assertAdminOnly()
+	name := h.PathVar("name")
+	var info adminAccountInfo
+	if err := h.readJSONInto(&info); err != nil {
+		return err
+	}
+	if info.Name != "" && info.Name != name {
+		return base.HTTPErrorf(http.StatusBadRequest, "Name mismatch (can't change name)")
+	}
+	role, err := auth.ParseAdminRole(info.Role)
+	if err != nil {
+		return err
+	}
+	var password, token string
+	if info.Password != nil {
+		password = *info.Password
+	}
+	if info.Token != nil {
+		token = *info.Token
+	}
+	if password == "" && token == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Admin account needs a password or a token")
+	}
+	account, err := auth.NewAdminAccount(name, role, password, token)
+	if err != nil {
+		return err
+	}
+	authenticator := h.db.Authenticator()
+	existing, err := authenticator.GetAdminAccount(name)
+	if err != nil {
+		return err
+	}
+	if err := authenticator.SaveAdminAccount(account); err != nil {
+		return err
+	}
+	if existing != nil {
+		h.writeStatus(http.StatusOK, "OK")
+	} else {
+		h.writeStatus(http.StatusCreated, "Created")
+	}
+	return nil
+}
+
+// ADMIN API: deletes an admin account stored in the database's bucket.
+func (h *handler) deleteAdminAccount() error {
+	h.assertAdminOnly()
+	return h.db.Authenticator().DeleteAdminAccount(h.PathVar("name"))
+}
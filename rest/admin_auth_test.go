@@ -0,0 +1,124 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/couchbaselabs/go.assert"
+)
+
+func adminBasicAuth(name, password string) map[string]string {
+	credentials := base64.StdEncoding.EncodeToString([]byte(name + ":" + password))
+	return map[string]string{"Authorization": "Basic " + credentials}
+}
+
+func newAdminAuthTester() *restTester {
+	password := "sekrit"
+	token := "0123456789abcdef"
+	return &restTester{adminAuthConfig: &AdminAuthConfig{
+		Enabled: true,
+		Accounts: map[string]*AdminAccountConfig{
+			"reader":  &AdminAccountConfig{Password: &password, Role: "read_only"},
+			"manager": &AdminAccountConfig{Password: &password, Role: "user_manager"},
+			"root":    &AdminAccountConfig{Token: &token, Role: "admin"},
+		},
+	}}
+}
+
+func TestAdminAuthRequired(t *testing.T) {
+	rt := newAdminAuthTester()
+
+	response := rt.sendAdminRequest("GET", "/db/_user/", "")
+	assertStatus(t, response, 401)
+	assert.True(t, response.Header().Get("WWW-Authenticate") != "")
+
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/_user/", "", adminBasicAuth("reader", "wrong"))
+	assertStatus(t, response, 401)
+
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/_user/", "", map[string]string{"Authorization": "Bearer bogus"})
+	assertStatus(t, response, 401)
+
+	// Unknown databases can't be told apart from real ones without logging in:
+	response = rt.sendAdminRequest("GET", "/nosuchdb/", "")
+	assertStatus(t, response, 401)
+	response = rt.sendAdminRequestWithHeaders("GET", "/nosuchdb/", "", adminBasicAuth("ops", "pw"))
+	assertStatus(t, response, 401)
+	response = rt.sendAdminRequestWithHeaders("GET", "/nosuchdb/", "", adminBasicAuth("reader", "sekrit"))
+	assertStatus(t, response, 404)
+}
+
+func TestAdminAuthRoles(t *testing.T) {
+	rt := newAdminAuthTester()
+	reader := adminBasicAuth("reader", "sekrit")
+	manager := adminBasicAuth("manager", "sekrit")
+
+	response := rt.sendAdminRequestWithHeaders("GET", "/db/_user/", "", reader)
+	assertStatus(t, response, 200)
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/_user/alice", `{"password":"letmein"}`, reader)
+	assertStatus(t, response, 403)
+
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/_user/alice", `{"password":"letmein"}`, manager)
+	assertStatus(t, response, 201)
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/_user/alice/_session", "", reader)
+	assertStatus(t, response, 403)
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/_user/alice/_session", "", manager)
+	assertStatus(t, response, 200)
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/doc1", `{"foo":"bar"}`, manager)
+	assertStatus(t, response, 403)
+	response = rt.sendAdminRequestWithHeaders("POST", "/db/_compact", "", manager)
+	assertStatus(t, response, 403)
+
+	root := map[string]string{"Authorization": "Bearer 0123456789abcdef"}
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/doc1", `{"foo":"bar"}`, root)
+	assertStatus(t, response, 201)
+	response = rt.sendAdminRequestWithHeaders("PUT", "/_logging", `{}`, root)
+	assertStatus(t, response, 200)
+}
+
+func TestAdminAccountsInBucket(t *testing.T) {
+	rt := newAdminAuthTester()
+	root := map[string]string{"Authorization": "Bearer 0123456789abcdef"}
+
+	response := rt.sendAdminRequestWithHeaders("PUT", "/db/_admin_account/ops", `{"role":"bogus", "password":"pw"}`, root)
+	assertStatus(t, response, 400)
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/_admin_account/ops", `{"role":"db_admin"}`, root)
+	assertStatus(t, response, 400)
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/_admin_account/ops", `{"role":"db_admin", "password":"pw", "token":"opstoken"}`, root)
+	assertStatus(t, response, 201)
+
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/_admin_account/ops", "", root)
+	assertStatus(t, response, 200)
+	assert.Equals(t, string(response.Body.Bytes()), `{"name":"ops","role":"db_admin","has_token":true}`)
+
+	// The bucket-stored account can log in on database endpoints, by password or by token:
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/doc1", `{"foo":"bar"}`, adminBasicAuth("ops", "pw"))
+	assertStatus(t, response, 201)
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/doc1", "", map[string]string{"Authorization": "Bearer opstoken"})
+	assertStatus(t, response, 200)
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/_admin_account/x", `{"role":"admin", "password":"pw"}`, adminBasicAuth("ops", "pw"))
+	assertStatus(t, response, 403)
+
+	// Changing the token revokes the old one:
+	response = rt.sendAdminRequestWithHeaders("PUT", "/db/_admin_account/ops", `{"role":"read_only", "token":"newtoken"}`, root)
+	assertStatus(t, response, 200)
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/doc1", "", map[string]string{"Authorization": "Bearer opstoken"})
+	assertStatus(t, response, 401)
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/doc1", "", map[string]string{"Authorization": "Bearer newtoken"})
+	assertStatus(t, response, 200)
+
+	response = rt.sendAdminRequestWithHeaders("DELETE", "/db/_admin_account/ops", "", root)
+	assertStatus(t, response, 200)
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/doc1", "", map[string]string{"Authorization": "Bearer newtoken"})
+	assertStatus(t, response, 401)
+	response = rt.sendAdminRequestWithHeaders("GET", "/db/_admin_account/ops", "", root)
+	assertStatus(t, response, 404)
+}
@@ -104,7 +104,7 @@ func (h *handler) handleVacuum() error {
 }
 
 func (h *handler) handleFlush() error {
-	if bucket, ok := h.db.Bucket.(sgbucket.DeleteableBucket); ok {
+	if bucket, ok := base.UnwrapBucket(h.db.Bucket).(sgbucket.DeleteableBucket); ok {
 		name := h.db.Name
 		config := h.server.GetDatabaseConfig(name)
 		h.server.RemoveDatabase(name)
@@ -153,6 +153,10 @@ func (h *handler) handleGetDB() error {
 		return nil
 	}
 	lastSeq, _ := h.db.LastSequence()
+	var purgeSeq uint64
+	if marker, err := h.db.GetPurgeMarker(); err == nil {
+		purgeSeq = marker.PurgeSeq
+	}
 
 	response := db.Body{
 		"db_name":              h.db.Name,
@@ -160,8 +164,8 @@ func (h *handler) handleGetDB() error {
 		"committed_update_seq": lastSeq,
 		"instance_start_time":  h.instanceStartTime(),
 		"compact_running":      false, // TODO: Implement this
-		"purge_seq":            0,     // TODO: Should track this value
-		"disk_format_version":  0,     // Probably meaningless, but add for compatibility
+		"purge_seq":            purgeSeq,
+		"disk_format_version":  0, // Probably meaningless, but add for compatibility
 		"state":                db.RunStateString[atomic.LoadUint32(&h.db.State)],
 		//"doc_count":          h.db.DocCount(), // Removed: too expensive to compute (#278)
 	}
@@ -46,10 +46,11 @@ var gBucketCounter = 0
 type restTester struct {
 	_bucket          base.Bucket
 	_sc              *ServerContext
-	noAdminParty     bool         // Unless this is true, Admin Party is in full effect
-	distributedIndex bool         // Test with walrus-based index bucket
-	syncFn           string       // put the sync() function source in here (optional)
-	cacheConfig      *CacheConfig // Cache options (optional)
+	noAdminParty     bool             // Unless this is true, Admin Party is in full effect
+	distributedIndex bool             // Test with walrus-based index bucket
+	syncFn           string           // put the sync() function source in here (optional)
+	cacheConfig      *CacheConfig     // Cache options (optional)
+	adminAuthConfig  *AdminAuthConfig // Admin API authentication (optional)
 }
 
 func (rt *restTester) bucket() base.Bucket {
@@ -74,6 +75,7 @@ func (rt *restTester) bucket() base.Bucket {
 			CORS:           corsConfig,
 			Facebook:       &FacebookConfig{},
 			AdminInterface: &DefaultAdminInterface,
+			AdminAuth:      rt.adminAuthConfig,
 		})
 
 		_, err := rt._sc.AddDatabaseFromConfig(&DbConfig{
@@ -1948,6 +1950,64 @@ func TestAllDocsChannelsAfterChannelMove(t *testing.T) {
 	assert.Equals(t, allDocsResult.Rows[0].Value.Channels[0], "ch2")
 }
 
+func TestAllDocsPagination(t *testing.T) {
+
+	var allDocsResult struct {
+		TotalRows    int    `json:"total_rows"`
+		Continuation string `json:"continuation"`
+		Rows         []struct {
+			ID string `json:"id"`
+		} `json:"rows"`
+	}
+	getAllDocs := func(response *testResponse) (ids []string) {
+		assertStatus(t, response, 200)
+		allDocsResult.Continuation = ""
+		allDocsResult.Rows = nil
+		assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &allDocsResult), nil)
+		for _, row := range allDocsResult.Rows {
+			ids = append(ids, row.ID)
+		}
+		return
+	}
+
+	rt := restTester{syncFn: `function(doc) {channel(doc.channels)}`}
+	a := rt.ServerContext().Database("db").Authenticator()
+	alice, err := a.NewUser("alice", "letmein", channels.SetOf("odd"))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, a.Save(alice), nil)
+	for i := 0; i < 10; i++ {
+		channel := "even"
+		if i%2 == 1 {
+			channel = "odd"
+		}
+		body := fmt.Sprintf(`{"channels":[%q]}`, channel)
+		assertStatus(t, rt.sendAdminRequest("PUT", fmt.Sprintf("/db/doc%d", i), body), 201)
+	}
+
+	// skip and limit, then follow the continuation token:
+	ids := getAllDocs(rt.sendAdminRequest("GET", "/db/_all_docs?skip=1&limit=3", ""))
+	assert.DeepEquals(t, ids, []string{"doc1", "doc2", "doc3"})
+	assert.True(t, allDocsResult.Continuation != "")
+	ids = getAllDocs(rt.sendAdminRequest("GET", "/db/_all_docs?limit=3&continuation="+allDocsResult.Continuation, ""))
+	assert.DeepEquals(t, ids, []string{"doc4", "doc5", "doc6"})
+
+	// Descending, with an exclusive end:
+	ids = getAllDocs(rt.sendAdminRequest("GET", `/db/_all_docs?descending=true&startkey="doc5"&endkey="doc2"&inclusive_end=false`, ""))
+	assert.DeepEquals(t, ids, []string{"doc5", "doc4", "doc3"})
+	assert.Equals(t, allDocsResult.Continuation, "")
+
+	// Pages for a user only count the docs they can see:
+	ids = getAllDocs(rt.send(requestByUser("GET", "/db/_all_docs?limit=2", "", "alice")))
+	assert.DeepEquals(t, ids, []string{"doc1", "doc3"})
+	ids = getAllDocs(rt.send(requestByUser("GET", "/db/_all_docs?limit=2&continuation="+allDocsResult.Continuation, "", "alice")))
+	assert.DeepEquals(t, ids, []string{"doc5", "doc7"})
+	ids = getAllDocs(rt.send(requestByUser("GET", "/db/_all_docs?limit=2&continuation="+allDocsResult.Continuation, "", "alice")))
+	assert.DeepEquals(t, ids, []string{"doc9"})
+	assert.Equals(t, allDocsResult.Continuation, "")
+
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_all_docs?continuation=bogus", ""), 400)
+}
+
 //Test for regression of issue #447
 func TestAttachmentsNoCrossTalk(t *testing.T) {
 
@@ -0,0 +1,185 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Returns the API key sent with the request, if any.  Keys can be sent in an X-API-Key header,
+// or as a bearer token; bearer tokens that are JWTs are left for OpenID Connect.
+func (h *handler) getAPIKey() string {
+	if key := h.rq.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token := h.getBearerToken(); token != "" && strings.Count(token, ".") != 2 {
+		return token
+	}
+	return ""
+}
+
+// Authenticates the request's user by API key, and checks that the key allows the request.
+func (h *handler) checkAPIKey(context *db.DatabaseContext, key string) error {
+	user, apiKey, err := context.Authenticator().AuthenticateAPIKey(key)
+	if err != nil {
+		return err
+	} else if user == nil {
+		base.Logf("HTTP auth failed for API key")
+		return base.HTTPErrorf(http.StatusUnauthorized, "Invalid API key")
+	}
+	if !apiKey.AllowsMethod(h.rq.Method) || (apiKey.ReadOnly && !h.isReadOnlyRequest()) {
+		return base.HTTPErrorf(http.StatusForbidden, "API key doesn't allow this request")
+	}
+	h.user = user
+	h.apiKey = apiKey
+	return nil
+}
+
+// Returns true if the request can't modify the database.  A few read-only operations use POST
+// because their parameters may be too large for a URL.
+func (h *handler) isReadOnlyRequest() bool {
+	switch h.rq.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	case "POST":
+		path := strings.TrimSuffix(h.rq.URL.Path, "/")
+		for _, suffix := range []string{"/_changes", "/_bulk_get", "/_all_docs"} {
+			if strings.HasSuffix(path, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//////// ADMIN API:
+
+// The properties of an API key in admin API requests and responses.
+type apiKeyInfo struct {
+	ID          string   `json:"id,omitempty"`
+	Key         string   `json:"key,omitempty"` // Only returned when the key is created
+	Description string   `json:"description,omitempty"`
+	ReadOnly    bool     `json:"read_only,omitempty"`
+	Channels    base.Set `json:"channels,omitempty"`
+	Methods     []string `json:"methods,omitempty"`
+	Created     string   `json:"created,omitempty"`
+	LastUsed    string   `json:"last_used,omitempty"`
+}
+
+func makeAPIKeyInfo(key *auth.APIKey) apiKeyInfo {
+	info := apiKeyInfo{
+		ID:          key.ID,
+		Description: key.Description,
+		ReadOnly:    key.ReadOnly,
+		Channels:    key.Channels,
+		Methods:     key.Methods,
+		Created:     key.Created.Format(base.ISO8601Format),
+	}
+	if key.LastUsed != nil {
+		info.LastUsed = key.LastUsed.Format(base.ISO8601Format)
+	}
+	return info
+}
+
+// Looks up the real user named in the request path.
+func (h *handler) getAPIKeyOwner() (string, error) {
+	name := internalUserName(h.PathVar("name"))
+	if name == "" {
+		return "", base.HTTPErrorf(http.StatusBadRequest, "The guest user can't have API keys")
+	}
+	user, err := h.db.Authenticator().GetUser(name)
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return "", err
+	}
+	return name, nil
+}
+
+// ADMIN API: lists a user's API keys.
+func (h *handler) getAPIKeys() error {
+	h.assertAdminOnly()
+	name, err := h.getAPIKeyOwner()
+	if err != nil {
+		return err
+	}
+	keys, err := h.db.Authenticator().GetAPIKeys(name)
+	if err != nil {
+		return err
+	}
+	result := make([]apiKeyInfo, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, makeAPIKeyInfo(key))
+	}
+	h.writeJSON(result)
+	return nil
+}
+
+// ADMIN API: creates an API key for a user.  This is the only time the key itself is returned.
+func (h *handler) createAPIKey() error {
+	h.assertAdminOnly()
+	name, err := h.getAPIKeyOwner()
+	if err != nil {
+		return err
+	}
+	var params apiKeyInfo
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	key := &auth.APIKey{
+		Username:    name,
+		Description: params.Description,
+		ReadOnly:    params.ReadOnly,
+		Channels:    params.Channels,
+		Methods:     params.Methods,
+	}
+	secret, err := h.db.Authenticator().CreateAPIKey(key)
+	if err != nil {
+		return err
+	}
+	info := makeAPIKeyInfo(key)
+	info.Key = secret
+	h.writeJSONStatus(http.StatusCreated, info)
+	return nil
+}
+
+// ADMIN API: returns one of a user's API keys.
+func (h *handler) getAPIKeyInfo() error {
+	h.assertAdminOnly()
+	name, err := h.getAPIKeyOwner()
+	if err != nil {
+		return err
+	}
+	key, err := h.db.Authenticator().GetAPIKey(name, h.PathVar("keyid"))
+	if key == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	h.writeJSON(makeAPIKeyInfo(key))
+	return nil
+}
+
+// ADMIN API: revokes one of a user's API keys.
+func (h *handler) deleteAPIKey() error {
+	h.assertAdminOnly()
+	name, err := h.getAPIKeyOwner()
+	if err != nil {
+		return err
+	}
+	return h.db.Authenticator().DeleteAPIKey(name, h.PathVar("keyid"))
+}
@@ -0,0 +1,114 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func createTestAPIKey(t *testing.T, rt *restTester, username string, body string) apiKeyInfo {
+	response := rt.sendAdminRequest("POST", "/db/_user/"+username+"/_apikey", body)
+	assertStatus(t, response, 201)
+	var info apiKeyInfo
+	assert.Equals(t, json.Unmarshal(response.Body.Bytes(), &info), nil)
+	assert.True(t, info.ID != "")
+	assert.True(t, info.Key != "")
+	return info
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	a := rt.ServerContext().Database("db").Authenticator()
+	user, err := a.NewUser("alice", "letmein", channels.SetOf("a", "b"))
+	assert.Equals(t, err, nil)
+	assert.Equals(t, a.Save(user), nil)
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/docA", `{"channels":["a"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/docB", `{"channels":["b"]}`), 201)
+
+	key := createTestAPIKey(t, &rt, "alice", `{"description":"backup job"}`)
+	headers := map[string]string{"X-API-Key": key.Key}
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docA", "", headers), 200)
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docB", "", headers), 200)
+	assertStatus(t, rt.sendRequestWithHeaders("PUT", "/db/docC", `{"channels":["a"]}`, headers), 201)
+
+	bearer := map[string]string{"Authorization": "Bearer " + key.Key}
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docA", "", bearer), 200)
+
+	// API keys can't be traded for a session, and unknown keys are rejected:
+	assertStatus(t, rt.sendRequestWithHeaders("POST", "/db/_session", "", headers), 403)
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docA", "", map[string]string{"X-API-Key": "bogus"}), 401)
+
+	// The key's last-used time is recorded:
+	response := rt.sendAdminRequest("GET", "/db/_user/alice/_apikey/"+key.ID, "")
+	assertStatus(t, response, 200)
+	var info apiKeyInfo
+	json.Unmarshal(response.Body.Bytes(), &info)
+	assert.Equals(t, info.Description, "backup job")
+	assert.Equals(t, info.Key, "")
+	assert.True(t, info.LastUsed != "")
+
+	// Revoking the key:
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/alice/_apikey/"+key.ID, ""), 200)
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docA", "", headers), 401)
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/alice/_apikey/"+key.ID, ""), 404)
+}
+
+func TestAPIKeyRestrictions(t *testing.T) {
+	rt := restTester{noAdminParty: true}
+	a := rt.ServerContext().Database("db").Authenticator()
+	user, _ := a.NewUser("alice", "letmein", channels.SetOf("a", "b"))
+	a.Save(user)
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/docA", `{"channels":["a"]}`), 201)
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/docB", `{"channels":["b"]}`), 201)
+
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_user/alice/_apikey", `{"methods":["FETCH"]}`), 400)
+	assertStatus(t, rt.sendAdminRequest("POST", "/db/_user/nobody/_apikey", `{}`), 404)
+
+	// Read-only key limited to channel "a":
+	key := createTestAPIKey(t, &rt, "alice", `{"read_only":true, "channels":["a"]}`)
+	headers := map[string]string{"X-API-Key": key.Key}
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docA", "", headers), 200)
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docB", "", headers), 403)
+	assertStatus(t, rt.sendRequestWithHeaders("PUT", "/db/docC", `{"channels":["a"]}`, headers), 403)
+
+	response := rt.sendRequestWithHeaders("POST", "/db/_changes", `{}`, headers)
+	assertStatus(t, response, 200)
+	var changes struct {
+		Results []struct {
+			ID string `json:"id"`
+		} `json:"results"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &changes)
+	assert.Equals(t, len(changes.Results), 1)
+	assert.Equals(t, changes.Results[0].ID, "docA")
+
+	// Key limited to GET:
+	key = createTestAPIKey(t, &rt, "alice", `{"methods":["get"]}`)
+	headers = map[string]string{"X-API-Key": key.Key}
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docB", "", headers), 200)
+	assertStatus(t, rt.sendRequestWithHeaders("DELETE", "/db/docB", "", headers), 403)
+
+	response = rt.sendAdminRequest("GET", "/db/_user/alice/_apikey", "")
+	assertStatus(t, response, 200)
+	var keys []apiKeyInfo
+	json.Unmarshal(response.Body.Bytes(), &keys)
+	assert.Equals(t, len(keys), 2)
+	assert.DeepEquals(t, keys[1].Methods, []string{"GET"})
+
+	// Deleting the user revokes its keys:
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_user/alice", ""), 200)
+	assertStatus(t, rt.sendRequestWithHeaders("GET", "/db/docA", "", headers), 401)
+}
@@ -10,6 +10,7 @@
 package rest
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"html"
@@ -167,10 +168,18 @@ func (h *handler) handleAllDocs() error {
 		return row
 	}
 
-	// Subroutine that writes a response entry for a document:
+	// Subroutine that writes a response entry for a document, after skipping the first 'skip':
+	skip := h.getIntQuery("skip", 0)
+	skipped := uint64(0)
+	lastDocID := ""
 	writeDoc := func(doc db.IDAndRev, channels []string) bool {
 		row := createRow(doc, channels)
 		if row != nil {
+			if skipped < skip {
+				skipped++
+				return true
+			}
+			lastDocID = doc.DocID
 			if row.Status >= 300 {
 				row.Error = base.CouchHTTPErrorName(row.Status)
 			}
@@ -187,7 +196,27 @@ func (h *handler) handleAllDocs() error {
 	var options db.ForEachDocIDOptions
 	options.Startkey = h.getJSONStringQuery("startkey")
 	options.Endkey = h.getJSONStringQuery("endkey")
-	options.Limit = h.getIntQuery("limit", 0)
+	options.Descending = h.getBoolQuery("descending")
+	options.ExclusiveEnd = !h.getOptBoolQuery("inclusive_end", true)
+
+	// A continuation token from a previous response picks up the range where that one ended:
+	if token := h.getQuery("continuation"); token != "" {
+		resume, err := decodeAllDocsContinuation(token)
+		if err != nil {
+			return err
+		}
+		options.Startkey = ""
+		options.ResumeAfter = resume.After
+		options.Endkey = resume.Endkey
+		options.Descending = resume.Descending
+		options.ExclusiveEnd = resume.ExclusiveEnd
+	}
+
+	// Skipped rows count towards the limit passed to ForEachDocID, since writeDoc accepts them:
+	limit := h.getIntQuery("limit", 0)
+	if limit > 0 {
+		options.Limit = limit + skip
+	}
 
 	// Now it's time to actually write the response!
 	lastSeq, _ := h.db.LastSequence()
@@ -210,8 +239,104 @@ func (h *handler) handleAllDocs() error {
 		}
 	}
 
-	h.response.Write([]byte(fmt.Sprintf("],\n"+`"total_rows":%d,"update_seq":%d}`,
+	h.response.Write([]byte(fmt.Sprintf("],\n"+`"total_rows":%d,"update_seq":%d`,
 		totalRows, lastSeq)))
+
+	// If the limit was reached there may be more rows; give the client a token to fetch them:
+	if explicitDocIDs == nil && limit > 0 && uint64(totalRows) == limit {
+		resume := allDocsContinuation{
+			After:        lastDocID,
+			Endkey:       options.Endkey,
+			Descending:   options.Descending,
+			ExclusiveEnd: options.ExclusiveEnd,
+		}
+		h.response.Write([]byte(fmt.Sprintf(`,"continuation":%q`, resume.encode())))
+	}
+	h.response.Write([]byte("}"))
+	return nil
+}
+
+// The state needed to resume an _all_docs query, which is handed to the client as an opaque
+// continuation token.
+type allDocsContinuation struct {
+	After        string `json:"a"`
+	Endkey       string `json:"e,omitempty"`
+	Descending   bool   `json:"d,omitempty"`
+	ExclusiveEnd bool   `json:"x,omitempty"`
+}
+
+func (c allDocsContinuation) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeAllDocsContinuation(token string) (c allDocsContinuation, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.After == "" {
+		err = base.HTTPErrorf(http.StatusBadRequest, "Invalid continuation token")
+	}
+	return
+}
+
+// HTTP handler for a POST to _find
+func (h *handler) handleFind() error {
+	var query db.FindQuery
+	if err := h.readJSONInto(&query); err != nil {
+		return err
+	}
+	result, err := h.db.Find(query)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
+// HTTP handler for GET _search
+func (h *handler) handleSearch() error {
+	hits, err := h.db.Search(h.getQuery("q"), int(h.getIntQuery("limit", 0)))
+	if err != nil {
+		return err
+	}
+	includeDocs := h.getBoolQuery("include_docs")
+	type searchRow struct {
+		db.SearchHit
+		Doc db.Body `json:"doc,omitempty"`
+	}
+	rows := make([]searchRow, 0, len(hits))
+	for _, hit := range hits {
+		row := searchRow{SearchHit: hit}
+		if includeDocs {
+			if row.Doc, err = h.db.Get(hit.DocID); err != nil {
+				continue // doc was deleted or became inaccessible since it was indexed
+			}
+		}
+		rows = append(rows, row)
+	}
+	h.writeJSON(db.Body{"total_rows": len(rows), "rows": rows})
+	return nil
+}
+
+// HTTP handler for GET _channels.  Regular users have to add ?mine=true, which lists only the
+// channels they can read.  While the counts are being seeded the response says so, with the
+// number of docs read so far, and the counts can't be relied on.
+func (h *handler) handleChannels() error {
+	if h.user != nil && !h.getBoolQuery("mine") {
+		return base.HTTPErrorf(http.StatusForbidden, "Only ?mine=true is allowed")
+	}
+	counts, err := h.db.ChannelCounts()
+	if err != nil {
+		return err
+	}
+	response := db.Body{"channels": counts}
+	if seeding, docsRead := h.db.ChannelCountsSeeding(); seeding {
+		response["seeding"] = true
+		response["seeded_docs"] = docsRead
+	}
+	h.writeJSON(response)
 	return nil
 }
 
@@ -317,6 +442,7 @@ func (h *handler) handleBulkGet() error {
 		return internalerr
 	}
 
+	h.countReplicatedDocs(len(docs))
 	err = h.writeMultipart("mixed", func(writer *multipart.Writer) error {
 		for _, item := range docs {
 			var body db.Body
@@ -386,6 +512,7 @@ func (h *handler) handleBulkDocs() error {
 		return err
 	}
 	lenDocs := len(userDocs)
+	h.countReplicatedDocs(lenDocs)
 	// split out local docs, save them on their own
 	localDocs := make([]interface{}, 0, lenDocs)
 	docs := make([]interface{}, 0, lenDocs)
@@ -433,6 +560,9 @@ func (h *handler) handleBulkDocs() error {
 			status["error"] = base.CouchHTTPErrorName(code)
 			status["reason"] = msg
 			base.Logf("\tBulkDocs: Doc %q --> %d %s (%v)", docid, code, msg, err)
+			if !newEdits && h.privs == adminPrivs {
+				h.recordReplicationDocFailure(docid, revid, msg)
+			}
 			err = nil // wrote it to output already; not going to return it
 		} else {
 			status["rev"] = revid
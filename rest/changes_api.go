@@ -252,9 +252,6 @@ func (h *handler) handleChanges() error {
 				return base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
 			}
 		} else if filter == "_doc_ids" {
-			if feed != "normal" && feed != "" {
-				return base.HTTPErrorf(http.StatusBadRequest, "Filter '_doc_ids' is only valid for feed=normal replications")
-			}
 			if docIdsArray == nil {
 				return base.HTTPErrorf(http.StatusBadRequest, "Missing 'doc_ids' filter parameter")
 			}
@@ -266,6 +263,19 @@ func (h *handler) handleChanges() error {
 		}
 	}
 
+	// A filtered replication's source URL may add a filter; see replicationEndpoint.
+	if replicationFilter, err := h.getReplicationFilter(); err != nil {
+		return err
+	} else if replicationFilter != nil {
+		if filter == "_doc_ids" {
+			return base.HTTPErrorf(http.StatusBadRequest, "Filter '_doc_ids' can't be combined with a replication filter")
+		}
+		options.Filter = replicationFilter
+	} else if filter == "_doc_ids" && feed != "normal" && feed != "" {
+		// Other feed types apply the doc IDs as a filter on the channels' changes
+		options.Filter = &db.ChangesFilter{DocIDs: base.SetFromArray(docIdsArray)}
+	}
+
 	h.db.ChangesClientStats.Increment()
 	defer h.db.ChangesClientStats.Decrement()
 
@@ -706,6 +716,7 @@ func (h *handler) sendContinuousChangesByWebSocket(inChannels base.Set, options
 		//options.Terminator will be closed automatically when
 		//changes feed completes
 		wsoptions.Terminator = options.Terminator
+		wsoptions.Filter = options.Filter
 
 		// Set up GZip compression
 		var writer *bytes.Buffer
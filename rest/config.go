@@ -62,6 +62,7 @@ type ServerConfig struct {
 	ServerWriteTimeout             *int                     `json:",omitempty"` // maximum duration.Second before timing out write of the HTTP(S) response
 	AdminInterface                 *string                  `json:",omitempty"` // Interface to bind admin API to, default ":4985"
 	AdminUI                        *string                  `json:",omitempty"` // Path to Admin HTML page, if omitted uses bundled HTML
+	AdminAuth                      *AdminAuthConfig         `json:",omitempty"` // Authentication and roles for the admin API
 	ProfileInterface               *string                  `json:",omitempty"` // Interface to bind Go profile API to (no default)
 	ConfigServer                   *string                  `json:",omitempty"` // URL of config server (for dynamic db discovery)
 	Facebook                       *FacebookConfig          `json:",omitempty"` // Configuration for Facebook validation
@@ -116,6 +117,7 @@ type DbConfig struct {
 	Roles              map[string]*db.PrincipalConfig `json:"roles,omitempty"`                // Initial roles
 	RevsLimit          *uint32                        `json:"revs_limit,omitempty"`           // Max depth a document's revision tree can grow to
 	ImportDocs         interface{}                    `json:"import_docs,omitempty"`          // false, true, or "continuous"
+	ImportFilter       *string                        `json:"import_filter,omitempty"`        // JS function(doc) deciding which docs are imported
 	Shadow             *ShadowConfig                  `json:"shadow,omitempty"`               // External bucket to shadow
 	EventHandlers      interface{}                    `json:"event_handlers,omitempty"`       // Event handlers (webhook)
 	FeedType           string                         `json:"feed_type,omitempty"`            // Feed type - "DCP" or "TAP"; defaults based on Couchbase server version
@@ -126,6 +128,12 @@ type DbConfig struct {
 	StartOffline       bool                           `json:"offline,omitempty"`              // start the DB in the offline state, defaults to false
 	Unsupported        *UnsupportedConfig             `json:"unsupported,omitempty"`          // Config for unsupported features
 	OIDCConfig         *auth.OIDCOptions              `json:"oidc,omitempty"`                 // Config properties for OpenID Connect authentication
+	LoginThrottle      *auth.LoginThrottleOptions     `json:"login_throttle,omitempty"`       // Throttling of failed password logins
+	Session            *auth.SessionOptions           `json:"session,omitempty"`              // Login session timeouts and cookie attributes
+	BucketRetry        *BucketRetryConfig             `json:"bucket_retry,omitempty"`         // Retrying of failed bucket operations; off unless set
+	Indexes            []*db.QueryIndexDef            `json:"indexes,omitempty"`              // Secondary indexes for _find queries
+	Search             *db.SearchOptions              `json:"search,omitempty"`               // Full-text search settings
+	TombstonePurge     *db.TombstonePurgeOptions      `json:"tombstone_purge,omitempty"`      // Retention period of deleted docs' tombstones
 }
 
 type DbConfigMap map[string]*DbConfig
@@ -141,6 +149,21 @@ type GoogleConfig struct {
 	AppClientID []string `json:"app_client_id"` // list of enabled client ids
 }
 
+// Configuration for authenticating requests to the admin API.  When enabled, every admin request
+// must present either basic auth credentials or a bearer token for an account defined here or
+// in a "_sync:admin:" document in the database's bucket.
+type AdminAuthConfig struct {
+	Enabled  bool                           `json:"enabled"`                  // Whether admin requests require authentication
+	Accounts map[string]*AdminAccountConfig `json:"accounts,omitempty"`       // Admin accounts, mapped by name
+	AuditLog *string                        `json:"audit_log_file,omitempty"` // Path to audit log file; if missing, audit records go to the main log
+}
+
+type AdminAccountConfig struct {
+	Password *string `json:"password,omitempty"` // Password for basic auth
+	Token    *string `json:"token,omitempty"`    // Bearer token
+	Role     string  `json:"role"`               // One of "read_only", "user_manager", "db_admin", "admin"
+}
+
 type CORSConfig struct {
 	Origin      []string // List of allowed origins, use ["*"] to allow access from everywhere
 	LoginOrigin []string // List of allowed login origins
@@ -150,8 +173,9 @@ type CORSConfig struct {
 
 type ShadowConfig struct {
 	BucketConfig
-	Doc_id_regex *string `json:"doc_id_regex,omitempty"` // Optional regex that doc IDs must match
-	FeedType     string  `json:"feed_type,omitempty"`    // Feed type - "DCP" or "TAP"; defaults to TAP
+	Doc_id_regex   *string `json:"doc_id_regex,omitempty"`    // Optional regex that doc IDs must match
+	FeedType       string  `json:"feed_type,omitempty"`       // Feed type - "DCP" (default; resumes from checkpoints) or "TAP" (default for Walrus)
+	ConflictPolicy string  `json:"conflict_policy,omitempty"` // "remote_wins" (default), "local_wins" or JS function(local, remote)
 }
 
 type EventHandlerConfig struct {
@@ -176,6 +200,17 @@ type CacheConfig struct {
 	ChannelCacheMaxLength  *int    `json:"channel_cache_max_length"`   // Maximum number of entries maintained in cache per channel
 	ChannelCacheMinLength  *int    `json:"channel_cache_min_length"`   // Minimum number of entries maintained in cache per channel
 	ChannelCacheAge        *int    `json:"channel_cache_expiry"`       // Time (seconds) to keep entries in cache beyond the minimum retained
+	ChannelCacheMaxBytes   *int64  `json:"channel_cache_max_bytes"`    // Approximate memory limit for all channel caches combined
+	SnapshotDir            *string `json:"snapshot_dir,omitempty"`     // Directory to save channel caches in at shutdown, to reload at startup
+	WarmupChannels         *int    `json:"warmup_channels,omitempty"`  // Number of most-requested channels to load at startup (requires snapshot_dir)
+}
+
+type BucketRetryConfig struct {
+	MaxRetries       *int    `json:"max_retries,omitempty"`       // Retries of a failed bucket operation
+	InitialBackoff   *uint32 `json:"initial_backoff,omitempty"`   // Time (ms) before the first retry; doubles on each retry
+	MaxBackoff       *uint32 `json:"max_backoff,omitempty"`       // Maximum time (ms) between retries
+	BreakerThreshold *int    `json:"breaker_threshold,omitempty"` // Consecutive failed operations that make the database unavailable (0 = never)
+	BreakerOpenTime  *uint32 `json:"breaker_open_time,omitempty"` // Time (seconds) to wait before trying the bucket again
 }
 
 type ChannelIndexConfig struct {
@@ -194,6 +229,7 @@ type SequenceHashConfig struct {
 type UnsupportedConfig struct {
 	UserViews        *UserViewsConfig            `json:"user_views,omitempty"`         // Config settings for user views
 	OidcTestProvider *db.OidcTestProviderOptions `json:"oidc_test_provider,omitempty"` // Config settings for OIDC Provider
+	FaultInjection   *bool                       `json:"fault_injection,omitempty"`    // Allow injecting bucket faults via /db/_debug/faults
 }
 
 type UnsupportedServerConfig struct {
@@ -336,6 +372,9 @@ func ReadServerConfigFromData(data []byte) (*ServerConfig, error) {
 	if err := config.setupAndValidateDatabases(); err != nil {
 		return nil, err
 	}
+	if err := config.AdminAuth.validate(); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
@@ -388,6 +427,9 @@ func ReadServerConfigFromFile(path string) (*ServerConfig, error) {
 	if err := config.setupAndValidateDatabases(); err != nil {
 		return nil, err
 	}
+	if err := config.AdminAuth.validate(); err != nil {
+		return nil, err
+	}
 	return config, nil
 
 }
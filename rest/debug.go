@@ -16,6 +16,7 @@ import (
 	"github.com/samuel/go-metrics/metrics"
 
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
 )
 
 const (
@@ -151,3 +152,72 @@ func (h *handler) handleExpvar() error {
 	http.DefaultServeMux.ServeHTTP(h.response, h.rq)
 	return nil
 }
+
+//////// FAULT INJECTION:
+
+const kDefaultFaultTTL = 5 * time.Minute // How long injected faults last, by default
+const kMaxFaultTTL = 24 * time.Hour
+
+// Returns the database's bucket as a LeakyBucket, if fault injection is enabled in its config.
+func (h *handler) leakyBucket() (*base.LeakyBucket, error) {
+	leaky, ok := base.UnwrapBucket(h.db.Bucket).(*base.LeakyBucket)
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusPreconditionFailed,
+			"Fault injection isn't enabled; set unsupported.fault_injection in the database config")
+	}
+	return leaky, nil
+}
+
+// HTTP handler for GET /db/_debug/faults
+func (h *handler) handleGetFaults() error {
+	leaky, err := h.leakyBucket()
+	if err != nil {
+		return err
+	}
+	if faults := leaky.Faults(); faults != nil {
+		h.writeJSON(faults)
+	} else {
+		h.writeJSON(db.Body{})
+	}
+	return nil
+}
+
+// HTTP handler for PUT /db/_debug/faults.  The body is a base.LeakyFaults, plus an optional
+// "ttl" in seconds after which the faults are removed.
+func (h *handler) handlePutFaults() error {
+	leaky, err := h.leakyBucket()
+	if err != nil {
+		return err
+	}
+	var body struct {
+		base.LeakyFaults
+		TTL int `json:"ttl,omitempty"`
+	}
+	if err := h.readJSONInto(&body); err != nil {
+		return err
+	}
+	if err := body.Validate(); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "%v", err)
+	}
+	ttl := kDefaultFaultTTL
+	if body.TTL < 0 || time.Duration(body.TTL)*time.Second > kMaxFaultTTL {
+		return base.HTTPErrorf(http.StatusBadRequest, "ttl must be at most %d", int(kMaxFaultTTL.Seconds()))
+	} else if body.TTL > 0 {
+		ttl = time.Duration(body.TTL) * time.Second
+	}
+	faults := body.LeakyFaults
+	faults.Expires = time.Now().Add(ttl)
+	leaky.SetFaults(&faults)
+	h.writeJSON(faults)
+	return nil
+}
+
+// HTTP handler for DELETE /db/_debug/faults
+func (h *handler) handleDeleteFaults() error {
+	leaky, err := h.leakyBucket()
+	if err != nil {
+		return err
+	}
+	leaky.SetFaults(nil)
+	return nil
+}
@@ -27,6 +27,7 @@ func (h *handler) handleGetDoc() error {
 	revid := h.getQuery("rev")
 	openRevs := h.getQuery("open_revs")
 	showExp := h.getBoolQuery("show_exp")
+	h.countReplicatedDocs(1)
 
 	// Check whether the caller wants a revision history, or attachment bodies, or both:
 	var revsLimit = 0
@@ -86,7 +87,7 @@ func (h *handler) handleGetDoc() error {
 
 		if openRevs == "all" {
 			// open_revs=all
-			doc, err := h.db.GetDoc(docid)
+			doc, err := h.db.GetDocImportingOnDemand(docid)
 			if err != nil {
 				return err
 			}
@@ -248,6 +249,7 @@ func (h *handler) handlePutAttachment() error {
 // HTTP handler for a PUT of a document
 func (h *handler) handlePutDoc() error {
 	docid := h.PathVar("docid")
+	h.countReplicatedDocs(1)
 	body, err := h.readDocument()
 	if err != nil {
 		return err
@@ -0,0 +1,181 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Command-line flags that locate a database's bucket, for the commands that run without the
+// server.  The bucket is given either directly or by a database in a config file.
+type bucketFlags struct {
+	url        *string
+	pool       *string
+	bucket     *string
+	configFile *string
+	dbName     *string
+}
+
+func addBucketFlags(flags *flag.FlagSet) *bucketFlags {
+	return &bucketFlags{
+		url:        flags.String("url", DefaultServer, "Address of Couchbase server"),
+		pool:       flags.String("pool", DefaultPool, "Name of pool"),
+		bucket:     flags.String("bucket", "sync_gateway", "Name of bucket"),
+		configFile: flags.String("config", "", "Config file to find the database in, instead of -url/-bucket"),
+		dbName:     flags.String("dbname", "", "Name of the database in the config file (if it has more than one)"),
+	}
+}
+
+func (f *bucketFlags) connect() (base.Bucket, error) {
+	spec := base.BucketSpec{Server: *f.url, PoolName: *f.pool, BucketName: *f.bucket}
+	if *f.configFile != "" {
+		config, err := ReadServerConfig(*f.configFile)
+		if err != nil {
+			return nil, err
+		}
+		dbConfig := config.Databases[*f.dbName]
+		if *f.dbName == "" && len(config.Databases) == 1 {
+			for _, only := range config.Databases {
+				dbConfig = only
+			}
+		}
+		if dbConfig == nil {
+			return nil, fmt.Errorf("No database %q in %s", *f.dbName, *f.configFile)
+		}
+		spec = base.BucketSpec{
+			Server:     *dbConfig.Server,
+			PoolName:   *dbConfig.Pool,
+			BucketName: *dbConfig.Bucket,
+			Auth:       dbConfig,
+		}
+	}
+	return db.ConnectToBucket(spec, nil)
+}
+
+// Entry point for "sync_gateway export", which writes a database to NDJSON.
+func ExportMain(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	location := addBucketFlags(flags)
+	outPath := flags.String("out", "-", "File to write the export to, or - for stdout")
+	resume := flags.Bool("resume", false, "Continue an interrupted export to the -out file")
+	flags.Parse(args)
+
+	var options db.ExportOptions
+	var out io.Writer = os.Stdout
+	if *outPath != "-" {
+		file, err := os.OpenFile(*outPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			base.LogFatal("Can't open %s: %v", *outPath, err)
+		}
+		defer file.Close()
+		var last *db.ExportRecord
+		if *resume {
+			if last, err = truncateExport(file); err != nil {
+				base.LogFatal("Can't resume export to %s: %v", *outPath, err)
+			}
+		} else if err = file.Truncate(0); err != nil {
+			base.LogFatal("Can't write to %s: %v", *outPath, err)
+		}
+		if last != nil && last.Type == db.ExportEnd {
+			base.Logf("Export to %s is already complete", *outPath)
+			return
+		} else if last != nil && last.Type != db.ExportHeader {
+			options.After = last.Key
+			base.Logf("Resuming export after %q", last.Key)
+		} else if err = file.Truncate(0); err != nil {
+			base.LogFatal("Can't write to %s: %v", *outPath, err)
+		}
+		if _, err = file.Seek(0, os.SEEK_END); err != nil {
+			base.LogFatal("Can't write to %s: %v", *outPath, err)
+		}
+		out = file
+	} else if *resume {
+		base.LogFatal("-resume requires an -out file")
+	}
+
+	bucket, err := location.connect()
+	if err != nil {
+		base.LogFatal("Can't open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	writer := bufio.NewWriter(out)
+	if _, err = db.ExportDatabase(bucket, writer, options); err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		writer.Flush()
+		base.LogFatal("Export failed: %v", err)
+	}
+}
+
+// Truncates a partial export file after its last complete record, and returns that record
+// (or nil if there isn't one).
+func truncateExport(file *os.File) (*db.ExportRecord, error) {
+	reader := bufio.NewReader(file)
+	var lastLine []byte
+	var offset, lastEnd int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		lastLine, lastEnd = line, offset
+	}
+	if err := file.Truncate(lastEnd); err != nil {
+		return nil, err
+	} else if lastLine == nil {
+		return nil, nil
+	}
+	var record db.ExportRecord
+	if err := json.Unmarshal(lastLine, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Entry point for "sync_gateway import", which reads a database exported to NDJSON.
+func ImportMain(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	location := addBucketFlags(flags)
+	inPath := flags.String("in", "-", "File to read the export from, or - for stdin")
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if *inPath != "-" {
+		file, err := os.Open(*inPath)
+		if err != nil {
+			base.LogFatal("Can't open %s: %v", *inPath, err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	bucket, err := location.connect()
+	if err != nil {
+		base.LogFatal("Can't open bucket: %v", err)
+	}
+	defer bucket.Close()
+
+	if _, err := db.ImportDatabase(bucket, bufio.NewReader(in)); err != nil {
+		base.LogFatal("Import failed: %v (run the import again to resume it)", err)
+	}
+}
@@ -70,6 +70,10 @@ type handler struct {
 	serialNumber   uint64
 	loggedDuration bool
 	runOffline     bool
+	adminRole      auth.AdminRole          // Admin role required by the route, if admin auth is enabled
+	adminAccount   *auth.AdminAccount      // Authenticated admin account, if admin auth is enabled
+	apiKey         *auth.APIKey            // API key the user authenticated with, if any
+	rateLimiter    *replicationRateLimiter // Limiter of the replication being served, if any
 }
 
 type handlerPrivs int
@@ -77,7 +81,7 @@ type handlerPrivs int
 const (
 	regularPrivs = iota // Handler requires authentication
 	publicPrivs         // Handler checks auth but doesn't require it
-	adminPrivs          // Handler ignores auth, always runs with root/admin privs
+	adminPrivs          // Handler runs with root/admin privs; only checks auth if admin auth is enabled
 )
 
 type handlerMethod func(*handler) error
@@ -90,6 +94,7 @@ func makeHandler(server *ServerContext, privs handlerPrivs, method handlerMethod
 		err := h.invoke(method)
 		h.writeError(err)
 		h.logDuration(true)
+		h.writeAuditRecord()
 	})
 }
 
@@ -101,6 +106,7 @@ func makeOfflineHandler(server *ServerContext, privs handlerPrivs, method handle
 		err := h.invoke(method)
 		h.writeError(err)
 		h.logDuration(true)
+		h.writeAuditRecord()
 	})
 }
 
@@ -145,6 +151,15 @@ func (h *handler) invoke(method handlerMethod) error {
 
 	h.setHeader("Server", VersionString)
 
+	// On the admin port, authenticate before looking up the database, so that callers who can't
+	// log in get the same error whether or not a database exists:
+	if h.privs == adminPrivs {
+		if err = h.checkAdminAuth(h.PathVar("db")); err != nil {
+			h.logRequestLine()
+			return err
+		}
+	}
+
 	// If there is a "db" path variable, look up the database context:
 	var dbContext *db.DatabaseContext
 	if dbname := h.PathVar("db"); dbname != "" {
@@ -207,6 +222,9 @@ func (h *handler) logRequestLine() {
 	as := ""
 	if h.privs == adminPrivs {
 		as = "  (ADMIN)"
+		if h.adminAccount != nil {
+			as = fmt.Sprintf("  (ADMIN as %s)", h.adminAccount.Name)
+		}
 	} else if h.user != nil && h.user.Name() != "" {
 		as = fmt.Sprintf("  (as %s)", h.user.Name())
 	}
@@ -275,6 +293,11 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 		return nil
 	}
 
+	// Check for an API key
+	if key := h.getAPIKey(); key != "" {
+		return h.checkAPIKey(context, key)
+	}
+
 	var err error
 	// If oidc enabled, check for bearer ID token
 	if context.Options.OIDCOptions != nil {
@@ -308,8 +331,9 @@ func (h *handler) checkAuth(context *db.DatabaseContext) error {
 
 	// Check basic auth first
 	if userName, password := h.getBasicAuth(); userName != "" {
-		h.user = context.Authenticator().AuthenticateUser(userName, password)
-		if h.user == nil {
+		if h.user, err = h.authenticateUser(context, userName, password); err != nil {
+			return err
+		} else if h.user == nil {
 			base.Logf("HTTP auth failed for username=%q", userName)
 			h.response.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Sync Gateway"`)
 			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
@@ -613,6 +637,9 @@ func (h *handler) writeError(err error) {
 	if err != nil {
 		err = auth.OIDCToHTTPError(err) // Map OIDC/OAuth2 errors to HTTP form
 		status, message := base.ErrorAsHTTPStatus(err)
+		if unavailable, ok := err.(*base.BucketUnavailableError); ok {
+			h.response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(unavailable.RetryAfter.Seconds()))))
+		}
 		h.writeStatus(status, message)
 	}
 }
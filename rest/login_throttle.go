@@ -0,0 +1,93 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// Authenticates a user by name and password, subject to the database's login throttle.
+// Returns nil if the name or password is wrong, or a 429 error if the client has to wait.
+func (h *handler) authenticateUser(context *db.DatabaseContext, username string, password string) (auth.User, error) {
+	throttle := context.LoginThrottle
+	if throttle == nil || username == "" {
+		return context.Authenticator().AuthenticateUser(username, password), nil
+	}
+	attempt, wait, err := throttle.CheckLogin(username, h.clientAddress())
+	if err != nil {
+		return nil, err
+	} else if attempt == nil {
+		h.response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return nil, base.HTTPErrorf(429, "Too many failed logins; try again later")
+	}
+	user := context.Authenticator().AuthenticateUser(username, password)
+	if user == nil {
+		attempt.Failed()
+	} else {
+		attempt.Succeeded()
+	}
+	return user, nil
+}
+
+// The IP address of the client that sent the request.
+func (h *handler) clientAddress() string {
+	host, _, err := net.SplitHostPort(h.rq.RemoteAddr)
+	if err != nil {
+		return h.rq.RemoteAddr
+	}
+	return host
+}
+
+func (h *handler) getLoginThrottle() (*auth.LoginThrottle, string, error) {
+	throttle := h.db.LoginThrottle
+	if throttle == nil {
+		return nil, "", base.HTTPErrorf(http.StatusNotFound, "Login throttling is not enabled")
+	}
+	kind := h.PathVar("kind")
+	if kind != auth.LoginFailuresUser && kind != auth.LoginFailuresClient {
+		return nil, "", base.HTTPErrorf(http.StatusBadRequest, "Unknown login failure type %q", kind)
+	}
+	return throttle, kind, nil
+}
+
+// ADMIN API: returns the recent login failures, and any lockout, of a username or client address.
+func (h *handler) getLoginFailures() error {
+	h.assertAdminOnly()
+	throttle, kind, err := h.getLoginThrottle()
+	if err != nil {
+		return err
+	}
+	failures, err := throttle.GetFailures(kind, h.PathVar("id"))
+	if failures == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	h.writeJSON(failures)
+	return nil
+}
+
+// ADMIN API: clears the login failures of a username or client address, lifting any lockout.
+func (h *handler) deleteLoginFailures() error {
+	h.assertAdminOnly()
+	throttle, kind, err := h.getLoginThrottle()
+	if err != nil {
+		return err
+	}
+	return throttle.ClearFailures(kind, h.PathVar("id"))
+}
@@ -0,0 +1,138 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func newLoginThrottleTester(options *auth.LoginThrottleOptions, usernames ...string) *restTester {
+	rt := &restTester{noAdminParty: true}
+	context := rt.getDatabase()
+	context.LoginThrottle = auth.NewLoginThrottle(rt.bucket(), options)
+	a := context.Authenticator()
+	for _, name := range usernames {
+		user, _ := a.NewUser(name, "letmein", channels.SetOf("*"))
+		a.Save(user)
+	}
+	return rt
+}
+
+func (rt *restTester) sendLoginFrom(client string, username string, password string) *testResponse {
+	req := request("GET", "/db/", "")
+	req.SetBasicAuth(username, password)
+	req.RemoteAddr = client + ":12345"
+	return rt.send(req)
+}
+
+func TestLoginThrottleProgressiveDelay(t *testing.T) {
+	rt := newLoginThrottleTester(&auth.LoginThrottleOptions{}, "alice")
+
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "alice", "wrong"), 401)
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "alice", "wrong"), 401)
+
+	// After two failures, even the right password has to wait:
+	response := rt.sendLoginFrom("10.0.0.1", "alice", "letmein")
+	assertStatus(t, response, 429)
+	assert.Equals(t, response.Header().Get("Retry-After"), "1")
+
+	// Session login is throttled too:
+	response = rt.sendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`)
+	assertStatus(t, response, 429)
+
+	response = rt.sendAdminRequest("GET", "/db/_login_failures/user/alice", "")
+	assertStatus(t, response, 200)
+	var failures auth.LoginFailures
+	json.Unmarshal(response.Body.Bytes(), &failures)
+	assert.Equals(t, failures.Failures, 2)
+	assert.True(t, failures.LockedUntil == nil)
+
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_login_failures/user/alice", ""), 200)
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "alice", "letmein"), 200)
+
+	// A successful login forgets earlier failures:
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "alice", "wrong"), 401)
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "alice", "letmein"), 200)
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_login_failures/user/alice", ""), 404)
+}
+
+func TestLoginThrottleLockout(t *testing.T) {
+	maxUserFailures := 1
+	maxClientFailures := 3
+	lockoutSecs := 600
+	rt := newLoginThrottleTester(&auth.LoginThrottleOptions{
+		MaxUserFailures:   &maxUserFailures,
+		MaxClientFailures: &maxClientFailures,
+		LockoutSecs:       &lockoutSecs,
+	}, "alice", "bob", "carol", "dave")
+
+	// One failure locks out the username, from any client:
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "alice", "wrong"), 401)
+	response := rt.sendLoginFrom("10.0.0.2", "alice", "letmein")
+	assertStatus(t, response, 429)
+	retryAfter, _ := strconv.Atoi(response.Header().Get("Retry-After"))
+	assert.True(t, retryAfter > 590 && retryAfter <= 600)
+
+	// Three failures lock out the client address, for any username:
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "bob", "wrong"), 401)
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "carol", "wrong"), 401)
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "dave", "letmein"), 429)
+	assertStatus(t, rt.sendLoginFrom("10.0.0.2", "dave", "letmein"), 200)
+
+	response = rt.sendAdminRequest("GET", "/db/_login_failures/client/10.0.0.1", "")
+	assertStatus(t, response, 200)
+	var failures auth.LoginFailures
+	json.Unmarshal(response.Body.Bytes(), &failures)
+	assert.Equals(t, failures.Failures, 3)
+	assert.True(t, failures.LockedUntil != nil)
+
+	assertStatus(t, rt.sendAdminRequest("DELETE", "/db/_login_failures/client/10.0.0.1", ""), 200)
+	assertStatus(t, rt.sendLoginFrom("10.0.0.1", "dave", "letmein"), 200)
+
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_login_failures/bogus/x", ""), 400)
+}
+
+func TestLoginThrottleConcurrentAttempts(t *testing.T) {
+	rt := newLoginThrottleTester(&auth.LoginThrottleOptions{}, "alice")
+
+	// Each attempt is counted before its password is checked, so only the first two of a burst of
+	// concurrent attempts get to check one; the rest have to wait:
+	const numAttempts = 10
+	statuses := make(chan int, numAttempts)
+	var wg sync.WaitGroup
+	for i := 0; i < numAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- rt.sendLoginFrom("10.0.0.1", "alice", "wrong").Code
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	counts := map[int]int{}
+	for status := range statuses {
+		counts[status]++
+	}
+	assert.DeepEquals(t, counts, map[int]int{401: 2, 429: numAttempts - 2})
+
+	// Attempts that had to wait don't count as failures, and don't count against the client:
+	response := rt.sendAdminRequest("GET", "/db/_login_failures/client/10.0.0.1", "")
+	assertStatus(t, response, 200)
+	var failures auth.LoginFailures
+	json.Unmarshal(response.Body.Bytes(), &failures)
+	assert.Equals(t, failures.Failures, 2)
+}
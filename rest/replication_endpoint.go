@@ -0,0 +1,146 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Options for a replication's requests to a database on this server, which sg-replicate has no
+// parameters for.  They're encoded into the database's URL: the replication uses
+// "/db/_endpoint/<endpoint>/", which serves the same document API as "/db/" but applies the
+// options.  Since the URL is part of the replication's checkpoint ID, so are the options, which
+// is why the rate limits themselves aren't in it: they're looked up by replication ID.  A
+// replication with an ID names itself in its local target's endpoint, so that the documents the
+// target rejects are recorded for it.
+type replicationEndpoint struct {
+	Replication string   `json:"replication,omitempty"` // ID of the replication, for rate limits and doc failures
+	DocIDs      []string `json:"doc_ids,omitempty"`     // Filter applied to _changes
+	Function    string   `json:"function,omitempty"`    // JavaScript function(doc) filter applied to _changes
+}
+
+func (endpoint replicationEndpoint) isEmpty() bool {
+	return endpoint.Replication == "" && endpoint.DocIDs == nil && endpoint.Function == ""
+}
+
+// Encodes the endpoint as a URL path component.
+func (endpoint replicationEndpoint) encode() string {
+	data, _ := json.Marshal(endpoint)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Returns the path of the endpoint within the database, like "db/_endpoint/<endpoint>".
+func (endpoint replicationEndpoint) dbPath(dbName string) string {
+	if endpoint.isEmpty() {
+		return dbName
+	}
+	return dbName + "/_endpoint/" + endpoint.encode()
+}
+
+func decodeReplicationEndpoint(encoded string) (*replicationEndpoint, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid replication endpoint")
+	}
+	var endpoint replicationEndpoint
+	if err := json.Unmarshal(data, &endpoint); err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid replication endpoint")
+	}
+	return &endpoint, nil
+}
+
+// Returns the replication endpoint in a "/db/_endpoint/<endpoint>/" URL, or nil if there isn't
+// one.
+func (h *handler) getReplicationEndpoint() (*replicationEndpoint, error) {
+	encoded := h.PathVar("endpoint")
+	if encoded == "" {
+		return nil, nil
+	}
+	return decodeReplicationEndpoint(encoded)
+}
+
+// Wraps a handler method served at a replication endpoint, to apply the replication's rate
+// limits.  Requests wait until the replication is back within its limits, then are charged for
+// the bytes they transfer and the documents they read or write, as counted by
+// countReplicatedDocs.  Replications reach local databases through the admin API, so only it
+// serves endpoints that name a replication; otherwise any user could use up a replication's
+// limits and stall it.
+func rateLimited(method handlerMethod) handlerMethod {
+	return func(h *handler) error {
+		endpoint, err := h.getReplicationEndpoint()
+		if err != nil {
+			return err
+		}
+		if endpoint == nil || endpoint.Replication == "" {
+			return method(h)
+		}
+		if h.privs != adminPrivs {
+			return base.HTTPErrorf(http.StatusForbidden, "Replication endpoints can only be used through the admin API")
+		}
+		limiter := h.server.replications.getRateLimiter(endpoint.Replication)
+		if limiter == nil {
+			return method(h)
+		}
+		limiter.wait()
+		// Count the bytes after compression, if the response is compressed:
+		counter := &countingResponseWriter{ResponseWriter: h.response}
+		if encoded, ok := h.response.(*EncodedResponseWriter); ok {
+			counter.ResponseWriter = encoded.ResponseWriter
+			encoded.ResponseWriter = counter
+		} else {
+			h.response = counter
+		}
+		h.rateLimiter = limiter
+		err = method(h)
+		requestBytes := h.rq.ContentLength
+		if requestBytes < 0 {
+			requestBytes = 0
+		}
+		limiter.charge(0, requestBytes+counter.count)
+		return err
+	}
+}
+
+// Charges the replication being served, if any, for documents read or written.
+func (h *handler) countReplicatedDocs(count int) {
+	if h.rateLimiter != nil {
+		h.rateLimiter.charge(count, 0)
+	}
+}
+
+// A ResponseWriter that counts the bytes written through it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	count int64
+}
+
+func (w *countingResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.count += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *countingResponseWriter) CloseNotify() <-chan bool {
+	var closeNotify <-chan bool
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		closeNotify = cn.CloseNotify()
+	}
+	return closeNotify
+}
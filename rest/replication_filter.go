@@ -0,0 +1,196 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+	"github.com/couchbaselabs/sg-replicate"
+)
+
+// Returns true if a replication "filter" parameter is a JavaScript function, rather than the
+// name of a built-in filter.
+func isFilterFunction(filter string) bool {
+	return strings.HasPrefix(strings.TrimSpace(filter), "function")
+}
+
+// Returns the changes-feed filter given by the replication endpoint, or nil if there isn't one.
+// Filter functions can only be run by the admin API, since they could be used to tie up the
+// server.
+func (h *handler) getReplicationFilter() (*db.ChangesFilter, error) {
+	endpoint, err := h.getReplicationEndpoint()
+	if endpoint == nil || (endpoint.DocIDs == nil && endpoint.Function == "") {
+		return nil, err
+	}
+	var changesFilter db.ChangesFilter
+	if endpoint.DocIDs != nil {
+		changesFilter.DocIDs = base.SetFromArray(endpoint.DocIDs)
+	}
+	if endpoint.Function != "" {
+		if h.privs != adminPrivs {
+			return nil, base.HTTPErrorf(http.StatusForbidden, "Replication filter functions can only be run by the admin API")
+		}
+		changesFilter.Function = db.NewJSEventFunction(endpoint.Function)
+	}
+	return &changesFilter, nil
+}
+
+// A filtered replication's remote source.  sg-replicate can only ask a source for channels, so
+// the replication reads the source through a proxy on this server's admin API, at
+// "/_filtered_source/<id>/", which forwards its requests and adds the standard "filter" and
+// "doc_ids" parameters to its _changes requests.  The ID is a digest of the source and its
+// filter, so it's part of the replication's checkpoint ID.
+type filteredSource struct {
+	URL         string            `json:"url"`                    // The source database
+	DocIDs      []string          `json:"doc_ids,omitempty"`      // Sent as the _doc_ids filter
+	Filter      string            `json:"filter,omitempty"`       // Name of a design doc filter
+	QueryParams map[string]string `json:"query_params,omitempty"` // Parameters of the design doc filter
+
+	registeredAt time.Time // When it was last registered
+}
+
+// Sources are registered when replication parameters are validated, which happens before every
+// replication starts, including the ones restarted from the config or the bucket.  They're
+// unregistered once no running replication reads them (see unregisterUnusedFilteredSources).
+var filteredSources = struct {
+	sync.RWMutex
+	byID map[string]*filteredSource
+}{byID: map[string]*filteredSource{}}
+
+// Returns the ID of the source; the URL's password isn't part of it, so changing it doesn't
+// restart the replication.
+func (source filteredSource) id() string {
+	source.URL = redactURLPassword(source.URL)
+	data, _ := json.Marshal(source)
+	return fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+// How long an unused source stays registered, to cover the time between validating a
+// replication's parameters and starting it.
+var filteredSourceGracePeriod = 1 * time.Minute
+
+// Registers the source and returns its path on the admin API, like "_filtered_source/<id>".
+func (source *filteredSource) register() string {
+	id := source.id()
+	source.registeredAt = time.Now()
+	filteredSources.Lock()
+	filteredSources.byID[id] = source
+	filteredSources.Unlock()
+	return filteredSourcePath(id)
+}
+
+func filteredSourcePath(id string) string {
+	return "_filtered_source/" + id
+}
+
+// Unregisters the sources that none of the running replications read, except ones registered
+// within the grace period.  Called whenever a replication stops or finishes.
+func unregisterUnusedFilteredSources(running []sgreplicate.ReplicationParameters) {
+	inUse := make(map[string]bool, len(running))
+	for _, params := range running {
+		inUse[params.SourceDb] = true
+	}
+	filteredSources.Lock()
+	defer filteredSources.Unlock()
+	for id, source := range filteredSources.byID {
+		if !inUse[filteredSourcePath(id)] && time.Since(source.registeredAt) >= filteredSourceGracePeriod {
+			delete(filteredSources.byID, id)
+		}
+	}
+}
+
+func getFilteredSource(id string) *filteredSource {
+	filteredSources.RLock()
+	defer filteredSources.RUnlock()
+	return filteredSources.byID[id]
+}
+
+// Converts a replication's query_params to the parameters of a design doc filter.
+func filterQueryParams(queryParams interface{}) (map[string]string, error) {
+	if queryParams == nil {
+		return nil, nil
+	}
+	paramsMap, ok := queryParams.(map[string]interface{})
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "/_replicate query_params must be an object")
+	}
+	params := make(map[string]string, len(paramsMap))
+	for key, value := range paramsMap {
+		if str, ok := value.(string); ok {
+			params[key] = str
+		} else {
+			data, _ := json.Marshal(value)
+			params[key] = string(data)
+		}
+	}
+	return params, nil
+}
+
+// Adds the source's filter to the query of a _changes request.
+func (source *filteredSource) addFilter(query url.Values) {
+	if source.DocIDs != nil {
+		docIDs, _ := json.Marshal(source.DocIDs)
+		query.Set("filter", "_doc_ids")
+		query.Set("doc_ids", string(docIDs))
+	} else {
+		query.Set("filter", source.Filter)
+		for key, value := range source.QueryParams {
+			query.Set(key, value)
+		}
+	}
+}
+
+// HTTP handler for "/_filtered_source/<id>/...": forwards the request to the source database.
+func (h *handler) handleFilteredSource() error {
+	id := h.PathVar("source")
+	source := getFilteredSource(id)
+	if source == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "No such replication source")
+	}
+	sourceURL, err := url.Parse(source.URL)
+	if err != nil {
+		return err
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(rq *http.Request) {
+			path := strings.TrimPrefix(rq.URL.Path, "/_filtered_source/"+id)
+			rq.URL.Scheme = sourceURL.Scheme
+			rq.URL.Host = sourceURL.Host
+			rq.URL.Path = strings.TrimRight(sourceURL.Path, "/") + path
+			rq.URL.RawPath = ""
+			rq.Host = sourceURL.Host
+			if path == "/_changes" {
+				query := rq.URL.Query()
+				source.addFilter(query)
+				rq.URL.RawQuery = query.Encode()
+			}
+			rq.Header.Del("Authorization")
+			if sourceURL.User != nil {
+				password, _ := sourceURL.User.Password()
+				rq.SetBasicAuth(sourceURL.User.Username(), password)
+			}
+			// Let the transport handle compression, since this server may compress the response
+			rq.Header.Del("Accept-Encoding")
+		},
+		FlushInterval: 100 * time.Millisecond, // for continuous and longpoll feeds
+	}
+	proxy.ServeHTTP(h.response, h.rq)
+	return nil
+}
@@ -0,0 +1,250 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// A time-of-day window during which a continuous replication runs.  Times are "hh:mm", in the
+// replication's schedule_timezone; a window whose end is before its start runs past midnight,
+// and an end of "24:00" means midnight.  Days are the days the window starts on, like "mon";
+// if there are none, it's every day.
+type ReplicationWindow struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+var kWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Parses "hh:mm" into minutes since midnight.
+func parseTimeOfDay(str string) (int, bool) {
+	t, err := time.Parse("15:04", str)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), true
+	} else if str == "24:00" {
+		return 24 * 60, true
+	}
+	return 0, false
+}
+
+func (window *ReplicationWindow) validate() error {
+	start, ok1 := parseTimeOfDay(window.Start)
+	end, ok2 := parseTimeOfDay(window.End)
+	if !ok1 || !ok2 || start == 24*60 || start == end {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid replication schedule window %q-%q", window.Start, window.End)
+	}
+	for _, day := range window.Days {
+		if _, ok := kWeekdays[strings.ToLower(day)]; !ok {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid day %q in replication schedule", day)
+		}
+	}
+	return nil
+}
+
+func (window *ReplicationWindow) startsOn(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, name := range window.Days {
+		if kWeekdays[strings.ToLower(name)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the (local) time is within the window.
+func (window *ReplicationWindow) contains(now time.Time) bool {
+	start, _ := parseTimeOfDay(window.Start)
+	end, _ := parseTimeOfDay(window.End)
+	minute := now.Hour()*60 + now.Minute()
+	if start < end {
+		return minute >= start && minute < end && window.startsOn(now.Weekday())
+	}
+	// The window runs past midnight, so it may have started yesterday:
+	return (minute >= start && window.startsOn(now.Weekday())) ||
+		(minute < end && window.startsOn(now.AddDate(0, 0, -1).Weekday()))
+}
+
+// Checks a replication config's rate limits and schedule.
+func validateReplicationLimits(config *ReplicationConfig) error {
+	if config.MaxDocsPerSec < 0 || config.MaxBytesPerSec < 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Replication rate limits can't be negative")
+	}
+	if len(config.Schedule) > 0 && !config.Continuous {
+		return base.HTTPErrorf(http.StatusBadRequest, "Only continuous replications can have a schedule")
+	}
+	for i := range config.Schedule {
+		if err := config.Schedule[i].validate(); err != nil {
+			return err
+		}
+	}
+	if _, err := config.scheduleLocation(); err != nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid schedule_timezone %q", config.ScheduleTimezone)
+	}
+	return nil
+}
+
+func (config *ReplicationConfig) scheduleLocation() (*time.Location, error) {
+	if config.ScheduleTimezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(config.ScheduleTimezone)
+}
+
+// Returns true if the replication's schedule lets it run at the given time.  Replications
+// without a schedule always run.
+func (config *ReplicationConfig) isScheduled(now time.Time) bool {
+	if len(config.Schedule) == 0 {
+		return true
+	}
+	location, err := config.scheduleLocation()
+	if err != nil {
+		return true
+	}
+	now = now.In(location)
+	for i := range config.Schedule {
+		if config.Schedule[i].contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the config has rate limits or a schedule.
+func (config *ReplicationConfig) hasLimits() bool {
+	return config.MaxDocsPerSec > 0 || config.MaxBytesPerSec > 0 || len(config.Schedule) > 0
+}
+
+// Returns true if the config has rate limits, so that the replication goes through its endpoint.
+func (config *ReplicationConfig) hasRateLimits() bool {
+	return config.MaxDocsPerSec > 0 || config.MaxBytesPerSec > 0
+}
+
+// Returns a copy of the config without its rate limits and schedule, whose values can be changed
+// without restarting the replication.  Adding or removing rate limits does restart it, since it
+// changes the replication's endpoint.
+func (config ReplicationConfig) withoutLimits() ReplicationConfig {
+	config.MaxDocsPerSec = 0
+	config.MaxBytesPerSec = 0
+	config.Schedule = nil
+	config.ScheduleTimezone = ""
+	return config
+}
+
+// Limits the rate at which a replication reads or writes documents and bytes on this node.
+// Usage is charged after the fact, and requests wait while the replication's usage exceeds
+// what its limits allow; up to one second's worth can be used in a burst.
+type replicationRateLimiter struct {
+	lock        sync.Mutex
+	docsPerSec  float64
+	bytesPerSec float64
+	docs        float64 // Usage not yet allowed for; negative if there's unused allowance
+	bytes       float64
+	updated     time.Time
+}
+
+func newReplicationRateLimiter() *replicationRateLimiter {
+	return &replicationRateLimiter{updated: time.Now()}
+}
+
+func (limiter *replicationRateLimiter) setLimits(docsPerSec float64, bytesPerSec int64) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.update(time.Now())
+	limiter.docsPerSec = docsPerSec
+	limiter.bytesPerSec = float64(bytesPerSec)
+	limiter.update(time.Now()) // Clears the usage of removed limits
+}
+
+func (limiter *replicationRateLimiter) limits() (docsPerSec float64, bytesPerSec int64) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	return limiter.docsPerSec, int64(limiter.bytesPerSec)
+}
+
+// Subtracts the allowance accumulated since the last update from the usage.
+func (limiter *replicationRateLimiter) update(now time.Time) {
+	elapsed := now.Sub(limiter.updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	} else {
+		limiter.updated = now
+	}
+	limiter.docs = allowFor(limiter.docs, limiter.docsPerSec, elapsed)
+	limiter.bytes = allowFor(limiter.bytes, limiter.bytesPerSec, elapsed)
+}
+
+func allowFor(usage float64, rate float64, elapsed float64) float64 {
+	if rate <= 0 {
+		return 0
+	}
+	usage -= rate * elapsed
+	if usage < -rate {
+		usage = -rate // Don't save up more than a second's worth
+	}
+	return usage
+}
+
+func (limiter *replicationRateLimiter) charge(docs int, bytes int64) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.update(time.Now())
+	if limiter.docsPerSec > 0 {
+		limiter.docs += float64(docs)
+	}
+	if limiter.bytesPerSec > 0 {
+		limiter.bytes += float64(bytes)
+	}
+}
+
+// Returns how long the replication has to wait before it's back within its limits.
+func (limiter *replicationRateLimiter) delay(now time.Time) time.Duration {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.update(now)
+	var delay float64
+	if limiter.docs > 0 {
+		delay = limiter.docs / limiter.docsPerSec
+	}
+	if limiter.bytes > 0 && limiter.bytes/limiter.bytesPerSec > delay {
+		delay = limiter.bytes / limiter.bytesPerSec
+	}
+	return time.Duration(delay * float64(time.Second))
+}
+
+// Waits until the replication is back within its limits.  The limits may change meanwhile.
+func (limiter *replicationRateLimiter) wait() {
+	for {
+		delay := limiter.delay(time.Now())
+		if delay <= 0 {
+			return
+		}
+		if delay > time.Second {
+			delay = time.Second
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Returns true if the replication is waiting to get back within its limits.
+func (limiter *replicationRateLimiter) isThrottled() bool {
+	return limiter.delay(time.Now()) > 0
+}
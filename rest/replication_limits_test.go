@@ -0,0 +1,170 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbaselabs/go.assert"
+)
+
+func TestReplicationWindows(t *testing.T) {
+	// Monday 2016-03-07:
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2016, 3, 7, hour, minute, 0, 0, time.UTC)
+	}
+	window := ReplicationWindow{Start: "09:00", End: "17:30"}
+	assert.Equals(t, window.validate(), nil)
+	assert.False(t, window.contains(monday(8, 59)))
+	assert.True(t, window.contains(monday(9, 0)))
+	assert.True(t, window.contains(monday(17, 29)))
+	assert.False(t, window.contains(monday(17, 30)))
+
+	window = ReplicationWindow{Days: []string{"Sun"}, Start: "22:00", End: "06:00"}
+	assert.Equals(t, window.validate(), nil)
+	assert.True(t, window.contains(monday(5, 0))) // started Sunday night
+	assert.False(t, window.contains(monday(6, 0)))
+	assert.False(t, window.contains(monday(23, 0))) // doesn't start on Monday
+
+	window = ReplicationWindow{Start: "20:00", End: "24:00"}
+	assert.Equals(t, window.validate(), nil)
+	assert.True(t, window.contains(monday(23, 59)))
+	assert.False(t, window.contains(monday(0, 0)))
+
+	assert.True(t, (&ReplicationWindow{Start: "9am", End: "17:00"}).validate() != nil)
+	assert.True(t, (&ReplicationWindow{Start: "09:00", End: "09:00"}).validate() != nil)
+	assert.True(t, (&ReplicationWindow{Days: []string{"someday"}, Start: "09:00", End: "10:00"}).validate() != nil)
+
+	config := ReplicationConfig{Continuous: true, Schedule: []ReplicationWindow{{Start: "09:00", End: "17:00"}}}
+	assert.True(t, config.isScheduled(monday(10, 0)))
+	assert.False(t, config.isScheduled(monday(18, 0)))
+	config.ScheduleTimezone = "America/Los_Angeles" // UTC-8 in March, before DST
+	assert.False(t, config.isScheduled(monday(10, 0)))
+	assert.True(t, config.isScheduled(monday(18, 0)))
+	assert.True(t, (&ReplicationConfig{}).isScheduled(monday(3, 0)))
+}
+
+func TestReplicationRateLimiter(t *testing.T) {
+	limiter := newReplicationRateLimiter()
+	limiter.setLimits(10, 1000)
+	start := limiter.updated
+
+	limiter.charge(20, 500)
+	delay := limiter.delay(start)
+	assert.True(t, delay > 1900*time.Millisecond && delay <= 2*time.Second)
+	assert.Equals(t, limiter.delay(start.Add(2*time.Second+time.Millisecond)), time.Duration(0))
+
+	// Unused allowance is saved up to one second's worth:
+	limiter.delay(start.Add(time.Minute))
+	limiter.charge(0, 1500)
+	delay = limiter.delay(start.Add(time.Minute))
+	assert.True(t, delay > 0 && delay <= 500*time.Millisecond)
+
+	// Removing a limit removes its debt:
+	limiter.setLimits(10, 0)
+	limiter.charge(0, 1000000)
+	assert.Equals(t, limiter.delay(start.Add(time.Minute)), time.Duration(0))
+}
+
+func TestReplicationLimitsValidation(t *testing.T) {
+	managed := func(config ReplicationConfig) error {
+		config.ReplicationId = "db/r1"
+		_, _, _, err := validateReplicationParameters(config, true, DefaultAdminInterface)
+		return err
+	}
+	assert.Equals(t, managed(ReplicationConfig{Source: "db", Target: "http://example.com/other", MaxDocsPerSec: 100}), nil)
+	assert.True(t, managed(ReplicationConfig{Source: "http://example.com/a", Target: "http://example.com/b", MaxDocsPerSec: 100}) != nil)
+	assert.True(t, managed(ReplicationConfig{Source: "db", Target: "other", MaxBytesPerSec: -1}) != nil)
+	assert.True(t, managed(ReplicationConfig{Source: "db", Target: "other", Schedule: []ReplicationWindow{{Start: "01:00", End: "02:00"}}}) != nil)
+	assert.True(t, managed(ReplicationConfig{Source: "db", Target: "other", Continuous: true, ScheduleTimezone: "Nowhere/Special"}) != nil)
+
+	// Only managed replications can have limits:
+	_, _, _, err := validateReplicationParameters(ReplicationConfig{Source: "db", Target: "other", MaxDocsPerSec: 100}, false, DefaultAdminInterface)
+	assert.True(t, err != nil)
+
+	// The endpoint identifies a rate-limited replication, on whichever side is local:
+	params, _, _, err := validateReplicationParameters(ReplicationConfig{Source: "http://example.com/a", Target: "db", ReplicationId: "db/r1", MaxBytesPerSec: 1000}, true, DefaultAdminInterface)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, params.SourceDb, "a")
+	assert.True(t, strings.HasPrefix(params.TargetDb, "db/_endpoint/"))
+	endpoint, _ := decodeReplicationEndpoint(strings.TrimPrefix(params.TargetDb, "db/_endpoint/"))
+	assert.Equals(t, endpoint.Replication, "db/r1")
+
+	// A local target names the replication even without rate limits, to record its doc failures:
+	schedule := []ReplicationWindow{{Start: "01:00", End: "02:00"}}
+	params, _, _, err = validateReplicationParameters(ReplicationConfig{Source: "http://example.com/a", Target: "db", ReplicationId: "db/r1", Continuous: true, Schedule: schedule}, true, DefaultAdminInterface)
+	assert.Equals(t, err, nil)
+	endpoint, _ = decodeReplicationEndpoint(strings.TrimPrefix(params.TargetDb, "db/_endpoint/"))
+	assert.Equals(t, endpoint.Replication, "db/r1")
+
+	// ...but a local source without rate limits uses the plain URL, so its checkpoints don't change:
+	params, _, _, err = validateReplicationParameters(ReplicationConfig{Source: "db", Target: "http://example.com/b", ReplicationId: "db/r1", Continuous: true, Schedule: schedule}, true, DefaultAdminInterface)
+	assert.Equals(t, err, nil)
+	assert.Equals(t, params.SourceDb, "db")
+}
+
+func TestReplicationLimitsAPI(t *testing.T) {
+	var rt restTester
+	rt.ServerContext().replications.stop()
+	bucket := rt.bucket()
+
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_replication/r1", `{"source":"db", "target":"http://example.com:4984/other", "continuous":true}`), 201)
+
+	// Adding rate limits restarts the replication, since it changes its endpoint:
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_replication/r1", `{"source":"db", "target":"http://example.com:4984/other", "continuous":true,
+		"max_docs_per_sec":20}`), 200)
+	def, _ := getReplication(bucket, "r1")
+	assert.Equals(t, def.Revision, 2)
+
+	// Changing the limits and schedule doesn't:
+	now := time.Now().UTC()
+	schedule := `[{"start":"` + now.Add(2*time.Hour).Format("15:04") + `", "end":"` + now.Add(3*time.Hour).Format("15:04") + `"}]`
+	assertStatus(t, rt.sendAdminRequest("PUT", "/db/_replication/r1", `{"source":"db", "target":"http://example.com:4984/other", "continuous":true,
+		"max_docs_per_sec":50, "schedule":`+schedule+`}`), 200)
+	def, _ = getReplication(bucket, "r1")
+	assert.Equals(t, def.Revision, 2)
+	assert.Equals(t, def.Config.MaxDocsPerSec, 50.0)
+
+	// The replication is outside its schedule, so it's paused rather than started:
+	node := newReplicationManager(rt.ServerContext())
+	node.checkReplications()
+	assert.False(t, rt.ServerContext().replicator.HasReplication("db/r1"))
+	tasks := node.populateTasks(nil)
+	assert.Equals(t, len(tasks), 1)
+	assert.Equals(t, tasks[0].ReplicationID, "db/r1")
+	assert.Equals(t, tasks[0].State, base.ReplicationStatePaused)
+	assert.Equals(t, tasks[0].MaxDocsPerSec, 50.0)
+	assert.True(t, node.getRateLimiter("db/r1") != nil)
+
+	// Stopping the manager removes its paused replications and limiters:
+	node.stop()
+	assert.Equals(t, len(node.populateTasks(nil)), 0)
+	assert.True(t, node.getRateLimiter("db/r1") == nil)
+}
+
+func TestRateLimitedEndpoint(t *testing.T) {
+	var rt restTester
+	manager := rt.ServerContext().replications
+	manager.stop()
+	manager.setRateLimits("db/r1", &ReplicationConfig{MaxBytesPerSec: 1})
+	limiter := manager.getRateLimiter("db/r1")
+
+	// Users can't name a replication through the public API, so they can't use up its limits:
+	endpoint := replicationEndpoint{Replication: "db/r1"}
+	assertStatus(t, rt.sendRequest("GET", "/db/_endpoint/"+endpoint.encode()+"/", ""), 403)
+	assert.False(t, limiter.isThrottled())
+
+	// Requests through the admin API are charged:
+	assertStatus(t, rt.sendAdminRequest("GET", "/db/_endpoint/"+endpoint.encode()+"/", ""), 200)
+	assert.True(t, limiter.isThrottled())
+}
@@ -0,0 +1,873 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package rest
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+	"github.com/couchbaselabs/sg-replicate"
+)
+
+const (
+	kReplicationCheckInterval = 10 * time.Second // How often the manager checks replication definitions
+	kReplicationLeaseTime     = 30 * time.Second // How long a node owns a replication without renewing
+)
+
+// Key prefix reserved for replication definitions in the bucket
+const ReplicationKeyPrefix = "_sync:repl:"
+
+// Key of the document listing a database's replication definitions
+const ReplicationListKey = "_sync:repls"
+
+// States of a replication definition
+const (
+	ReplicationStateActive    = "active"    // Should be running
+	ReplicationStateCompleted = "completed" // One-shot replication that finished
+	ReplicationStateError     = "error"     // One-shot replication that failed
+)
+
+// A replication definition, stored in the bucket of the database it belongs to so that every
+// node serving the database sees it.  The node running the replication holds a lease on it,
+// which it renews periodically; if the node goes away, another node takes over once the lease
+// expires.  Replications resume from sg-replicate's checkpoints when they're restarted.
+type replicationDefinition struct {
+	ID           string            `json:"id"`
+	Config       ReplicationConfig `json:"config"`
+	Revision     int               `json:"revision"`              // Incremented when the config changes
+	State        string            `json:"state"`                 // See ReplicationState constants
+	Error        string            `json:"error,omitempty"`       // Why a one-shot replication failed
+	FromConfig   bool              `json:"from_config,omitempty"` // Defined in a server config file
+	Owner        string            `json:"owner,omitempty"`       // ID of the node running the replication
+	LeaseExpires *time.Time        `json:"lease_expires,omitempty"`
+}
+
+type replicationList struct {
+	IDs []string `json:"ids"`
+}
+
+func docIDForReplication(id string) string {
+	return ReplicationKeyPrefix + id
+}
+
+func (def *replicationDefinition) leaseExpired(now time.Time) bool {
+	return def.Owner == "" || def.LeaseExpires == nil || now.After(*def.LeaseExpires)
+}
+
+// Splits a key of replicationManager.running into the database name and replication ID.
+func splitReplicationKey(key string) (dbName string, id string) {
+	if i := strings.Index(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// A replication this node is running on behalf of a definition.
+type managedReplication struct {
+	replicationID string // ID in the server's base.Replicator
+	revision      int    // Revision of the definition being run
+	continuous    bool
+	paused        bool // Not running because it's outside its schedule
+	config        ReplicationConfig
+	done          chan struct{} // Closed when a one-shot replication finishes
+}
+
+// Runs the replications defined in the databases' buckets, making sure each one is run by only
+// one node of the cluster.
+type replicationManager struct {
+	sc         *ServerContext
+	nodeID     string                          // Identifies this node in replication leases
+	configured map[string][]*ReplicationConfig // Replications from the server config, by local db name
+	running    map[string]*managedReplication  // Keyed by db name + "/" + replication ID
+	lock       sync.Mutex
+	wake       chan struct{}
+	terminator chan struct{}
+	tasks      sync.WaitGroup // Tracks the background task, so stop can wait for it to exit
+	oneShots   sync.WaitGroup // Tracks the goroutines running one-shot replications
+
+	// Rate limiters of running replications, looked up by requests to their endpoints; these
+	// have their own lock so that those requests never wait for the main one.
+	limiters    map[string]*replicationRateLimiter
+	limiterLock sync.RWMutex
+}
+
+func newReplicationManager(sc *ServerContext) *replicationManager {
+	return &replicationManager{
+		sc:         sc,
+		nodeID:     base.CreateUUID(),
+		configured: map[string][]*ReplicationConfig{},
+		running:    map[string]*managedReplication{},
+		wake:       make(chan struct{}, 1),
+		terminator: make(chan struct{}),
+		limiters:   map[string]*replicationRateLimiter{},
+	}
+}
+
+// Starts checking replication definitions in the background.  The first check happens after
+// kReplicationCheckInterval, by which time the REST APIs are listening, since replications
+// may refer to local databases by URL.
+func (m *replicationManager) start() {
+	m.tasks.Add(1)
+	go func() {
+		defer m.tasks.Done()
+		ticker := time.NewTicker(kReplicationCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-m.wake:
+			case <-m.terminator:
+				return
+			}
+			m.checkReplications()
+		}
+	}()
+}
+
+// Stops the manager and the replications it's running, releasing their leases so other nodes
+// can take them over right away.
+func (m *replicationManager) stop() {
+	m.lock.Lock()
+	select {
+	case <-m.terminator:
+		m.lock.Unlock()
+		return // already stopped
+	default:
+		close(m.terminator)
+	}
+	m.lock.Unlock()
+
+	// Wait for a check that's in progress, so that it can't start replications after this:
+	m.tasks.Wait()
+
+	m.lock.Lock()
+	databases := m.sc.AllDatabases()
+	for key := range m.running {
+		// Release the lease first, so a one-shot replication interrupted by stopping it isn't
+		// recorded as having failed:
+		dbName, id := splitReplicationKey(key)
+		if database := databases[dbName]; database != nil {
+			m.releaseLease(database.Bucket, id)
+		}
+		m.stopReplication(key)
+	}
+	m.lock.Unlock()
+
+	// Wait for the one-shot replications to return, so they can't write to a closed database:
+	m.oneShots.Wait()
+}
+
+// Returns true once stop has been called.
+func (m *replicationManager) stopped() bool {
+	select {
+	case <-m.terminator:
+		return true
+	default:
+		return false
+	}
+}
+
+// Makes the manager check replication definitions soon, after one has been changed.
+func (m *replicationManager) poke() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Adds a replication from the server config.  It's saved in the local database it refers to
+// once that database has been loaded.
+func (m *replicationManager) addConfigured(dbName string, config *ReplicationConfig) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.configured[dbName] = append(m.configured[dbName], config)
+}
+
+// Checks every replication definition, starting or stopping replications on this node as its
+// leases dictate.  Only the background task calls this, so the bucket is accessed without
+// holding the lock; it's only held while updating the running replications, so that
+// _active_tasks doesn't wait for the whole pass.
+func (m *replicationManager) checkReplications() {
+	databases := m.sc.AllDatabases()
+	seen := map[string]bool{}
+	for dbName, database := range databases {
+		m.lock.Lock()
+		configs := m.configured[dbName]
+		delete(m.configured, dbName)
+		m.lock.Unlock()
+		if configs != nil {
+			m.registerConfigured(database, configs)
+		}
+		ids, err := getReplicationIDs(database.Bucket)
+		if err != nil {
+			base.Warn("Replications: Couldn't list replications of db %q: %v", dbName, err)
+			continue
+		}
+		for _, id := range ids {
+			if m.stopped() {
+				return // don't take any more leases
+			}
+			key := dbName + "/" + id
+			seen[key] = true
+			def, err := m.renewLease(database.Bucket, id)
+			if err != nil {
+				base.Warn("Replications: Couldn't update lease on %q: %v", key, err)
+				continue
+			}
+			m.lock.Lock()
+			if m.stopped() {
+				m.lock.Unlock()
+				return
+			}
+			startErr := m.checkReplication(database, def, key)
+			m.lock.Unlock()
+			if startErr != nil {
+				m.finishReplication(database.Bucket, def.ID, def.Revision, startErr)
+			}
+		}
+	}
+
+	// Stop replications that were deleted, or whose database went away:
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key := range m.running {
+		if !seen[key] {
+			m.stopReplication(key)
+		}
+	}
+}
+
+// Brings a replication this node may be running in line with its definition, just loaded with
+// this node's lease renewed.  Returns the error if it had to be started and couldn't be, which
+// the caller records in the definition.  Must be called with the lock held.
+func (m *replicationManager) checkReplication(database *db.DatabaseContext, def *replicationDefinition, key string) error {
+	running := m.running[key]
+	if running != nil && running.done != nil {
+		select {
+		case <-running.done:
+			delete(m.running, key)
+			running = nil
+		default:
+		}
+	}
+
+	if def == nil || def.State != ReplicationStateActive || def.Owner != m.nodeID {
+		// Deleted, finished, or owned by another node:
+		if running != nil {
+			m.stopReplication(key)
+		}
+		return nil
+	}
+
+	if running != nil && running.revision != def.Revision {
+		base.LogTo("Replicate", "Replication %q was changed; restarting it", key)
+		m.stopReplication(key)
+		running = nil
+	}
+	if running != nil {
+		// The rate limits and schedule can change without the revision changing:
+		running.config = def.Config
+	}
+
+	if !def.Config.isScheduled(time.Now()) {
+		if running == nil || !running.paused {
+			base.LogTo("Replicate", "Replications: Pausing replication %q outside its schedule", key)
+			m.stopReplication(key)
+			m.running[key] = &managedReplication{
+				replicationID: key,
+				revision:      def.Revision,
+				continuous:    true,
+				paused:        true,
+				config:        def.Config,
+			}
+		}
+	} else {
+		if running != nil && running.paused {
+			base.LogTo("Replicate", "Replications: Resuming replication %q within its schedule", key)
+			delete(m.running, key)
+			running = nil
+		}
+		if running != nil && running.continuous && !m.sc.replicator.HasReplication(running.replicationID) {
+			base.LogTo("Replicate", "Replication %q terminated; restarting it", key)
+			delete(m.running, key)
+			running = nil
+		}
+		if running == nil {
+			if err := m.startReplication(database, def, key); err != nil {
+				return err
+			}
+		}
+	}
+	if m.running[key] != nil {
+		m.setRateLimits(key, &def.Config)
+	}
+	return nil
+}
+
+// Starts running a replication.  Returns an error if its definition isn't valid.
+func (m *replicationManager) startReplication(database *db.DatabaseContext, def *replicationDefinition, key string) error {
+	config := def.Config
+	config.ReplicationId = key
+	params, _, _, err := validateReplicationParameters(config, true, *m.sc.config.AdminInterface)
+	if err != nil {
+		return err
+	}
+	running := &managedReplication{
+		replicationID: key,
+		revision:      def.Revision,
+		continuous:    params.Lifecycle == sgreplicate.CONTINUOUS,
+		config:        def.Config,
+	}
+	base.LogTo("Replicate", "Replications: Node %s starting replication %q", m.nodeID, key)
+	if running.continuous {
+		if _, err := m.sc.replicator.Replicate(params, false); err != nil {
+			base.Warn("Replications: Couldn't start replication %q: %v", key, err)
+			return nil
+		}
+	} else {
+		// Run the one-shot replication synchronously in its own goroutine, to find out when
+		// it's finished:
+		params.Async = false
+		running.done = make(chan struct{})
+		m.oneShots.Add(1)
+		go func() {
+			defer m.oneShots.Done()
+			defer close(running.done)
+			_, err := m.sc.replicator.Replicate(params, false)
+			m.finishReplication(database.Bucket, def.ID, def.Revision, err)
+		}()
+	}
+	m.running[key] = running
+	return nil
+}
+
+func (m *replicationManager) stopReplication(key string) {
+	running := m.running[key]
+	if running == nil {
+		return
+	}
+	delete(m.running, key)
+	m.setRateLimits(key, nil)
+	if !running.paused && m.sc.replicator.HasReplication(running.replicationID) {
+		base.LogTo("Replicate", "Replications: Node %s stopping replication %q", m.nodeID, key)
+		if _, err := m.sc.replicator.StopReplication(running.replicationID); err != nil {
+			base.Warn("Replications: Error stopping replication %q: %v", key, err)
+		}
+	}
+}
+
+// Sets a running replication's rate limits, or removes them if config is nil.
+func (m *replicationManager) setRateLimits(key string, config *ReplicationConfig) {
+	m.limiterLock.Lock()
+	defer m.limiterLock.Unlock()
+	limiter := m.limiters[key]
+	if config == nil || (config.MaxDocsPerSec <= 0 && config.MaxBytesPerSec <= 0) {
+		delete(m.limiters, key)
+		return
+	} else if limiter == nil {
+		limiter = newReplicationRateLimiter()
+		m.limiters[key] = limiter
+	}
+	limiter.setLimits(config.MaxDocsPerSec, config.MaxBytesPerSec)
+}
+
+// Returns the rate limiter of a running replication, or nil if it has no limits.
+func (m *replicationManager) getRateLimiter(key string) *replicationRateLimiter {
+	m.limiterLock.RLock()
+	defer m.limiterLock.RUnlock()
+	return m.limiters[key]
+}
+
+// Adds the rate limits and state of the replications this node is running to their active
+// tasks, and adds tasks for the continuous replications that are paused by their schedules.
+func (m *replicationManager) populateTasks(tasks []base.ActiveTask) []base.ActiveTask {
+	for i := range tasks {
+		m.populateTask(&tasks[i])
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key, running := range m.running {
+		if running.paused {
+			tasks = append(tasks, m.pausedTask(key, running))
+		}
+	}
+	return tasks
+}
+
+// Returns the active task of a replication this node is running, including paused ones, or
+// nil if it isn't running it.
+func (m *replicationManager) activeTask(key string) *base.ActiveTask {
+	if task := m.sc.replicator.ActiveTask(key); task != nil {
+		m.populateTask(task)
+		return task
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if running := m.running[key]; running != nil && running.paused {
+		task := m.pausedTask(key, running)
+		return &task
+	}
+	return nil
+}
+
+func (m *replicationManager) populateTask(task *base.ActiveTask) {
+	if limiter := m.getRateLimiter(task.ReplicationID); limiter != nil {
+		task.MaxDocsPerSec, task.MaxBytesPerSec = limiter.limits()
+		if limiter.isThrottled() && task.State == base.ReplicationStateRunning {
+			task.State = base.ReplicationStateThrottled
+		}
+	}
+}
+
+func (m *replicationManager) pausedTask(key string, running *managedReplication) base.ActiveTask {
+	return base.ActiveTask{
+		TaskType:       "replication",
+		ReplicationID:  key,
+		Continuous:     true,
+		Source:         running.config.Source,
+		Target:         running.config.Target,
+		State:          base.ReplicationStatePaused,
+		MaxDocsPerSec:  running.config.MaxDocsPerSec,
+		MaxBytesPerSec: running.config.MaxBytesPerSec,
+	}
+}
+
+//////// PERSISTENCE:
+
+func getReplicationIDs(bucket base.Bucket) ([]string, error) {
+	var list replicationList
+	_, err := bucket.Get(ReplicationListKey, &list)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	return list.IDs, nil
+}
+
+func updateReplicationIDs(bucket base.Bucket, callback func([]string) []string) error {
+	return bucket.Update(ReplicationListKey, 0, func(currentValue []byte) ([]byte, error) {
+		var list replicationList
+		if currentValue != nil {
+			if err := json.Unmarshal(currentValue, &list); err != nil {
+				return nil, err
+			}
+		}
+		list.IDs = callback(list.IDs)
+		return json.Marshal(list)
+	})
+}
+
+// Returns a replication definition, or nil if it doesn't exist.
+func getReplication(bucket base.Bucket, id string) (*replicationDefinition, error) {
+	var def replicationDefinition
+	_, err := bucket.Get(docIDForReplication(id), &def)
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+// Updates a replication definition.  The callback is given nil if the replication doesn't
+// exist yet, and may return nil to leave the definition unchanged.
+func updateReplication(bucket base.Bucket, id string, callback func(*replicationDefinition) *replicationDefinition) (*replicationDefinition, error) {
+	var result *replicationDefinition
+	err := bucket.Update(docIDForReplication(id), 0, func(currentValue []byte) ([]byte, error) {
+		var current *replicationDefinition
+		if currentValue != nil {
+			current = &replicationDefinition{}
+			if err := json.Unmarshal(currentValue, current); err != nil {
+				return nil, err
+			}
+		}
+		if result = callback(current); result == nil {
+			result = current
+			return nil, couchbase.UpdateCancel
+		}
+		return json.Marshal(result)
+	})
+	if err == couchbase.UpdateCancel {
+		err = nil
+	}
+	return result, err
+}
+
+// Creates or replaces a replication definition.  Returns true if it was created.
+func putReplication(bucket base.Bucket, id string, config ReplicationConfig, fromConfig bool) (created bool, err error) {
+	config.ReplicationId = ""
+	_, err = updateReplication(bucket, id, func(def *replicationDefinition) *replicationDefinition {
+		created = false
+		if def == nil {
+			created = true
+			def = &replicationDefinition{ID: id}
+		} else if reflect.DeepEqual(def.Config, config) &&
+			(def.State == ReplicationStateActive || def.State == ReplicationStateCompleted || !fromConfig) {
+			// Unchanged; a one-shot replication from the config that's finished doesn't run again
+			// when the config is reloaded:
+			return nil
+		} else if reflect.DeepEqual(def.Config.withoutLimits(), config.withoutLimits()) &&
+			def.Config.hasRateLimits() == config.hasRateLimits() && def.State == ReplicationStateActive {
+			// Only the rate limits or schedule changed, which the running replication picks up:
+			def.Config = config
+			return def
+		}
+		// Changing a replication makes it start over, on whichever node gets the lease:
+		def.Config = config
+		def.Revision++
+		def.State = ReplicationStateActive
+		def.Error = ""
+		def.FromConfig = fromConfig
+		return def
+	})
+	if err != nil || !created {
+		return
+	}
+	err = updateReplicationIDs(bucket, func(ids []string) []string {
+		for _, existing := range ids {
+			if existing == id {
+				return ids
+			}
+		}
+		return append(ids, id)
+	})
+	return
+}
+
+func deleteReplication(bucket base.Bucket, id string) error {
+	if err := bucket.Delete(docIDForReplication(id)); err != nil {
+		if base.IsDocNotFoundError(err) {
+			err = base.HTTPErrorf(http.StatusNotFound, "missing")
+		}
+		return err
+	}
+	return updateReplicationIDs(bucket, func(ids []string) []string {
+		for i, existing := range ids {
+			if existing == id {
+				return append(ids[:i], ids[i+1:]...)
+			}
+		}
+		return ids
+	})
+}
+
+// Takes or renews this node's lease on an active replication, unless another node holds an
+// unexpired lease on it.  Returns the definition, whose Owner shows whether this node has the
+// lease, or nil if it doesn't exist.
+func (m *replicationManager) renewLease(bucket base.Bucket, id string) (*replicationDefinition, error) {
+	return updateReplication(bucket, id, func(def *replicationDefinition) *replicationDefinition {
+		now := time.Now()
+		if def == nil || def.State != ReplicationStateActive {
+			return nil
+		} else if def.Owner != m.nodeID && !def.leaseExpired(now) {
+			return nil
+		}
+		if def.Owner != m.nodeID {
+			base.LogTo("Replicate", "Replications: Node %s taking over replication %q from %q", m.nodeID, id, def.Owner)
+		}
+		expires := now.Add(kReplicationLeaseTime)
+		def.Owner = m.nodeID
+		def.LeaseExpires = &expires
+		return def
+	})
+}
+
+func (m *replicationManager) releaseLease(bucket base.Bucket, id string) {
+	_, err := updateReplication(bucket, id, func(def *replicationDefinition) *replicationDefinition {
+		if def == nil || def.Owner != m.nodeID {
+			return nil
+		}
+		def.Owner = ""
+		def.LeaseExpires = nil
+		return def
+	})
+	if err != nil {
+		base.Warn("Replications: Couldn't release lease on %q: %v", id, err)
+	}
+}
+
+// Records that a one-shot replication finished (or couldn't start), unless it's been changed
+// since.
+func (m *replicationManager) finishReplication(bucket base.Bucket, id string, revision int, replErr error) {
+	_, err := updateReplication(bucket, id, func(def *replicationDefinition) *replicationDefinition {
+		if def == nil || def.Revision != revision || def.State != ReplicationStateActive || def.Owner != m.nodeID {
+			return nil
+		}
+		if replErr != nil {
+			def.State = ReplicationStateError
+			def.Error = replErr.Error()
+		} else {
+			def.State = ReplicationStateCompleted
+		}
+		def.Owner = ""
+		def.LeaseExpires = nil
+		return def
+	})
+	if err != nil {
+		base.Warn("Replications: Couldn't record end of replication %q: %v", id, err)
+	}
+	if replErr != nil {
+		base.Warn("Replications: Replication %q failed: %v", id, replErr)
+	}
+}
+
+// Saves the server config's replications for a database.  Replications without an ID are
+// identified by a digest of their config, so every node saves them under the same ID.
+func (m *replicationManager) registerConfigured(database *db.DatabaseContext, configs []*ReplicationConfig) {
+	for _, config := range configs {
+		id := config.ReplicationId
+		if id == "" {
+			data, _ := json.Marshal(config)
+			id = fmt.Sprintf("config-%x", sha1.Sum(data))[:23]
+		}
+		if _, err := putReplication(database.Bucket, id, *config, true); err != nil {
+			base.Warn("Replications: Couldn't save configured replication %q of db %q: %v", id, database.Name, err)
+		}
+	}
+}
+
+// Returns the name of the local database a replication config refers to, if any: the source
+// if that's local, otherwise the target.
+func localReplicationDb(config *ReplicationConfig) string {
+	for _, dbURL := range []string{config.Source, config.Target} {
+		if u, err := url.Parse(dbURL); err == nil && dbURL != "" && base.SyncSourceFromURL(u) == "" {
+			return strings.Trim(u.Path, "/")
+		}
+	}
+	return ""
+}
+
+// Returns the database whose bucket holds a configured replication's definition and lease:
+// the local database it refers to, or for a replication between two remote databases, the
+// configured database whose name sorts first, which is the same one on every node.  Returns ""
+// if the server has no databases to coordinate through.
+func replicationHostDb(config *ReplicationConfig, databases DbConfigMap) string {
+	if dbName := localReplicationDb(config); dbName != "" {
+		return dbName
+	}
+	hostDb := ""
+	for dbName := range databases {
+		if hostDb == "" || dbName < hostDb {
+			hostDb = dbName
+		}
+	}
+	return hostDb
+}
+
+//////// ADMIN API:
+
+func (h *handler) readReplicationDefinition() (ReplicationConfig, error) {
+	var config ReplicationConfig
+	if err := h.readJSONInto(&config); err != nil {
+		return config, err
+	}
+	if config.Cancel {
+		return config, base.HTTPErrorf(http.StatusBadRequest, "cancel is invalid in a replication definition; DELETE the replication instead")
+	}
+	config.Async = false
+	_, _, _, err := validateReplicationParameters(config, true, *h.server.config.AdminInterface)
+	return config, err
+}
+
+// Replaces the passwords in a URL, if it has any.
+func redactURLPassword(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return rawURL
+	}
+	u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return u.String()
+}
+
+// Returns a copy of the config without the credentials embedded in its URLs.
+func (config ReplicationConfig) redacted() ReplicationConfig {
+	config.Source = redactURLPassword(config.Source)
+	config.Target = redactURLPassword(config.Target)
+	config.Proxy = redactURLPassword(config.Proxy)
+	return config
+}
+
+// Replication configs may embed credentials for the remote database, which only admins who can
+// change replications get to see.
+func (h *handler) canSeeReplicationCredentials() bool {
+	return h.adminAccount == nil || h.adminAccount.Role.Allows(auth.AdminRoleFullAdmin)
+}
+
+func (h *handler) redactReplication(def *replicationDefinition) {
+	if !h.canSeeReplicationCredentials() {
+		def.Config = def.Config.redacted()
+	}
+}
+
+// ADMIN API: Lists the database's replications.
+func (h *handler) getReplications() error {
+	h.assertAdminOnly()
+	result, err := h.listReplications(h.db.Bucket)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(result)
+	return nil
+}
+
+// ADMIN API: Lists the replications of every database, by database name.  Replications are
+// stored in their database's bucket, so the server-level routes under "/_replication/{db}/"
+// are the same as the database's own.
+func (h *handler) getAllReplications() error {
+	h.assertAdminOnly()
+	result := map[string][]*replicationDefinition{}
+	for dbName, database := range h.server.AllDatabases() {
+		defs, err := h.listReplications(database.Bucket)
+		if err != nil {
+			return err
+		}
+		result[dbName] = defs
+	}
+	h.writeJSON(result)
+	return nil
+}
+
+func (h *handler) listReplications(bucket base.Bucket) ([]*replicationDefinition, error) {
+	ids, err := getReplicationIDs(bucket)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*replicationDefinition, 0, len(ids))
+	for _, id := range ids {
+		def, err := getReplication(bucket, id)
+		if err != nil {
+			return nil, err
+		} else if def != nil {
+			h.redactReplication(def)
+			result = append(result, def)
+		}
+	}
+	return result, nil
+}
+
+// ADMIN API: Returns a replication definition and its status.
+func (h *handler) getReplicationInfo() error {
+	h.assertAdminOnly()
+	def, err := getReplication(h.db.Bucket, h.PathVar("id"))
+	if def == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	h.redactReplication(def)
+	h.writeJSON(def)
+	return nil
+}
+
+// The status of a replication in the admin API.
+type replicationStatusInfo struct {
+	ID           string           `json:"id"`
+	State        string           `json:"state"`
+	Error        string           `json:"error,omitempty"`
+	Owner        string           `json:"owner,omitempty"`
+	LeaseExpires *time.Time       `json:"lease_expires,omitempty"`
+	Task         *base.ActiveTask `json:"task,omitempty"` // Only if it's running on this node
+}
+
+// ADMIN API: Returns the status of a replication.  Its progress is only available from the node
+// running it, which is given by "owner".
+func (h *handler) getReplicationStatus() error {
+	h.assertAdminOnly()
+	def, err := getReplication(h.db.Bucket, h.PathVar("id"))
+	if def == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	status := replicationStatusInfo{
+		ID:           def.ID,
+		State:        def.State,
+		Error:        def.Error,
+		Owner:        def.Owner,
+		LeaseExpires: def.LeaseExpires,
+	}
+	if def.Owner == h.server.replications.nodeID {
+		if status.Task = h.server.replications.activeTask(h.db.Name + "/" + def.ID); status.Task != nil {
+			h.server.estimatePendingChanges(status.Task)
+			if !h.canSeeReplicationCredentials() {
+				status.Task.Source = redactURLPassword(status.Task.Source)
+				status.Task.Target = redactURLPassword(status.Task.Target)
+			}
+		}
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// ADMIN API: Creates a replication with a new ID, or the replication_id given in the body.
+func (h *handler) postReplication() error {
+	h.assertAdminOnly()
+	config, err := h.readReplicationDefinition()
+	if err != nil {
+		return err
+	}
+	id := config.ReplicationId
+	if id == "" {
+		id = base.CreateUUID()
+	}
+	return h.saveReplication(id, config)
+}
+
+// ADMIN API: Creates or replaces a replication.  A replaced replication is restarted.
+func (h *handler) putReplication() error {
+	h.assertAdminOnly()
+	config, err := h.readReplicationDefinition()
+	if err != nil {
+		return err
+	}
+	return h.saveReplication(h.PathVar("id"), config)
+}
+
+func (h *handler) saveReplication(id string, config ReplicationConfig) error {
+	if id == "" || strings.Contains(id, "/") {
+		return base.HTTPErrorf(http.StatusBadRequest, "Invalid replication ID")
+	}
+	created, err := putReplication(h.db.Bucket, id, config, false)
+	if err != nil {
+		return err
+	}
+	h.server.replications.poke()
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	h.writeJSONStatus(status, db.Body{"id": id})
+	return nil
+}
+
+// ADMIN API: Deletes a replication, stopping it.
+func (h *handler) deleteReplication() error {
+	h.assertAdminOnly()
+	if err := deleteReplication(h.db.Bucket, h.PathVar("id")); err != nil {
+		return err
+	}
+	h.server.replications.poke()
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbaselabs/sync_gateway_admin_ui"
 	"github.com/gorilla/mux"
 )
@@ -52,6 +53,9 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	dbr.StrictSlash(true)
 	dbr.Handle("/_all_docs", makeHandler(sc, privs, (*handler).handleAllDocs)).Methods("GET", "HEAD", "POST")
 	dbr.Handle("/_bulk_docs", makeHandler(sc, privs, (*handler).handleBulkDocs)).Methods("POST")
+	dbr.Handle("/_find", makeHandler(sc, privs, (*handler).handleFind)).Methods("POST")
+	dbr.Handle("/_search", makeHandler(sc, privs, (*handler).handleSearch)).Methods("GET", "HEAD")
+	dbr.Handle("/_channels", makeHandler(sc, privs, (*handler).handleChannels)).Methods("GET", "HEAD")
 	dbr.Handle("/_bulk_get", makeHandler(sc, privs, (*handler).handleBulkGet)).Methods("POST")
 	dbr.Handle("/_changes", makeHandler(sc, privs, (*handler).handleChanges)).Methods("GET", "HEAD", "POST")
 	dbr.Handle("/_design/{ddoc}", makeHandler(sc, privs, (*handler).handleGetDesignDoc)).Methods("GET", "HEAD")
@@ -61,6 +65,19 @@ func createHandler(sc *ServerContext, privs handlerPrivs) (*mux.Router, *mux.Rou
 	dbr.Handle("/_ensure_full_commit", makeHandler(sc, privs, (*handler).handleEFC)).Methods("POST")
 	dbr.Handle("/_revs_diff", makeHandler(sc, privs, (*handler).handleRevsDiff)).Methods("POST")
 
+	// Endpoints used by replications to local databases; see replicationEndpoint:
+	dbr.Handle("/_endpoint/{endpoint}/", makeOfflineHandler(sc, privs, rateLimited((*handler).handleGetDB))).Methods("GET", "HEAD")
+	dbr.Handle("/_endpoint/{endpoint}/_changes", makeHandler(sc, privs, rateLimited((*handler).handleChanges))).Methods("GET", "HEAD", "POST")
+	dbr.Handle("/_endpoint/{endpoint}/_bulk_get", makeHandler(sc, privs, rateLimited((*handler).handleBulkGet))).Methods("POST")
+	dbr.Handle("/_endpoint/{endpoint}/_bulk_docs", makeHandler(sc, privs, rateLimited((*handler).handleBulkDocs))).Methods("POST")
+	dbr.Handle("/_endpoint/{endpoint}/_revs_diff", makeHandler(sc, privs, rateLimited((*handler).handleRevsDiff))).Methods("POST")
+	dbr.Handle("/_endpoint/{endpoint}/_ensure_full_commit", makeHandler(sc, privs, (*handler).handleEFC)).Methods("POST")
+	dbr.Handle("/_endpoint/{endpoint}/_local/{docid}", makeHandler(sc, privs, (*handler).handleGetLocalDoc)).Methods("GET", "HEAD")
+	dbr.Handle("/_endpoint/{endpoint}/_local/{docid}", makeHandler(sc, privs, (*handler).handlePutLocalDoc)).Methods("PUT")
+	dbr.Handle("/_endpoint/{endpoint}/{docid:"+docRegex+"}", makeHandler(sc, privs, rateLimited((*handler).handleGetDoc))).Methods("GET", "HEAD")
+	dbr.Handle("/_endpoint/{endpoint}/{docid:"+docRegex+"}", makeHandler(sc, privs, rateLimited((*handler).handlePutDoc))).Methods("PUT")
+	dbr.Handle("/_endpoint/{endpoint}/{docid:"+docRegex+"}/{attach}", makeHandler(sc, privs, rateLimited((*handler).handleGetAttachment))).Methods("GET", "HEAD")
+
 	// Document URLs:
 	dbr.Handle("/_local/{docid}", makeHandler(sc, privs, (*handler).handleGetLocalDoc)).Methods("GET", "HEAD")
 	dbr.Handle("/_local/{docid}", makeHandler(sc, privs, (*handler).handlePutLocalDoc)).Methods("PUT")
@@ -152,124 +169,200 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 	})
 
 	dbr.Handle("/_session",
-		makeHandler(sc, adminPrivs, (*handler).createUserSession)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).createUserSession)).Methods("POST")
 
 	dbr.Handle("/_session/{sessionid}",
-		makeHandler(sc, adminPrivs, (*handler).getUserSession)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getUserSession)).Methods("GET")
 
 	dbr.Handle("/_session/{sessionid}",
-		makeHandler(sc, adminPrivs, (*handler).deleteUserSession)).Methods("DELETE")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).deleteUserSession)).Methods("DELETE")
 
 	dbr.Handle("/_raw/{docid:"+docRegex+"}",
-		makeHandler(sc, adminPrivs, (*handler).handleGetRawDoc)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleGetRawDoc)).Methods("GET", "HEAD")
 
 	dbr.Handle("/_user/",
-		makeHandler(sc, adminPrivs, (*handler).getUsers)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getUsers)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/",
-		makeHandler(sc, adminPrivs, (*handler).putUser)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).putUser)).Methods("POST")
 	dbr.Handle("/_user/{name}",
-		makeHandler(sc, adminPrivs, (*handler).getUserInfo)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getUserInfo)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/{name}",
-		makeHandler(sc, adminPrivs, (*handler).putUser)).Methods("PUT")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).putUser)).Methods("PUT")
 	dbr.Handle("/_user/{name}",
-		makeHandler(sc, adminPrivs, (*handler).deleteUser)).Methods("DELETE")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).deleteUser)).Methods("DELETE")
 
+	dbr.Handle("/_user/{name}/_session", // reveals when and from what user agents the user logs in, so not for read-only operators
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).getUserSessions)).Methods("GET", "HEAD")
 	dbr.Handle("/_user/{name}/_session",
-		makeHandler(sc, adminPrivs, (*handler).deleteUserSessions)).Methods("DELETE")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).deleteUserSessions)).Methods("DELETE")
 	dbr.Handle("/_user/{name}/_session/{sessionid}",
-		makeHandler(sc, adminPrivs, (*handler).deleteUserSession)).Methods("DELETE")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).deleteUserSession)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_apikey",
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).getAPIKeys)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_apikey",
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).createAPIKey)).Methods("POST")
+	dbr.Handle("/_user/{name}/_apikey/{keyid}",
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).getAPIKeyInfo)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_apikey/{keyid}",
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).deleteAPIKey)).Methods("DELETE")
+
+	dbr.Handle("/_login_failures/{kind}/{id}",
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getLoginFailures)).Methods("GET", "HEAD")
+	dbr.Handle("/_login_failures/{kind}/{id}",
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).deleteLoginFailures)).Methods("DELETE")
 
 	dbr.Handle("/_role/",
-		makeHandler(sc, adminPrivs, (*handler).getRoles)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getRoles)).Methods("GET", "HEAD")
 	dbr.Handle("/_role/",
-		makeHandler(sc, adminPrivs, (*handler).putRole)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).putRole)).Methods("POST")
 	dbr.Handle("/_role/{name}",
-		makeHandler(sc, adminPrivs, (*handler).getRoleInfo)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getRoleInfo)).Methods("GET", "HEAD")
 	dbr.Handle("/_role/{name}",
-		makeHandler(sc, adminPrivs, (*handler).putRole)).Methods("PUT")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).putRole)).Methods("PUT")
 	dbr.Handle("/_role/{name}",
-		makeHandler(sc, adminPrivs, (*handler).deleteRole)).Methods("DELETE")
+		makeAdminHandler(sc, auth.AdminRoleUserManager, (*handler).deleteRole)).Methods("DELETE")
+
+	dbr.Handle("/_admin_account/{name}",
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).getAdminAccount)).Methods("GET", "HEAD")
+	dbr.Handle("/_admin_account/{name}",
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).putAdminAccount)).Methods("PUT")
+	dbr.Handle("/_admin_account/{name}",
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).deleteAdminAccount)).Methods("DELETE")
 
 	r.Handle("/_logging",
-		makeHandler(sc, adminPrivs, (*handler).handleGetLogging)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleGetLogging)).Methods("GET")
 	r.Handle("/_logging",
-		makeHandler(sc, adminPrivs, (*handler).handleSetLogging)).Methods("PUT", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleSetLogging)).Methods("PUT", "POST")
 	r.Handle("/_profile/{name}",
-		makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleProfiling)).Methods("POST")
 	r.Handle("/_profile",
-		makeHandler(sc, adminPrivs, (*handler).handleProfiling)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleProfiling)).Methods("POST")
 	r.Handle("/_heap",
-		makeHandler(sc, adminPrivs, (*handler).handleHeapProfiling)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleHeapProfiling)).Methods("POST")
 	r.Handle("/_stats",
-		makeHandler(sc, adminPrivs, (*handler).handleStats)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleStats)).Methods("GET")
 	r.Handle(kDebugURLPathPrefix,
-		makeHandler(sc, adminPrivs, (*handler).handleExpvar)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleExpvar)).Methods("GET")
 	r.Handle("/_config",
-		makeHandler(sc, adminPrivs, (*handler).handleGetConfig)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleGetConfig)).Methods("GET")
 	r.Handle("/_replicate",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleReplicate)).Methods("POST")
+		makeOfflineAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleReplicate)).Methods("POST")
+	r.PathPrefix("/_filtered_source/{source}/").Handler(
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleFilteredSource))
 	r.Handle("/_active_tasks",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleActiveTasks)).Methods("GET")
+		makeOfflineAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleActiveTasks)).Methods("GET")
+	r.Handle("/_replication/",
+		makeOfflineAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getAllReplications)).Methods("GET", "HEAD")
+	r.Handle("/_replication/{db:"+dbRegex+"}/",
+		makeOfflineAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getReplications)).Methods("GET", "HEAD")
+	r.Handle("/_replication/{db:"+dbRegex+"}/",
+		makeOfflineAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).postReplication)).Methods("POST")
+	r.Handle("/_replication/{db:"+dbRegex+"}/{id}",
+		makeOfflineAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getReplicationInfo)).Methods("GET", "HEAD")
+	r.Handle("/_replication/{db:"+dbRegex+"}/{id}",
+		makeOfflineAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).putReplication)).Methods("PUT")
+	r.Handle("/_replication/{db:"+dbRegex+"}/{id}",
+		makeOfflineAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).deleteReplication)).Methods("DELETE")
+	r.Handle("/_replication/{db:"+dbRegex+"}/{id}/status",
+		makeOfflineAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getReplicationStatus)).Methods("GET", "HEAD")
 
 	// Debugging handlers
 	r.Handle("/_debug/pprof/goroutine",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofGoroutine)).Methods("GET", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handlePprofGoroutine)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/cmdline",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofCmdline)).Methods("GET", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handlePprofCmdline)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/symbol",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofSymbol)).Methods("GET", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handlePprofSymbol)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/heap",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofHeap)).Methods("GET", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handlePprofHeap)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/profile",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofProfile)).Methods("GET", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handlePprofProfile)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/block",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofBlock)).Methods("GET", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handlePprofBlock)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/threadcreate",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofThreadcreate)).Methods("GET", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handlePprofThreadcreate)).Methods("GET", "POST")
 	r.Handle("/_debug/pprof/trace",
-		makeHandler(sc, adminPrivs, (*handler).handlePprofTrace)).Methods("GET", "POST")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handlePprofTrace)).Methods("GET", "POST")
 
 	// Database-relative handlers:
 	dbr.Handle("/_config",
-		makeHandler(sc, adminPrivs, (*handler).handleGetDbConfig)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleGetDbConfig)).Methods("GET")
 	dbr.Handle("/_config",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handlePutDbConfig)).Methods("PUT")
+		makeOfflineAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handlePutDbConfig)).Methods("PUT")
+	dbr.Handle("/_debug/faults",
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleGetFaults)).Methods("GET", "HEAD")
+	dbr.Handle("/_debug/faults",
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handlePutFaults)).Methods("PUT")
+	dbr.Handle("/_debug/faults",
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleDeleteFaults)).Methods("DELETE")
 	dbr.Handle("/_resync",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleResync)).Methods("POST")
+		makeOfflineAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleResync)).Methods("POST")
 	dbr.Handle("/_vacuum",
-		makeHandler(sc, adminPrivs, (*handler).handleVacuum)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleVacuum)).Methods("POST")
 	dbr.Handle("/_purge",
-		makeHandler(sc, adminPrivs, (*handler).handlePurge)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handlePurge)).Methods("POST")
 	dbr.Handle("/_flush",
-		makeHandler(sc, adminPrivs, (*handler).handleFlush)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleFlush)).Methods("POST")
 	dbr.Handle("/_online",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOnline)).Methods("POST")
+		makeOfflineAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleDbOnline)).Methods("POST")
 	dbr.Handle("/_offline",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleDbOffline)).Methods("POST")
+		makeOfflineAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleDbOffline)).Methods("POST")
 	dbr.Handle("/_dump/{view}",
-		makeHandler(sc, adminPrivs, (*handler).handleDump)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleDump)).Methods("GET")
 	dbr.Handle("/_view/{view}", // redundant; just for backward compatibility with 1.0
-		makeHandler(sc, adminPrivs, (*handler).handleView)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleView)).Methods("GET")
 	dbr.Handle("/_dumpchannel/{channel}",
-		makeHandler(sc, adminPrivs, (*handler).handleDumpChannel)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleDumpChannel)).Methods("GET")
 	dbr.Handle("/_index",
-		makeHandler(sc, adminPrivs, (*handler).handleIndex)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleIndex)).Methods("GET")
 	dbr.Handle("/_index/channel/{channel}",
-		makeHandler(sc, adminPrivs, (*handler).handleIndexChannel)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleIndexChannel)).Methods("GET")
 	dbr.Handle("/_index/channels",
-		makeHandler(sc, adminPrivs, (*handler).handleIndexAllChannels)).Methods("GET")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleIndexAllChannels)).Methods("GET")
+	dbr.Handle("/_index/compact",
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleGetIndexCompact)).Methods("GET")
+	dbr.Handle("/_index/compact",
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handlePostIndexCompact)).Methods("POST")
+	dbr.Handle("/_search_index",
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleGetSearchIndex)).Methods("GET")
+	dbr.Handle("/_search_index/_rebuild",
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handlePostSearchIndexRebuild)).Methods("POST")
+	dbr.Handle("/_tombstone_purge",
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleGetTombstonePurge)).Methods("GET")
+	dbr.Handle("/_tombstone_purge",
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handlePostTombstonePurge)).Methods("POST")
+	dbr.Handle("/_cache",
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleGetCache)).Methods("GET")
+	dbr.Handle("/_cache/channels",
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleGetCacheChannels)).Methods("GET")
+	dbr.Handle("/_cache/channel/{channel}",
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleGetCacheChannel)).Methods("GET")
+	dbr.Handle("/_cache/skipped",
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handlePostCacheSkipped)).Methods("POST")
+	dbr.Handle("/_replication/",
+		makeOfflineAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getReplications)).Methods("GET", "HEAD")
+	dbr.Handle("/_replication/",
+		makeOfflineAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).postReplication)).Methods("POST")
+	dbr.Handle("/_replication/{id}",
+		makeOfflineAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getReplicationInfo)).Methods("GET", "HEAD")
+	dbr.Handle("/_replication/{id}",
+		makeOfflineAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).putReplication)).Methods("PUT")
+	dbr.Handle("/_replication/{id}",
+		makeOfflineAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).deleteReplication)).Methods("DELETE")
+	dbr.Handle("/_replication/{id}/status",
+		makeOfflineAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).getReplicationStatus)).Methods("GET", "HEAD")
 
 	// The routes below are part of the CouchDB REST API but should only be available to admins,
 	// so the handlers are moved to the admin port.
 	r.Handle("/{newdb:"+dbRegex+"}/",
-		makeHandler(sc, adminPrivs, (*handler).handleCreateDB)).Methods("PUT")
+		makeAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleCreateDB)).Methods("PUT")
 	r.Handle("/{db:"+dbRegex+"}/",
-		makeOfflineHandler(sc, adminPrivs, (*handler).handleDeleteDB)).Methods("DELETE")
+		makeOfflineAdminHandler(sc, auth.AdminRoleFullAdmin, (*handler).handleDeleteDB)).Methods("DELETE")
 
 	r.Handle("/_all_dbs",
-		makeHandler(sc, adminPrivs, (*handler).handleAllDbs)).Methods("GET", "HEAD")
+		makeAdminHandler(sc, auth.AdminRoleReadOnly, (*handler).handleAllDbs)).Methods("GET", "HEAD")
 	dbr.Handle("/_compact",
-		makeHandler(sc, adminPrivs, (*handler).handleCompact)).Methods("POST")
+		makeAdminHandler(sc, auth.AdminRoleDbAdmin, (*handler).handleCompact)).Methods("POST")
 
 	return r
 }
@@ -34,7 +34,6 @@ import (
 const kStatsReportURL = "http://localhost:9999/stats"
 const kStatsReportInterval = time.Hour
 const kDefaultSlowServerCallWarningThreshold = 200 // ms
-const kOneShotLocalDbReplicateWait = 10 * time.Second
 
 // Shared context of HTTP handlers: primarily a registry of databases by name. It also stores
 // the configuration settings so handlers can refer to them.
@@ -47,6 +46,9 @@ type ServerContext struct {
 	statsTicker *time.Ticker
 	HTTPClient  *http.Client
 	replicator  *base.Replicator
+	auditLog    *auditLogger // Audit log of admin API mutations, if admin auth is enabled
+
+	replications *replicationManager // Runs the replications defined in databases
 }
 
 func NewServerContext(config *ServerConfig) *ServerContext {
@@ -56,6 +58,10 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 		HTTPClient: http.DefaultClient,
 		replicator: base.NewReplicator(),
 	}
+	sc.replications = newReplicationManager(sc)
+	sc.replicator.OnRemove = func(sgreplicate.ReplicationParameters) {
+		unregisterUnusedFilteredSources(sc.replicator.AllParams())
+	}
 	if config.Databases == nil {
 		config.Databases = DbConfigMap{}
 	}
@@ -84,34 +90,48 @@ func NewServerContext(config *ServerConfig) *ServerContext {
 		sc.startStatsReporter()
 	}
 
+	if config.AdminAuth.isEnabled() {
+		auditLog, err := newAuditLogger(config.AdminAuth.AuditLog)
+		if err != nil {
+			base.Warn("Unable to open admin audit log %s, writing audit records to main log: %v", *config.AdminAuth.AuditLog, err)
+			auditLog, _ = newAuditLogger(nil)
+		}
+		sc.auditLog = auditLog
+	}
+
 	if config.Replications != nil {
 
 		for _, replicationConfig := range config.Replications {
 
-			params, _, localdb, err := validateReplicationParameters(*replicationConfig, true, *config.AdminInterface)
+			params, _, _, err := validateReplicationParameters(*replicationConfig, true, *config.AdminInterface)
 
 			if err != nil {
 				base.LogError(err)
 				continue
 			}
 
+			// Replications are saved in a database's bucket, so that only one node of the cluster
+			// runs them:
+			if dbName := replicationHostDb(replicationConfig, config.Databases); dbName != "" {
+				sc.replications.addConfigured(dbName, replicationConfig)
+				continue
+			}
+
+			if len(replicationConfig.Schedule) > 0 {
+				base.Warn("Ignoring schedule of replication %q: a server without databases can't schedule replications",
+					replicationConfig.ReplicationId)
+			}
+
 			//Force one-shot replications to run Async
 			//to avoid blocking server startup
 			params.Async = true
 
 			//Run single replication, cancel parameter will always be false
-			go func() {
-				//Delay the start of the replication if its a oneshot that
-				//uses a localdb reference to allow the REST API's to come up
-				if params.Lifecycle == sgreplicate.ONE_SHOT && localdb {
-					base.Warn("Delaying start of local database one-shot replication, source %v, target %v for %v seconds", params.SourceDb, params.TargetDb, kOneShotLocalDbReplicateWait)
-					time.Sleep(kOneShotLocalDbReplicateWait)
-				}
-				sc.replicator.Replicate(params, false)
-			}()
+			go sc.replicator.Replicate(params, false)
 		}
 
 	}
+	sc.replications.start()
 
 	return sc
 }
@@ -130,10 +150,13 @@ func (sc *ServerContext) FindDbByBucketName(bucketName string) string {
 }
 
 func (sc *ServerContext) Close() {
+	sc.replications.stop()
+
 	sc.lock.Lock()
 	defer sc.lock.Unlock()
 
 	sc.stopStatsReporter()
+	sc.auditLog.close()
 	for _, ctx := range sc.databases_ {
 		ctx.Close()
 		if ctx.EventMgr.HasHandlerForEvent(db.DBStateChange) {
@@ -342,6 +365,15 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		if config.CacheConfig.ChannelCacheAge != nil && *config.CacheConfig.ChannelCacheAge > 0 {
 			cacheOptions.ChannelCacheAge = time.Duration(*config.CacheConfig.ChannelCacheAge) * time.Second
 		}
+		if config.CacheConfig.ChannelCacheMaxBytes != nil && *config.CacheConfig.ChannelCacheMaxBytes > 0 {
+			cacheOptions.ChannelCacheMaxBytes = *config.CacheConfig.ChannelCacheMaxBytes
+		}
+		if config.CacheConfig.SnapshotDir != nil {
+			cacheOptions.SnapshotDir = *config.CacheConfig.SnapshotDir
+		}
+		if config.CacheConfig.WarmupChannels != nil && *config.CacheConfig.WarmupChannels > 0 {
+			cacheOptions.WarmupChannels = *config.CacheConfig.WarmupChannels
+		}
 
 	}
 
@@ -385,6 +417,33 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 	if err != nil {
 		return nil, err
 	}
+	if config.Unsupported != nil && config.Unsupported.FaultInjection != nil && *config.Unsupported.FaultInjection {
+		// Wrap the bucket so that faults can be injected at runtime; its feeds need wrapping from the start
+		base.Warn("Fault injection is enabled for database %q; don't use this in production", dbName)
+		bucket = base.NewLeakyBucket(bucket, base.LeakyBucketConfig{TapFeedFaults: true})
+	}
+
+	// If configured, retry failed bucket operations on top of the driver's own retries, and stop trying
+	// for a while if the bucket seems to be down
+	if config.BucketRetry != nil {
+		retryPolicy := base.DefaultBucketRetryPolicy
+		if config.BucketRetry.MaxRetries != nil && *config.BucketRetry.MaxRetries >= 0 {
+			retryPolicy.MaxRetries = *config.BucketRetry.MaxRetries
+		}
+		if config.BucketRetry.InitialBackoff != nil && *config.BucketRetry.InitialBackoff > 0 {
+			retryPolicy.InitialBackoff = time.Duration(*config.BucketRetry.InitialBackoff) * time.Millisecond
+		}
+		if config.BucketRetry.MaxBackoff != nil && *config.BucketRetry.MaxBackoff > 0 {
+			retryPolicy.MaxBackoff = time.Duration(*config.BucketRetry.MaxBackoff) * time.Millisecond
+		}
+		if config.BucketRetry.BreakerThreshold != nil && *config.BucketRetry.BreakerThreshold >= 0 {
+			retryPolicy.BreakerThreshold = *config.BucketRetry.BreakerThreshold
+		}
+		if config.BucketRetry.BreakerOpenTime != nil && *config.BucketRetry.BreakerOpenTime > 0 {
+			retryPolicy.BreakerOpenTime = time.Duration(*config.BucketRetry.BreakerOpenTime) * time.Second
+		}
+		bucket = base.NewRetryBucket(bucket, retryPolicy)
+	}
 
 	// Channel index definition, if present
 	channelIndexOptions := &db.ChangeIndexOptions{} // TODO: this is confusing!  why is it called both a "change index" and a "channel index"?
@@ -484,6 +543,20 @@ func (sc *ServerContext) _getOrAddDatabaseFromConfig(config *DbConfig, useExisti
 		UnsupportedOptions:    unsupportedOptions,
 		TrackDocs:             trackDocs,
 		OIDCOptions:           config.OIDCConfig,
+		LoginThrottleOptions:  config.LoginThrottle,
+		SessionOptions:        config.Session,
+		QueryIndexes:          config.Indexes,
+		SearchOptions:         config.Search,
+		TombstonePurgeOptions: config.TombstonePurge,
+	}
+
+	// Docs written to the bucket by other apps are also imported on demand, when clients read
+	// or update them through the gateway, if importing is enabled:
+	if importDocs || config.ImportFilter != nil {
+		contextOptions.ImportOptions.OnDemand = true
+	}
+	if config.ImportFilter != nil {
+		contextOptions.ImportOptions.Filter = db.NewJSEventFunction(*config.ImportFilter)
 	}
 
 	dbcontext, err := db.NewDatabaseContext(dbName, bucket, autoImport, contextOptions)
@@ -692,11 +765,18 @@ func (sc *ServerContext) startShadowing(dbcontext *db.DatabaseContext, shadow *S
 		}
 	}
 
+	// DCP lets the shadower resume from its checkpoints after a restart, so it's the default for
+	// Couchbase Server.  Walrus and local buckets have no DCP feed, so they default to TAP.
+	feedType := strings.ToLower(shadow.FeedType)
+	if feedType == "" && !base.IsWalrusServer(*shadow.Server) && !strings.HasPrefix(*shadow.Server, base.LocalBucketScheme) {
+		feedType = base.DcpFeedType
+	}
+
 	spec := base.BucketSpec{
 		Server:     *shadow.Server,
 		PoolName:   "default",
 		BucketName: *shadow.Bucket,
-		FeedType:   shadow.FeedType,
+		FeedType:   feedType,
 	}
 	if shadow.Pool != nil {
 		spec.PoolName = *shadow.Pool
@@ -712,7 +792,10 @@ func (sc *ServerContext) startShadowing(dbcontext *db.DatabaseContext, shadow *S
 			"Unable to connect to shadow bucket: %s", err)
 		return err
 	}
-	shadower, err := db.NewShadower(dbcontext, bucket, pattern)
+	shadower, err := db.NewShadower(dbcontext, bucket, db.ShadowerOptions{
+		DocIDPattern:   pattern,
+		ConflictPolicy: shadow.ConflictPolicy,
+	})
 	if err != nil {
 		bucket.Close()
 		return err
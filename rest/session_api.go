@@ -19,8 +19,6 @@ import (
 	"github.com/couchbase/sync_gateway/db"
 )
 
-const kDefaultSessionTTL = 24 * time.Hour
-
 // Respond with a JSON struct containing info about the current login session
 func (h *handler) respondWithSessionInfo() error {
 
@@ -53,6 +51,10 @@ func (h *handler) handleSessionPOST() error {
 
 	// If we fail to get a user from the body and we've got a non-GUEST authenticated user, create the session based on that user
 	if user == nil && h.user != nil && h.user.Name() != "" {
+		if h.apiKey != nil {
+			// A session would escape the API key's restrictions
+			return base.HTTPErrorf(http.StatusForbidden, "Can't create a session with an API key")
+		}
 		return h.makeSession(h.user)
 	} else {
 		if err != nil {
@@ -74,16 +76,7 @@ func (h *handler) getUserFromSessionRequestBody() (auth.User, error) {
 		return nil, err
 	}
 
-	var user auth.User
-	user, err = h.db.Authenticator().GetUser(params.Name)
-	if err != nil {
-		return nil, err
-	}
-
-	if user != nil && !user.Authenticate(params.Password) {
-		user = nil
-	}
-	return user, err
+	return h.authenticateUser(h.db.DatabaseContext, params.Name, params.Password)
 }
 
 // DELETE /_session logs out the current session
@@ -92,17 +85,18 @@ func (h *handler) handleSessionDELETE() error {
 		// CORS not allowed for login #115
 		return base.HTTPErrorf(http.StatusBadRequest, "No CORS")
 	}
-	cookie := h.db.Authenticator().DeleteSessionForCookie(h.rq)
+	authenticator := h.db.Authenticator()
+	cookie := authenticator.DeleteSessionForCookie(h.rq)
 	if cookie == nil {
 		return base.HTTPErrorf(http.StatusNotFound, "no session")
 	}
-	http.SetCookie(h.response, cookie)
+	authenticator.SetSessionCookie(h.response, cookie)
 	return nil
 }
 
 func (h *handler) makeSession(user auth.User) error {
 
-	_, err := h.makeSessionWithTTL(user, kDefaultSessionTTL)
+	_, err := h.makeSessionWithTTL(user, h.db.Options.SessionOptions.IdleTimeout())
 	if err != nil {
 		return err
 	}
@@ -116,13 +110,13 @@ func (h *handler) makeSessionWithTTL(user auth.User, expiry time.Duration) (sess
 	}
 	h.user = user
 	auth := h.db.Authenticator()
-	session, err := auth.CreateSession(user.Name(), expiry)
+	session, err := auth.CreateSession(user.Name(), expiry, h.rq.Header.Get("User-Agent"))
 	if err != nil {
 		return "", err
 	}
 	cookie := auth.MakeSessionCookie(session)
 	base.AddDbPathToCookie(h.rq, cookie)
-	http.SetCookie(h.response, cookie)
+	auth.SetSessionCookie(h.response, cookie)
 	return session.ID, nil
 }
 
@@ -207,7 +201,7 @@ func (h *handler) createUserSession() error {
 		Name string `json:"name"`
 		TTL  int    `json:"ttl"`
 	}
-	params.TTL = int(kDefaultSessionTTL / time.Second)
+	params.TTL = int(h.db.Options.SessionOptions.IdleTimeout() / time.Second)
 	err := h.readJSONInto(&params)
 	if err != nil {
 		return err
@@ -225,7 +219,7 @@ func (h *handler) createUserSession() error {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid or missing ttl")
 	}
 
-	session, err := h.db.Authenticator().CreateSession(params.Name, ttl)
+	session, err := h.db.Authenticator().CreateSession(params.Name, ttl, "")
 	if err != nil {
 		return err
 	}
@@ -257,7 +251,8 @@ func (h *handler) getUserSession() error {
 }
 
 // ADMIN API: Deletes a specified session.  If username is present on the request, validates
-// that the session being deleted is associated with the user.
+// that the session being deleted is associated with the user; the session can then also be
+// identified by the session_hash from the user's session list.
 func (h *handler) deleteUserSession() error {
 	h.assertAdminOnly()
 	userName := h.PathVar("name")
@@ -268,6 +263,43 @@ func (h *handler) deleteUserSession() error {
 	}
 }
 
+// The properties of a session in the admin API's session list.  The session ID is a bearer
+// credential, so only its hash is listed.
+type sessionInfo struct {
+	Hash       string     `json:"session_hash"` // See auth.SessionIDHash`
+	Created    *time.Time `json:"created,omitempty"`
+	LastUsed   *time.Time `json:"last_used,omitempty"`
+	Expiration time.Time  `json:"expires"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+}
+
+// ADMIN API: Lists a user's active sessions
+func (h *handler) getUserSessions() error {
+	h.assertAdminOnly()
+	userName := internalUserName(h.PathVar("name"))
+	if user, err := h.db.Authenticator().GetUser(userName); user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return err
+	}
+	sessions, err := h.db.GetUserSessions(userName)
+	if err != nil {
+		return err
+	}
+	result := make([]sessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		info := sessionInfo{Hash: auth.SessionIDHash(session.ID), Expiration: session.Expiration, UserAgent: session.UserAgent}
+		if !session.Created.IsZero() {
+			info.Created = &session.Created
+			info.LastUsed = &session.LastUsed
+		}
+		result = append(result, info)
+	}
+	h.writeJSON(result)
+	return nil
+}
+
 // ADMIN API: Deletes all sessions for a user
 func (h *handler) deleteUserSessions() error {
 	h.assertAdminOnly()
@@ -282,6 +314,12 @@ func (h *handler) deleteUserSessionWithValidation(sessionId string, userName str
 	// Validate that the session being deleted belongs to the user.  This adds some
 	// overhead - for user-agnostic session deletion should use deleteSession
 	session, getErr := h.db.Authenticator().GetSession(sessionId)
+	if session == nil && getErr == nil {
+		session, getErr = h.getUserSessionByHash(userName, sessionId)
+		if session != nil {
+			sessionId = session.ID
+		}
+	}
 	if session == nil {
 		if getErr == nil {
 			getErr = kNotFoundError
@@ -302,6 +340,20 @@ func (h *handler) deleteUserSessionWithValidation(sessionId string, userName str
 	return nil
 }
 
+// Finds the session of a user whose ID has the given hash, or returns nil if there isn't one.
+func (h *handler) getUserSessionByHash(userName string, hash string) (*auth.LoginSession, error) {
+	sessions, err := h.db.GetUserSessions(userName)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if auth.SessionIDHash(session.ID) == hash {
+			return session, nil
+		}
+	}
+	return nil, nil
+}
+
 // Respond with a JSON struct containing info about the current login session
 func (h *handler) respondWithSessionInfoForSession(session *auth.LoginSession) error {
 